@@ -1,6 +1,8 @@
 package biz
 
 import (
+	"time"
+
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 )
@@ -13,12 +15,199 @@ type Config struct {
 	TablePrefix      string
 	TableSuffix      string
 	Applies          []string
+	WanIface         string   // name of WAN interface, the default route with the lowest metric is used if empty
+	WanIfaces        []string // extra WAN interfaces of multi-WAN SNAT, `*` means all default routes
+	WanTable         int      // routing table of the default routes of the WAN interfaces, the main table if 0
 	MyIface          string
 	MyPort           uint16
+	ManagerKnock     []KnockStep // port knocking sequence granting access to the manager ports on MyIface, besides manager_ipset
 	ClearRuleset     bool
 	DisableInitSet   bool
 	Ifaces           []string
 	TrustPorts       []uint16
+	Zones            []Zone
+	ZonePolicies     []ZonePolicy
+	Services         []Service
+	AntiSpoof        []AntiSpoof
+	LogDrop          bool   // log the packets dropped by the filter chains and the blacklist
+	LogPrefix        string // prefix of the logs, followed by the chain name. default: `nft drop `
+	LogGroup         uint16 // NFLOG group, logs to the kernel log if 0
+	LogRate          string // per-chain rate limit of the logs, e.g. `10/p/m`. default: `5/p/s`
+	LogBurst         uint32
+	BanFlushFlows    bool     // delete the conntrack flows of the addresses banned by Ban
+	EarlyDrop        bool     // drop the sources of blacklist_ipset in netdev ingress chains of the WAN interfaces, before conntrack and routing
+	EarlyDropBogons  bool     // also drop the bogon sources in the ingress chains, see BogonIPv4 and BogonIPv6
+	EarlyDropFrags   bool     // also drop the IP fragments in the ingress chains
+	Flowtable        bool     // offload the established TCP/UDP flows forwarded between MyIface and the WAN interfaces to a flowtable
+	FlowtableDevices []string // devices of the flowtable, default: MyIface and the WAN interfaces
+	FlowtableOffload bool     // hardware offload, the devices must support it
+	NotrackLoopback  bool     // skip conntrack on the loopback interface
+	NotrackDNS       bool     // skip conntrack for the DNS server of this host
+	SynFlood         string   // SYN flood protection of the declared TCP services: synproxy (requires net.netfilter.nf_conntrack_tcp_loose=0) / limit (per-source SYN rate limit), none if empty
+	SynProxyMSS      uint16   // MSS of the backend announced by synproxy. default: 1460
+	SynProxyWscale   uint8    // window scale of the backend announced by synproxy. default: 7
+	SynLimitRate     string   // SYN rate of a source to a port of the limit protection, e.g. `25/p/s`. default: `25/p/s`
+	SynLimitBurst    uint32
+	Counters         string           // counters of the rules: rule (anonymous per-rule counters) / named (counter objects named by rule ID), none if empty
+	GeoIPFiles       []string         // country databases of the country:XX sources: MaxMind / DB-IP files in MMDB (.mmdb) or CSV format
+	GeoIPRefresh     time.Duration    // interval of RunGeoIPRefresh reloading GeoIPFiles, no refresh if 0
+	Schedules        []Schedule       // time windows of the rule groups, the rules not scheduled are always active
+	Outbound         []Outbound       // outbound allowlists of the local users and cgroups, the other owners are left to the output rules
+	VirtualServices  []VirtualService // L4 load balancing of frontend addresses to backends, without IPVS
+	Mirrors          []Mirror         // copies of the selected traffic sent to other interfaces, e.g. of an IDS
+	Bridges          []Bridge         // L2 policies of the Linux bridges, applied by the IPv4 firewall to the frames of all families
+	Coexist          bool             // coexistence with Docker and Kubernetes: the ruleset is never flushed, the foreign tables are left untouched and their traffic passes the forward chain
+	CoexistIfaces    []string         // bridges passed through the forward chain in coexistence mode, e.g. docker0, br-*, cni0. default: the bridges of the detected owners, see ForeignIfaces
+	CoexistSources   []string         // pod and service CIDRs passed through the forward chain in coexistence mode, e.g. 10.244.0.0/16
+	Priorities       Priorities       // offsets of the priorities of the base chains, to run before or after the chains of other firewalls
+}
+
+// Priorities are added to the standard priorities of the base chains, e.g.
+// Filter: -10 runs the filter chains before those of Docker and kube-proxy,
+// which use the filter priority, and Filter: 10 after them.
+type Priorities struct {
+	Filter int32 // input, forward, output and prerouting chains of the filter table
+	NAT    int32 // prerouting (dstnat) and postrouting (srcnat) chains of the nat table
+	Raw    int32 // chains of the raw table
+}
+
+// Zone is a named group of interfaces and/or source prefixes.
+type Zone struct {
+	Name    string
+	Ifaces  []string // exact interface names, each one in at most one zone
+	Sources []string // e.g. 10.0.0.0/8, 192.168.1.10-192.168.1.20, country:CN
+	Input   string   // default policy for traffic to this host: accept / drop / reject, empty means no verdict
+	Forward string   // default policy for forwarded traffic not matched by ZonePolicies: accept / drop / reject
+	CtZone  uint16   // conntrack zone of the interfaces, for overlapping address spaces. 0 is the default zone
+}
+
+// ZonePolicy is an inter-zone forward policy.
+type ZonePolicy struct {
+	From   string
+	To     string
+	Action string // allow / deny / masquerade
+}
+
+// Service is a service provided by this host or, if Forward is true, by the hosts behind it.
+type Service struct {
+	Name     string
+	Protocol string   // tcp / udp, all protocols of Helper if empty, default: tcp
+	Ports    []uint16 // control ports, the default ports of Helper if empty
+	Sources  []string // allowed sources, e.g. 10.0.0.0/8, 192.168.1.10-192.168.1.20, country:CN, all if empty
+	Forward  bool
+	Helper   string      // conntrack helper of the control connections: ftp / sip / tftp / irc / h323
+	Knock    []KnockStep // port knocking sequence granting access to the service, no knocking if empty
+}
+
+// KnockStep is a step of a port knocking sequence.
+type KnockStep struct {
+	Protocol string // tcp / udp, default: tcp
+	Port     uint16
+	Timeout  time.Duration // time left to knock the next step, or to connect after the last step. default: 10s
+}
+
+// AntiSpoof filters the spoofed sources of the packets received on an interface.
+type AntiSpoof struct {
+	Iface      string
+	RPF        string // reverse path filter: strict (the route to the source goes through Iface) / loose (any route to the source), none if empty
+	Bogons     bool   // drop the bogon and martian sources, e.g. on the WAN interfaces
+	PublicOnly bool   // also drop the private sources (RFC 1918, RFC 6598, RFC 4193) if Bogons is true
+}
+
+// Schedule restricts rule groups to time windows. The time is matched in the
+// kernel if possible, otherwise the rules are inserted and removed by
+// RunScheduler.
+type Schedule struct {
+	Rules     []string       // IDs of the rules or of their groups, e.g. service_ssh matches service_ssh_tcp and service_ssh_tcp_reply
+	Days      []time.Weekday // active days, all if empty
+	From      string         // start of the daily window, e.g. 08:00, all day if From and To are empty
+	To        string         // end of the daily window, e.g. 18:00. the window wraps midnight if To is before From
+	Start     time.Time      // activation time, unbounded if zero
+	End       time.Time      // expiration time, unbounded if zero
+	Location  string         // time zone of Days, From and To, e.g. Asia/Shanghai. default: Local
+	Scheduler bool           // always insert and remove the rules by RunScheduler instead of matching the time in the kernel
+}
+
+// Outbound restricts the new outbound connections of local users, groups and
+// cgroups to its destinations. The other new connections of the owners are
+// dropped before the output rules, except on the loopback interface.
+type Outbound struct {
+	Name         string
+	Users        []string // user names or UIDs
+	Groups       []string // group names or GIDs
+	Cgroups      []string // cgroup v2 paths relative to /sys/fs/cgroup, including their descendants, e.g. system.slice/build.service
+	Destinations []string // allowed destinations, e.g. 10.0.0.0/8, 192.168.1.10-192.168.1.20, updated by AddOutboundDestinations. none if empty
+	Protocol     string   // tcp / udp of Ports, default: tcp
+	Ports        []uint16 // allowed destination ports, all if empty
+}
+
+// VirtualService balances the connections to a frontend address over its
+// backends by DNAT, the backends are reached through the forward chain.
+type VirtualService struct {
+	Name       string
+	Frontend   string // ip:port of the service, e.g. 203.0.113.1:80, [2001:db8::1]:80
+	Protocol   string // tcp / udp, default: tcp
+	Scheduler  string // rr (round robin) / random / hash (source address and port), default: rr
+	Backends   []VirtualBackend
+	Masquerade bool // SNAT the connections to the backends, if their replies are not routed through this host
+}
+
+// VirtualBackend is a backend of a VirtualService.
+type VirtualBackend struct {
+	Address string // ip:port, or ip for the port of the frontend
+	Weight  uint32 // share of the connections relative to the other backends. default: 1
+}
+
+// Mirror sends a copy of the packets received on Iface and matched by Sources
+// and Service to the interface To. The copies are sent unchanged from the
+// ingress of Iface, or routed to Gateway through To if Gateway is set.
+type Mirror struct {
+	Name    string
+	Iface   string   // interface of the mirrored packets, required unless Gateway is set, all if empty
+	Sources []string // source addresses, e.g. 10.0.0.0/8, 192.168.1.10-192.168.1.20, country:CN, all if empty
+	Service string   // name of a declared Service whose ports are mirrored, all if empty
+	To      string   // interface the copies are sent to
+	Gateway string   // address of the receiver of the copies behind To, e.g. for a remote IDS
+	Rate    string   // rate cap of the copies, e.g. `1000/p/s`, `10485760/b/s`, unlimited if empty
+}
+
+// Bridge is the L2 policy of a Linux bridge, applied in the bridge table to
+// the frames received on its ports.
+type Bridge struct {
+	Name  string       // bridge interface, e.g. br0
+	Ports []BridgePort // ports whose source addresses are guarded
+	Rules []BridgeRule // rules of the frames forwarded between the ports, the first matching rule applies
+}
+
+// BridgePort restricts the source addresses of the frames received on a
+// bridge port, e.g. the tap of a VM.
+type BridgePort struct {
+	Iface string   // port interface, e.g. vnet0. a trailing * matches the names starting with the rest
+	MACs  []string // source MAC addresses allowed from the port, e.g. 52:54:00:12:34:56, all if empty
+	IPs   []string // IPv4 addresses bound to MACs by the ARP guard, which drops the ARP packets of other senders. every IP is allowed with every MAC of the port, use a port per MAC to bind them by pair. no guard if empty
+}
+
+// BridgeRule accepts or drops the frames forwarded by a bridge.
+type BridgeRule struct {
+	Name      string
+	From      []string // input ports, all if empty
+	To        []string // output ports, all if empty
+	SrcMACs   []string // source MAC addresses, all if empty
+	DstMACs   []string // destination MAC addresses, all if empty
+	EtherType string   // ip / ip6 / arp / vlan or a number, e.g. 0x88cc, all if empty. the type encapsulated by the tagged frames if Vlan or PCP is set
+	Vlan      uint16   // VLAN id of the tagged frames, all if 0
+	PCP       string   // priority code point of the tagged frames, 0 to 7, all if empty
+	Action    string   // accept / drop
+}
+
+// Zone returns the zone by name.
+func (c *Config) Zone(name string) *Zone {
+	for i := range c.Zones {
+		if c.Zones[i].Name == name {
+			return &c.Zones[i]
+		}
+	}
+	return nil
 }
 
 func (c *Config) CanApply(name string) bool {
@@ -1,10 +1,12 @@
 package biz
 
 const (
-	TableFilter = `filter`
-	TableNAT    = `nat`
-	TableMangle = `mangle`
-	TableRaw    = `raw`
+	TableFilter  = `filter`
+	TableNAT     = `nat`
+	TableMangle  = `mangle`
+	TableRaw     = `raw`
+	TableIngress = `ingress`
+	TableBridge  = `bridge`
 )
 
 const (
@@ -13,6 +15,46 @@ const (
 	ChainForward     = `FORWARD`
 	ChainPreRouting  = `PREROUTING`
 	ChainPostRouting = `POSTROUTING`
+	ChainIngress     = `INGRESS`
+
+	ChainOutputHelper = `OUTPUT_HELPER`
+)
+
+const (
+	ZonePolicyAllow      = `allow`
+	ZonePolicyDeny       = `deny`
+	ZonePolicyMasquerade = `masquerade`
+)
+
+const (
+	SynFloodSynproxy = `synproxy`
+	SynFloodLimit    = `limit`
+)
+
+const (
+	SchedulerRoundRobin = `rr`
+	SchedulerRandom     = `random`
+	SchedulerHash       = `hash`
+)
+
+const (
+	BridgeActionAccept = `accept`
+	BridgeActionDrop   = `drop`
+)
+
+const (
+	ForeignDocker     = `docker`
+	ForeignKubernetes = `kubernetes`
+)
+
+const (
+	RPFStrict = `strict`
+	RPFLoose  = `loose`
+)
+
+const (
+	CounterModeRule  = `rule`
+	CounterModeNamed = `named`
 )
 
 const (
@@ -45,4 +87,14 @@ const (
 	RULE_INPUT_LOCAL_IFACE  = 64
 	RULE_OUTPUT_LOCAL_IFACE = 128
 	RULE_ALL                = 512
+	RULE_ZONE               = 1024
+	RULE_SERVICE            = 2048
+	RULE_RAW                = 4096
+	RULE_ANTISPOOF          = 8192
+	RULE_OUTBOUND           = 16384
+	RULE_VIRTUAL_SERVICE    = 32768
+	RULE_MIRROR             = 65536
+	RULE_EARLY_DROP         = 131072
+	RULE_BRIDGE             = 262144
+	RULE_COEXIST            = 524288
 )
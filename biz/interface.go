@@ -4,6 +4,8 @@ import (
 	"net"
 	"time"
 
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/rule"
 	"github.com/google/nftables"
 )
 
@@ -20,15 +22,27 @@ type INFTables interface {
 	// Ban adding ip to backlist.
 	Ban(ipAddresses []string, timeout time.Duration) error
 
+	// Unban removes ip from backlist.
+	Unban(ipAddresses []string) error
+
 	// Cleanup rules to default policy filtering.
 	Cleanup() error
 
 	// WanIP returns ip address of wan interface.
 	WanIP() net.IP
 
+	// Wans returns the WAN interfaces, the primary one first.
+	Wans() []utils.DefaultRoute
+
+	// Counters returns the packets and bytes counted by the rules by rule ID.
+	Counters(reset bool) (map[string]rule.Counter, error)
+
 	// IfacesIPs returns ip addresses list of additional ifaces.
 	IfacesIPs() ([]net.IP, error)
 
+	// Foreign returns the tables of Docker and Kubernetes found in the ruleset.
+	Foreign() ([]ForeignTable, error)
+
 	// -- table & chain & set --
 
 	TableFilter() *nftables.Table
@@ -40,6 +54,9 @@ type INFTables interface {
 	ChainPrerouting() *nftables.Chain
 	ChainPostrouting() *nftables.Chain
 
+	TableRaw() *nftables.Table
+	TableBridge() *nftables.Table
+
 	FilterSetTrustIP() *nftables.Set
 	FilterSetManagerIP() *nftables.Set
 	FilterSetForwardIP() *nftables.Set
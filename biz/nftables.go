@@ -1,30 +1,50 @@
 package biz
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/geoip"
 	setutils "github.com/admpub/nftablesutils/set"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
 const loIface = "lo"
 
 var _ INFTables = &NFTables{}
 
-func New(tableFamily nftables.TableFamily, c Config, managerPorts []uint16) *NFTables {
-	return &NFTables{
+func New(tableFamily nftables.TableFamily, c Config, managerPorts []uint16, opts ...Option) *NFTables {
+	nft := &NFTables{
 		tableFamily:  tableFamily,
 		cfg:          &c,
 		managerPorts: managerPorts,
 	}
+	for _, opt := range opts {
+		opt(nft)
+	}
+	return nft
+}
+
+// Option of New.
+type Option func(*NFTables)
+
+// WithConnOptions makes Do open the connections with opts instead of in the
+// configured network namespace, e.g. with nftables.WithTestDial to use a
+// fake netlink connection such as nftest.Kernel.Dial.
+func WithConnOptions(opts ...nftables.ConnOption) Option {
+	return func(nft *NFTables) {
+		nft.connOpts = opts
+	}
 }
 
 // NFTables struct.
@@ -34,9 +54,12 @@ type NFTables struct {
 
 	originNetNS netns.NsHandle
 	targetNetNS netns.NsHandle
+	applyMu     sync.Mutex // serializes apply, Do and the other binders of the netns, whose listings and batches depend on each other
+	connOpts    []nftables.ConnOption
 
 	wanIface string
 	wanIP    net.IP
+	wans     []utils.DefaultRoute
 	myIface  string
 	myPort   uint16
 
@@ -54,12 +77,62 @@ type NFTables struct {
 	filterSetForwardIP   *nftables.Set
 	filterSetBlacklistIP *nftables.Set
 
+	zones []*zoneChains
+
+	tRaw           *nftables.Table
+	cRawPrerouting *nftables.Chain
+	cRawOutput     *nftables.Chain
+
+	cFilterPrerouting *nftables.Chain
+	cOutputHelper     *nftables.Chain // assigns the ct helpers to the local connections
+
+	tIngress *nftables.Table
+	cIngress []*nftables.Chain // ingress chains of the devices
+
+	ingressSetBlacklistIP *nftables.Set // mirror of filterSetBlacklistIP in tIngress
+
+	tBridge           *nftables.Table
+	cBridgePrerouting *nftables.Chain
+	cBridgeForward    *nftables.Chain
+
+	filterSetSynLimit *nftables.Set
+
+	filterSetBogonIP   *nftables.Set
+	filterSetPrivateIP *nftables.Set
+
+	knocks map[string]*knockSequence
+
+	geoDB   *geoip.DB
+	geoSets map[string]*geoSet
+	geoMu   sync.Mutex
+
+	schedules  []*schedule
+	scheduled  map[string]*scheduledRule // rules of the scheduler by table/chain/ID
+	ruleOrder  map[string][]string       // IDs of the rules by table/chain, in the order they were added
+	scheduleMu sync.Mutex                // guards the schedules, the listings and batches of the scheduler are serialized by applyMu
+
+	addedRules   map[string]*nftables.Rule    // rules added by table/chain/ID
+	keptRules    map[string]map[string]uint64 // handles of the rules kept by ReapplyIface by table/chain and ID
+	addedSets    map[string]*nftables.Set     // named sets of the filter table added by the last apply by name
+	counterNames map[string]bool              // named counters added by withCounter by table/name, the only ones pruned
+	rulesMu      sync.Mutex                   // guards addedRules, keptRules, addedSets and counterNames, read by the scheduler and the GeoIP refresh
+
+	outboundSets map[string]*nftables.Set // destination sets of the outbound allowlists by name
+
+	flowtable *nftables.Flowtable
+
+	foreign []ForeignTable // tables of Docker and Kubernetes detected by apply in coexistence mode
+
 	tables       []*nftables.Table
 	chains       []*nftables.Chain
 	sets         []*nftables.Set
 	managerPorts []uint16
 
-	applied bool
+	applied     bool
+	appliedFlag int
+
+	counterBase counterBaseline
+	stats       statsRecorder
 }
 
 // Init nftables firewall.
@@ -69,13 +142,10 @@ func (nft *NFTables) Init() error {
 	}
 	cfg := nft.cfg
 	// obtain default interface name, ip address and gateway ip address
-	var wanIface string
-	var wanIP net.IP
-	var err error
-	if nft.tableFamily == nftables.TableFamilyIPv6 {
-		wanIface, _, wanIP, err = utils.IPv6Addr()
-	} else {
-		wanIface, _, wanIP, err = utils.IPAddr()
+	var wans []utils.DefaultRoute
+	routes, err := nft.defaultRoutes()
+	if err == nil {
+		wans, err = selectWans(routes, cfg)
 	}
 	if err != nil {
 		err = fmt.Errorf(`failed to obtain default interface name: %w`, err)
@@ -94,7 +164,7 @@ func (nft *NFTables) Init() error {
 		Name:     ChainInput,
 		Table:    tFilter,
 		Type:     nftables.ChainTypeFilter,
-		Priority: nftables.ChainPriorityFilter,
+		Priority: priority(nftables.ChainPriorityFilter, cfg.Priorities.Filter),
 		Hooknum:  nftables.ChainHookInput,
 		Policy:   &defaultPolicy,
 	}
@@ -102,7 +172,7 @@ func (nft *NFTables) Init() error {
 		Name:     ChainForward,
 		Table:    tFilter,
 		Type:     nftables.ChainTypeFilter,
-		Priority: nftables.ChainPriorityFilter,
+		Priority: priority(nftables.ChainPriorityFilter, cfg.Priorities.Filter),
 		Hooknum:  nftables.ChainHookForward,
 		Policy:   &defaultPolicy,
 	}
@@ -110,7 +180,7 @@ func (nft *NFTables) Init() error {
 		Name:     ChainOutput,
 		Table:    tFilter,
 		Type:     nftables.ChainTypeFilter,
-		Priority: nftables.ChainPriorityFilter,
+		Priority: priority(nftables.ChainPriorityFilter, cfg.Priorities.Filter),
 		Hooknum:  nftables.ChainHookOutput,
 		Policy:   &defaultPolicy,
 	}
@@ -124,14 +194,14 @@ func (nft *NFTables) Init() error {
 		Name:     ChainPreRouting,
 		Table:    tNAT,
 		Type:     nftables.ChainTypeNAT,
-		Priority: nftables.ChainPriorityNATDest,
+		Priority: priority(nftables.ChainPriorityNATDest, cfg.Priorities.NAT),
 		Hooknum:  nftables.ChainHookPrerouting,
 	}
 	cPostrouting := &nftables.Chain{
 		Name:     ChainPostRouting,
 		Table:    tNAT,
 		Type:     nftables.ChainTypeNAT,
-		Priority: nftables.ChainPriorityNATSource,
+		Priority: priority(nftables.ChainPriorityNATSource, cfg.Priorities.NAT),
 		Hooknum:  nftables.ChainHookPostrouting,
 	}
 
@@ -164,8 +234,9 @@ func (nft *NFTables) Init() error {
 		filterSetBlacklistIP.KeyType = nftables.TypeIP6Addr
 	}
 
-	nft.wanIface = wanIface
-	nft.wanIP = wanIP
+	if wanErr := nft.setWans(wans); wanErr != nil && err == nil {
+		err = wanErr
+	}
 	nft.myIface = cfg.MyIface
 	nft.myPort = cfg.MyPort
 
@@ -186,15 +257,80 @@ func (nft *NFTables) Init() error {
 	nft.tables = []*nftables.Table{nft.tFilter, nft.tNAT}
 	nft.chains = []*nftables.Chain{nft.cInput, nft.cOutput, nft.cForward, nft.cPrerouting, nft.cPostrouting}
 	nft.sets = []*nftables.Set{nft.filterSetBlacklistIP, nft.filterSetForwardIP, nft.filterSetManagerIP, nft.filterSetTrustIP}
+	nft.initZones()
+	nft.initFilterPrerouting()
+	nft.initOutputHelper()
+	nft.initSynFlood()
+	nft.initAntiSpoof()
+	nft.initKnock()
+	nft.initRaw()
+	nft.initOutbound()
+	nft.initIngress()
+	nft.initBridge()
 	return err
 }
 
+// initFilterPrerouting creates the prerouting chain of the filter table, which
+// assigns the ct helpers of the services, drops the spoofed sources and
+// mirrors the routed traffic.
+func (nft *NFTables) initFilterPrerouting() {
+	nft.cFilterPrerouting = nil
+	if !nft.hasServiceHelper() && len(nft.cfg.AntiSpoof) == 0 && !nft.hasGatewayMirror() {
+		return
+	}
+	nft.cFilterPrerouting = &nftables.Chain{
+		Name:     ChainPreRouting,
+		Table:    nft.tFilter,
+		Type:     nftables.ChainTypeFilter,
+		Priority: priority(nftables.ChainPriorityFilter, nft.cfg.Priorities.Filter),
+		Hooknum:  nftables.ChainHookPrerouting,
+	}
+	nft.chains = append(nft.chains, nft.cFilterPrerouting)
+}
+
+// initOutputHelper creates the output chain of the filter table assigning the
+// ct helpers of the local services to the locally originated connections. It
+// is a base chain of its own, the accept rules of the output chain don't skip
+// it.
+func (nft *NFTables) initOutputHelper() {
+	nft.cOutputHelper = nil
+	var local bool
+	for _, svc := range nft.cfg.Services {
+		if len(svc.Helper) > 0 && !svc.Forward {
+			local = true
+			break
+		}
+	}
+	if !local {
+		return
+	}
+	nft.cOutputHelper = &nftables.Chain{
+		Name:     ChainOutputHelper,
+		Table:    nft.tFilter,
+		Type:     nftables.ChainTypeFilter,
+		Priority: priority(nftables.ChainPriorityFilter, nft.cfg.Priorities.Filter),
+		Hooknum:  nftables.ChainHookOutput,
+	}
+	nft.chains = append(nft.chains, nft.cOutputHelper)
+}
+
+// priority returns the standard priority base moved by offset.
+func priority(base *nftables.ChainPriority, offset int32) *nftables.ChainPriority {
+	if offset == 0 {
+		return base
+	}
+	return nftables.ChainPriorityRef(*base + nftables.ChainPriority(offset))
+}
+
 func (nft *NFTables) ApplyDefault(flag int) error {
 	return nft.apply(flag)
 }
 
 // networkNamespaceBind target by name.
 func (nft *NFTables) networkNamespaceBind() (*nftables.Conn, error) {
+	if len(nft.connOpts) > 0 {
+		return nftables.New(nft.connOpts...)
+	}
 	if nft.cfg.NetworkNamespace == "" {
 		return &nftables.Conn{NetNS: int(nft.originNetNS)}, nil
 	}
@@ -229,7 +365,7 @@ func (nft *NFTables) networkNamespaceBind() (*nftables.Conn, error) {
 
 // networkNamespaceRelease to origin.
 func (nft *NFTables) networkNamespaceRelease() error {
-	if nft.cfg.NetworkNamespace == "" {
+	if nft.cfg.NetworkNamespace == "" || len(nft.connOpts) > 0 {
 		return nil
 	}
 
@@ -282,6 +418,65 @@ func (nft *NFTables) ApplyBase(c *nftables.Conn) error {
 	// { type nat hook postrouting priority 100 \; }
 	c.AddChain(nft.cPostrouting)
 
+	// add zone chains
+	// cmd: nft add chain ip filter zone_lan_input
+	for _, zc := range nft.zones {
+		c.AddChain(zc.input)
+		c.AddChain(zc.forward)
+	}
+
+	// add raw table
+	// cmd: nft add table ip raw
+	// cmd: nft add chain ip raw prerouting \
+	// { type filter hook prerouting priority -300 \; }
+	if nft.tRaw != nil {
+		c.AddTable(nft.tRaw)
+		c.AddChain(nft.cRawPrerouting)
+		c.AddChain(nft.cRawOutput)
+	}
+
+	// add flowtable
+	// cmd: nft add flowtable ip filter ft \
+	// { hook ingress priority 0 \; devices = { eth0, wg0 } \; }
+	if ft := nft.newFlowtable(); ft != nil {
+		c.AddFlowtable(ft)
+	}
+
+	// add prerouting chain of filter table
+	// cmd: nft add chain ip filter PREROUTING \
+	// { type filter hook prerouting priority 0 \; }
+	if nft.cFilterPrerouting != nil {
+		c.AddChain(nft.cFilterPrerouting)
+	}
+
+	// add helper output chain of filter table
+	// cmd: nft add chain ip filter OUTPUT_HELPER \
+	// { type filter hook output priority 0 \; }
+	if nft.cOutputHelper != nil {
+		c.AddChain(nft.cOutputHelper)
+	}
+
+	// add netdev table and ingress chains
+	// cmd: nft add table netdev ingress
+	// cmd: nft add chain netdev ingress INGRESS_eth0 \
+	// { type filter hook ingress device "eth0" priority 0 \; }
+	if nft.tIngress != nil {
+		c.AddTable(nft.tIngress)
+		for _, chain := range nft.cIngress {
+			c.AddChain(chain)
+		}
+	}
+
+	// add bridge table
+	// cmd: nft add table bridge bridge
+	// cmd: nft add chain bridge bridge PREROUTING \
+	// { type filter hook prerouting priority 0 \; }
+	if nft.tBridge != nil {
+		c.AddTable(nft.tBridge)
+		c.AddChain(nft.cBridgePrerouting)
+		c.AddChain(nft.cBridgeForward)
+	}
+
 	if nft.cfg.DisableInitSet {
 		return nil
 	}
@@ -301,7 +496,7 @@ func (nft *NFTables) InitSet(c *nftables.Conn, flag int) error {
 		// set trust_ipset {
 		//         type ipv4_addr
 		// }
-		err = c.AddSet(nft.filterSetTrustIP, nil)
+		err = nft.addSet(c, nft.filterSetTrustIP, nil)
 		if err != nil {
 			return fmt.Errorf(`nft.AddSet(%q): %w`, nft.filterSetTrustIP.Name, err)
 		}
@@ -314,7 +509,7 @@ func (nft *NFTables) InitSet(c *nftables.Conn, flag int) error {
 		// set manager_ipset {
 		//         type ipv4_addr
 		// }
-		err = c.AddSet(nft.filterSetManagerIP, nil)
+		err = nft.addSet(c, nft.filterSetManagerIP, nil)
 		if err != nil {
 			return fmt.Errorf(`nft.AddSet(%q): %w`, nft.filterSetManagerIP.Name, err)
 		}
@@ -327,7 +522,7 @@ func (nft *NFTables) InitSet(c *nftables.Conn, flag int) error {
 		// set forward_ipset {
 		//         type ipv4_addr
 		// }
-		err = c.AddSet(nft.filterSetForwardIP, nil)
+		err = nft.addSet(c, nft.filterSetForwardIP, nil)
 		if err != nil {
 			return fmt.Errorf(`nft.AddSet(%q): %w`, nft.filterSetForwardIP.Name, err)
 		}
@@ -341,19 +536,96 @@ func (nft *NFTables) InitSet(c *nftables.Conn, flag int) error {
 		//         type ipv4_addr
 		//         flags timeout
 		// }
-		err = c.AddSet(nft.filterSetBlacklistIP, nil)
+		err = nft.addSet(c, nft.filterSetBlacklistIP, nil)
 		if err != nil {
 			return fmt.Errorf(`nft.AddSet(%q): %w`, nft.filterSetBlacklistIP.Name, err)
 		}
+		if nft.ingressSetBlacklistIP != nil {
+			// cmd: nft add set netdev ingress blacklist_ipset { type ipv4_addr\; flags interval,timeout\; }
+			err = nft.syncIngressBlacklist(c)
+			if err != nil {
+				return fmt.Errorf(`nft.AddSet(%q): %w`, nft.ingressSetBlacklistIP.Name, err)
+			}
+		}
 	}
 	return err
 }
 
+// addSet adds set and records it for Reconcile and SetSizes.
+func (nft *NFTables) addSet(c *nftables.Conn, set *nftables.Set, elems []nftables.SetElement) error {
+	if err := c.AddSet(set, elems); err != nil {
+		return err
+	}
+	nft.rulesMu.Lock()
+	if nft.addedSets == nil {
+		nft.addedSets = map[string]*nftables.Set{}
+	}
+	nft.addedSets[set.Name] = set
+	nft.rulesMu.Unlock()
+	return nil
+}
+
+// appliedSets returns the sets of nft.sets added by the last apply.
+func (nft *NFTables) appliedSets() []*nftables.Set {
+	nft.rulesMu.Lock()
+	defer nft.rulesMu.Unlock()
+	sets := make([]*nftables.Set, 0, len(nft.addedSets))
+	for _, set := range nft.sets {
+		if nft.addedSets[set.Name] == set {
+			sets = append(sets, set)
+		}
+	}
+	return sets
+}
+
+// addRule adds the rule with a counter according to Config.Counters and the
+// time matching of its schedule. The rules of the scheduler which are
+// inactive are added behind inactiveExprs.
+func (nft *NFTables) addRule(c *nftables.Conn, r *nftables.Rule) *nftables.Rule {
+	inactive := nft.scheduleRule(c, r)
+	nft.withCounter(c, r)
+	if len(r.UserData) == 0 {
+		return c.AddRule(r)
+	}
+	nft.rulesMu.Lock()
+	if nft.addedRules == nil {
+		nft.addedRules = map[string]*nftables.Rule{}
+	}
+	nft.addedRules[chainKey(r.Table, r.Chain)+`/`+string(r.UserData)] = r
+	kept := nft.keptRules
+	nft.rulesMu.Unlock()
+	nft.recordRuleOrder(r)
+	var insert bool
+	if kept != nil {
+		// the rules regenerated by ReapplyIface are inserted back at their place
+		r.Position = nft.nextRuleHandle(r, kept[chainKey(r.Table, r.Chain)])
+		insert = r.Position > 0
+	}
+	added := r
+	if inactive {
+		// the rule is recorded without the guard, syncSchedules restores it so
+		clone := *r
+		clone.Exprs = append(inactiveExprs(), r.Exprs...)
+		added = &clone
+	}
+	// cmd: nft insert rule ip filter input position 12 ...
+	if insert {
+		return c.InsertRule(added)
+	}
+	return c.AddRule(added)
+}
+
 // apply rules
-func (nft *NFTables) apply(flag int) error {
+func (nft *NFTables) apply(flag int) (err error) {
 	if !nft.cfg.Enabled {
 		return nil
 	}
+	nft.applyMu.Lock()
+	defer nft.applyMu.Unlock()
+	start := time.Now()
+	defer func() {
+		nft.stats.applied(start, err)
+	}()
 
 	// bind network namespace if it was set in config
 	c, err := nft.networkNamespaceBind()
@@ -363,13 +635,18 @@ func (nft *NFTables) apply(flag int) error {
 
 	// release network namespace finally
 	defer nft.networkNamespaceRelease()
-	if nft.cfg.ClearRuleset {
-		c.FlushRuleset()
-	} else {
-		for _, table := range nft.tables {
-			c.FlushTable(table)
+	nft.rulesMu.Lock()
+	nft.addedSets = map[string]*nftables.Set{}
+	nft.rulesMu.Unlock()
+	if nft.cfg.Coexist {
+		if err = nft.detectForeign(c); err != nil {
+			return fmt.Errorf(`nft.detectForeign: %w`, err)
 		}
-		_ = c.Flush()
+	}
+	if nft.cfg.ClearRuleset && !nft.cfg.Coexist {
+		c.FlushRuleset()
+	} else if err = nft.flushTables(c); err != nil {
+		return fmt.Errorf(`nft.flushTables: %w`, err)
 	}
 	//
 	// Init Tables and Chains.
@@ -378,15 +655,34 @@ func (nft *NFTables) apply(flag int) error {
 	if err != nil {
 		return err
 	}
+	nft.rulesMu.Lock()
+	nft.addedRules = map[string]*nftables.Rule{}
+	nft.rulesMu.Unlock()
+	nft.resetGeoSets()
+	if err = nft.initSchedules(time.Now()); err != nil {
+		return fmt.Errorf(`nft.initSchedules: %w`, err)
+	}
 	if err = nft.ApplyFilterRule(c, flag); err != nil {
 		return err
 	}
+	nft.pruneGeoSets(c, nft.cfg.ClearRuleset && !nft.cfg.Coexist)
+	if err = nft.pruneCounters(c, nft.cfg.ClearRuleset && !nft.cfg.Coexist); err != nil {
+		return fmt.Errorf(`nft.pruneCounters: %w`, err)
+	}
 	// apply configuration
 	err = c.Flush()
 	if err != nil {
 		return err
 	}
+	// remove the scheduled rules which are inactive
+	if err = nft.syncSchedules(c, time.Now()); err != nil {
+		return fmt.Errorf(`nft.syncSchedules: %w`, err)
+	}
+	if err = c.Flush(); err != nil {
+		return err
+	}
 	nft.applied = true
+	nft.appliedFlag = flag
 
 	return nil
 }
@@ -397,6 +693,13 @@ func (nft *NFTables) ApplyFilterRule(c *nftables.Conn, flag int) (err error) {
 	// Init filter rules.
 	//
 
+	// the outbound allowlists precede the output rules
+	if flag&RULE_ALL != 0 || flag&RULE_OUTBOUND != 0 {
+		err = nft.outboundRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.outboundRules: %w`, err)
+		}
+	}
 	if flag&RULE_ALL != 0 || flag&RULE_LOCAL_IFACE != 0 || flag&RULE_INPUT_LOCAL_IFACE != 0 {
 		nft.inputLocalIfaceRules(c)
 	}
@@ -404,11 +707,14 @@ func (nft *NFTables) ApplyFilterRule(c *nftables.Conn, flag int) (err error) {
 		nft.outputLocalIfaceRules(c)
 	}
 	if flag&RULE_ALL != 0 || flag&RULE_WAN_IFACE != 0 {
-		if err = nft.applyCommonRules(c, nft.wanIface); err != nil {
-			return err
+		for _, wanIface := range nft.wanIfaces() {
+			if err = nft.applyCommonRules(c, wanIface); err != nil {
+				return err
+			}
 		}
 	}
 	if flag&RULE_ALL != 0 || flag&RULE_SDN != 0 {
+		nft.flowtableRules(c)
 		err = nft.sdnRules(c)
 		if err != nil {
 			return fmt.Errorf(`nft.sdnRules: %w`, err)
@@ -425,7 +731,7 @@ func (nft *NFTables) ApplyFilterRule(c *nftables.Conn, flag int) (err error) {
 	}
 
 	for _, iface := range nft.cfg.Ifaces {
-		if iface == nft.wanIface {
+		if nft.isWanIface(iface) {
 			continue
 		}
 
@@ -434,11 +740,300 @@ func (nft *NFTables) ApplyFilterRule(c *nftables.Conn, flag int) (err error) {
 		}
 	}
 	if flag&RULE_ALL != 0 || flag&RULE_BLACKLIST != 0 {
-		err = nft.blacklistRules(c)
+		if err = nft.blacklistRules(c); err != nil {
+			return err
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_EARLY_DROP != 0 {
+		err = nft.earlyDropRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.earlyDropRules: %w`, err)
+		}
+	}
+	// the foreign traffic precedes the zone policies
+	if flag&RULE_ALL != 0 || flag&RULE_COEXIST != 0 {
+		err = nft.coexistRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.coexistRules: %w`, err)
+		}
+	}
+	// synproxy takes the SYNs before the zone policies drop them
+	if flag&RULE_ALL != 0 || flag&RULE_SERVICE != 0 {
+		err = nft.synProxyServiceRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.synProxyServiceRules: %w`, err)
+		}
+	}
+	// the translated connections are accepted before the zone policies drop them
+	if flag&RULE_ALL != 0 || flag&RULE_VIRTUAL_SERVICE != 0 {
+		err = nft.virtualServiceRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.virtualServiceRules: %w`, err)
+		}
+	}
+	// the declared services are accepted before the zone policies drop them
+	if flag&RULE_ALL != 0 || flag&RULE_SERVICE != 0 {
+		err = nft.serviceRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.serviceRules: %w`, err)
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_ZONE != 0 {
+		err = nft.zoneRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.zoneRules: %w`, err)
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_ANTISPOOF != 0 {
+		err = nft.antiSpoofRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.antiSpoofRules: %w`, err)
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_RAW != 0 {
+		if err = nft.rawRules(c); err != nil {
+			return fmt.Errorf(`nft.rawRules: %w`, err)
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_MIRROR != 0 {
+		err = nft.mirrorRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.mirrorRules: %w`, err)
+		}
+	}
+	if flag&RULE_ALL != 0 || flag&RULE_BRIDGE != 0 {
+		err = nft.bridgeRules(c)
+		if err != nil {
+			return fmt.Errorf(`nft.bridgeRules: %w`, err)
+		}
+	}
+	if err = nft.logDropRules(c); err != nil {
+		return fmt.Errorf(`nft.logDropRules: %w`, err)
 	}
 	return err
 }
 
+// ReapplyIface regenerates the rules bound to iface, leaving the rules of
+// other interfaces untouched. It is used when iface was recreated, renamed
+// back or its addresses changed after the rules were applied.
+func (nft *NFTables) ReapplyIface(iface string) error {
+	if len(iface) == 0 {
+		return nil
+	}
+	return nft.Do(func(c *nftables.Conn) error {
+		// applied is read under the apply lock, the timers race with apply
+		if !nft.applied {
+			return nil
+		}
+		if err := nft.reapplyIfaceRules(c, iface); err != nil {
+			return err
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		if err := nft.syncSchedules(c, time.Now()); err != nil {
+			return fmt.Errorf(`nft.syncSchedules: %w`, err)
+		}
+		return c.Flush()
+	})
+}
+
+func (nft *NFTables) reapplyIfaceRules(c *nftables.Conn, iface string) error {
+	flag := nft.appliedFlag
+	enabled := func(rule int) bool {
+		return flag&RULE_ALL != 0 || flag&rule != 0
+	}
+	isWan := nft.isWanIface(iface)
+	isCommon := (isWan && enabled(RULE_WAN_IFACE)) || (!isWan && inStrings(nft.cfg.Ifaces, iface))
+	isSDN := len(nft.myIface) > 0 && (iface == nft.myIface || isWan)
+	antiSpoof := nft.antiSpoofOf(iface)
+	if antiSpoof != nil && !enabled(RULE_ANTISPOOF) {
+		antiSpoof = nil
+	}
+	var ctZone uint16
+	if nft.tRaw != nil && enabled(RULE_RAW) {
+		ctZone = nft.ctZoneOf(iface)
+	}
+	isFlowtableDevice := nft.flowtable != nil && inStrings(nft.flowtableDevices(), iface)
+	var mirrors []*Mirror
+	if enabled(RULE_MIRROR) {
+		mirrors = nft.ifaceMirrors(iface)
+	}
+	if !isCommon && !isSDN && !isWan && antiSpoof == nil && ctZone == 0 && !isFlowtableDevice && len(mirrors) == 0 {
+		return nil
+	}
+
+	tags := []string{iface}
+	if isSDN && iface != nft.myIface {
+		tags = append(tags, nft.myIface)
+	}
+	// the rules of the mirrors sending their copies to iface are tagged with
+	// their own interface
+	ids := map[string]bool{}
+	for _, m := range mirrors {
+		for _, ports := range nft.mirrorPorts(m) {
+			ids[string(mirrorRuleID(m, ports))] = true
+		}
+	}
+	kept, err := nft.deleteIfaceRules(c, ids, tags...)
+	if err != nil {
+		return err
+	}
+	nft.rulesMu.Lock()
+	nft.keptRules = kept
+	nft.rulesMu.Unlock()
+	defer func() {
+		nft.rulesMu.Lock()
+		nft.keptRules = nil
+		nft.rulesMu.Unlock()
+	}()
+
+	if isWan {
+		wanIP, err := nft.ifaceIP(iface)
+		if err != nil {
+			return fmt.Errorf(`failed to obtain ip address of %q: %w`, iface, err)
+		}
+		nft.updateWanIP(iface, wanIP)
+	}
+	if isFlowtableDevice {
+		// the kernel unbinds a deleted device from the flowtable, the devices
+		// of the flowtable are added again.
+		// cmd: nft add flowtable ip filter ft \
+		// { hook ingress priority 0 \; devices = { eth0, wg0 } \; }
+		if ft := nft.newFlowtable(); ft != nil {
+			c.AddFlowtable(ft)
+		}
+	}
+	if isCommon {
+		if err := nft.applyCommonRules(c, iface); err != nil {
+			return err
+		}
+	}
+	if isSDN {
+		if enabled(RULE_SDN) {
+			if err := nft.sdnRules(c); err != nil {
+				return fmt.Errorf(`nft.sdnRules: %w`, err)
+			}
+		}
+		if enabled(RULE_SDN_FORWARD) {
+			if err := nft.forwardInterfaceRules(c); err != nil {
+				return fmt.Errorf(`nft.forwardInterfaceRules: %w`, err)
+			}
+		}
+	}
+	if isWan && enabled(RULE_NAT) {
+		nft.natRules(c, iface)
+	}
+	if isWan && enabled(RULE_EARLY_DROP) {
+		if err := nft.earlyDropIfaceRules(c, iface); err != nil {
+			return fmt.Errorf(`nft.earlyDropIfaceRules: %w`, err)
+		}
+	}
+	if antiSpoof != nil {
+		nft.antiSpoofIfaceRules(c, antiSpoof)
+	}
+	if ctZone > 0 {
+		nft.ctZoneIfaceRules(c, iface, ctZone)
+	}
+	for _, m := range mirrors {
+		if err := nft.mirrorRule(c, m); err != nil {
+			return fmt.Errorf(`mirror %q: %w`, m.Name, err)
+		}
+	}
+	if err := nft.reappendLogDropRules(c); err != nil {
+		return fmt.Errorf(`nft.reappendLogDropRules: %w`, err)
+	}
+	return nil
+}
+
+// deleteIfaceRules deletes the rules generated for the ifaces and the rules of
+// ids, and returns the handles of the other rules by table/chain and ID.
+func (nft *NFTables) deleteIfaceRules(c *nftables.Conn, ids map[string]bool, ifaces ...string) (map[string]map[string]uint64, error) {
+	kept := map[string]map[string]uint64{}
+	for _, chain := range nft.chains {
+		rules, err := c.GetRules(chain.Table, chain)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list rules of chain %q: %w`, chain.Name, err)
+		}
+		handles := map[string]uint64{}
+		for _, rule := range rules {
+			deleted := ids[string(rule.UserData)]
+			for _, iface := range ifaces {
+				if deleted {
+					break
+				}
+				deleted = isIfaceRuleID(rule.UserData, iface)
+			}
+			if deleted {
+				if err = c.DelRule(rule); err != nil {
+					return nil, err
+				}
+			} else if len(rule.UserData) > 0 {
+				handles[string(rule.UserData)] = rule.Handle
+			}
+		}
+		kept[chainKey(chain.Table, chain)] = handles
+	}
+	return kept, nil
+}
+
+// ifaceIP returns the address of iface matching the table family, looked up
+// in Config.NetworkNamespace.
+func (nft *NFTables) ifaceIP(iface string) (net.IP, error) {
+	family := unix.AF_INET
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		family = unix.AF_INET6
+	}
+	var (
+		ips []net.IP
+		err error
+	)
+	if len(nft.cfg.NetworkNamespace) == 0 {
+		ips, err = utils.IfaceAddrs(iface, family)
+	} else {
+		var ns netns.NsHandle
+		ns, err = netns.GetFromName(nft.cfg.NetworkNamespace)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to netns.GetFromName(%q): %w`, nft.cfg.NetworkNamespace, err)
+		}
+		defer ns.Close()
+		ips, err = utils.IfaceAddrsAt(ns, iface, family)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if family == unix.AF_INET6 {
+			if ip.To4() == nil && ip.IsGlobalUnicast() {
+				return ip, nil
+			}
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	return nil, fmt.Errorf(`no address found on %q`, iface)
+}
+
+// ifaceRuleID returns the ID of a rule generated for iface.
+func ifaceRuleID(name string, iface string) []byte {
+	return []byte(name + `@` + iface)
+}
+
+func isIfaceRuleID(id []byte, iface string) bool {
+	return bytes.HasSuffix(id, []byte(`@`+iface))
+}
+
+func inStrings(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
 // sdnRules to apply.
 func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	if len(nft.myIface) == 0 {
@@ -461,11 +1056,12 @@ func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.SetConntrackStateNew()...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_sdn_ping`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter input meta iifname "wg0" ip protocol icmp \
 	// ct state { established, related } accept
@@ -490,11 +1086,12 @@ func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_sdn_icmp`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter input meta iifname "wg0" \
 	// ip protocol tcp tcp dport { 80, 8080 } ip saddr @mymanager_ipset \
@@ -531,11 +1128,12 @@ func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_sdn_manager`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter output meta oifname "wg0" ip protocol icmp \
 	// ct state { new, established } accept
@@ -560,11 +1158,12 @@ func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_sdn_icmp`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter output meta oifname "wg0" \
 	// ip protocol tcp tcp sport { 80, 8080 } ip daddr @mymanager_ipset \
@@ -594,13 +1193,14 @@ func (nft *NFTables) sdnRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.SetConntrackStateEstablished()...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_sdn_manager`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
-	return nil
+	return nft.managerKnockRules(c)
 }
 
 // sdnForwardRules to apply.
@@ -613,9 +1213,14 @@ func (nft *NFTables) sdnForwardRules(c *nftables.Conn) error {
 	return nft.forwardInterfaceRules(c)
 }
 
-// natRules to apply.
-func (nft *NFTables) natRules(c *nftables.Conn) {
-	nft.natInterfaceRules(c)
+// natRules adds the SNAT rules of wanIfaces, all WAN interfaces if empty.
+func (nft *NFTables) natRules(c *nftables.Conn, wanIfaces ...string) {
+	if len(wanIfaces) == 0 {
+		wanIfaces = nft.wanIfaces()
+	}
+	for _, wanIface := range wanIfaces {
+		nft.natInterfaceRules(c, wanIface)
+	}
 }
 
 // UpdateTrustIPs updates filterSetTrustIP.
@@ -661,16 +1266,73 @@ func (nft *NFTables) Ban(ipAddresses []string, timeout time.Duration) error {
 	if len(elements) == 0 {
 		return nil
 	}
-	return nft.Do(func(conn *nftables.Conn) error {
+	err = nft.Do(func(conn *nftables.Conn) error {
 		err := conn.SetAddElements(nft.filterSetBlacklistIP, elements)
 		if err != nil {
 			return err
 		}
+		if nft.ingressSetBlacklistIP != nil {
+			err = conn.SetAddElements(nft.ingressSetBlacklistIP, elements)
+			if err != nil {
+				return err
+			}
+		}
+		return conn.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	// an interval added to the set counts as one ban
+	var banned int
+	for _, elem := range elements {
+		if !elem.IntervalEnd {
+			banned++
+		}
+	}
+	nft.stats.banned(banned)
+	if nft.cfg.BanFlushFlows {
+		// the established flows would be accepted before reaching the blacklist rule
+		if _, err = nft.DeleteFlows(ipAddresses); err != nil {
+			return fmt.Errorf(`nft.DeleteFlows: %w`, err)
+		}
+	}
+	return nil
+}
+
+// Unban removes ip from the blacklist, and from its copy in the ingress table.
+func (nft *NFTables) Unban(ipAddresses []string) error {
+	var elements []nftables.SetElement
+	var err error
+	switch nft.tableFamily {
+	case nftables.TableFamilyIPv4:
+		elements, err = setutils.GenerateElementsFromIPv4Address(ipAddresses)
+	case nftables.TableFamilyIPv6:
+		elements, err = setutils.GenerateElementsFromIPv6Address(ipAddresses)
+	}
+	if err != nil {
+		return err
+	}
+	if len(elements) == 0 {
+		return nil
+	}
+	return nft.Do(func(conn *nftables.Conn) error {
+		err := conn.SetDeleteElements(nft.filterSetBlacklistIP, elements)
+		if err != nil {
+			return err
+		}
+		if nft.ingressSetBlacklistIP != nil {
+			err = conn.SetDeleteElements(nft.ingressSetBlacklistIP, elements)
+			if err != nil {
+				return err
+			}
+		}
 		return conn.Flush()
 	})
 }
 
 func (nft *NFTables) updateIPSet(set *nftables.Set, del, add []net.IP, timeout ...time.Duration) error {
+	nft.applyMu.Lock()
+	defer nft.applyMu.Unlock()
 	// bind network namespace if it was set in config
 	c, err := nft.networkNamespaceBind()
 	if err != nil {
@@ -713,6 +1375,8 @@ func (nft *NFTables) Cleanup() error {
 	if !nft.cfg.Enabled {
 		return nil
 	}
+	nft.applyMu.Lock()
+	defer nft.applyMu.Unlock()
 	// bind network namespace if it was set in config
 	c, err := nft.networkNamespaceBind()
 	if err != nil {
@@ -721,19 +1385,73 @@ func (nft *NFTables) Cleanup() error {
 	// release network namespace finally
 	defer nft.networkNamespaceRelease()
 
-	if nft.cfg.ClearRuleset {
+	if nft.cfg.ClearRuleset && !nft.cfg.Coexist {
 		c.FlushRuleset()
+		err = c.Flush()
 	} else {
-		for _, table := range nft.tables {
-			c.FlushTable(table)
-		}
+		err = nft.flushTables(c)
+	}
+	if err != nil {
+		return err
 	}
-	_ = c.Flush()
 	nft.applied = false
 
 	return nil
 }
 
+// ownTables returns the tables the firewall may create, configured or not.
+func (nft *NFTables) ownTables() []*nftables.Table {
+	tables := []*nftables.Table{nft.tFilter, nft.tNAT, nft.rawTable(), nft.ingressTable()}
+	if nft.tableFamily == nftables.TableFamilyIPv4 {
+		tables = append(tables, nft.bridgeTable())
+	}
+	return tables
+}
+
+// flushTables flushes the rules of the configured tables found in the
+// ruleset, and deletes the tables of the firewall which are no longer
+// configured. A batch flushing a missing table would be rejected as a whole.
+func (nft *NFTables) flushTables(c *nftables.Conn) error {
+	existing, err := c.ListTables()
+	if err != nil {
+		return fmt.Errorf(`failed to list tables: %w`, err)
+	}
+	exists := func(t *nftables.Table) bool {
+		for _, e := range existing {
+			if e.Family == t.Family && e.Name == t.Name {
+				return true
+			}
+		}
+		return false
+	}
+	var changed bool
+	for _, table := range nft.ownTables() {
+		if !exists(table) {
+			continue
+		}
+		if nft.hasTable(table) {
+			c.FlushTable(table)
+		} else {
+			c.DelTable(table)
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return c.Flush()
+}
+
+// hasTable reports whether table is configured.
+func (nft *NFTables) hasTable(table *nftables.Table) bool {
+	for _, t := range nft.tables {
+		if t.Family == table.Family && t.Name == table.Name {
+			return true
+		}
+	}
+	return false
+}
+
 func (nft *NFTables) DeleteAll(c *nftables.Conn) {
 	for _, table := range nft.tables {
 		c.DelTable(table)
@@ -786,7 +1504,7 @@ func (nft *NFTables) IfacesIPs() ([]net.IP, error) {
 	ips := make([]net.IP, 0, len(nft.cfg.Ifaces))
 
 	for _, v := range nft.cfg.Ifaces {
-		if v == nft.wanIface || v == nft.myIface {
+		if nft.isWanIface(v) || v == nft.myIface {
 			continue
 		}
 
@@ -843,6 +1561,17 @@ func (nft *NFTables) ChainPrerouting() *nftables.Chain {
 	return nft.cPrerouting
 }
 
+// TableRaw returns the raw table, nil if it is not required by the configuration.
+func (nft *NFTables) TableRaw() *nftables.Table {
+	return nft.tRaw
+}
+
+// TableBridge returns the bridge table, nil if no bridge is configured or the
+// table family is not IPv4.
+func (nft *NFTables) TableBridge() *nftables.Table {
+	return nft.tBridge
+}
+
 func (nft *NFTables) FilterSetTrustIP() *nftables.Set {
 	return nft.filterSetTrustIP
 }
@@ -859,7 +1588,11 @@ func (nft *NFTables) FilterSetBlacklistIP() *nftables.Set {
 	return nft.filterSetBlacklistIP
 }
 
+// Do calls f with a connection to the network namespace of the config. The
+// calls are serialized with apply and each other, f must not call Do.
 func (nft *NFTables) Do(f func(conn *nftables.Conn) error) error {
+	nft.applyMu.Lock()
+	defer nft.applyMu.Unlock()
 	// bind network namespace if it was set in config
 	c, err := nft.networkNamespaceBind()
 	if err != nil {
@@ -0,0 +1,100 @@
+package biz
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// anonymousSet is a copy of an anonymous set. An anonymous set is bound to a
+// single rule and deleted with it, the rule replacing or restoring it is bound
+// to a new copy.
+type anonymousSet struct {
+	set   *nftables.Set
+	elems []nftables.SetElement
+}
+
+func isAnonymousSetName(name string) bool {
+	return strings.HasPrefix(name, `__set`) || strings.HasPrefix(name, `__map`)
+}
+
+// getAnonymousSet reads the anonymous set and its elements.
+func getAnonymousSet(c *nftables.Conn, t *nftables.Table, name string) (*anonymousSet, error) {
+	set, err := c.GetSetByName(t, name)
+	if err != nil {
+		return nil, fmt.Errorf(`nft.GetSetByName(%q): %w`, name, err)
+	}
+	elems, err := c.GetSetElements(set)
+	if err != nil {
+		return nil, fmt.Errorf(`nft.GetSetElements(%q): %w`, name, err)
+	}
+	set.Table = t
+	return &anonymousSet{set: set, elems: elems}, nil
+}
+
+// add adds a copy of the set.
+func (a *anonymousSet) add(c *nftables.Conn) (*nftables.Set, error) {
+	clone := *a.set
+	clone.ID = 0
+	if err := c.AddSet(&clone, a.elems); err != nil {
+		return nil, fmt.Errorf(`nft.AddSet(%q): %w`, a.set.Name, err)
+	}
+	return &clone, nil
+}
+
+// getRuleAnonymousSets reads the anonymous sets looked up by the rule, by name.
+func getRuleAnonymousSets(c *nftables.Conn, r *nftables.Rule) (map[string]*anonymousSet, error) {
+	sets := map[string]*anonymousSet{}
+	for _, e := range r.Exprs {
+		lookup, ok := e.(*expr.Lookup)
+		if !ok || !isAnonymousSetName(lookup.SetName) {
+			continue
+		}
+		if _, ok := sets[lookup.SetName]; ok {
+			continue
+		}
+		anon, err := getAnonymousSet(c, r.Table, lookup.SetName)
+		if err != nil {
+			return nil, err
+		}
+		sets[lookup.SetName] = anon
+	}
+	return sets, nil
+}
+
+// appliedExprs returns the expressions of the listed rule as they were added,
+// since github.com/google/nftables drops the expressions it can't decode, e.g.
+// byteorder. The lookups are renamed to the sets of the listed rule, which were
+// swapped by RefreshGeoIP or allocated by the kernel for the anonymous sets.
+func (nft *NFTables) appliedExprs(r *nftables.Rule) []expr.Any {
+	nft.rulesMu.Lock()
+	added, ok := nft.addedRules[chainKey(r.Table, r.Chain)+`/`+string(r.UserData)]
+	nft.rulesMu.Unlock()
+	if !ok || len(r.UserData) == 0 {
+		return r.Exprs
+	}
+	var lookups []*expr.Lookup
+	for _, e := range r.Exprs {
+		if lookup, ok := e.(*expr.Lookup); ok {
+			lookups = append(lookups, lookup)
+		}
+	}
+	exprs := make([]expr.Any, len(added.Exprs))
+	var i int
+	for j, e := range added.Exprs {
+		lookup, ok := e.(*expr.Lookup)
+		if !ok {
+			exprs[j] = e
+			continue
+		}
+		clone := *lookup
+		if i < len(lookups) {
+			clone.SetName, clone.SetID = lookups[i].SetName, lookups[i].SetID
+		}
+		i++
+		exprs[j] = &clone
+	}
+	return exprs
+}
@@ -0,0 +1,239 @@
+package biz
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/gaissmai/extnetip"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// BogonIPv4 are the IPv4 sources never seen on the internet: "this" network,
+// loopback, link-local, IETF protocol assignments, documentation (RFC 5737),
+// benchmarking, multicast and reserved. 255.255.255.255 is a martian source
+// dropped by the kernel.
+var BogonIPv4 = []string{
+	`0.0.0.0/8`,
+	`127.0.0.0/8`,
+	`169.254.0.0/16`,
+	`192.0.0.0/24`,
+	`192.0.2.0/24`,
+	`198.18.0.0/15`,
+	`198.51.100.0/24`,
+	`203.0.113.0/24`,
+	`224.0.0.0/3`,
+}
+
+// BogonIPv6 are the IPv6 sources never seen on the internet: unspecified,
+// loopback, IPv4-mapped, discard-only, documentation and multicast.
+var BogonIPv6 = []string{
+	`::/127`,
+	`::ffff:0:0/96`,
+	`100::/64`,
+	`2001:db8::/32`,
+	`3fff::/20`,
+	`ff00::/8`,
+}
+
+// PrivateIPv4 are the private (RFC 1918) and shared (RFC 6598) IPv4 sources.
+var PrivateIPv4 = []string{
+	`10.0.0.0/8`,
+	`100.64.0.0/10`,
+	`172.16.0.0/12`,
+	`192.168.0.0/16`,
+}
+
+// PrivateIPv6 are the unique local (RFC 4193) IPv6 sources.
+var PrivateIPv6 = []string{
+	`fc00::/7`,
+}
+
+// initAntiSpoof creates the interval sets of the bogon and private sources.
+func (nft *NFTables) initAntiSpoof() {
+	nft.filterSetBogonIP, nft.filterSetPrivateIP = nil, nil
+	var bogons, private bool
+	for _, as := range nft.cfg.AntiSpoof {
+		if as.Bogons {
+			bogons = true
+			private = private || as.PublicOnly
+		}
+	}
+	if !bogons {
+		return
+	}
+	keyType := nftables.TypeIPAddr
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	nft.filterSetBogonIP = &nftables.Set{
+		Name:     `bogon_ipset`,
+		Table:    nft.tFilter,
+		KeyType:  keyType,
+		Interval: true,
+	}
+	nft.sets = append(nft.sets, nft.filterSetBogonIP)
+	if private {
+		nft.filterSetPrivateIP = &nftables.Set{
+			Name:     `private_ipset`,
+			Table:    nft.tFilter,
+			KeyType:  keyType,
+			Interval: true,
+		}
+		nft.sets = append(nft.sets, nft.filterSetPrivateIP)
+	}
+}
+
+// antiSpoofOf returns the anti-spoofing configuration of iface.
+func (nft *NFTables) antiSpoofOf(iface string) *AntiSpoof {
+	for i := range nft.cfg.AntiSpoof {
+		if nft.cfg.AntiSpoof[i].Iface == iface {
+			return &nft.cfg.AntiSpoof[i]
+		}
+	}
+	return nil
+}
+
+func validateAntiSpoof(as *AntiSpoof) error {
+	if len(as.Iface) == 0 {
+		return fmt.Errorf(`anti-spoofing interface is required`)
+	}
+	switch strings.ToLower(as.RPF) {
+	case ``, RPFStrict, RPFLoose:
+		return nil
+	}
+	return fmt.Errorf(`anti-spoofing %q: unsupported RPF mode %q`, as.Iface, as.RPF)
+}
+
+// antiSpoofSetElems returns the interval elements of the prefixes matching
+// the table family. The set package refuses the unspecified addresses, so the
+// elements are built here. The end element of an interval reaching the top of
+// the address space is omitted, so that the interval is left open.
+func (nft *NFTables) antiSpoofSetElems(ipv4, ipv6 []string) ([]nftables.SetElement, error) {
+	prefixes := ipv4
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		prefixes = ipv6
+	}
+	elems := make([]nftables.SetElement, 0, len(prefixes)*2)
+	for _, v := range prefixes {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		first, last := extnetip.Range(prefix)
+		elems = append(elems, nftables.SetElement{Key: first.AsSlice()})
+		if next := last.Next(); next.IsValid() {
+			elems = append(elems, nftables.SetElement{Key: next.AsSlice(), IntervalEnd: true})
+		}
+	}
+	return elems, nil
+}
+
+// updateAntiSpoofSets replaces the elements of the bogon and private sets.
+func (nft *NFTables) updateAntiSpoofSets(c *nftables.Conn) error {
+	for _, v := range []struct {
+		set        *nftables.Set
+		ipv4, ipv6 []string
+	}{
+		{nft.filterSetBogonIP, BogonIPv4, BogonIPv6},
+		{nft.filterSetPrivateIP, PrivateIPv4, PrivateIPv6},
+	} {
+		if v.set == nil {
+			continue
+		}
+		elems, err := nft.antiSpoofSetElems(v.ipv4, v.ipv6)
+		if err != nil {
+			return fmt.Errorf(`%s: %w`, v.set.Name, err)
+		}
+		// cmd: nft add set ip filter bogon_ipset { type ipv4_addr\; flags interval\; }
+		// cmd: nft flush set ip filter bogon_ipset
+		// cmd: nft add element ip filter bogon_ipset { 0.0.0.0/8, 127.0.0.0/8 }
+		if err = nft.addSet(c, v.set, nil); err != nil {
+			return fmt.Errorf(`nft.AddSet(%q): %w`, v.set.Name, err)
+		}
+		c.FlushSet(v.set)
+		if err = c.SetAddElements(v.set, elems); err != nil {
+			return fmt.Errorf(`nft.SetAddElements(%q): %w`, v.set.Name, err)
+		}
+	}
+	return nil
+}
+
+// RefreshBogons reloads the bogon and private sets from BogonIPv4, BogonIPv6,
+// PrivateIPv4 and PrivateIPv6, without applying the rules again.
+func (nft *NFTables) RefreshBogons() error {
+	if !nft.applied || nft.filterSetBogonIP == nil {
+		return nil
+	}
+	return nft.Do(func(c *nftables.Conn) error {
+		if err := nft.updateAntiSpoofSets(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+}
+
+// antiSpoofRules drops the spoofed sources received on the anti-spoofing interfaces.
+func (nft *NFTables) antiSpoofRules(c *nftables.Conn) error {
+	if len(nft.cfg.AntiSpoof) == 0 {
+		return nil
+	}
+	for i := range nft.cfg.AntiSpoof {
+		if err := validateAntiSpoof(&nft.cfg.AntiSpoof[i]); err != nil {
+			return err
+		}
+	}
+	if err := nft.updateAntiSpoofSets(c); err != nil {
+		return err
+	}
+	for i := range nft.cfg.AntiSpoof {
+		nft.antiSpoofIfaceRules(c, &nft.cfg.AntiSpoof[i])
+	}
+	return nil
+}
+
+// antiSpoofIfaceRules drops the bogon sources and the sources failing the
+// reverse path filter received on the interface.
+func (nft *NFTables) antiSpoofIfaceRules(c *nftables.Conn, as *AntiSpoof) {
+	if as.Bogons {
+		sets := []*nftables.Set{nft.filterSetBogonIP}
+		if as.PublicOnly {
+			sets = append(sets, nft.filterSetPrivateIP)
+		}
+		for _, set := range sets {
+			// cmd: nft add rule ip filter PREROUTING meta iifname "eth0" \
+			// ip saddr @bogon_ipset drop
+			exprs := make([]expr.Any, 0, 5)
+			exprs = append(exprs, utils.SetIIF(as.Iface)...)
+			if nft.tableFamily == nftables.TableFamilyIPv6 {
+				exprs = append(exprs, utils.SetSAddrIPv6Set(set)...)
+			} else {
+				exprs = append(exprs, utils.SetSAddrSet(set)...)
+			}
+			exprs = append(exprs, utils.Drop())
+			name := `prerouting_` + strings.TrimSuffix(set.Name, `_ipset`)
+			rule := &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    nft.cFilterPrerouting,
+				Exprs:    exprs,
+				UserData: ifaceRuleID(name, as.Iface),
+			}
+			nft.addRule(c, rule)
+		}
+	}
+
+	if len(as.RPF) > 0 {
+		// cmd: nft add rule ip filter PREROUTING meta iifname "eth0" \
+		// fib saddr . iif oif missing drop
+		strict := strings.ToLower(as.RPF) == RPFStrict
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cFilterPrerouting,
+			Exprs:    utils.JoinExprs(utils.SetIIF(as.Iface), utils.SetFibSAddrOIFMissing(strict)).Add(utils.Drop()),
+			UserData: ifaceRuleID(`prerouting_rpf`, as.Iface),
+		}
+		nft.addRule(c, rule)
+	}
+}
@@ -0,0 +1,85 @@
+package biz
+
+import (
+	"net"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAntiSpoofConfig() Config {
+	return Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		AntiSpoof: []AntiSpoof{
+			{Iface: `eth0`, RPF: RPFStrict, Bogons: true, PublicOnly: true},
+			{Iface: `eth1`, RPF: RPFLoose},
+			{Iface: `eth2`, Bogons: true},
+		},
+	}
+}
+
+func TestAntiSpoofRules(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testAntiSpoofConfig(), nil, RULE_ANTISPOOF)
+	assert.NotNil(t, nft.cFilterPrerouting)
+
+	ids := []string{
+		`prerouting_bogon@eth0`, `prerouting_private@eth0`, `prerouting_rpf@eth0`,
+		`prerouting_rpf@eth1`,
+		`prerouting_bogon@eth2`,
+	}
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cFilterPrerouting))
+
+	r, err := k.RuleByID(nft.tFilter, nft.cFilterPrerouting, []byte(`prerouting_rpf@eth0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.ExprFibSAddrOIFPresent(1, true), r.Exprs[2])
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cFilterPrerouting, []byte(`prerouting_rpf@eth1`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.ExprFibSAddrOIFPresent(1, false), r.Exprs[2])
+	}
+
+	// the interval reaching 255.255.255.255 is left open
+	elems, err := k.SetElements(nft.tFilter, `bogon_ipset`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, len(BogonIPv4)*2-1)
+	elems, err = k.SetElements(nft.tFilter, `private_ipset`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, len(PrivateIPv4)*2)
+	assert.Equal(t, []byte(net.ParseIP(`10.0.0.0`).To4()), elems[0].Key)
+
+	// applying again replaces the elements
+	assert.NoError(t, nft.ApplyDefault(RULE_ANTISPOOF))
+	elems, err = k.SetElements(nft.tFilter, `bogon_ipset`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, len(BogonIPv4)*2-1)
+
+	// the rules of the interface are regenerated
+	assert.NoError(t, nft.ReapplyIface(`eth1`))
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cFilterPrerouting))
+}
+
+func TestAntiSpoofRulesIPv6(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv6, testAntiSpoofConfig(), func(cfg *Config) {
+		cfg.AntiSpoof = cfg.AntiSpoof[:1]
+	}, RULE_ANTISPOOF)
+	assert.Equal(t, nftables.TypeIP6Addr, nft.filterSetBogonIP.KeyType)
+
+	elems, err := k.SetElements(nft.tFilter, `bogon_ipset`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, len(BogonIPv6)*2-1)
+	elems, err = k.SetElements(nft.tFilter, `private_ipset`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, len(PrivateIPv6)*2)
+}
+
+func TestValidateAntiSpoof(t *testing.T) {
+	assert.EqualError(t, validateAntiSpoof(&AntiSpoof{RPF: RPFStrict}), `anti-spoofing interface is required`)
+	assert.EqualError(t, validateAntiSpoof(&AntiSpoof{Iface: `eth0`, RPF: `auto`}), `anti-spoofing "eth0": unsupported RPF mode "auto"`)
+	assert.NoError(t, validateAntiSpoof(&AntiSpoof{Iface: `eth0`, RPF: `Loose`}))
+}
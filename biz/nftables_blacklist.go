@@ -7,19 +7,34 @@ import (
 )
 
 func (nft *NFTables) blacklistRules(c *nftables.Conn) error {
-	exprs := make([]expr.Any, 0, 3)
+	exprs := make([]expr.Any, 0, 5)
 	switch nft.tableFamily {
 	case nftables.TableFamilyIPv4:
 		exprs = append(exprs, utils.SetSAddrSet(nft.filterSetBlacklistIP)...)
 	case nftables.TableFamilyIPv6:
 		exprs = append(exprs, utils.SetSAddrIPv6Set(nft.filterSetBlacklistIP)...)
 	}
+	if nft.cfg.LogDrop {
+		// cmd: nft add rule ip filter input ip saddr @blacklist_ipset \
+		// limit rate 5/second log prefix "nft drop blacklist: "
+		logExprs, err := nft.logExprs(`blacklist`)
+		if err != nil {
+			return err
+		}
+		nft.addRule(c, &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cInput,
+			Exprs:    utils.JoinExprs(exprs, logExprs),
+			UserData: []byte(`log_blacklist`),
+		})
+	}
 	exprs = append(exprs, utils.Reject())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: []byte(`input_blacklist`),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
@@ -0,0 +1,346 @@
+package biz
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	utils "github.com/admpub/nftablesutils"
+	setutils "github.com/admpub/nftablesutils/set"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// bridgeTable returns the bridge table of the firewall.
+func (nft *NFTables) bridgeTable() *nftables.Table {
+	return &nftables.Table{
+		Family: nftables.TableFamilyBridge,
+		Name:   nft.cfg.TablePrefix + TableBridge + nft.cfg.TableSuffix,
+	}
+}
+
+// initBridge creates the bridge table and its chains. The frames of all
+// families cross a single bridge table, which is owned by the IPv4 firewall.
+func (nft *NFTables) initBridge() {
+	nft.tBridge, nft.cBridgePrerouting, nft.cBridgeForward = nil, nil, nil
+	if len(nft.cfg.Bridges) == 0 || nft.tableFamily != nftables.TableFamilyIPv4 {
+		return
+	}
+	nft.tBridge = nft.bridgeTable()
+	nft.cBridgePrerouting = &nftables.Chain{
+		Name:     ChainPreRouting,
+		Table:    nft.tBridge,
+		Type:     nftables.ChainTypeFilter,
+		Priority: nftables.ChainPriorityFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+	}
+	nft.cBridgeForward = &nftables.Chain{
+		Name:     ChainForward,
+		Table:    nft.tBridge,
+		Type:     nftables.ChainTypeFilter,
+		Priority: nftables.ChainPriorityFilter,
+		Hooknum:  nftables.ChainHookForward,
+	}
+	nft.tables = append(nft.tables, nft.tBridge)
+	nft.chains = append(nft.chains, nft.cBridgePrerouting, nft.cBridgeForward)
+}
+
+// parseEtherType parses the ethertype of a BridgeRule.
+func parseEtherType(etherType string) (uint16, error) {
+	switch etherType {
+	case `ip`:
+		return unix.ETH_P_IP, nil
+	case `ip6`:
+		return unix.ETH_P_IPV6, nil
+	case `arp`:
+		return unix.ETH_P_ARP, nil
+	case `vlan`:
+		return unix.ETH_P_8021Q, nil
+	}
+	n, err := strconv.ParseUint(etherType, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf(`invalid ether type %q`, etherType)
+	}
+	return uint16(n), nil
+}
+
+// parsePCP parses the priority code point of a BridgeRule.
+func parsePCP(pcp string) (uint8, error) {
+	n, err := strconv.ParseUint(pcp, 10, 8)
+	if err != nil || n > 7 {
+		return 0, fmt.Errorf(`invalid pcp %q`, pcp)
+	}
+	return uint8(n), nil
+}
+
+// validateBridges checks the names, the ports and the rules of the bridges.
+func (nft *NFTables) validateBridges() error {
+	names := map[string]struct{}{}
+	for i := range nft.cfg.Bridges {
+		br := &nft.cfg.Bridges[i]
+		if len(br.Name) == 0 {
+			return fmt.Errorf(`bridge name is required`)
+		}
+		if _, ok := names[br.Name]; ok {
+			return fmt.Errorf(`duplicate bridge %q`, br.Name)
+		}
+		names[br.Name] = struct{}{}
+		for _, port := range br.Ports {
+			if err := validateBridgePort(&port); err != nil {
+				return fmt.Errorf(`bridge %q: %w`, br.Name, err)
+			}
+		}
+		rules := map[string]struct{}{}
+		for _, rule := range br.Rules {
+			if len(rule.Name) == 0 {
+				return fmt.Errorf(`bridge %q: rule name is required`, br.Name)
+			}
+			if _, ok := rules[rule.Name]; ok {
+				return fmt.Errorf(`bridge %q: duplicate rule %q`, br.Name, rule.Name)
+			}
+			rules[rule.Name] = struct{}{}
+			if err := validateBridgeRule(&rule); err != nil {
+				return fmt.Errorf(`bridge %q: rule %q: %w`, br.Name, rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func validateBridgePort(port *BridgePort) error {
+	if _, err := setutils.IfaceStringToSetData(port.Iface); err != nil {
+		return err
+	}
+	if _, err := setutils.EtherAddrStringsToSetData(port.MACs); err != nil {
+		return fmt.Errorf(`port %q: %w`, port.Iface, err)
+	}
+	if len(port.IPs) > 0 && len(port.MACs) == 0 {
+		return fmt.Errorf(`port %q: MACs are required by the ARP guard`, port.Iface)
+	}
+	for _, ip := range port.IPs {
+		if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+			return fmt.Errorf(`port %q: invalid IPv4 address %q`, port.Iface, ip)
+		}
+	}
+	return nil
+}
+
+func validateBridgeRule(rule *BridgeRule) error {
+	switch rule.Action {
+	case BridgeActionAccept, BridgeActionDrop:
+	default:
+		return fmt.Errorf(`invalid action %q`, rule.Action)
+	}
+	if _, err := setutils.IfaceStringsToSetData(rule.From); err != nil {
+		return err
+	}
+	if _, err := setutils.IfaceStringsToSetData(rule.To); err != nil {
+		return err
+	}
+	if _, err := setutils.EtherAddrStringsToSetData(rule.SrcMACs); err != nil {
+		return err
+	}
+	if _, err := setutils.EtherAddrStringsToSetData(rule.DstMACs); err != nil {
+		return err
+	}
+	if len(rule.EtherType) > 0 {
+		if _, err := parseEtherType(rule.EtherType); err != nil {
+			return err
+		}
+	}
+	if rule.Vlan > utils.VlanIDMask {
+		return fmt.Errorf(`invalid vlan id %d`, rule.Vlan)
+	}
+	if len(rule.PCP) > 0 {
+		if _, err := parsePCP(rule.PCP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bridgeMACExprs returns the expressions matching the source or destination
+// MAC addresses, or the other addresses if isEq is false.
+func (nft *NFTables) bridgeMACExprs(c *nftables.Conn, dir utils.ExprDirection, macs []string, isEq bool) ([]expr.Any, error) {
+	if len(macs) == 0 {
+		return nil, nil
+	}
+	hwAddrs := make([]net.HardwareAddr, len(macs))
+	for i, mac := range macs {
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, err
+		}
+		hwAddrs[i] = hwAddr
+	}
+	elems, err := utils.GetEtherAddrSetElems(hwAddrs)
+	if err != nil {
+		return nil, err
+	}
+	set := utils.GetEtherAddrSet(nft.tBridge)
+	if err = c.AddSet(set, elems); err != nil {
+		return nil, err
+	}
+	if dir == utils.ExprDirectionSource {
+		return utils.SetEtherSAddrSet(set, isEq), nil
+	}
+	return utils.SetEtherDAddrSet(set, isEq), nil
+}
+
+// bridgeRules guards the source addresses of the bridge ports in the
+// prerouting chain and adds the forward rules of the bridges.
+func (nft *NFTables) bridgeRules(c *nftables.Conn) error {
+	if nft.tBridge == nil {
+		return nil
+	}
+	if err := nft.validateBridges(); err != nil {
+		return err
+	}
+	for i := range nft.cfg.Bridges {
+		br := &nft.cfg.Bridges[i]
+		for j := range br.Ports {
+			if err := nft.bridgePortRules(c, br, &br.Ports[j]); err != nil {
+				return fmt.Errorf(`bridge %q: port %q: %w`, br.Name, br.Ports[j].Iface, err)
+			}
+		}
+		for j := range br.Rules {
+			if err := nft.bridgeForwardRule(c, br, &br.Rules[j]); err != nil {
+				return fmt.Errorf(`bridge %q: rule %q: %w`, br.Name, br.Rules[j].Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (nft *NFTables) bridgePortRules(c *nftables.Conn, br *Bridge, port *BridgePort) error {
+	// an anonymous set is bound to a single rule, each rule matches the port
+	// by its own ifname set
+	portExprs := func() ([]expr.Any, error) {
+		exprs, err := nft.ifnameExprs(c, nft.tBridge, utils.ExprDirectionSource, []string{port.Iface})
+		if err != nil {
+			return nil, err
+		}
+		return append(utils.SetIBrName(br.Name), exprs...), nil
+	}
+	id := `bridge_` + br.Name + `_` + port.Iface
+
+	if len(port.MACs) > 0 {
+		// cmd: nft add rule bridge bridge PREROUTING meta ibrname "br0" iifname "vnet0" \
+		// ether saddr != { 52:54:00:12:34:56 } drop
+		ruleExprs, err := portExprs()
+		if err != nil {
+			return err
+		}
+		macExprs, err := nft.bridgeMACExprs(c, utils.ExprDirectionSource, port.MACs, false)
+		if err != nil {
+			return err
+		}
+		ruleExprs = append(ruleExprs, macExprs...)
+		rule := &nftables.Rule{
+			Table:    nft.tBridge,
+			Chain:    nft.cBridgePrerouting,
+			Exprs:    append(ruleExprs, utils.ExprDrop()),
+			UserData: []byte(id + `_mac`),
+		}
+		nft.addRule(c, rule)
+	}
+
+	if len(port.IPs) > 0 {
+		// cmd: nft add rule bridge bridge PREROUTING meta ibrname "br0" iifname "vnet0" \
+		// ether type arp arp saddr ip . arp saddr ether != { 10.0.0.5 . 52:54:00:12:34:56 } drop
+		// the port has no pairing of its IPs and MACs, each IP is bound to
+		// every MAC of the port
+		var bindings []utils.ARPBinding
+		for _, ip := range port.IPs {
+			for _, mac := range port.MACs {
+				hw, _ := net.ParseMAC(mac)
+				bindings = append(bindings, utils.ARPBinding{IP: net.ParseIP(ip), MAC: hw})
+			}
+		}
+		elems, err := utils.GetARPBindingSetElems(bindings)
+		if err != nil {
+			return err
+		}
+		set, err := utils.GetARPBindingSet(nft.tBridge)
+		if err != nil {
+			return err
+		}
+		if err = c.AddSet(set, elems); err != nil {
+			return err
+		}
+		ruleExprs, err := portExprs()
+		if err != nil {
+			return err
+		}
+		ruleExprs = append(ruleExprs, utils.SetEtherType(unix.ETH_P_ARP)...)
+		ruleExprs = append(ruleExprs, utils.SetARPBindingSet(set, false)...)
+		rule := &nftables.Rule{
+			Table:    nft.tBridge,
+			Chain:    nft.cBridgePrerouting,
+			Exprs:    append(ruleExprs, utils.ExprDrop()),
+			UserData: []byte(id + `_arp`),
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
+
+func (nft *NFTables) bridgeForwardRule(c *nftables.Conn, br *Bridge, r *BridgeRule) error {
+	// cmd: nft add rule bridge bridge FORWARD meta ibrname "br0" iifname "vnet0" oifname "vnet1" \
+	// ether type vlan vlan id 100 vlan pcp 5 ether saddr { 52:54:00:12:34:56 } drop
+	exprs := utils.SetIBrName(br.Name)
+	fromExprs, err := nft.ifnameExprs(c, nft.tBridge, utils.ExprDirectionSource, r.From)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, fromExprs...)
+	toExprs, err := nft.ifnameExprs(c, nft.tBridge, utils.ExprDirectionDestination, r.To)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, toExprs...)
+	// the ether type of the tagged frames is vlan, the type they encapsulate
+	// is matched instead
+	// cmd: nft add rule bridge bridge FORWARD ... ether type vlan vlan type ip ...
+	tagged := r.Vlan > 0 || len(r.PCP) > 0
+	if len(r.EtherType) > 0 {
+		etherType, _ := parseEtherType(r.EtherType)
+		switch {
+		case !tagged:
+			exprs = append(exprs, utils.SetEtherType(etherType)...)
+		case etherType != unix.ETH_P_8021Q:
+			exprs = append(exprs, utils.SetVlanType(etherType)...)
+		}
+	}
+	if r.Vlan > 0 {
+		exprs = append(exprs, utils.SetVlanID(r.Vlan)...)
+	}
+	if len(r.PCP) > 0 {
+		pcp, _ := parsePCP(r.PCP)
+		exprs = append(exprs, utils.SetVlanPCP(pcp)...)
+	}
+	srcExprs, err := nft.bridgeMACExprs(c, utils.ExprDirectionSource, r.SrcMACs, true)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, srcExprs...)
+	dstExprs, err := nft.bridgeMACExprs(c, utils.ExprDirectionDestination, r.DstMACs, true)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, dstExprs...)
+	if r.Action == BridgeActionDrop {
+		exprs = append(exprs, utils.ExprDrop())
+	} else {
+		exprs = append(exprs, utils.ExprAccept())
+	}
+	rule := &nftables.Rule{
+		Table:    nft.tBridge,
+		Chain:    nft.cBridgeForward,
+		Exprs:    exprs,
+		UserData: []byte(`bridge_` + br.Name + `_` + r.Name),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
@@ -0,0 +1,133 @@
+package biz
+
+import (
+	"net"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testBridgeConfig() Config {
+	return Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		Bridges: []Bridge{{
+			Name: `br0`,
+			Ports: []BridgePort{
+				{Iface: `vnet0`, MACs: []string{`52:54:00:12:34:56`}, IPs: []string{`10.0.0.5`, `10.0.0.6`}},
+				{Iface: `tap*`, MACs: []string{`52:54:00:00:00:01`, `52:54:00:00:00:02`}},
+			},
+			Rules: []BridgeRule{
+				{Name: `no_lldp`, EtherType: `0x88cc`, Action: `drop`},
+				{Name: `voice`, From: []string{`vnet0`}, To: []string{`vnet1`, `tap*`}, Vlan: 100, PCP: `5`, Action: `accept`},
+				{Name: `gw`, DstMACs: []string{`52:54:00:ff:ff:01`}, Action: `accept`},
+			},
+		}},
+	}
+}
+
+func TestBridgeRules(t *testing.T) {
+	cfg := testBridgeConfig()
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_BRIDGE)
+	if !assert.NotNil(t, nft.TableBridge()) {
+		return
+	}
+	assert.Equal(t, nftables.TableFamilyBridge, nft.tBridge.Family)
+
+	assert.Equal(t, []string{
+		`bridge_br0_vnet0_mac`,
+		`bridge_br0_vnet0_arp`,
+		`bridge_br0_tap*_mac`,
+	}, ruleIDsOf(t, k, nft.cBridgePrerouting))
+	assert.Equal(t, []string{
+		`bridge_br0_no_lldp`,
+		`bridge_br0_voice`,
+		`bridge_br0_gw`,
+	}, ruleIDsOf(t, k, nft.cBridgeForward))
+
+	mac, _ := net.ParseMAC(`52:54:00:12:34:56`)
+	r, err := k.RuleByID(nft.tBridge, nft.cBridgePrerouting, []byte(`bridge_br0_vnet0_arp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetIBrName(`br0`), utils.Exprs(exprs[:2]))
+		assert.Equal(t, utils.SetIIF(`vnet0`), utils.Exprs(exprs[2:4]))
+		assert.Equal(t, []byte{0x08, 0x06}, exprs[5].(*expr.Cmp).Data)
+		lookup := exprs[8].(*expr.Lookup)
+		assert.True(t, lookup.Invert)
+		elems, err := k.SetElements(nft.tBridge, lookup.SetName)
+		assert.NoError(t, err)
+		if assert.Len(t, elems, 2) {
+			assert.Equal(t, append(append([]byte{10, 0, 0, 5}, mac...), 0, 0), elems[0].Key)
+		}
+		assert.Equal(t, utils.ExprDrop(), exprs[9])
+	}
+
+	r, err = k.RuleByID(nft.tBridge, nft.cBridgeForward, []byte(`bridge_br0_voice`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		// iifname "vnet0" oifname { "vnet1", "tap*" }
+		assert.Equal(t, utils.SetIIF(`vnet0`), utils.Exprs(exprs[2:4]))
+		assert.Equal(t, utils.ExprOIFName(), exprs[4])
+		lookup := exprs[5].(*expr.Lookup)
+		elems, err := k.SetElements(nft.tBridge, lookup.SetName)
+		assert.NoError(t, err)
+		assert.Len(t, elems, 4)
+		assert.Equal(t, utils.SetVlanID(100), utils.Exprs(exprs[6:11]))
+		assert.Equal(t, utils.SetVlanPCP(5), utils.Exprs(exprs[11:16]))
+		assert.Equal(t, utils.ExprAccept(), exprs[16])
+	}
+
+	// the IPv6 firewall shares the bridge table of the IPv4 firewall
+	nft6 := newTestNFTables(t, nftables.TableFamilyIPv6, cfg, nil, nil)
+	assert.Nil(t, nft6.TableBridge())
+}
+
+func TestBridgeVlanEtherType(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testBridgeConfig(), func(cfg *Config) {
+		cfg.Bridges[0].Rules = []BridgeRule{
+			{Name: `vlan_ip`, EtherType: `ip`, Vlan: 100, Action: `accept`},
+			{Name: `vlan_any`, EtherType: `vlan`, PCP: `5`, Action: `accept`},
+		}
+	}, RULE_BRIDGE)
+
+	// ether type vlan vlan type ip vlan id 100
+	r, err := k.RuleByID(nft.tBridge, nft.cBridgeForward, []byte(`bridge_br0_vlan_ip`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetVlanType(unix.ETH_P_IP), utils.Exprs(exprs[2:6]))
+		assert.Equal(t, utils.SetVlanID(100), utils.Exprs(exprs[6:11]))
+	}
+	r, err = k.RuleByID(nft.tBridge, nft.cBridgeForward, []byte(`bridge_br0_vlan_any`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetVlanPCP(5), utils.Exprs(exprs[2:7]))
+	}
+}
+
+func TestValidateBridges(t *testing.T) {
+	for _, c := range []struct {
+		bridge Bridge
+		err    string
+	}{
+		{Bridge{}, `bridge name is required`},
+		{Bridge{Name: `br0`, Ports: []BridgePort{{Iface: `*`}}}, `bridge "br0": invalid interface name: "*"`},
+		{Bridge{Name: `br0`, Ports: []BridgePort{{Iface: `vnet0`, IPs: []string{`10.0.0.5`}}}}, `bridge "br0": port "vnet0": MACs are required by the ARP guard`},
+		{Bridge{Name: `br0`, Ports: []BridgePort{{Iface: `vnet0`, MACs: []string{`52:54:00:12:34:56`}, IPs: []string{`2001:db8::1`}}}}, `bridge "br0": port "vnet0": invalid IPv4 address "2001:db8::1"`},
+		{Bridge{Name: `br0`, Rules: []BridgeRule{{Name: `a`, Action: `reject`}}}, `bridge "br0": rule "a": invalid action "reject"`},
+		{Bridge{Name: `br0`, Rules: []BridgeRule{{Name: `a`, Action: `drop`, EtherType: `ipx`}}}, `bridge "br0": rule "a": invalid ether type "ipx"`},
+		{Bridge{Name: `br0`, Rules: []BridgeRule{{Name: `a`, Action: `drop`, PCP: `8`}}}, `bridge "br0": rule "a": invalid pcp "8"`},
+		{Bridge{Name: `br0`, Rules: []BridgeRule{{Name: `a`, Action: `drop`, Vlan: 4096}}}, `bridge "br0": rule "a": invalid vlan id 4096`},
+	} {
+		nft := New(nftables.TableFamilyIPv4, Config{Bridges: []Bridge{c.bridge}}, nil)
+		assert.EqualError(t, nft.validateBridges(), c.err)
+	}
+}
@@ -0,0 +1,206 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	setutils "github.com/admpub/nftablesutils/set"
+	"github.com/google/nftables"
+)
+
+// ForeignIfaces are the bridges of the owners passed through the forward
+// chain in coexistence mode if CoexistIfaces is empty.
+var ForeignIfaces = map[string][]string{
+	ForeignDocker:     {`docker0`, `br-*`},
+	ForeignKubernetes: {`cni0`, `cali*`, `flannel*`, `cilium_*`, `kube-bridge`},
+}
+
+// ForeignTable is a table of the ruleset owned by Docker or Kubernetes, or
+// holding some of their chains, e.g. the ip filter table of iptables-nft
+// holding the DOCKER-USER chain.
+type ForeignTable struct {
+	Family nftables.TableFamily
+	Name   string
+	Owners []string // docker / kubernetes
+	Chains []string // chains of the owners, all the chains if the table is owned
+}
+
+// ForeignOwner returns the owner of the chain of table, or of table if chain
+// is empty: docker / kubernetes, empty if the name is not known.
+//
+//	table docker-bridges             // Docker with the nftables backend
+//	chain DOCKER, DOCKER-USER, ...   // Docker with iptables-nft
+//	table kube-proxy                 // kube-proxy in nftables mode
+//	chain KUBE-SERVICES, ...         // kube-proxy with iptables-nft
+func ForeignOwner(table, chain string) string {
+	if len(chain) == 0 {
+		switch {
+		case strings.HasPrefix(table, `docker-`):
+			return ForeignDocker
+		case strings.HasPrefix(table, `kube-`):
+			return ForeignKubernetes
+		}
+		return ``
+	}
+	switch {
+	case chain == `DOCKER`, strings.HasPrefix(chain, `DOCKER-`):
+		return ForeignDocker
+	case strings.HasPrefix(chain, `KUBE-`):
+		return ForeignKubernetes
+	}
+	return ``
+}
+
+// DetectForeign returns the foreign tables among tables, in their order, and
+// their chains found in chains.
+func DetectForeign(tables []*nftables.Table, chains []*nftables.Chain) []ForeignTable {
+	chainsOf := map[string][]string{}
+	for _, chain := range chains {
+		if chain.Table == nil {
+			continue
+		}
+		key := tableKey(chain.Table)
+		chainsOf[key] = append(chainsOf[key], chain.Name)
+	}
+	var found []ForeignTable
+	for _, t := range tables {
+		ft := ForeignTable{Family: t.Family, Name: t.Name}
+		if owner := ForeignOwner(t.Name, ``); len(owner) > 0 {
+			ft.Owners = []string{owner}
+			ft.Chains = chainsOf[tableKey(t)]
+		} else {
+			for _, name := range chainsOf[tableKey(t)] {
+				owner := ForeignOwner(t.Name, name)
+				if len(owner) == 0 {
+					continue
+				}
+				ft.Chains = append(ft.Chains, name)
+				if !inStrings(ft.Owners, owner) {
+					ft.Owners = append(ft.Owners, owner)
+				}
+			}
+		}
+		if len(ft.Owners) > 0 {
+			found = append(found, ft)
+		}
+	}
+	return found
+}
+
+// listForeign lists the tables and chains of the ruleset, see DetectForeign.
+func listForeign(c *nftables.Conn) ([]ForeignTable, error) {
+	tables, err := c.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list tables: %w`, err)
+	}
+	chains, err := c.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf(`failed to list chains: %w`, err)
+	}
+	return DetectForeign(tables, chains), nil
+}
+
+// Foreign returns the tables of Docker and Kubernetes found in the ruleset.
+func (nft *NFTables) Foreign() ([]ForeignTable, error) {
+	var found []ForeignTable
+	err := nft.Do(func(c *nftables.Conn) (err error) {
+		found, err = listForeign(c)
+		return err
+	})
+	return found, err
+}
+
+// detectForeign detects the foreign tables before the tables are flushed, and
+// refuses the tables of the firewall having the names of foreign tables.
+func (nft *NFTables) detectForeign(c *nftables.Conn) error {
+	found, err := listForeign(c)
+	if err != nil {
+		return err
+	}
+	for _, ft := range found {
+		for _, t := range nft.tables {
+			if t.Family == ft.Family && t.Name == ft.Name {
+				return fmt.Errorf(`table %q is shared with %s, set TablePrefix or TableSuffix`, t.Name, strings.Join(ft.Owners, ` and `))
+			}
+		}
+	}
+	nft.foreign = found
+	return nil
+}
+
+// hasForeign reports whether the detected foreign tables belong to owner.
+func (nft *NFTables) hasForeign(owner string) bool {
+	for _, ft := range nft.foreign {
+		if inStrings(ft.Owners, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// coexistIfaces returns CoexistIfaces, or the bridges of the detected owners.
+func (nft *NFTables) coexistIfaces() []string {
+	if len(nft.cfg.CoexistIfaces) > 0 {
+		return nft.cfg.CoexistIfaces
+	}
+	var ifaces []string
+	for _, owner := range []string{ForeignDocker, ForeignKubernetes} {
+		if nft.hasForeign(owner) {
+			ifaces = append(ifaces, ForeignIfaces[owner]...)
+		}
+	}
+	return ifaces
+}
+
+// coexistRules accepts the forwarded traffic of the foreign bridges and of the
+// pod CIDRs, which is still filtered by the chains of their owners.
+func (nft *NFTables) coexistRules(c *nftables.Conn) error {
+	if !nft.cfg.Coexist {
+		return nil
+	}
+	if _, err := setutils.IfaceStringsToSetData(nft.cfg.CoexistIfaces); err != nil {
+		return err
+	}
+	ifaces := nft.coexistIfaces()
+	for _, pass := range []struct {
+		dir     utils.ExprDirection
+		ifaceID string
+		addrID  string
+	}{
+		{utils.ExprDirectionSource, `coexist_iif`, `coexist_saddr`},
+		{utils.ExprDirectionDestination, `coexist_oif`, `coexist_daddr`},
+	} {
+		// cmd: nft add rule ip filter FORWARD iifname { "docker0", "br-*" } accept
+		exprs, err := nft.ifnameExprs(c, nft.tFilter, pass.dir, ifaces)
+		if err != nil {
+			return err
+		}
+		if len(exprs) > 0 {
+			rule := &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    nft.cForward,
+				Exprs:    append(exprs, utils.ExprAccept()),
+				UserData: []byte(pass.ifaceID),
+			}
+			nft.addRule(c, rule)
+		}
+
+		// cmd: nft add rule ip filter FORWARD ip saddr { 10.244.0.0/16 } accept
+		exprs, err = nft.zoneAddrSet(c, nft.tFilter, pass.dir, nft.cfg.CoexistSources)
+		if err != nil && !errors.Is(err, errNoFamilySource) {
+			return err
+		}
+		if len(exprs) > 0 {
+			rule := &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    nft.cForward,
+				Exprs:    append(exprs, utils.ExprAccept()),
+				UserData: []byte(pass.addrID),
+			}
+			nft.addRule(c, rule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package biz
+
+import (
+	"testing"
+
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForeignOwner(t *testing.T) {
+	for _, c := range []struct {
+		table, chain string
+		owner        string
+	}{
+		{`docker-bridges`, ``, ForeignDocker},
+		{`kube-proxy`, ``, ForeignKubernetes},
+		{`filter`, ``, ``},
+		{`filter`, `DOCKER`, ForeignDocker},
+		{`filter`, `DOCKER-USER`, ForeignDocker},
+		{`filter`, `DOCKER-ISOLATION-STAGE-1`, ForeignDocker},
+		{`nat`, `KUBE-SERVICES`, ForeignKubernetes},
+		{`filter`, `FORWARD`, ``},
+		{`filter`, `DOCKERX`, ``},
+		{`filter`, `kube-services`, ``},
+	} {
+		assert.Equal(t, c.owner, ForeignOwner(c.table, c.chain), c.table+` `+c.chain)
+	}
+}
+
+func TestDetectForeign(t *testing.T) {
+	filter := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: `filter`}
+	filter6 := &nftables.Table{Family: nftables.TableFamilyIPv6, Name: `filter`}
+	nat := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: `nat`}
+	kube := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: `kube-proxy`}
+	tables := []*nftables.Table{filter, filter6, nat, kube}
+	chains := []*nftables.Chain{
+		{Table: filter, Name: `FORWARD`},
+		{Table: filter, Name: `DOCKER-USER`},
+		{Table: filter, Name: `KUBE-FORWARD`},
+		{Table: filter, Name: `DOCKER`},
+		{Table: filter6, Name: `FORWARD`},
+		{Table: nat, Name: `POSTROUTING`},
+		{Table: kube, Name: `services`},
+		{Table: kube, Name: `filter-forward`},
+	}
+	assert.Equal(t, []ForeignTable{
+		{Family: nftables.TableFamilyIPv4, Name: `filter`, Owners: []string{ForeignDocker, ForeignKubernetes}, Chains: []string{`DOCKER-USER`, `KUBE-FORWARD`, `DOCKER`}},
+		{Family: nftables.TableFamilyIPv4, Name: `kube-proxy`, Owners: []string{ForeignKubernetes}, Chains: []string{`services`, `filter-forward`}},
+	}, DetectForeign(tables, chains))
+	assert.Empty(t, DetectForeign(tables[1:3], chains))
+}
+
+// addForeignTables adds the tables of Docker with iptables-nft and of
+// kube-proxy in nftables mode.
+func addForeignTables(t *testing.T, k *nftest.Kernel) {
+	c := k.Conn()
+	filter := c.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: `filter`})
+	c.AddChain(&nftables.Chain{Table: filter, Name: `FORWARD`, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter})
+	c.AddChain(&nftables.Chain{Table: filter, Name: `DOCKER-USER`})
+	kube := c.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: `kube-proxy`})
+	c.AddChain(&nftables.Chain{Table: kube, Name: `services`})
+	assert.NoError(t, c.Flush())
+}
+
+func TestCoexistRules(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		ClearRuleset:   true,
+		TablePrefix:    `fw_`,
+		Coexist:        true,
+		CoexistSources: []string{`10.244.0.0/16`, `fd00:10:244::/56`},
+		Priorities:     Priorities{Filter: 10, NAT: -5},
+	}
+	k := nftest.New()
+	addForeignTables(t, k)
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	assert.Equal(t, nftables.ChainPriority(10), *nft.cForward.Priority)
+	assert.Equal(t, nftables.ChainPriority(-105), *nft.cPrerouting.Priority)
+	assert.Equal(t, nftables.ChainPriority(95), *nft.cPostrouting.Priority)
+	require.NoError(t, nft.ApplyDefault(RULE_COEXIST))
+
+	assert.Equal(t, []string{`coexist_iif`, `coexist_saddr`, `coexist_oif`, `coexist_daddr`}, ruleIDsOf(t, k, nft.cForward))
+	r, err := k.RuleByID(nft.tFilter, nft.cForward, []byte(`coexist_iif`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		lookup := exprs[1].(*expr.Lookup)
+		elems, err := k.SetElements(nft.tFilter, lookup.SetName)
+		assert.NoError(t, err)
+		// docker0, br-*, cni0, cali*, flannel*, cilium_*, kube-bridge
+		assert.Len(t, elems, 14)
+	}
+	// the IPv6 source is left to the IPv6 firewall
+	assert.Equal(t, []string{`10.244.0.0`, `-10.245.0.0`}, setElemKeysOfRule(t, k, nft, `coexist_saddr`))
+
+	found, err := nft.Foreign()
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+
+	// the foreign tables and chains are left untouched
+	assert.NoError(t, nft.Cleanup())
+	tables, err := k.Tables(nftables.TableFamilyIPv4)
+	assert.NoError(t, err)
+	var names []string
+	for _, table := range tables {
+		names = append(names, table.Name)
+	}
+	assert.Contains(t, names, `filter`)
+	assert.Contains(t, names, `kube-proxy`)
+	chains, err := k.Chains(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: `filter`})
+	assert.NoError(t, err)
+	assert.Len(t, chains, 2)
+}
+
+// setElemKeysOfRule returns the keys of the address set looked up by the rule
+// of the forward chain.
+func setElemKeysOfRule(t *testing.T, k *nftest.Kernel, nft *NFTables, id string) []string {
+	r, err := k.RuleByID(nft.tFilter, nft.cForward, []byte(id))
+	if !assert.NoError(t, err) || !assert.NotNil(t, r) {
+		return nil
+	}
+	for _, e := range nft.appliedExprs(r) {
+		if lookup, ok := e.(*expr.Lookup); ok {
+			return setElemKeys(t, k, nft.tFilter, lookup.SetName)
+		}
+	}
+	return nil
+}
+
+func TestCoexistIfaces(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DisableInitSet: true,
+		TablePrefix:    `fw_`,
+		Coexist:        true,
+		CoexistIfaces:  []string{`docker0`},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_COEXIST)
+	assert.Equal(t, []string{`coexist_iif`, `coexist_oif`}, ruleIDsOf(t, k, nft.cForward))
+
+	// no foreign table is detected without CoexistIfaces
+	nft.cfg.CoexistIfaces = nil
+	assert.NoError(t, nft.ApplyDefault(RULE_COEXIST))
+	assert.Empty(t, ruleIDsOf(t, k, nft.cForward))
+
+	nft.cfg.CoexistIfaces = []string{`a*b`}
+	assert.Error(t, nft.ApplyDefault(RULE_COEXIST))
+}
+
+func TestCoexistSharedTable(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DisableInitSet: true,
+		Coexist:        true,
+	}
+	k := nftest.New()
+	addForeignTables(t, k)
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	assert.EqualError(t, nft.ApplyDefault(RULE_COEXIST), `nft.detectForeign: table "filter" is shared with docker, set TablePrefix or TableSuffix`)
+	chains, err := k.Chains(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: `filter`})
+	assert.NoError(t, err)
+	assert.Len(t, chains, 2)
+}
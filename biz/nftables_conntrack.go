@@ -0,0 +1,38 @@
+package biz
+
+import (
+	"github.com/admpub/nftablesutils/conntrack"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Conntrack opens the conntrack table of Config.NetworkNamespace.
+func (nft *NFTables) Conntrack() (*conntrack.Conntrack, error) {
+	return conntrack.Open(nft.cfg.NetworkNamespace)
+}
+
+func (nft *NFTables) inetFamily() netlink.InetFamily {
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		return unix.AF_INET6
+	}
+	return unix.AF_INET
+}
+
+// DeleteFlows deletes the conntrack flows from or to the addresses and
+// returns their number.
+func (nft *NFTables) DeleteFlows(ipAddresses []string) (uint, error) {
+	addrs, err := conntrack.ParseAddrs(ipAddresses)
+	if err != nil {
+		return 0, err
+	}
+	if len(addrs) == 0 {
+		return 0, nil
+	}
+	ct, err := nft.Conntrack()
+	if err != nil {
+		return 0, err
+	}
+	defer ct.Close()
+	return ct.Delete(nft.inetFamily(), conntrack.Filter{Addrs: addrs})
+}
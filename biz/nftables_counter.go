@@ -0,0 +1,193 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/rule"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ErrCountersDisabled is returned by Counters if Config.Counters is empty.
+var ErrCountersDisabled = errors.New(`counters are disabled`)
+
+// counterBaseline is the software reset point of the anonymous rule counters,
+// a rule can't be replaced to reset them while it references an anonymous set.
+type counterBaseline struct {
+	mu    sync.Mutex
+	rules map[string]rule.Counter // table/chain/handle => counter at the last reset
+}
+
+func counterKey(r *nftables.Rule) string {
+	return fmt.Sprintf(`%s/%s/%d`, r.Table.Name, r.Chain.Name, r.Handle)
+}
+
+// withCounter adds the counter of the rule according to Config.Counters.
+func (nft *NFTables) withCounter(c *nftables.Conn, r *nftables.Rule) {
+	switch nft.cfg.Counters {
+	case CounterModeRule:
+		r.Exprs = utils.WithCounter(r.Exprs, utils.ExprCounter())
+	case CounterModeNamed:
+		if len(r.UserData) == 0 {
+			break
+		}
+		// cmd: nft add counter ip filter input_public@eth0
+		// cmd: nft add rule ip filter input ... counter name "input_public@eth0" accept
+		name := string(r.UserData)
+		c.AddObj(&nftables.CounterObj{Table: r.Table, Name: name})
+		r.Exprs = utils.WithCounter(r.Exprs, utils.ExprCounterRef(name))
+		nft.rulesMu.Lock()
+		if nft.counterNames == nil {
+			nft.counterNames = map[string]bool{}
+		}
+		nft.counterNames[r.Table.Name+`/`+name] = true
+		nft.rulesMu.Unlock()
+	}
+}
+
+// pruneCounters deletes the named counters of the rules which were not added
+// again by the apply, unless the ruleset was flushed. The counters of the
+// rules added again keep their values, the counters not added by withCounter
+// are left alone.
+func (nft *NFTables) pruneCounters(c *nftables.Conn, flushed bool) error {
+	if nft.cfg.Counters != CounterModeNamed || flushed {
+		return nil
+	}
+	nft.rulesMu.Lock()
+	added := make(map[string]bool, len(nft.addedRules))
+	for _, r := range nft.addedRules {
+		added[r.Table.Name+`/`+string(r.UserData)] = true
+	}
+	owned := maps.Clone(nft.counterNames)
+	nft.rulesMu.Unlock()
+	existing, err := c.ListTables()
+	if err != nil {
+		return fmt.Errorf(`failed to list tables: %w`, err)
+	}
+	for _, table := range nft.tables {
+		// the tables added by the apply have no counters yet
+		if !slices.ContainsFunc(existing, func(e *nftables.Table) bool {
+			return e.Family == table.Family && e.Name == table.Name
+		}) {
+			continue
+		}
+		objs, err := c.GetNamedObjects(table)
+		if err != nil {
+			return fmt.Errorf(`failed to list objects of table %q: %w`, table.Name, err)
+		}
+		for _, obj := range objs {
+			v, ok := obj.(*nftables.NamedObj)
+			key := table.Name + `/` + v.Name
+			if !ok || v.Type != nftables.ObjTypeCounter || added[key] || !owned[key] {
+				continue
+			}
+			// cmd: nft delete counter ip filter input_public@eth1
+			c.DeleteObject(v)
+			nft.rulesMu.Lock()
+			delete(nft.counterNames, key)
+			nft.rulesMu.Unlock()
+		}
+	}
+	return nil
+}
+
+// Counters returns the packets and bytes counted by the rules by rule ID.
+// The counters are zeroed after being read if reset is true.
+func (nft *NFTables) Counters(reset bool) (map[string]rule.Counter, error) {
+	var counters map[string]rule.Counter
+	err := nft.Do(func(c *nftables.Conn) (err error) {
+		switch nft.cfg.Counters {
+		case CounterModeNamed:
+			counters, err = nft.namedCounters(c, reset)
+		case CounterModeRule:
+			counters, err = nft.ruleCounters(c, reset)
+		default:
+			err = ErrCountersDisabled
+		}
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`nft.Counters: %w`, err)
+	}
+	return counters, nil
+}
+
+func (nft *NFTables) namedCounters(c *nftables.Conn, reset bool) (map[string]rule.Counter, error) {
+	counters := make(map[string]rule.Counter)
+	for _, table := range nft.tables {
+		// GetObjects fails on the objects other than counters and quotas
+		objs, err := c.GetNamedObjects(table)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list objects of table %q: %w`, table.Name, err)
+		}
+		for _, obj := range objs {
+			v, ok := obj.(*nftables.NamedObj)
+			if !ok || v.Type != nftables.ObjTypeCounter {
+				continue
+			}
+			data, ok := v.Obj.(*expr.Counter)
+			if !ok {
+				continue
+			}
+			if reset {
+				// reset one by one, ResetObjects would also reset the quotas.
+				// the values returned by the reset include the packets counted
+				// since they were listed
+				obj, err := c.ResetObject(v)
+				if err != nil {
+					return nil, fmt.Errorf(`failed to reset counter %q: %w`, v.Name, err)
+				}
+				if v, ok := obj.(*nftables.NamedObj); ok {
+					if counter, ok := v.Obj.(*expr.Counter); ok {
+						data = counter
+					}
+				}
+			}
+			counter := counters[v.Name]
+			counter.Add(rule.Counter{Packets: data.Packets, Bytes: data.Bytes})
+			counters[v.Name] = counter
+		}
+	}
+	return counters, nil
+}
+
+func (nft *NFTables) ruleCounters(c *nftables.Conn, reset bool) (map[string]rule.Counter, error) {
+	nft.counterBase.mu.Lock()
+	defer nft.counterBase.mu.Unlock()
+	// rebuilt from the listed rules, the baselines of the deleted rules are dropped
+	base := make(map[string]rule.Counter)
+	counters := make(map[string]rule.Counter)
+	for _, chain := range nft.chains {
+		rules, err := c.GetRules(chain.Table, chain)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list rules of chain %q: %w`, chain.Name, err)
+		}
+		for _, r := range rules {
+			if len(r.UserData) == 0 {
+				continue
+			}
+			v, ok := rule.CounterOf(r)
+			if !ok {
+				continue
+			}
+			key := counterKey(r)
+			prev, ok := nft.counterBase.rules[key]
+			counter := counters[string(r.UserData)]
+			counter.Add(v.Sub(prev))
+			counters[string(r.UserData)] = counter
+			if reset {
+				prev, ok = v, true
+			}
+			if ok {
+				base[key] = prev
+			}
+		}
+	}
+	nft.counterBase.rules = base
+	return counters, nil
+}
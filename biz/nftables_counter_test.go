@@ -0,0 +1,167 @@
+package biz
+
+import (
+	"testing"
+
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/admpub/nftablesutils/rule"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func testCounterNFTables(t *testing.T, mode string) (*NFTables, *nftest.Kernel) {
+	cfg := Config{
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		Counters:       mode,
+	}
+	k := nftest.New()
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	err := nft.Do(func(c *nftables.Conn) error {
+		if err := nft.ApplyBase(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+	require.NoError(t, err)
+	return nft, k
+}
+
+func TestNamedCounters(t *testing.T) {
+	nft, k := testCounterNFTables(t, CounterModeNamed)
+	err := nft.Do(func(c *nftables.Conn) error {
+		// existing counters are kept when the rules are applied again
+		c.AddObj(&nftables.CounterObj{Table: nft.tFilter, Name: `input_lo`, Packets: 3, Bytes: 180})
+		nft.inputLocalIfaceRules(c)
+		return c.Flush()
+	})
+	assert.NoError(t, err)
+
+	rules, err := k.Rules(nft.tFilter, nft.cInput)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		exprs := rules[0].Exprs
+		ref := exprs[len(exprs)-2].(*expr.Objref)
+		assert.Equal(t, `input_lo`, ref.Name)
+		assert.IsType(t, &expr.Verdict{}, exprs[len(exprs)-1])
+	}
+	objs, err := k.Objects(nft.tFilter)
+	assert.NoError(t, err)
+	assert.Len(t, objs, 2)
+
+	counters, err := nft.Counters(true)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{Packets: 3, Bytes: 180}, counters[`input_lo`])
+	assert.Equal(t, rule.Counter{}, counters[`input_lo_spoof`])
+
+	counters, err = nft.Counters(false)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{}, counters[`input_lo`])
+}
+
+func TestNamedCountersReset(t *testing.T) {
+	nft, k := testCounterNFTables(t, CounterModeNamed)
+	obj := &nftables.CounterObj{Table: nft.tFilter, Name: `extra`, Packets: 2, Bytes: 120}
+	c := k.Conn()
+	c.AddObj(obj)
+	assert.NoError(t, c.Flush())
+
+	var listed bool
+	setTestDial(nft, func(req []netlink.Message) ([]netlink.Message, error) {
+		replies, err := k.Dial(req)
+		if !listed && len(req) > 0 && int(req[0].Header.Type)&0xff == unix.NFT_MSG_GETOBJ {
+			listed = true
+			// packets counted between the listing and the reset
+			c := k.Conn()
+			c.DeleteObject(obj)
+			c.AddObj(&nftables.CounterObj{Table: nft.tFilter, Name: `extra`, Packets: 5, Bytes: 300})
+			assert.NoError(t, c.Flush())
+		}
+		return replies, err
+	})
+	counters, err := nft.Counters(true)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{Packets: 5, Bytes: 300}, counters[`extra`])
+
+	counters, err = nft.Counters(false)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{}, counters[`extra`])
+}
+
+func TestNamedCountersPrune(t *testing.T) {
+	nft, k := testCounterNFTables(t, CounterModeNamed)
+	nft.cfg.Enabled = true
+	assert.NoError(t, nft.ApplyDefault(RULE_INPUT_LOCAL_IFACE))
+	// the counters of the rules which were removed from the configuration
+	err := nft.Do(func(c *nftables.Conn) error {
+		nft.addRule(c, &nftables.Rule{Table: nft.tFilter, Chain: nft.cInput, UserData: []byte(`input_stale`)})
+		return c.Flush()
+	})
+	assert.NoError(t, err)
+	// the counters added by others are kept
+	c := k.Conn()
+	c.AddObj(&nftables.CounterObj{Table: nft.tFilter, Name: `foreign`})
+	assert.NoError(t, c.Flush())
+
+	assert.NoError(t, nft.ApplyDefault(RULE_INPUT_LOCAL_IFACE))
+	objs, err := k.Objects(nft.tFilter)
+	assert.NoError(t, err)
+	names := make([]string, 0, len(objs))
+	for _, obj := range objs {
+		names = append(names, obj.(*nftables.CounterObj).Name)
+	}
+	assert.ElementsMatch(t, []string{`input_lo`, `input_lo_spoof`, `foreign`}, names)
+}
+
+func TestRuleCounters(t *testing.T) {
+	nft, k := testCounterNFTables(t, CounterModeRule)
+	err := nft.Do(func(c *nftables.Conn) error {
+		nft.outputLocalIfaceRules(c)
+		return c.Flush()
+	})
+	assert.NoError(t, err)
+	rules, err := k.Rules(nft.tFilter, nft.cOutput)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		counter, ok := rule.CounterOf(rules[0])
+		assert.True(t, ok)
+		assert.Equal(t, rule.Counter{}, counter)
+	}
+
+	// a rule that already counted some traffic
+	c := k.Conn()
+	c.AddRule(&nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    []expr.Any{&expr.Counter{Packets: 5, Bytes: 300}},
+		UserData: []byte(`input_counted`),
+	})
+	assert.NoError(t, c.Flush())
+
+	counters, err := nft.Counters(true)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{Packets: 5, Bytes: 300}, counters[`input_counted`])
+	assert.Equal(t, rule.Counter{}, counters[`output_lo`])
+
+	counters, err = nft.Counters(false)
+	assert.NoError(t, err)
+	assert.Equal(t, rule.Counter{}, counters[`input_counted`])
+
+	// the baseline of a deleted rule is dropped by the next listing
+	counted, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`input_counted`))
+	assert.NoError(t, err)
+	assert.NoError(t, c.DelRule(counted))
+	assert.NoError(t, c.Flush())
+	_, err = nft.Counters(false)
+	assert.NoError(t, err)
+	assert.NotContains(t, nft.counterBase.rules, counterKey(counted))
+	assert.Len(t, nft.counterBase.rules, 1)
+
+	nft.cfg.Counters = ``
+	_, err = nft.Counters(false)
+	assert.Error(t, err)
+}
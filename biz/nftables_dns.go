@@ -23,11 +23,12 @@ func (nft *NFTables) inputDNSRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_dns_udp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter input meta iifname "eth0" \
 	// ip protocol tcp tcp sport 53 \
@@ -42,11 +43,12 @@ func (nft *NFTables) inputDNSRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_dns_tcp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
 
@@ -73,11 +75,12 @@ func (nft *NFTables) outputDNSRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_dns_udp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter output meta oifname "eth0" \
 	// ip protocol tcp tcp dport 53 \
@@ -98,10 +101,11 @@ func (nft *NFTables) outputDNSRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_dns_tcp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
@@ -0,0 +1,151 @@
+package biz
+
+import (
+	"fmt"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+)
+
+// syncIngressBlacklist adds the blacklist of the ingress table and copies the
+// elements of filterSetBlacklistIP, which were banned before EarlyDrop was
+// enabled, with the time they have left.
+func (nft *NFTables) syncIngressBlacklist(c *nftables.Conn) error {
+	if err := c.AddSet(nft.ingressSetBlacklistIP, nil); err != nil {
+		return err
+	}
+	c.FlushSet(nft.ingressSetBlacklistIP)
+	// the filter blacklist does not exist before the first apply
+	exists, err := setExists(c, nft.filterSetBlacklistIP)
+	if err != nil || !exists {
+		return err
+	}
+	elems, err := c.GetSetElements(nft.filterSetBlacklistIP)
+	if err != nil {
+		return fmt.Errorf(`failed to list elements of set %q: %w`, nft.filterSetBlacklistIP.Name, err)
+	}
+	if len(elems) == 0 {
+		return nil
+	}
+	for i, elem := range elems {
+		elems[i] = nftables.SetElement{
+			Key:         elem.Key,
+			IntervalEnd: elem.IntervalEnd,
+			Timeout:     elem.Expires,
+		}
+	}
+	return c.SetAddElements(nft.ingressSetBlacklistIP, elems)
+}
+
+// setExists reports whether set exists in the ruleset.
+func setExists(c *nftables.Conn, set *nftables.Set) (bool, error) {
+	tables, err := c.ListTablesOfFamily(set.Table.Family)
+	if err != nil {
+		return false, fmt.Errorf(`failed to list tables: %w`, err)
+	}
+	var found bool
+	for _, t := range tables {
+		if t.Name == set.Table.Name {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	sets, err := c.GetSets(set.Table)
+	if err != nil {
+		return false, fmt.Errorf(`failed to list sets of table %q: %w`, set.Table.Name, err)
+	}
+	for _, v := range sets {
+		if v.Name == set.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// earlyDropRules drops the blacklisted sources, and the bogons and the
+// fragments if enabled, in the ingress chains of the WAN interfaces.
+func (nft *NFTables) earlyDropRules(c *nftables.Conn) error {
+	if !nft.cfg.EarlyDrop || nft.tIngress == nil {
+		return nil
+	}
+	for _, wanIface := range nft.wanIfaces() {
+		if err := nft.earlyDropIfaceRules(c, wanIface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// earlyDropIfaceRules adds the early drop rules of the WAN interface, and its
+// ingress chain which is removed with the device by some kernels.
+func (nft *NFTables) earlyDropIfaceRules(c *nftables.Conn, wanIface string) error {
+	chain := nft.ingressChain(wanIface)
+	if !nft.cfg.EarlyDrop || chain == nil {
+		return nil
+	}
+	c.AddChain(chain)
+
+	// cmd: nft add rule netdev ingress INGRESS_eth0 meta protocol ip \
+	// ip saddr @blacklist_ipset drop
+	exprs := nft.ingressProtocolExprs()
+	exprs = append(exprs, nft.addrSetExprs(nft.ingressSetBlacklistIP, utils.ExprDirectionSource)...)
+	exprs = append(exprs, utils.ExprDrop())
+	rule := &nftables.Rule{
+		Table:    nft.tIngress,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`early_drop_blacklist`, wanIface),
+	}
+	nft.addRule(c, rule)
+
+	if nft.cfg.EarlyDropBogons {
+		// cmd: nft add rule netdev ingress INGRESS_eth0 meta protocol ip \
+		// ip saddr { 0.0.0.0/8, 127.0.0.0/8, ... } drop
+		elems, err := nft.antiSpoofSetElems(BogonIPv4, BogonIPv6)
+		if err != nil {
+			return err
+		}
+		set := utils.GetIPv4AddrSet(nft.tIngress, true)
+		if nft.tableFamily == nftables.TableFamilyIPv6 {
+			set = utils.GetIPv6AddrSet(nft.tIngress, true)
+		}
+		if err = c.AddSet(set, elems); err != nil {
+			return err
+		}
+		exprs = nft.ingressProtocolExprs()
+		exprs = append(exprs, nft.addrSetExprs(set, utils.ExprDirectionSource)...)
+		exprs = append(exprs, utils.ExprDrop())
+		rule = &nftables.Rule{
+			Table:    nft.tIngress,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: ifaceRuleID(`early_drop_bogon`, wanIface),
+		}
+		nft.addRule(c, rule)
+	}
+
+	if nft.cfg.EarlyDropFrags {
+		// cmd: nft add rule netdev ingress INGRESS_eth0 meta protocol ip \
+		// ip frag-off & 0x3fff != 0 drop
+		// cmd: nft add rule netdev ingress6 INGRESS_eth0 meta protocol ip6 \
+		// exthdr frag exists drop
+		exprs = nft.ingressProtocolExprs()
+		if nft.tableFamily == nftables.TableFamilyIPv6 {
+			exprs = append(exprs, utils.SetIPv6Fragment()...)
+		} else {
+			exprs = append(exprs, utils.SetIPv4Fragment()...)
+		}
+		exprs = append(exprs, utils.ExprDrop())
+		rule = &nftables.Rule{
+			Table:    nft.tIngress,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: ifaceRuleID(`early_drop_fragment`, wanIface),
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
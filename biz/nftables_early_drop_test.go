@@ -0,0 +1,90 @@
+package biz
+
+import (
+	"testing"
+	"time"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEarlyDropRules(t *testing.T) {
+	cfg := Config{
+		Enabled:         true,
+		DefaultPolicy:   `drop`,
+		WanIface:        `eth0`,
+		EarlyDrop:       true,
+		EarlyDropBogons: true,
+		EarlyDropFrags:  true,
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_EARLY_DROP)
+	if assert.NotNil(t, nft.tIngress) {
+		assert.Equal(t, `ingress`, nft.tIngress.Name)
+	}
+	if assert.NotNil(t, nft.ingressSetBlacklistIP) {
+		assert.Equal(t, nft.filterSetBlacklistIP.Name, nft.ingressSetBlacklistIP.Name)
+		assert.Equal(t, nft.tIngress, nft.ingressSetBlacklistIP.Table)
+	}
+	chain := nft.ingressChain(`eth0`)
+	assert.Equal(t, []string{
+		`early_drop_blacklist@eth0`,
+		`early_drop_bogon@eth0`,
+		`early_drop_fragment@eth0`,
+	}, ruleIDsOf(t, k, chain))
+
+	r, err := k.RuleByID(nft.tIngress, chain, []byte(`early_drop_fragment@eth0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetMetaProtocol(0x0800), utils.Exprs(exprs[:2]))
+		assert.Equal(t, utils.SetIPv4Fragment(), utils.Exprs(exprs[2:5]))
+		assert.Equal(t, utils.ExprDrop(), exprs[5])
+	}
+
+	// the rules are added again when the interface comes back
+	assert.NoError(t, nft.ReapplyIface(`eth0`))
+	assert.Equal(t, []string{
+		`early_drop_blacklist@eth0`,
+		`early_drop_bogon@eth0`,
+		`early_drop_fragment@eth0`,
+	}, ruleIDsOf(t, k, chain))
+
+	// the bans are added to both blacklists
+	assert.NoError(t, nft.Ban([]string{`203.0.113.7`}, time.Hour))
+	assert.Contains(t, setElemKeys(t, k, nft.tFilter, nft.filterSetBlacklistIP.Name), `203.0.113.7`)
+	assert.Contains(t, setElemKeys(t, k, nft.tIngress, nft.ingressSetBlacklistIP.Name), `203.0.113.7`)
+
+	// the existing bans are copied when the ingress blacklist is created
+	nft2 := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	assert.NoError(t, nft2.Do(func(c *nftables.Conn) error {
+		c.DelTable(nft2.tIngress)
+		c.AddTable(nft2.tIngress)
+		if err := nft2.syncIngressBlacklist(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	}))
+	assert.Contains(t, setElemKeys(t, k, nft2.tIngress, nft2.ingressSetBlacklistIP.Name), `203.0.113.7`)
+
+	// the unbans are removed from both blacklists
+	assert.NoError(t, nft.Unban([]string{`203.0.113.7`}))
+	assert.NotContains(t, setElemKeys(t, k, nft.tFilter, nft.filterSetBlacklistIP.Name), `203.0.113.7`)
+	assert.NotContains(t, setElemKeys(t, k, nft.tIngress, nft.ingressSetBlacklistIP.Name), `203.0.113.7`)
+
+	nft6, k6 := applyTestNFTables(t, nftables.TableFamilyIPv6, cfg, nil, RULE_EARLY_DROP)
+	assert.Equal(t, `ingress6`, nft6.tIngress.Name)
+	r, err = k6.RuleByID(nft6.tIngress, nft6.ingressChain(`eth0`), []byte(`early_drop_fragment@eth0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft6.appliedExprs(r)
+		assert.Equal(t, utils.SetMetaProtocol(0x86dd), utils.Exprs(exprs[:2]))
+		assert.Equal(t, utils.SetIPv6Fragment(), utils.Exprs(exprs[2:4]))
+	}
+
+	// disabled
+	cfg.EarlyDrop = false
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	assert.Nil(t, nft.tIngress)
+	assert.Nil(t, nft.ingressSetBlacklistIP)
+}
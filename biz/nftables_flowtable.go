@@ -0,0 +1,63 @@
+package biz
+
+import (
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+)
+
+const flowtableName = `ft`
+
+// flowtableDevices returns the devices of the flowtable.
+func (nft *NFTables) flowtableDevices() []string {
+	if len(nft.cfg.FlowtableDevices) > 0 {
+		return nft.cfg.FlowtableDevices
+	}
+	var devices []string
+	if len(nft.myIface) > 0 {
+		devices = append(devices, nft.myIface)
+	}
+	for _, iface := range nft.wanIfaces() {
+		if !inStrings(devices, iface) {
+			devices = append(devices, iface)
+		}
+	}
+	return devices
+}
+
+// newFlowtable returns the flowtable of the filter table, nil if it is disabled
+// or has no device.
+func (nft *NFTables) newFlowtable() *nftables.Flowtable {
+	nft.flowtable = nil
+	if !nft.cfg.Flowtable {
+		return nil
+	}
+	devices := nft.flowtableDevices()
+	if len(devices) == 0 {
+		return nil
+	}
+	nft.flowtable = utils.GetFlowtable(nft.tFilter, flowtableName, devices, nft.cfg.FlowtableOffload)
+	return nft.flowtable
+}
+
+// flowtableRules offloads the established TCP/UDP flows to the flowtable, the
+// following packets of the flows bypass the forward chain.
+func (nft *NFTables) flowtableRules(c *nftables.Conn) {
+	if nft.flowtable == nil {
+		return
+	}
+	// cmd: nft add rule ip filter forward \
+	// meta l4proto tcp ct state established flow add @ft
+	for _, proto := range []string{`tcp`, `udp`} {
+		exprs := utils.SetProtoTCP()
+		if proto == `udp` {
+			exprs = utils.SetProtoUDP()
+		}
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cForward,
+			Exprs:    utils.JoinExprs(exprs, utils.SetFlowOffload(nft.flowtable.Name)),
+			UserData: []byte(`forward_offload_` + proto),
+		}
+		nft.addRule(c, rule)
+	}
+}
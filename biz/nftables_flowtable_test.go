@@ -0,0 +1,77 @@
+package biz
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowtableRules(t *testing.T) {
+	cfg := Config{
+		Enabled:          true,
+		DefaultPolicy:    `drop`,
+		MyIface:          `wg0`,
+		Flowtable:        true,
+		FlowtableDevices: []string{`eth0`, `wg0`},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_SDN)
+
+	fts, err := k.Flowtables(nft.tFilter)
+	assert.NoError(t, err)
+	if assert.Len(t, fts, 1) {
+		assert.Equal(t, flowtableName, fts[0].Name)
+		assert.Equal(t, []string{`eth0`, `wg0`}, fts[0].Devices)
+		assert.Equal(t, nftables.FlowtableFlags(0), fts[0].Flags)
+	}
+
+	rules, err := k.Rules(nft.tFilter, nft.cForward)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, rules) {
+		// the flows are offloaded before the forward rules accept them
+		assert.Equal(t, `forward_offload_tcp`, string(rules[0].UserData))
+		assert.Equal(t, `forward_offload_udp`, string(rules[1].UserData))
+	}
+	r, err := k.RuleByID(nft.tFilter, nft.cForward, []byte(`forward_offload_udp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{17}},
+		}, r.Exprs[:2])
+		assert.Equal(t, utils.ExprFlowOffload(flowtableName), r.Exprs[len(r.Exprs)-1])
+	}
+
+	// a recreated device is bound to the flowtable again
+	c := k.Conn()
+	c.AddFlowtable(utils.GetFlowtable(nft.tFilter, flowtableName, []string{`wg0`}, false))
+	assert.NoError(t, c.Flush())
+	assert.NoError(t, nft.ReapplyIface(`eth0`))
+	fts, err = k.Flowtables(nft.tFilter)
+	assert.NoError(t, err)
+	if assert.Len(t, fts, 1) {
+		assert.Equal(t, []string{`eth0`, `wg0`}, fts[0].Devices)
+	}
+
+	// hardware offload, default devices
+	cfg.FlowtableDevices = nil
+	cfg.FlowtableOffload = true
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	// the WAN interface does not exist in the test namespace
+	nft.wans = []utils.DefaultRoute{{Iface: `eth1`}}
+	require.NoError(t, nft.ApplyDefault(RULE_SDN))
+	fts, err = k.Flowtables(nft.tFilter)
+	assert.NoError(t, err)
+	if assert.Len(t, fts, 1) {
+		assert.Equal(t, []string{`wg0`, `eth1`}, fts[0].Devices)
+		assert.Equal(t, nftables.FlowtableFlagsHWOffload, fts[0].Flags)
+	}
+
+	// disabled
+	cfg.Flowtable = false
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	assert.Nil(t, nft.newFlowtable())
+}
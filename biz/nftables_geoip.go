@@ -0,0 +1,338 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/geoip"
+	setutils "github.com/admpub/nftablesutils/set"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// geoSourcePrefix marks a country source, e.g. country:CN.
+const geoSourcePrefix = `country:`
+
+// geoSet is a named interval set of the prefixes of countries and of literal
+// sources. It is swapped on refresh between the generations name_a and name_b.
+type geoSet struct {
+	table     *nftables.Table
+	countries []string
+	literals  []string
+	name      string
+	gen       int
+	set       *nftables.Set
+	used      bool
+	loaded    bool // by the current apply
+}
+
+func (gs *geoSet) setName(gen int) string {
+	if gen%2 == 0 {
+		return gs.name + `_a`
+	}
+	return gs.name + `_b`
+}
+
+// splitGeoSources splits the sources into the upper-case country codes and the
+// other sources.
+func splitGeoSources(sources []string) (countries []string, literals []string, err error) {
+	for _, source := range sources {
+		if len(source) < len(geoSourcePrefix) || !strings.EqualFold(source[:len(geoSourcePrefix)], geoSourcePrefix) {
+			literals = append(literals, source)
+			continue
+		}
+		country := strings.ToUpper(strings.TrimSpace(source[len(geoSourcePrefix):]))
+		if len(country) == 0 {
+			return nil, nil, fmt.Errorf(`invalid source %q: country code is required`, source)
+		}
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return
+}
+
+// geoDatabase returns the GeoIP databases, which are read on first use.
+func (nft *NFTables) geoDatabase() (*geoip.DB, error) {
+	if nft.geoDB != nil {
+		return nft.geoDB, nil
+	}
+	if len(nft.cfg.GeoIPFiles) == 0 {
+		return nil, fmt.Errorf(`country sources require GeoIPFiles`)
+	}
+	db, err := geoip.Open(nft.cfg.GeoIPFiles...)
+	if err != nil {
+		return nil, fmt.Errorf(`geoip.Open: %w`, err)
+	}
+	nft.geoDB = db
+	return db, nil
+}
+
+// geoAddrSet adds the named set of the countries and the literal sources and
+// returns the expressions matching it.
+func (nft *NFTables) geoAddrSet(c *nftables.Conn, t *nftables.Table, dir utils.ExprDirection, countries, literals []string) ([]expr.Any, error) {
+	nft.geoMu.Lock()
+	defer nft.geoMu.Unlock()
+	db, err := nft.geoDatabase()
+	if err != nil {
+		return nil, err
+	}
+	key := t.Name + `|` + strings.Join(countries, `,`) + `|` + strings.Join(literals, `,`)
+	gs, ok := nft.geoSets[key]
+	if !ok {
+		gs = &geoSet{
+			table:     t,
+			countries: countries,
+			literals:  literals,
+			name:      nft.geoSetName(t, countries),
+		}
+		if nft.geoSets == nil {
+			nft.geoSets = map[string]*geoSet{}
+		}
+		nft.geoSets[key] = gs
+	}
+	gs.used = true
+	if gs.set == nil {
+		gs.set = nft.newGeoSet(gs, gs.gen)
+	}
+	if !gs.loaded {
+		if err = nft.loadGeoSet(c, db, gs, gs.set); err != nil {
+			return nil, err
+		}
+		gs.loaded = true
+	}
+	return nft.addrSetExprs(gs.set, dir), nil
+}
+
+// resetGeoSets marks the sets of the previous apply unused and not loaded, the
+// sets still used keep their generation.
+func (nft *NFTables) resetGeoSets() {
+	nft.geoMu.Lock()
+	defer nft.geoMu.Unlock()
+	for _, gs := range nft.geoSets {
+		gs.used = false
+		gs.loaded = false
+	}
+}
+
+// pruneGeoSets removes the sets left unused by the apply, deleting them from
+// the ruleset unless it was flushed.
+func (nft *NFTables) pruneGeoSets(c *nftables.Conn, flushed bool) {
+	nft.geoMu.Lock()
+	defer nft.geoMu.Unlock()
+	for key, gs := range nft.geoSets {
+		if gs.used {
+			continue
+		}
+		if gs.set != nil && !flushed {
+			// cmd: nft delete set ip filter geo_cn_a
+			c.DelSet(gs.set)
+		}
+		delete(nft.geoSets, key)
+	}
+}
+
+// geoSetName returns an unused name for the set of the countries, e.g. geo_cn_ru.
+func (nft *NFTables) geoSetName(t *nftables.Table, countries []string) string {
+	base := `geo_` + strings.ToLower(strings.Join(countries, `_`))
+	name := base
+	for i := 2; ; i++ {
+		used := false
+		for _, gs := range nft.geoSets {
+			if gs.table.Name == t.Name && gs.name == name {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return name
+		}
+		name = base + `_` + strconv.Itoa(i)
+	}
+}
+
+func (nft *NFTables) geoKeyType() nftables.SetDatatype {
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		return nftables.TypeIP6Addr
+	}
+	return nftables.TypeIPAddr
+}
+
+func (nft *NFTables) newGeoSet(gs *geoSet, gen int) *nftables.Set {
+	return &nftables.Set{
+		Name:     gs.setName(gen),
+		Table:    gs.table,
+		KeyType:  nft.geoKeyType(),
+		Interval: true,
+	}
+}
+
+// geoSetElems returns the merged interval elements of the prefixes of the
+// countries matching the table family and of the literal sources.
+func (nft *NFTables) geoSetElems(db *geoip.DB, gs *geoSet) ([]nftables.SetElement, error) {
+	isIPv6 := nft.tableFamily == nftables.TableFamilyIPv6
+	var list []setutils.SetData
+	for _, prefix := range db.Prefixes(gs.countries...) {
+		if prefix.Addr().Is6() == isIPv6 {
+			list = append(list, setutils.SetData{Prefix: prefix})
+		}
+	}
+	for _, source := range gs.literals {
+		if strings.Contains(source, `:`) != isIPv6 {
+			continue
+		}
+		data, err := setutils.AddressStringsToSetData([]string{source})
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, data...)
+	}
+	return setutils.GenerateElements(nft.geoKeyType(), setutils.MergeAddressSetData(list))
+}
+
+// loadGeoSet adds the set and replaces its elements.
+func (nft *NFTables) loadGeoSet(c *nftables.Conn, db *geoip.DB, gs *geoSet, set *nftables.Set) error {
+	elems, err := nft.geoSetElems(db, gs)
+	if err != nil {
+		return fmt.Errorf(`%s: %w`, set.Name, err)
+	}
+	// cmd: nft add set ip filter geo_cn_a { type ipv4_addr\; flags interval\; }
+	// cmd: nft flush set ip filter geo_cn_a
+	// cmd: nft add element ip filter geo_cn_a { 1.0.1.0/24, 1.0.2.0/23 }
+	if err = c.AddSet(set, nil); err != nil {
+		return fmt.Errorf(`nft.AddSet(%q): %w`, set.Name, err)
+	}
+	c.FlushSet(set)
+	if len(elems) > 0 {
+		if err = c.SetAddElements(set, elems); err != nil {
+			return fmt.Errorf(`nft.SetAddElements(%q): %w`, set.Name, err)
+		}
+	}
+	return nil
+}
+
+// RefreshGeoIP reads the GeoIP databases again and swaps the country sets
+// atomically: the sets of the next generation are loaded, the rules are
+// retargeted to them and the previous sets are deleted in a single batch.
+func (nft *NFTables) RefreshGeoIP() error {
+	if !nft.applied || len(nft.cfg.GeoIPFiles) == 0 {
+		return nil
+	}
+	db, err := geoip.Open(nft.cfg.GeoIPFiles...)
+	if err != nil {
+		return fmt.Errorf(`geoip.Open: %w`, err)
+	}
+	// geoMu is taken after the apply lock of Do, like in apply
+	return nft.Do(func(c *nftables.Conn) error {
+		nft.geoMu.Lock()
+		defer nft.geoMu.Unlock()
+		if len(nft.geoSets) == 0 {
+			return nil
+		}
+		next := make(map[*geoSet]*nftables.Set, len(nft.geoSets))
+		for _, gs := range nft.geoSets {
+			if gs.set == nil {
+				continue
+			}
+			set := nft.newGeoSet(gs, gs.gen+1)
+			if err := nft.loadGeoSet(c, db, gs, set); err != nil {
+				return err
+			}
+			if err := nft.retargetGeoRules(c, gs.set, set); err != nil {
+				return err
+			}
+			// cmd: nft delete set ip filter geo_cn_a
+			c.DelSet(gs.set)
+			next[gs] = set
+		}
+		if err := c.Flush(); err != nil {
+			return err
+		}
+		for gs, set := range next {
+			gs.set = set
+			gs.gen++
+		}
+		nft.geoDB = db
+		return nil
+	})
+}
+
+// retargetGeoRules replaces the rules looking up the set from with rules
+// looking up the set to.
+func (nft *NFTables) retargetGeoRules(c *nftables.Conn, from, to *nftables.Set) error {
+	for _, chain := range nft.chains {
+		if chain.Table.Name != from.Table.Name {
+			continue
+		}
+		rules, err := c.GetRules(chain.Table, chain)
+		if err != nil {
+			return fmt.Errorf(`failed to list rules of chain %q: %w`, chain.Name, err)
+		}
+		for _, rule := range rules {
+			rule.Table = chain.Table
+			rule.Chain = chain
+			rule.Exprs = nft.appliedExprs(rule)
+			var found bool
+			for _, e := range rule.Exprs {
+				if lookup, ok := e.(*expr.Lookup); ok && lookup.SetName == from.Name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+			for _, e := range rule.Exprs {
+				lookup, ok := e.(*expr.Lookup)
+				if !ok {
+					continue
+				}
+				if lookup.SetName == from.Name {
+					lookup.SetName = to.Name
+					lookup.SetID = to.ID
+					continue
+				}
+				// an anonymous set is bound to a single rule, the replacing
+				// rule gets a copy of it
+				if isAnonymousSetName(lookup.SetName) {
+					anon, err := getAnonymousSet(c, chain.Table, lookup.SetName)
+					if err != nil {
+						return err
+					}
+					set, err := anon.add(c)
+					if err != nil {
+						return err
+					}
+					lookup.SetName = set.Name
+					lookup.SetID = set.ID
+				}
+			}
+			c.ReplaceRule(rule)
+		}
+	}
+	return nil
+}
+
+// RunGeoIPRefresh refreshes the country sets every GeoIPRefresh until ctx is done.
+func (nft *NFTables) RunGeoIPRefresh(ctx context.Context) {
+	if nft.cfg.GeoIPRefresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(nft.cfg.GeoIPRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := nft.RefreshGeoIP(); err != nil {
+				log.Errorf(`[nftables] RefreshGeoIP: %v`, err)
+			}
+		}
+	}
+}
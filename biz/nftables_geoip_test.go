@@ -0,0 +1,178 @@
+package biz
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func writeGeoIPCSV(t *testing.T, path string, content string) {
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func testGeoIPConfig(t *testing.T) Config {
+	path := filepath.Join(t.TempDir(), `country.csv`)
+	writeGeoIPCSV(t, path, "1.0.1.0,1.0.1.255,CN\n1.0.2.0,1.0.3.255,CN\n5.0.0.0,5.0.255.255,DE\n2400::,240f:ffff:ffff:ffff:ffff:ffff:ffff:ffff,CN\n")
+	return Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		GeoIPFiles:    []string{path},
+		Zones: []Zone{
+			{Name: `cn`, Sources: []string{`country:cn`}, Input: `drop`},
+		},
+		Services: []Service{
+			{Name: `ssh`, Ports: []uint16{22}, Sources: []string{`country:DE`, `1.0.0.0/24`, `10.0.0.0/8`}},
+		},
+	}
+}
+
+func geoLookupOf(t *testing.T, k *nftest.Kernel, table *nftables.Table, chain *nftables.Chain, id string) string {
+	r, err := k.RuleByID(table, chain, []byte(id))
+	assert.NoError(t, err)
+	if !assert.NotNil(t, r) {
+		return ``
+	}
+	for _, e := range r.Exprs {
+		if l, ok := e.(*expr.Lookup); ok {
+			return l.SetName
+		}
+	}
+	return ``
+}
+
+func setElemKeys(t *testing.T, k *nftest.Kernel, table *nftables.Table, name string) []string {
+	elems, err := k.SetElements(table, name)
+	assert.NoError(t, err)
+	keys := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		addr, _ := netip.AddrFromSlice(elem.Key)
+		if elem.IntervalEnd {
+			keys = append(keys, `-`+addr.String())
+		} else {
+			keys = append(keys, addr.String())
+		}
+	}
+	return keys
+}
+
+func TestGeoIPSources(t *testing.T) {
+	cfg := testGeoIPConfig(t)
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_ZONE|RULE_SERVICE)
+
+	assert.Equal(t, `geo_cn_a`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `zone_dispatch_input_cn_geo`))
+	assert.Equal(t, `geo_de_a`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `service_ssh_tcp`))
+	// the adjacent prefixes are merged, the IPv6 prefixes are left to the ip6 table
+	assert.Equal(t, []string{`1.0.1.0`, `-1.0.4.0`}, setElemKeys(t, k, nft.tFilter, `geo_cn_a`))
+	assert.ElementsMatch(t, []string{`1.0.0.0`, `-1.0.1.0`, `5.0.0.0`, `-5.1.0.0`, `10.0.0.0`, `-11.0.0.0`}, setElemKeys(t, k, nft.tFilter, `geo_de_a`))
+
+	// the sets of the next generation replace the previous ones
+	writeGeoIPCSV(t, cfg.GeoIPFiles[0], "1.0.1.0,1.0.1.255,CN\n6.0.0.0,6.0.0.255,DE\n")
+	assert.NoError(t, nft.RefreshGeoIP())
+	assert.Equal(t, `geo_cn_b`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `zone_dispatch_input_cn_geo`))
+	assert.Equal(t, `geo_de_b`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `service_ssh_tcp`))
+	assert.Equal(t, []string{`1.0.1.0`, `-1.0.2.0`}, setElemKeys(t, k, nft.tFilter, `geo_cn_b`))
+	sets, err := k.Sets(nft.tFilter)
+	assert.NoError(t, err)
+	var names []string
+	for _, set := range sets {
+		if !set.Anonymous {
+			names = append(names, set.Name)
+		}
+	}
+	assert.NotContains(t, names, `geo_cn_a`)
+	assert.NotContains(t, names, `geo_de_a`)
+
+	// and are swapped back on the next refresh
+	assert.NoError(t, nft.RefreshGeoIP())
+	assert.Equal(t, `geo_cn_a`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `zone_dispatch_input_cn_geo`))
+
+	// applying again keeps the current generation
+	assert.NoError(t, nft.ApplyDefault(RULE_ZONE|RULE_SERVICE))
+	assert.Equal(t, `geo_cn_a`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `zone_dispatch_input_cn_geo`))
+}
+
+func TestGeoIPSourcesRemoved(t *testing.T) {
+	cfg := testGeoIPConfig(t)
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_ZONE|RULE_SERVICE)
+	assert.NoError(t, nft.RefreshGeoIP())
+
+	// the set of the removed service is deleted and no longer refreshed
+	nft.cfg.Services = nil
+	assert.NoError(t, nft.ApplyDefault(RULE_ZONE|RULE_SERVICE))
+	assert.Len(t, nft.geoSets, 1)
+	assert.NoError(t, nft.RefreshGeoIP())
+	assert.Equal(t, `geo_cn_a`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `zone_dispatch_input_cn_geo`))
+	sets, err := k.Sets(nft.tFilter)
+	assert.NoError(t, err)
+	var names []string
+	for _, set := range sets {
+		names = append(names, set.Name)
+	}
+	assert.Contains(t, names, `geo_cn_a`)
+	assert.NotContains(t, names, `geo_de_a`)
+	assert.NotContains(t, names, `geo_de_b`)
+
+	// the sets are added again after the ruleset is flushed
+	nft.cfg.ClearRuleset = true
+	nft.cfg.Services = cfg.Services
+	assert.NoError(t, nft.ApplyDefault(RULE_ZONE|RULE_SERVICE))
+	assert.Len(t, nft.geoSets, 2)
+	assert.NoError(t, nft.RefreshGeoIP())
+	assert.Equal(t, `geo_de_b`, geoLookupOf(t, k, nft.tFilter, nft.cInput, `service_ssh_tcp`))
+}
+
+func TestGeoIPSourcesLoadedOnce(t *testing.T) {
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, testGeoIPConfig(t), nil, nil)
+	k := nftest.New()
+	var loads int
+	setTestDial(nft, func(req []netlink.Message) ([]netlink.Message, error) {
+		for _, m := range req {
+			if int(m.Header.Type)&0xff != unix.NFT_MSG_NEWSETELEM {
+				continue
+			}
+			attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+			assert.NoError(t, err)
+			for _, a := range attrs {
+				if a.Type == unix.NFTA_SET_ELEM_LIST_SET && string(bytes.TrimRight(a.Data, "\x00")) == `geo_cn_a` {
+					loads++
+				}
+			}
+		}
+		return k.Dial(req)
+	})
+
+	// the set of the zone is looked up by the input and forward dispatch rules
+	assert.NoError(t, nft.ApplyDefault(RULE_ZONE))
+	assert.Equal(t, 1, loads)
+	assert.Equal(t, []string{`1.0.1.0`, `-1.0.4.0`}, setElemKeys(t, k, nft.tFilter, `geo_cn_a`))
+
+	// and loaded again by the next apply
+	assert.NoError(t, nft.ApplyDefault(RULE_ZONE))
+	assert.Equal(t, 2, loads)
+}
+
+func TestGeoIPSourcesIPv6(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv6, testGeoIPConfig(t), nil, RULE_ZONE)
+	assert.Equal(t, []string{`2400::`, `-2410::`}, setElemKeys(t, k, nft.tFilter, `geo_cn_a`))
+}
+
+func TestSplitGeoSources(t *testing.T) {
+	countries, literals, err := splitGeoSources([]string{`country:ru`, `10.0.0.0/8`, `Country:CN`})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`CN`, `RU`}, countries)
+	assert.Equal(t, []string{`10.0.0.0/8`}, literals)
+	_, _, err = splitGeoSources([]string{`country:`})
+	assert.EqualError(t, err, `invalid source "country:": country code is required`)
+
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, Config{Enabled: true, Zones: []Zone{{Name: `cn`, Sources: []string{`country:CN`}}}}, nil, nftest.New())
+	assert.ErrorContains(t, nft.ApplyDefault(RULE_ZONE), `country sources require GeoIPFiles`)
+}
@@ -32,11 +32,12 @@ func (nft *NFTables) inputHTTPServerRules(c *nftables.Conn, iface string) error
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_http`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
 
@@ -71,10 +72,11 @@ func (nft *NFTables) outputHTTPServerRules(c *nftables.Conn, iface string) error
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_http`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
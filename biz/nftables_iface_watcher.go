@@ -0,0 +1,312 @@
+package biz
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/admpub/log"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// IfaceEventType of IfaceEvent.
+type IfaceEventType int
+
+const (
+	IfaceEventAdd       IfaceEventType = iota + 1 // link created
+	IfaceEventRemove                              // link deleted
+	IfaceEventUp                                  // link set up
+	IfaceEventDown                                // link set down
+	IfaceEventRename                              // link renamed
+	IfaceEventAddrAdd                             // address added
+	IfaceEventAddrDel                             // address deleted
+	IfaceEventReapplied                           // rules of the link reapplied
+)
+
+func (t IfaceEventType) String() string {
+	switch t {
+	case IfaceEventAdd:
+		return `add`
+	case IfaceEventRemove:
+		return `remove`
+	case IfaceEventUp:
+		return `up`
+	case IfaceEventDown:
+		return `down`
+	case IfaceEventRename:
+		return `rename`
+	case IfaceEventAddrAdd:
+		return `addr_add`
+	case IfaceEventAddrDel:
+		return `addr_del`
+	case IfaceEventReapplied:
+		return `reapplied`
+	}
+	return fmt.Sprintf(`unknown(%d)`, int(t))
+}
+
+// IfaceEvent is sent by IfaceWatcher.
+type IfaceEvent struct {
+	Type    IfaceEventType
+	Iface   string
+	OldName string     // previous name of IfaceEventRename
+	Index   int        // link index
+	Up      bool       // link state
+	Addr    *net.IPNet // address of IfaceEventAddrAdd / IfaceEventAddrDel
+	Err     error      // result of IfaceEventReapplied
+}
+
+type linkState struct {
+	name string
+	up   bool
+}
+
+// IfaceWatcher watches the links and addresses of the network namespace of
+// NFTables and reapplies the rules of the affected interfaces.
+type IfaceWatcher struct {
+	nft      *NFTables
+	debounce time.Duration
+	reapply  func(iface string) error
+
+	events   chan IfaceEvent
+	handlers []func(IfaceEvent)
+
+	mu      sync.Mutex
+	links   map[int]linkState
+	timers  map[string]*time.Timer
+	done    chan struct{}
+	stopped bool // checked by the timers which already fired
+}
+
+// NewIfaceWatcher creates a watcher of the interfaces used by nft.
+// Bursts of events of an interface within debounce are merged into one
+// ReapplyIface call.
+func NewIfaceWatcher(nft *NFTables, debounce time.Duration) *IfaceWatcher {
+	return &IfaceWatcher{
+		nft:      nft,
+		debounce: debounce,
+		reapply:  nft.ReapplyIface,
+		events:   make(chan IfaceEvent, 64),
+		links:    map[int]linkState{},
+		timers:   map[string]*time.Timer{},
+	}
+}
+
+// OnEvent registers a callback called for every event.
+// It must be called before Start.
+func (w *IfaceWatcher) OnEvent(h func(IfaceEvent)) {
+	w.handlers = append(w.handlers, h)
+}
+
+// Events returns the channel of events. Events are dropped when it is full.
+func (w *IfaceWatcher) Events() <-chan IfaceEvent {
+	return w.events
+}
+
+// Start subscribing to link and address changes.
+func (w *IfaceWatcher) Start() error {
+	ns := netns.None()
+	if len(w.nft.cfg.NetworkNamespace) > 0 {
+		var err error
+		ns, err = netns.GetFromName(w.nft.cfg.NetworkNamespace)
+		if err != nil {
+			return fmt.Errorf(`failed to netns.GetFromName(%q): %w`, w.nft.cfg.NetworkNamespace, err)
+		}
+		defer ns.Close()
+	}
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return fmt.Errorf(`failed to netlink.NewHandleAt: %w`, err)
+	}
+	links, err := handle.LinkList()
+	handle.Delete()
+	if err != nil {
+		return fmt.Errorf(`failed to list links: %w`, err)
+	}
+	w.mu.Lock()
+	for _, link := range links {
+		attrs := link.Attrs()
+		w.links[attrs.Index] = linkState{name: attrs.Name, up: attrs.Flags&net.FlagUp != 0}
+	}
+	done := make(chan struct{})
+	w.done = done
+	w.stopped = false
+	w.mu.Unlock()
+
+	linkCh := make(chan netlink.LinkUpdate)
+	addrCh := make(chan netlink.AddrUpdate)
+	onError := func(err error) {
+		log.Errorf(`[nftables] iface watcher: %v`, err)
+	}
+	err = netlink.LinkSubscribeWithOptions(linkCh, done, netlink.LinkSubscribeOptions{
+		Namespace:     &ns,
+		ErrorCallback: onError,
+	})
+	if err != nil {
+		w.Stop()
+		return fmt.Errorf(`failed to subscribe links: %w`, err)
+	}
+	err = netlink.AddrSubscribeWithOptions(addrCh, done, netlink.AddrSubscribeOptions{
+		Namespace:     &ns,
+		ErrorCallback: onError,
+	})
+	if err != nil {
+		w.Stop()
+		return fmt.Errorf(`failed to subscribe addresses: %w`, err)
+	}
+
+	go func() {
+		for {
+			select {
+			case u, ok := <-linkCh:
+				if !ok {
+					return
+				}
+				w.handleLink(u)
+			case u, ok := <-addrCh:
+				if !ok {
+					return
+				}
+				w.handleAddr(u)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop watching. Pending reapplies are canceled, no reapply starts after
+// Stop returns.
+func (w *IfaceWatcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopLocked()
+}
+
+func (w *IfaceWatcher) stopLocked() {
+	w.stopped = true
+	if w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+	for iface, timer := range w.timers {
+		timer.Stop()
+		delete(w.timers, iface)
+	}
+}
+
+func (w *IfaceWatcher) handleLink(u netlink.LinkUpdate) {
+	attrs := u.Link.Attrs()
+	curr := linkState{name: attrs.Name, up: attrs.Flags&net.FlagUp != 0}
+
+	w.mu.Lock()
+	prev, known := w.links[attrs.Index]
+	if u.Header.Type == unix.RTM_DELLINK {
+		delete(w.links, attrs.Index)
+	} else {
+		w.links[attrs.Index] = curr
+	}
+	w.mu.Unlock()
+
+	event := IfaceEvent{Iface: curr.name, Index: attrs.Index, Up: curr.up}
+	switch {
+	case u.Header.Type == unix.RTM_DELLINK:
+		event.Type = IfaceEventRemove
+		w.emit(event)
+		return
+	case !known:
+		event.Type = IfaceEventAdd
+	case prev.name != curr.name:
+		event.Type = IfaceEventRename
+		event.OldName = prev.name
+	case !prev.up && curr.up:
+		event.Type = IfaceEventUp
+	case prev.up && !curr.up:
+		event.Type = IfaceEventDown
+		w.emit(event)
+		return
+	default:
+		return
+	}
+	w.emit(event)
+	if event.Type == IfaceEventRename {
+		w.schedule(event.OldName)
+	}
+	w.schedule(event.Iface)
+}
+
+func (w *IfaceWatcher) handleAddr(u netlink.AddrUpdate) {
+	w.mu.Lock()
+	state, known := w.links[u.LinkIndex]
+	w.mu.Unlock()
+	if !known {
+		return
+	}
+	addr := u.LinkAddress
+	event := IfaceEvent{
+		Type:  IfaceEventAddrDel,
+		Iface: state.name,
+		Index: u.LinkIndex,
+		Up:    state.up,
+		Addr:  &addr,
+	}
+	if u.NewAddr {
+		event.Type = IfaceEventAddrAdd
+	}
+	w.emit(event)
+	w.schedule(event.Iface)
+}
+
+// watches reports whether the rules of iface are managed by nft.
+func (w *IfaceWatcher) watches(iface string) bool {
+	if len(iface) == 0 {
+		return false
+	}
+	return w.nft.isWanIface(iface) || iface == w.nft.myIface || inStrings(w.nft.cfg.Ifaces, iface)
+}
+
+func (w *IfaceWatcher) schedule(iface string) {
+	if !w.watches(iface) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	if timer, ok := w.timers[iface]; ok {
+		timer.Reset(w.debounce)
+		return
+	}
+	w.timers[iface] = time.AfterFunc(w.debounce, func() {
+		w.mu.Lock()
+		// the timer may have fired before Stop stopped it
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		delete(w.timers, iface)
+		w.mu.Unlock()
+		err := w.reapply(iface)
+		if err != nil {
+			log.Errorf(`[nftables] failed to reapply rules of %q: %v`, iface, err)
+		}
+		w.emit(IfaceEvent{Type: IfaceEventReapplied, Iface: iface, Err: err})
+	})
+}
+
+func (w *IfaceWatcher) emit(event IfaceEvent) {
+	for _, h := range w.handlers {
+		h(event)
+	}
+	select {
+	case w.events <- event:
+	default:
+		log.Warnf(`[nftables] iface watcher: event channel is full, %s event of %q dropped`, event.Type, event.Iface)
+	}
+}
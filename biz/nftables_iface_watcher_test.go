@@ -0,0 +1,124 @@
+package biz
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func testLinkUpdate(msgType uint16, index int, name string, up bool) netlink.LinkUpdate {
+	la := netlink.NewLinkAttrs()
+	la.Index = index
+	la.Name = name
+	if up {
+		la.Flags = net.FlagUp
+	}
+	u := netlink.LinkUpdate{Link: &netlink.Dummy{LinkAttrs: la}}
+	u.Header.Type = msgType
+	return u
+}
+
+func TestIfaceWatcherEvents(t *testing.T) {
+	nft := New(nftables.TableFamilyIPv4, Config{Ifaces: []string{`wg0`}}, nil)
+	nft.wanIface = `eth0`
+	w := NewIfaceWatcher(nft, 20*time.Millisecond)
+
+	var mu sync.Mutex
+	reapplied := map[string]int{}
+	w.reapply = func(iface string) error {
+		mu.Lock()
+		reapplied[iface]++
+		mu.Unlock()
+		return nil
+	}
+
+	w.links[1] = linkState{name: `eth0`, up: true}
+
+	// wg0 is recreated: the burst of events results in one reapply
+	w.handleLink(testLinkUpdate(unix.RTM_NEWLINK, 5, `wg0`, false))
+	w.handleLink(testLinkUpdate(unix.RTM_NEWLINK, 5, `wg0`, true))
+	w.handleAddr(netlink.AddrUpdate{
+		LinkIndex:   5,
+		NewAddr:     true,
+		LinkAddress: net.IPNet{IP: net.ParseIP(`10.0.0.1`), Mask: net.CIDRMask(24, 32)},
+	})
+	// untracked link
+	w.handleLink(testLinkUpdate(unix.RTM_NEWLINK, 6, `veth1`, true))
+	w.handleLink(testLinkUpdate(unix.RTM_NEWLINK, 1, `eth0`, false))
+	w.handleLink(testLinkUpdate(unix.RTM_DELLINK, 6, `veth1`, true))
+
+	var types []IfaceEventType
+	timeout := time.After(time.Second)
+	for len(types) < 7 {
+		select {
+		case e := <-w.Events():
+			types = append(types, e.Type)
+			if e.Type == IfaceEventReapplied {
+				assert.Equal(t, `wg0`, e.Iface)
+				assert.NoError(t, e.Err)
+			}
+		case <-timeout:
+			t.Fatalf(`timed out, got events: %v`, types)
+		}
+	}
+	assert.Equal(t, []IfaceEventType{
+		IfaceEventAdd, IfaceEventUp, IfaceEventAddrAdd,
+		IfaceEventAdd, IfaceEventDown, IfaceEventRemove,
+		IfaceEventReapplied,
+	}, types)
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{`wg0`: 1}, reapplied)
+	mu.Unlock()
+
+	w.handleLink(testLinkUpdate(unix.RTM_NEWLINK, 5, `wg1`, true))
+	e := <-w.Events()
+	assert.Equal(t, IfaceEventRename, e.Type)
+	assert.Equal(t, `wg0`, e.OldName)
+	assert.Equal(t, `wg1`, e.Iface)
+	w.Stop()
+}
+
+func TestIfaceWatcherStopFiredTimer(t *testing.T) {
+	nft := New(nftables.TableFamilyIPv4, Config{Ifaces: []string{`wg0`}}, nil)
+	w := NewIfaceWatcher(nft, time.Millisecond)
+	var mu sync.Mutex
+	var reapplied int
+	w.reapply = func(iface string) error {
+		mu.Lock()
+		reapplied++
+		mu.Unlock()
+		return nil
+	}
+
+	// the timer fires and waits for the lock held by Stop
+	w.schedule(`wg0`)
+	w.mu.Lock()
+	time.Sleep(20 * time.Millisecond)
+	w.stopLocked()
+	w.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 0, reapplied)
+	mu.Unlock()
+
+	// no reapply is scheduled after Stop
+	w.schedule(`wg0`)
+	w.mu.Lock()
+	assert.Empty(t, w.timers)
+	w.mu.Unlock()
+}
+
+func TestIfaceRuleID(t *testing.T) {
+	id := ifaceRuleID(`input_icmp`, `eth0`)
+	assert.Equal(t, []byte(`input_icmp@eth0`), id)
+	assert.True(t, isIfaceRuleID(id, `eth0`))
+	assert.False(t, isIfaceRuleID(id, `th0`))
+	assert.False(t, isIfaceRuleID([]byte(`001`), `eth0`))
+}
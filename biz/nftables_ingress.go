@@ -0,0 +1,85 @@
+package biz
+
+import (
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ingressDevices returns the devices having an ingress chain: the WAN
+// interfaces if EarlyDrop is enabled and the interfaces of the mirrors.
+func (nft *NFTables) ingressDevices() []string {
+	var devices []string
+	if nft.cfg.EarlyDrop {
+		devices = append(devices, nft.wanIfaces()...)
+	}
+	for _, m := range nft.cfg.Mirrors {
+		if len(m.Gateway) == 0 && len(m.Iface) > 0 && !inStrings(devices, m.Iface) {
+			devices = append(devices, m.Iface)
+		}
+	}
+	return devices
+}
+
+// ingressTable returns the netdev table of the firewall. The netdev tables of
+// the IPv4 and IPv6 firewalls are named ingress and ingress6, their rules only
+// match the packets of their family.
+func (nft *NFTables) ingressTable() *nftables.Table {
+	name := TableIngress
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		name += `6`
+	}
+	return &nftables.Table{
+		Family: nftables.TableFamilyNetdev,
+		Name:   nft.cfg.TablePrefix + name + nft.cfg.TableSuffix,
+	}
+}
+
+// initIngress creates the netdev table and the ingress chains of the devices.
+func (nft *NFTables) initIngress() {
+	nft.tIngress, nft.cIngress, nft.ingressSetBlacklistIP = nil, nil, nil
+	devices := nft.ingressDevices()
+	if len(devices) == 0 {
+		return
+	}
+	nft.tIngress = nft.ingressTable()
+	for _, device := range devices {
+		chain := &nftables.Chain{
+			Name:     ChainIngress + `_` + device,
+			Table:    nft.tIngress,
+			Type:     nftables.ChainTypeFilter,
+			Priority: nftables.ChainPriorityFilter,
+			Hooknum:  nftables.ChainHookIngress,
+			Device:   device,
+		}
+		nft.cIngress = append(nft.cIngress, chain)
+	}
+	nft.tables = append(nft.tables, nft.tIngress)
+	nft.chains = append(nft.chains, nft.cIngress...)
+	if nft.cfg.EarlyDrop {
+		// sets are local to their table, the blacklist is mirrored by Ban
+		set := *nft.filterSetBlacklistIP
+		set.Table = nft.tIngress
+		nft.ingressSetBlacklistIP = &set
+	}
+}
+
+// ingressChain returns the ingress chain of device, nil if it has none.
+func (nft *NFTables) ingressChain(device string) *nftables.Chain {
+	for _, chain := range nft.cIngress {
+		if chain.Device == device {
+			return chain
+		}
+	}
+	return nil
+}
+
+// ingressProtocolExprs returns the expressions matching the packets of the
+// table family in the ingress chains.
+func (nft *NFTables) ingressProtocolExprs() []expr.Any {
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		return utils.SetMetaProtocol(unix.ETH_P_IPV6)
+	}
+	return utils.SetMetaProtocol(unix.ETH_P_IP)
+}
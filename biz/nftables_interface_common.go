@@ -7,29 +7,29 @@ import (
 )
 
 func (nft *NFTables) applyCommonRules(c *nftables.Conn, iface string) error {
-	err := nft.inputHostBaseRules(c, nft.wanIface)
+	err := nft.inputHostBaseRules(c, iface)
 	if err != nil {
-		return fmt.Errorf(`nft.inputHostBaseRules(%q): %w`, nft.wanIface, err)
+		return fmt.Errorf(`nft.inputHostBaseRules(%q): %w`, iface, err)
 	}
-	err = nft.outputHostBaseRules(c, nft.wanIface)
+	err = nft.outputHostBaseRules(c, iface)
 	if err != nil {
-		return fmt.Errorf(`nft.outputHostBaseRules(%q): %w`, nft.wanIface, err)
+		return fmt.Errorf(`nft.outputHostBaseRules(%q): %w`, iface, err)
 	}
-	err = nft.inputTrustIPSetRules(c, nft.wanIface)
+	err = nft.inputTrustIPSetRules(c, iface)
 	if err != nil {
-		return fmt.Errorf(`nft.inputTrustIPSetRules(%q): %w`, nft.wanIface, err)
+		return fmt.Errorf(`nft.inputTrustIPSetRules(%q): %w`, iface, err)
 	}
-	err = nft.outputTrustIPSetRules(c, nft.wanIface)
+	err = nft.outputTrustIPSetRules(c, iface)
 	if err != nil {
-		return fmt.Errorf(`nft.outputTrustIPSetRules(%q): %w`, nft.wanIface, err)
+		return fmt.Errorf(`nft.outputTrustIPSetRules(%q): %w`, iface, err)
 	}
-	err = nft.inputPublicRules(c, nft.wanIface)
+	err = nft.inputPublicRules(c, iface)
 	if err != nil {
-		return fmt.Errorf(`nft.inputPublicRules(%q): %w`, nft.wanIface, err)
+		return fmt.Errorf(`nft.inputPublicRules(%q): %w`, iface, err)
 	}
-	err = nft.outputPublicRules(c, nft.wanIface)
+	err = nft.outputPublicRules(c, iface)
 	if err != nil {
-		err = fmt.Errorf(`nft.outputPublicRules(%q): %w`, nft.wanIface, err)
+		err = fmt.Errorf(`nft.outputPublicRules(%q): %w`, iface, err)
 	}
 	return err
 }
@@ -31,11 +31,12 @@ func (nft *NFTables) inputHostBaseRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_icmp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// DNS
 	if err = nft.inputDNSRules(c, iface); err != nil {
@@ -74,11 +75,12 @@ func (nft *NFTables) outputHostBaseRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.ExprAccept())
 
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_icmp`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// DNS
 	if err = nft.outputDNSRules(c, iface); err != nil {
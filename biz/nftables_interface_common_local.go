@@ -16,11 +16,12 @@ func (nft *NFTables) inputLocalIfaceRules(c *nftables.Conn) {
 	exprs = append(exprs, utils.SetIIF(loIface)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: []byte(`input_lo`),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter input meta iifname != "lo" \
 	// ip saddr 127.0.0.0/8 reject
@@ -46,11 +47,12 @@ func (nft *NFTables) inputLocalIfaceRules(c *nftables.Conn) {
 		))
 	}
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: []byte(`input_lo_spoof`),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 }
 
 // outputLocalIfaceRules to apply.
@@ -62,9 +64,10 @@ func (nft *NFTables) outputLocalIfaceRules(c *nftables.Conn) {
 	exprs = append(exprs, utils.SetOIF(loIface)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: []byte(`output_lo`),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 }
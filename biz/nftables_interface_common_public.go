@@ -22,11 +22,12 @@ func (nft *NFTables) inputPublicRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.SetDPort(nft.myPort)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_public`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	return nil
 }
@@ -47,11 +48,12 @@ func (nft *NFTables) outputPublicRules(c *nftables.Conn, iface string) error {
 	exprs = append(exprs, utils.SetSPort(nft.myPort)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_public`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	return nil
 }
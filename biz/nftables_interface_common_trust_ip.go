@@ -33,11 +33,12 @@ func (nft *NFTables) inputTrustIPSetRules(c *nftables.Conn, iface string) error
 	exprs = append(exprs, utils.SetConntrackStateNew()...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_trust_ping`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	// cmd: nft add rule ip filter input meta iifname "eth0" \
 	// ip protocol tcp tcp dport { 5522 } ip saddr @trust_ipset \
@@ -70,11 +71,12 @@ func (nft *NFTables) inputTrustIPSetRules(c *nftables.Conn, iface string) error
 	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule = &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cInput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_trust_ports`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	return nil
 }
@@ -108,11 +110,12 @@ func (nft *NFTables) outputTrustIPSetRules(c *nftables.Conn, iface string) error
 	exprs = append(exprs, utils.SetConntrackStateEstablished()...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cOutput,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_trust_ports`, iface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 
 	return nil
 }
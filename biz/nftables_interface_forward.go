@@ -18,7 +18,7 @@ func (nft *NFTables) forwardInterfaceRules(c *nftables.Conn) error {
 	// accept
 	// --
 	// iifname "wg0" oifname "eth0" accept;
-	{
+	for _, wanIface := range nft.wanIfaces() {
 		exprs := make([]expr.Any, 0, 10)
 		exprs = append(exprs, utils.SetIIF(nft.myIface)...)
 		switch nft.tableFamily {
@@ -27,14 +27,15 @@ func (nft *NFTables) forwardInterfaceRules(c *nftables.Conn) error {
 		case nftables.TableFamilyIPv6:
 			exprs = append(exprs, utils.SetSAddrIPv6Set(nft.filterSetForwardIP)...)
 		}
-		exprs = append(exprs, utils.SetOIF(nft.wanIface)...)
+		exprs = append(exprs, utils.SetOIF(wanIface)...)
 		exprs = append(exprs, utils.ExprAccept())
 		rule := &nftables.Rule{
-			Table: nft.tFilter,
-			Chain: nft.cForward,
-			Exprs: exprs,
+			Table:    nft.tFilter,
+			Chain:    nft.cForward,
+			Exprs:    exprs,
+			UserData: ifaceRuleID(`forward_out_`+wanIface, nft.myIface),
 		}
-		c.AddRule(rule)
+		nft.addRule(c, rule)
 	}
 
 	// cmd: nft add rule ip filter forward \
@@ -48,9 +49,9 @@ func (nft *NFTables) forwardInterfaceRules(c *nftables.Conn) error {
 		return err
 	}
 
-	{
+	for _, wanIface := range nft.wanIfaces() {
 		exprs := make([]expr.Any, 0, 10)
-		exprs = append(exprs, utils.SetIIF(nft.wanIface)...)
+		exprs = append(exprs, utils.SetIIF(wanIface)...)
 		switch nft.tableFamily {
 		case nftables.TableFamilyIPv4:
 			exprs = append(exprs, utils.SetDAddrSet(nft.filterSetForwardIP)...)
@@ -61,11 +62,12 @@ func (nft *NFTables) forwardInterfaceRules(c *nftables.Conn) error {
 		exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
 		exprs = append(exprs, utils.ExprAccept())
 		rule := &nftables.Rule{
-			Table: nft.tFilter,
-			Chain: nft.cForward,
-			Exprs: exprs,
+			Table:    nft.tFilter,
+			Chain:    nft.cForward,
+			Exprs:    exprs,
+			UserData: ifaceRuleID(`forward_in_`+wanIface, nft.myIface),
 		}
-		c.AddRule(rule)
+		nft.addRule(c, rule)
 	}
 
 	// cmd: nft add rule ip filter forward \
@@ -79,10 +81,11 @@ func (nft *NFTables) forwardInterfaceRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.SetOIF(nft.myIface)...)
 	exprs = append(exprs, utils.ExprAccept())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cForward,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cForward,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`forward_self`, nft.myIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
@@ -6,8 +6,9 @@ import (
 	"github.com/google/nftables/expr"
 )
 
-func (nft *NFTables) natInterfaceRules(c *nftables.Conn) error {
-	if len(nft.wanIface) == 0 || len(nft.wanIP) == 0 || nft.wanIP.IsUnspecified() {
+func (nft *NFTables) natInterfaceRules(c *nftables.Conn, wanIface string) error {
+	wanIP := nft.wanIPOf(wanIface)
+	if len(wanIface) == 0 || len(wanIP) == 0 || wanIP.IsUnspecified() {
 		return nil
 	}
 
@@ -16,8 +17,8 @@ func (nft *NFTables) natInterfaceRules(c *nftables.Conn) error {
 	// --
 	// oifname "eth0" snat to 192.168.15.11
 	exprs := make([]expr.Any, 0, 10)
-	exprs = append(exprs, utils.SetOIF(nft.wanIface)...)
-	exprs = append(exprs, utils.ExprImmediate(1, nft.wanIP))
+	exprs = append(exprs, utils.SetOIF(wanIface)...)
+	exprs = append(exprs, utils.ExprImmediate(1, wanIP))
 	switch nft.tNAT.Family {
 	case nftables.TableFamilyIPv4:
 		exprs = append(exprs, utils.ExprSNAT(1, 0))
@@ -25,10 +26,11 @@ func (nft *NFTables) natInterfaceRules(c *nftables.Conn) error {
 		exprs = append(exprs, utils.ExprSNATv6(1, 0))
 	}
 	rule := &nftables.Rule{
-		Table: nft.tNAT,
-		Chain: nft.cPostrouting,
-		Exprs: exprs,
+		Table:    nft.tNAT,
+		Chain:    nft.cPostrouting,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`nat_snat`, wanIface),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
@@ -0,0 +1,255 @@
+package biz
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultKnockTimeout = 10 * time.Second
+	managerKnockName    = `manager`
+)
+
+// knockSequence is a port knocking sequence and its staged sets, the sources
+// which knocked the step i are added to sets[i] until its timeout. The last
+// set holds the sources granted access.
+type knockSequence struct {
+	name  string
+	steps []KnockStep
+	sets  []*nftables.Set
+}
+
+func (k *knockSequence) grantSet() *nftables.Set {
+	return k.sets[len(k.sets)-1]
+}
+
+// ruleID returns the ID of the rule of the step i.
+func (k *knockSequence) ruleID(i int) string {
+	return `knock_` + k.name + `_` + strconv.Itoa(i+1)
+}
+
+// resetRuleID returns the ID of the rule resetting the progress of the step i.
+func (k *knockSequence) resetRuleID(i int) string {
+	return `knock_` + k.name + `_reset_` + strconv.Itoa(i+1)
+}
+
+func serviceKnockName(svc *Service) string {
+	return `svc_` + svc.Name
+}
+
+func validateKnock(steps []KnockStep) error {
+	for i, step := range steps {
+		if step.Port == 0 {
+			return fmt.Errorf(`knock step %d: port is required`, i+1)
+		}
+		if _, err := serviceProtocol(step.Protocol); err != nil {
+			return fmt.Errorf(`knock step %d: %w`, i+1, err)
+		}
+	}
+	return nil
+}
+
+// initKnock creates the staged dynamic sets of the port knocking sequences.
+func (nft *NFTables) initKnock() {
+	nft.knocks = map[string]*knockSequence{}
+	if len(nft.cfg.ManagerKnock) > 0 && len(nft.managerPorts) > 0 {
+		nft.newKnockSequence(managerKnockName, nft.cfg.ManagerKnock)
+	}
+	for i := range nft.cfg.Services {
+		svc := &nft.cfg.Services[i]
+		if len(svc.Knock) > 0 {
+			nft.newKnockSequence(serviceKnockName(svc), svc.Knock)
+		}
+	}
+}
+
+func (nft *NFTables) newKnockSequence(name string, steps []KnockStep) {
+	keyType := nftables.TypeIPAddr
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	seq := &knockSequence{name: name, steps: steps, sets: make([]*nftables.Set, len(steps))}
+	for i, step := range steps {
+		timeout := step.Timeout
+		if timeout <= 0 {
+			timeout = defaultKnockTimeout
+		}
+		seq.sets[i] = &nftables.Set{
+			Name:       `knock_` + name + `_` + strconv.Itoa(i+1),
+			Table:      nft.tFilter,
+			KeyType:    keyType,
+			Dynamic:    true,
+			HasTimeout: true,
+			Timeout:    timeout,
+		}
+	}
+	nft.knocks[name] = seq
+	nft.sets = append(nft.sets, seq.sets...)
+}
+
+// knockGrantExprs returns the expressions matching the sources granted access
+// by the sequence, nil if there is no such sequence.
+func (nft *NFTables) knockGrantExprs(name string) []expr.Any {
+	seq, ok := nft.knocks[name]
+	if !ok {
+		return nil
+	}
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		return utils.SetSAddrIPv6Set(seq.grantSet())
+	}
+	return utils.SetSAddrSet(seq.grantSet())
+}
+
+// knockRules adds the sources knocking the steps in order to the staged sets,
+// a new connection to another port removes them. The knocks are dropped,
+// iface restricts the knocks to an interface if set.
+func (nft *NFTables) knockRules(c *nftables.Conn, seq *knockSequence, chain *nftables.Chain, iface string) error {
+	if err := validateKnock(seq.steps); err != nil {
+		return err
+	}
+	for i, step := range seq.steps {
+		if err := nft.addSet(c, seq.sets[i], nil); err != nil {
+			return fmt.Errorf(`nft.AddSet(%q): %w`, seq.sets[i].Name, err)
+		}
+		// cmd: nft add rule ip filter input tcp dport 7000 add @knock_manager_1 { ip saddr } drop
+		// cmd: nft add rule ip filter input tcp dport 8000 ip saddr @knock_manager_1 \
+		// add @knock_manager_2 { ip saddr } drop
+		exprs := make([]expr.Any, 0, 12)
+		if len(iface) > 0 {
+			exprs = append(exprs, utils.SetIIF(iface)...)
+		}
+		protocol, _ := serviceProtocol(step.Protocol)
+		if protocol == unix.IPPROTO_UDP {
+			exprs = append(exprs, utils.SetProtoUDP()...)
+		} else {
+			exprs = append(exprs, utils.SetProtoTCP()...)
+		}
+		exprs = append(exprs, utils.SetDPort(step.Port)...)
+		if i > 0 {
+			if nft.tableFamily == nftables.TableFamilyIPv6 {
+				exprs = append(exprs, utils.SetSAddrIPv6Set(seq.sets[i-1])...)
+			} else {
+				exprs = append(exprs, utils.SetSAddrSet(seq.sets[i-1])...)
+			}
+		}
+		exprs = append(exprs, utils.SetAddSAddrToSet(seq.sets[i], 0)...)
+		exprs = append(exprs, utils.Drop())
+		id := []byte(seq.ruleID(i))
+		if len(iface) > 0 {
+			id = ifaceRuleID(seq.ruleID(i), iface)
+		}
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: id,
+		}
+		nft.addRule(c, rule)
+	}
+
+	// the new connections matching no step are wrong knocks, the progress of
+	// their source is reset. The grant set is kept.
+	// cmd: nft add rule ip filter input ct state new ip saddr @knock_manager_1 \
+	// delete @knock_manager_1 { ip saddr }
+	for i, set := range seq.sets[:len(seq.sets)-1] {
+		exprs := make([]expr.Any, 0, 10)
+		if len(iface) > 0 {
+			exprs = append(exprs, utils.SetIIF(iface)...)
+		}
+		exprs = append(exprs, utils.SetConntrackStateNew()...)
+		if nft.tableFamily == nftables.TableFamilyIPv6 {
+			exprs = append(exprs, utils.SetSAddrIPv6Set(set)...)
+		} else {
+			exprs = append(exprs, utils.SetSAddrSet(set)...)
+		}
+		exprs = append(exprs, utils.SetDelSAddrFromSet(set)...)
+		id := []byte(seq.resetRuleID(i))
+		if len(iface) > 0 {
+			id = ifaceRuleID(seq.resetRuleID(i), iface)
+		}
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    chain,
+			Exprs:    exprs,
+			UserData: id,
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
+
+// managerKnockRules opens the manager ports on MyIface to the sources which
+// knocked the manager sequence.
+func (nft *NFTables) managerKnockRules(c *nftables.Conn) error {
+	seq, ok := nft.knocks[managerKnockName]
+	if !ok {
+		return nil
+	}
+	if err := nft.knockRules(c, seq, nft.cInput, nft.myIface); err != nil {
+		return fmt.Errorf(`manager: %w`, err)
+	}
+	ports := servicePorts{protocol: unix.IPPROTO_TCP, ports: nft.managerPorts}
+
+	// cmd: nft add rule ip filter input meta iifname "wg0" \
+	// tcp dport { 80, 8080 } ip saddr @knock_manager_2 \
+	// ct state { new, established } accept
+	exprs := make([]expr.Any, 0, 14)
+	exprs = append(exprs, utils.SetIIF(nft.myIface)...)
+	portExprs, err := nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, nft.knockGrantExprs(managerKnockName)...)
+	ctStateSet := utils.GetConntrackStateSet(nft.tFilter)
+	err = c.AddSet(ctStateSet, utils.GetConntrackStateSetElems(defaultStateWithNew))
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule := &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cInput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`input_sdn_manager_knock`, nft.myIface),
+	}
+	nft.addRule(c, rule)
+
+	// the access may expire before the connections are closed, so the replies
+	// are accepted by their ct state only.
+	// cmd: nft add rule ip filter output meta oifname "wg0" \
+	// tcp sport { 80, 8080 } ct state established accept
+	exprs = make([]expr.Any, 0, 10)
+	exprs = append(exprs, utils.SetOIF(nft.myIface)...)
+	portExprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionSource)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, utils.SetConntrackStateEstablished()...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cOutput,
+		Exprs:    exprs,
+		UserData: ifaceRuleID(`output_sdn_manager_knock`, nft.myIface),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
+
+// serviceKnockRules adds the knocking steps of the service.
+func (nft *NFTables) serviceKnockRules(c *nftables.Conn, svc *Service) error {
+	seq, ok := nft.knocks[serviceKnockName(svc)]
+	if !ok {
+		return nil
+	}
+	return nft.knockRules(c, seq, nft.serviceChain(svc), ``)
+}
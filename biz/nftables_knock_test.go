@@ -0,0 +1,140 @@
+package biz
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKnockConfig() Config {
+	return Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		MyIface:       `wg0`,
+		ManagerKnock: []KnockStep{
+			{Port: 7000, Timeout: 5 * time.Second},
+			{Protocol: `udp`, Port: 8000},
+			{Port: 9000, Timeout: time.Minute},
+		},
+		Services: []Service{
+			{Name: `ssh`, Ports: []uint16{22}, Knock: []KnockStep{{Port: 1234}, {Port: 2345, Timeout: 30 * time.Second}}},
+			{Name: `web`, Ports: []uint16{80}},
+		},
+	}
+}
+
+func TestManagerKnockRules(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testKnockConfig(), nil, RULE_SDN, 8080)
+
+	sets, err := k.Sets(nft.tFilter)
+	assert.NoError(t, err)
+	timeouts := map[string]time.Duration{}
+	for _, set := range sets {
+		if set.Dynamic {
+			assert.True(t, set.HasTimeout)
+			timeouts[set.Name] = set.Timeout
+		}
+	}
+	assert.Equal(t, map[string]time.Duration{
+		`knock_manager_1`: 5 * time.Second,
+		`knock_manager_2`: defaultKnockTimeout,
+		`knock_manager_3`: time.Minute,
+	}, timeouts)
+
+	ids := ruleIDsOf(t, k, nft.cInput)
+	assert.Subset(t, ids, []string{
+		`knock_manager_1@wg0`, `knock_manager_2@wg0`, `knock_manager_3@wg0`,
+		`knock_manager_reset_1@wg0`, `knock_manager_reset_2@wg0`,
+		`input_sdn_manager_knock@wg0`,
+	})
+	assert.NotContains(t, ids, `knock_manager_reset_3@wg0`)
+	assert.Contains(t, ruleIDsOf(t, k, nft.cOutput), `output_sdn_manager_knock@wg0`)
+
+	// the first step adds the knocking source, the next steps require the previous one
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`knock_manager_1@wg0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, `knock_manager_1`, r.Exprs[len(r.Exprs)-2].(*expr.Dynset).SetName)
+		for _, e := range r.Exprs {
+			_, ok := e.(*expr.Lookup)
+			assert.False(t, ok)
+		}
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`knock_manager_2@wg0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1}, r.Exprs[2])
+		assert.Equal(t, `knock_manager_1`, r.Exprs[len(r.Exprs)-4].(*expr.Lookup).SetName)
+		assert.Equal(t, `knock_manager_2`, r.Exprs[len(r.Exprs)-2].(*expr.Dynset).SetName)
+		assert.Equal(t, expr.VerdictDrop, r.Exprs[len(r.Exprs)-1].(*expr.Verdict).Kind)
+	}
+	// a wrong knock removes the source from the staged set, the new
+	// connections which reach the reset rules matched no step
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`knock_manager_reset_2@wg0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		n := len(r.Exprs)
+		assert.Equal(t, utils.SetIIF(`wg0`), utils.Exprs(r.Exprs[:2]))
+		assert.Equal(t, utils.SetConntrackStateNew(), utils.Exprs(r.Exprs[2:5]))
+		assert.Equal(t, `knock_manager_2`, r.Exprs[n-3].(*expr.Lookup).SetName)
+		dynset := r.Exprs[n-1].(*expr.Dynset)
+		assert.Equal(t, `knock_manager_2`, dynset.SetName)
+		assert.Equal(t, uint32(utils.DynsetOpDelete), dynset.Operation)
+	}
+	assert.Less(t, slices.Index(ids, `knock_manager_3@wg0`), slices.Index(ids, `knock_manager_reset_1@wg0`))
+
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`input_sdn_manager_knock@wg0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		var lookups []string
+		for _, e := range r.Exprs {
+			if l, ok := e.(*expr.Lookup); ok {
+				lookups = append(lookups, l.SetName)
+			}
+		}
+		assert.Contains(t, lookups, `knock_manager_3`)
+	}
+
+	// the knocking rules of MyIface are regenerated
+	assert.NoError(t, nft.ReapplyIface(`wg0`))
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cInput))
+}
+
+func TestServiceKnockRules(t *testing.T) {
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		nft, k := applyTestNFTables(t, family, testKnockConfig(), nil, RULE_SERVICE)
+		assert.NotContains(t, nft.knocks, managerKnockName)
+
+		assert.Equal(t, []string{
+			`knock_svc_ssh_1`, `knock_svc_ssh_2`, `knock_svc_ssh_reset_1`, `service_ssh_tcp`,
+			`service_web_tcp`,
+		}, ruleIDsOf(t, k, nft.cInput))
+
+		keyType := nftables.TypeIPAddr
+		if family == nftables.TableFamilyIPv6 {
+			keyType = nftables.TypeIP6Addr
+		}
+		assert.Equal(t, keyType, nft.knocks[`svc_ssh`].grantSet().KeyType)
+		assert.Equal(t, 30*time.Second, nft.knocks[`svc_ssh`].grantSet().Timeout)
+
+		r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_ssh_tcp`))
+		assert.NoError(t, err)
+		if assert.NotNil(t, r) {
+			assert.Equal(t, `knock_svc_ssh_2`, r.Exprs[1].(*expr.Lookup).SetName)
+		}
+	}
+}
+
+func TestValidateKnock(t *testing.T) {
+	cfg := testKnockConfig()
+	cfg.Services[0].Knock[1].Port = 0
+	nft := New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateServices(), `service "ssh": knock step 2: port is required`)
+	cfg.Services[0].Knock[1] = KnockStep{Protocol: `icmp`, Port: 1}
+	assert.EqualError(t, nft.validateServices(), `service "ssh": knock step 2: unsupported protocol "icmp"`)
+}
@@ -0,0 +1,104 @@
+package biz
+
+import (
+	"fmt"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	defaultLogPrefix = `nft drop `
+	defaultLogRate   = `5/p/s`
+)
+
+// logExprs returns the rate-limited log expressions of the chain name.
+func (nft *NFTables) logExprs(name string) (utils.Exprs, error) {
+	rate := nft.cfg.LogRate
+	if len(rate) == 0 {
+		rate = defaultLogRate
+	}
+	limit, err := utils.ParseLimits(rate, nft.cfg.LogBurst)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid log rate %q: %w`, rate, err)
+	}
+	prefix := nft.cfg.LogPrefix
+	if len(prefix) == 0 {
+		prefix = defaultLogPrefix
+	}
+	prefix += strings.ToLower(name) + `: `
+	var log *expr.Log
+	if nft.cfg.LogGroup > 0 {
+		log = utils.ExprLogGroup(prefix, nft.cfg.LogGroup, 0, 0)
+	} else {
+		log = utils.ExprLog(prefix, expr.LogLevelWarning)
+	}
+	return utils.SetLog(log, limit), nil
+}
+
+func logDropRuleID(chain string) []byte {
+	return []byte(`log_drop_` + strings.ToLower(chain))
+}
+
+// logDropChains returns the filter chains with a drop policy.
+func (nft *NFTables) logDropChains() []*nftables.Chain {
+	var chains []*nftables.Chain
+	for _, chain := range []*nftables.Chain{nft.cInput, nft.cForward, nft.cOutput} {
+		if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// logDropRules appends a rate-limited log-and-drop rule to the end of the
+// filter chains with a drop policy.
+func (nft *NFTables) logDropRules(c *nftables.Conn) error {
+	if !nft.cfg.LogDrop {
+		return nil
+	}
+	for _, chain := range nft.logDropChains() {
+		// cmd: nft add rule ip filter input \
+		// limit rate 5/second log prefix "nft drop input: " drop
+		// --
+		// limit rate 5/second burst 5 packets log prefix "nft drop input: " drop
+		exprs, err := nft.logExprs(chain.Name)
+		if err != nil {
+			return err
+		}
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    chain,
+			Exprs:    exprs.Add(utils.Drop()),
+			UserData: logDropRuleID(chain.Name),
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
+
+// reappendLogDropRules moves the log-and-drop rules back to the end of the
+// chains after rules were appended to them.
+func (nft *NFTables) reappendLogDropRules(c *nftables.Conn) error {
+	if !nft.cfg.LogDrop {
+		return nil
+	}
+	for _, chain := range nft.logDropChains() {
+		rules, err := c.GetRules(chain.Table, chain)
+		if err != nil {
+			return fmt.Errorf(`failed to list rules of chain %q: %w`, chain.Name, err)
+		}
+		id := logDropRuleID(chain.Name)
+		for _, rule := range rules {
+			if string(rule.UserData) != string(id) {
+				continue
+			}
+			if err = c.DelRule(rule); err != nil {
+				return err
+			}
+		}
+	}
+	return nft.logDropRules(c)
+}
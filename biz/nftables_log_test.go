@@ -0,0 +1,123 @@
+package biz
+
+import (
+	"sync"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogDropRules(t *testing.T) {
+	cfg := Config{
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		LogDrop:        true,
+		LogRate:        `10/p/m`,
+	}
+	k := nftest.New()
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	err := nft.Do(func(c *nftables.Conn) error {
+		if err := nft.ApplyBase(c); err != nil {
+			return err
+		}
+		if err := nft.logDropRules(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+	require.NoError(t, err)
+
+	rules, err := k.Rules(nft.tFilter, nft.cInput)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, `log_drop_input`, string(rules[0].UserData))
+		limit := rules[0].Exprs[0].(*expr.Limit)
+		assert.Equal(t, uint64(10), limit.Rate)
+		assert.Equal(t, expr.LimitTimeMinute, limit.Unit)
+		log := rules[0].Exprs[1].(*expr.Log)
+		assert.Equal(t, `nft drop input: `, string(log.Data))
+		assert.Equal(t, expr.LogLevelWarning, log.Level)
+	}
+
+	// rules appended later are moved before the log-and-drop rule
+	err = nft.Do(func(c *nftables.Conn) error {
+		c.AddRule(&nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cInput,
+			Exprs:    utils.JoinExprs(utils.SetProtoTCP(), utils.SetDPort(22)).Add(utils.Accept()),
+			UserData: []byte(`ssh`),
+		})
+		if err := nft.reappendLogDropRules(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+	assert.NoError(t, err)
+	rules, err = k.Rules(nft.tFilter, nft.cInput)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 2) {
+		assert.Equal(t, `ssh`, string(rules[0].UserData))
+		assert.Equal(t, `log_drop_input`, string(rules[1].UserData))
+	}
+	for _, chain := range []*nftables.Chain{nft.cForward, nft.cOutput} {
+		rules, err = k.Rules(nft.tFilter, chain)
+		assert.NoError(t, err)
+		assert.Len(t, rules, 1)
+	}
+}
+
+func TestReapplyIfaceRuleOrder(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		LogDrop:        true,
+		Ifaces:         []string{`eth1`, `eth2`},
+		Services: []Service{
+			{Name: `ssh`, Ports: []uint16{22}},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_SERVICE)
+	ids := ruleIDsOf(t, k, nft.cInput)
+	assert.Contains(t, ids, `service_ssh_tcp`)
+
+	// the regenerated rules keep their place before the rules following them
+	assert.NoError(t, nft.ReapplyIface(`eth1`))
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cInput))
+	assert.NoError(t, nft.ReapplyIface(`eth2`))
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cInput))
+}
+
+func TestReapplyIfaceConcurrent(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		LogDrop:        true,
+		Ifaces:         []string{`eth1`, `eth2`},
+		Services: []Service{
+			{Name: `ssh`, Ports: []uint16{22}},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_SERVICE)
+	ids := ruleIDsOf(t, k, nft.cInput)
+
+	// the debounce timers of the interface watcher fire in their own goroutines
+	var wg sync.WaitGroup
+	for _, iface := range []string{`eth1`, `eth2`} {
+		wg.Add(1)
+		go func(iface string) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				assert.NoError(t, nft.ReapplyIface(iface))
+			}
+		}(iface)
+	}
+	wg.Wait()
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cInput))
+}
@@ -0,0 +1,203 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// hasGatewayMirror reports whether a mirror routes the copies to a gateway.
+func (nft *NFTables) hasGatewayMirror() bool {
+	for _, m := range nft.cfg.Mirrors {
+		if len(m.Gateway) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorService returns the declared service of the mirror.
+func (nft *NFTables) mirrorService(m *Mirror) *Service {
+	for i := range nft.cfg.Services {
+		if nft.cfg.Services[i].Name == m.Service {
+			return &nft.cfg.Services[i]
+		}
+	}
+	return nil
+}
+
+// validateMirrors checks the names, the interfaces, the services and the
+// rates of the mirrors.
+func (nft *NFTables) validateMirrors() error {
+	names := map[string]struct{}{}
+	for i := range nft.cfg.Mirrors {
+		m := &nft.cfg.Mirrors[i]
+		if len(m.Name) == 0 {
+			return fmt.Errorf(`mirror name is required`)
+		}
+		if _, ok := names[m.Name]; ok {
+			return fmt.Errorf(`duplicate mirror %q`, m.Name)
+		}
+		names[m.Name] = struct{}{}
+		if len(m.To) == 0 {
+			return fmt.Errorf(`mirror %q: destination interface is required`, m.Name)
+		}
+		if len(m.Gateway) == 0 && len(m.Iface) == 0 {
+			return fmt.Errorf(`mirror %q: interface is required without gateway`, m.Name)
+		}
+		if len(m.Gateway) > 0 && net.ParseIP(m.Gateway) == nil {
+			return fmt.Errorf(`mirror %q: invalid gateway %q`, m.Name, m.Gateway)
+		}
+		if len(m.Service) > 0 {
+			svc := nft.mirrorService(m)
+			if svc == nil {
+				return fmt.Errorf(`mirror %q: service %q not found`, m.Name, m.Service)
+			}
+			if _, err := servicePortsOf(svc); err != nil {
+				return fmt.Errorf(`mirror %q: %w`, m.Name, err)
+			}
+		}
+		if len(m.Rate) > 0 {
+			limit, err := utils.ParseLimits(m.Rate, 0)
+			if err == nil && limit.Over {
+				err = fmt.Errorf(`rate %q is not a cap`, m.Rate)
+			}
+			if err != nil {
+				return fmt.Errorf(`mirror %q: %w`, m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mirrorRules sends the copies of the packets matched by the mirrors, from the
+// ingress chains or, for the mirrors having a gateway, from the prerouting
+// chain of the filter table.
+func (nft *NFTables) mirrorRules(c *nftables.Conn) error {
+	if len(nft.cfg.Mirrors) == 0 {
+		return nil
+	}
+	if err := nft.validateMirrors(); err != nil {
+		return err
+	}
+	for i := range nft.cfg.Mirrors {
+		m := &nft.cfg.Mirrors[i]
+		if err := nft.mirrorRule(c, m); err != nil {
+			return fmt.Errorf(`mirror %q: %w`, m.Name, err)
+		}
+	}
+	return nil
+}
+
+func (nft *NFTables) mirrorRule(c *nftables.Conn, m *Mirror) error {
+	var gateway net.IP
+	if len(m.Gateway) > 0 {
+		gateway = net.ParseIP(m.Gateway)
+		if (gateway.To4() == nil) != (nft.tableFamily == nftables.TableFamilyIPv6) {
+			return nil
+		}
+	}
+	ifindex, err := utils.IfIndex(m.To)
+	if err != nil {
+		return err
+	}
+	table, chain := nft.tFilter, nft.cFilterPrerouting
+	var exprs []expr.Any
+	if gateway == nil {
+		// the ingress chain is removed with the device by some kernels
+		table, chain = nft.tIngress, nft.ingressChain(m.Iface)
+		c.AddChain(chain)
+		exprs = append(exprs, nft.ingressProtocolExprs()...)
+	} else if len(m.Iface) > 0 {
+		exprs = append(exprs, utils.SetIIF(m.Iface)...)
+	}
+	addrExprs, err := nft.zoneAddrSet(c, table, utils.ExprDirectionSource, m.Sources)
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	exprs = append(exprs, addrExprs...)
+
+	for _, ports := range nft.mirrorPorts(m) {
+		// cmd: nft add rule netdev ingress INGRESS_eth0 meta protocol ip \
+		// ip saddr { 10.0.0.0/8 } tcp dport { 80, 443 } limit rate 1000/second dup to "ids0"
+		// cmd: nft add rule ip filter PREROUTING iifname "eth0" \
+		// ip saddr { 10.0.0.0/8 } dup to 192.168.10.2 device "ids0"
+		ruleExprs := append([]expr.Any{}, exprs...)
+		if len(ports.ports) > 0 {
+			portExprs, err := nft.portSetExprs(c, table, ports, utils.ExprDirectionDestination)
+			if err != nil {
+				return err
+			}
+			ruleExprs = append(ruleExprs, portExprs...)
+		}
+		if len(m.Rate) > 0 {
+			limit, _ := utils.ParseLimits(m.Rate, 0)
+			ruleExprs = append(ruleExprs, limit)
+		}
+		if gateway == nil {
+			ruleExprs = append(ruleExprs, utils.SetDupToDev(ifindex)...)
+		} else {
+			ruleExprs = append(ruleExprs, utils.SetDupTo(gateway, ifindex)...)
+		}
+		rule := &nftables.Rule{
+			Table:    table,
+			Chain:    chain,
+			Exprs:    ruleExprs,
+			UserData: mirrorRuleID(m, ports),
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
+
+// mirrorPorts returns the ports of the service of the mirror, one entry
+// without port if it mirrors all the ports.
+func (nft *NFTables) mirrorPorts(m *Mirror) []servicePorts {
+	var list []servicePorts
+	if svc := nft.mirrorService(m); svc != nil {
+		list, _ = servicePortsOf(svc)
+	}
+	if len(list) == 0 {
+		list = append(list, servicePorts{})
+	}
+	return list
+}
+
+// mirrorIface returns the interface the rules of the mirror are generated for:
+// its interface, or the destination of the copies if it mirrors all of them.
+func mirrorIface(m *Mirror) string {
+	if len(m.Iface) > 0 {
+		return m.Iface
+	}
+	return m.To
+}
+
+// mirrorRuleID returns the ID of the rule of the mirror matching ports, e.g.
+// mirror_web_tcp@eth0.
+func mirrorRuleID(m *Mirror, ports servicePorts) []byte {
+	name := `mirror_` + m.Name
+	if len(ports.ports) > 0 {
+		name += `_` + ports.protocolName()
+	}
+	return ifaceRuleID(name, mirrorIface(m))
+}
+
+// ifaceMirrors returns the mirrors of iface or sending their copies to iface,
+// the index of the destination is in their rules.
+func (nft *NFTables) ifaceMirrors(iface string) []*Mirror {
+	var mirrors []*Mirror
+	for i := range nft.cfg.Mirrors {
+		m := &nft.cfg.Mirrors[i]
+		if m.Iface == iface || m.To == iface {
+			mirrors = append(mirrors, m)
+		}
+	}
+	return mirrors
+}
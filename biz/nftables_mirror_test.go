@@ -0,0 +1,106 @@
+package biz
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirrorRules(t *testing.T) {
+	lo, err := utils.IfIndex(loIface)
+	if err != nil {
+		t.Skip(err)
+	}
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		Services: []Service{
+			{Name: `web`, Ports: []uint16{80, 443}},
+			{Name: `ftp`, Helper: `ftp`},
+		},
+		Mirrors: []Mirror{
+			{Name: `web`, Iface: `eth0`, Sources: []string{`10.0.0.0/8`}, Service: `web`, To: loIface, Rate: `1000/p/s`},
+			{Name: `all`, Iface: `eth0`, To: loIface},
+			{Name: `ftp`, Iface: `eth1`, Service: `ftp`, To: loIface},
+			{Name: `remote`, Iface: `eth1`, To: loIface, Gateway: `192.168.10.2`},
+			{Name: `remote6`, To: loIface, Gateway: `2001:db8::2`},
+			{Name: `v6`, Iface: `eth0`, Sources: []string{`2001:db8::/32`}, To: loIface},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_MIRROR)
+	assert.Equal(t, `ingress`, nft.tIngress.Name)
+	assert.Equal(t, nftables.TableFamilyNetdev, nft.tIngress.Family)
+	assert.NotNil(t, nft.cFilterPrerouting)
+
+	// the mirrors of the other family are skipped
+	assert.Equal(t, []string{`mirror_web_tcp@eth0`, `mirror_all@eth0`}, ruleIDsOf(t, k, nft.ingressChain(`eth0`)))
+	assert.Equal(t, []string{`mirror_ftp_tcp@eth1`}, ruleIDsOf(t, k, nft.ingressChain(`eth1`)))
+	assert.Equal(t, []string{`mirror_remote@eth1`}, ruleIDsOf(t, k, nft.cFilterPrerouting))
+
+	r, err := k.RuleByID(nft.tIngress, nft.ingressChain(`eth0`), []byte(`mirror_web_tcp@eth0`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetMetaProtocol(0x0800), utils.Exprs(exprs[:2]))
+		n := len(exprs)
+		assert.Equal(t, &expr.Limit{Type: expr.LimitTypePkts, Rate: 1000, Unit: expr.LimitTimeSecond}, exprs[n-3])
+		assert.Equal(t, utils.SetDupToDev(lo), utils.Exprs(exprs[n-2:]))
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cFilterPrerouting, []byte(`mirror_remote@eth1`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := nft.appliedExprs(r)
+		assert.Equal(t, utils.SetIIF(`eth1`), utils.Exprs(exprs[:2]))
+		assert.Equal(t, &expr.Dup{RegAddr: 1, RegDev: 2, IsRegDevSet: true}, exprs[len(exprs)-1])
+	}
+
+	// the rules sending the copies to a recreated device get its new index,
+	// the rules of a recreated source are added again to its ingress chain
+	handles := map[string]uint64{}
+	for _, chain := range []*nftables.Chain{nft.ingressChain(`eth0`), nft.ingressChain(`eth1`), nft.cFilterPrerouting} {
+		rules, err := k.Rules(chain.Table, chain)
+		assert.NoError(t, err)
+		for _, r := range rules {
+			handles[string(r.UserData)] = r.Handle
+		}
+	}
+	for _, iface := range []string{loIface, `eth1`} {
+		assert.NoError(t, nft.ReapplyIface(iface))
+		assert.Equal(t, []string{`mirror_web_tcp@eth0`, `mirror_all@eth0`}, ruleIDsOf(t, k, nft.ingressChain(`eth0`)))
+		assert.Equal(t, []string{`mirror_ftp_tcp@eth1`}, ruleIDsOf(t, k, nft.ingressChain(`eth1`)))
+		assert.Equal(t, []string{`mirror_remote@eth1`}, ruleIDsOf(t, k, nft.cFilterPrerouting))
+	}
+	for _, chain := range []*nftables.Chain{nft.ingressChain(`eth0`), nft.ingressChain(`eth1`), nft.cFilterPrerouting} {
+		rules, err := k.Rules(chain.Table, chain)
+		assert.NoError(t, err)
+		for _, r := range rules {
+			assert.NotEqual(t, handles[string(r.UserData)], r.Handle, string(r.UserData))
+		}
+	}
+
+	nft6, k6 := applyTestNFTables(t, nftables.TableFamilyIPv6, cfg, nil, RULE_MIRROR)
+	assert.Equal(t, `ingress6`, nft6.tIngress.Name)
+	assert.Equal(t, []string{`mirror_all@eth0`, `mirror_v6@eth0`}, ruleIDsOf(t, k6, nft6.ingressChain(`eth0`)))
+	assert.Equal(t, []string{`mirror_remote6@` + loIface}, ruleIDsOf(t, k6, nft6.cFilterPrerouting))
+}
+
+func TestValidateMirrors(t *testing.T) {
+	for _, c := range []struct {
+		mirror Mirror
+		err    string
+	}{
+		{Mirror{To: `ids0`}, `mirror name is required`},
+		{Mirror{Name: `a`, Iface: `eth0`}, `mirror "a": destination interface is required`},
+		{Mirror{Name: `a`, To: `ids0`}, `mirror "a": interface is required without gateway`},
+		{Mirror{Name: `a`, To: `ids0`, Gateway: `ids`}, `mirror "a": invalid gateway "ids"`},
+		{Mirror{Name: `a`, Iface: `eth0`, To: `ids0`, Service: `web`}, `mirror "a": service "web" not found`},
+		{Mirror{Name: `a`, Iface: `eth0`, To: `ids0`, Rate: `10+/p/s`}, `mirror "a": rate "10+/p/s" is not a cap`},
+	} {
+		nft := New(nftables.TableFamilyIPv4, Config{Mirrors: []Mirror{c.mirror}}, nil)
+		assert.EqualError(t, nft.validateMirrors(), c.err)
+	}
+}
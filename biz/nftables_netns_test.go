@@ -0,0 +1,307 @@
+package biz
+
+import (
+	"context"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/admpub/nftablesutils/conntrack"
+	"github.com/admpub/nftablesutils/nflog"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestNetnsReachability(t *testing.T) {
+	n, err := nftest.NewNetwork(`nftest`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+
+	probes := []nftest.Probe{
+		{Proto: nftest.ProbeTCP, Port: 22},
+		{Proto: nftest.ProbeTCP, Port: 8080},
+		{Proto: nftest.ProbeTCP, Port: 3306},
+		{Proto: nftest.ProbeUDP, Port: 53},
+		{Proto: nftest.ProbeUDP, Port: 5353},
+		{Proto: nftest.ProbeICMP},
+	}
+	assert.NoError(t, n.Listen(probes...))
+	r := n.Probe(time.Second, probes...)
+	for _, p := range probes {
+		assert.True(t, r[p], p.String())
+	}
+
+	cfg := Config{
+		Enabled:          true,
+		NetworkNamespace: n.Host,
+		DefaultPolicy:    `drop`,
+		MyPort:           5353,
+		TrustPorts:       []uint16{22},
+		Applies:          []string{ApplyTypeDNS},
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil, 8080)
+	assert.Equal(t, n.HostIface, nft.wanIface)
+	assert.NoError(t, nft.ApplyDefault(RULE_ALL))
+	r = n.Probe(time.Second, probes...)
+	t.Log("\n" + r.String())
+	assert.Equal(t, nftest.Reachability{
+		probes[0]: false,
+		probes[1]: false,
+		probes[2]: false,
+		probes[3]: false,
+		probes[4]: true, // public port
+		probes[5]: false,
+	}, r)
+
+	assert.NoError(t, nft.UpdateTrustIPs(nil, []net.IP{n.PeerIP}))
+	r = n.Probe(time.Second, probes...)
+	t.Log("\n" + r.String())
+	assert.Equal(t, nftest.Reachability{
+		probes[0]: true, // trust port
+		probes[1]: false,
+		probes[2]: false,
+		probes[3]: false,
+		probes[4]: true,
+		probes[5]: true, // trust ping
+	}, r)
+
+	assert.NoError(t, nft.Cleanup())
+}
+
+func TestNetnsWanIfaceIP(t *testing.T) {
+	n, err := nftest.NewNetwork(`nftest`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+
+	// a WAN without default route only exists in the host namespace
+	wanIP := net.IPv4(10, 201, 0, 1).To4()
+	assert.NoError(t, n.InHost(func() error {
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: `wan1`}, PeerName: `wan1p`}
+		if err := netlink.LinkAdd(link); err != nil {
+			return err
+		}
+		return netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: wanIP, Mask: net.CIDRMask(24, 32)}})
+	}))
+
+	cfg := Config{
+		Enabled:          true,
+		NetworkNamespace: n.Host,
+		WanIfaces:        []string{`wan1`},
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	if assert.Len(t, nft.wans, 2) {
+		assert.Equal(t, `wan1`, nft.wans[1].Iface)
+		assert.True(t, wanIP.Equal(nft.wans[1].Src))
+	}
+}
+
+func TestNetnsLogDrop(t *testing.T) {
+	n, err := nftest.NewNetwork(`nftest`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+
+	ns, err := netns.GetFromName(n.Host)
+	assert.NoError(t, err)
+	defer ns.Close()
+	r, err := nflog.Open(nflog.Config{Group: 100, NetNS: int(ns)})
+	assert.NoError(t, err)
+	defer r.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch := make(chan nflog.Packet, 16)
+	go r.Listen(ctx, ch)
+
+	cfg := Config{
+		Enabled:          true,
+		NetworkNamespace: n.Host,
+		DefaultPolicy:    `drop`,
+		LogDrop:          true,
+		LogGroup:         100,
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	assert.NoError(t, nft.ApplyDefault(RULE_ALL))
+	probe := nftest.Probe{Proto: nftest.ProbeTCP, Port: 3306}
+	assert.False(t, n.Probe(200*time.Millisecond, probe).Reachable(probe.Proto, probe.Port))
+
+	select {
+	case p := <-ch:
+		assert.Equal(t, `nft drop input: `, p.Prefix)
+		assert.True(t, n.PeerIP.Equal(p.SrcIP))
+		assert.Equal(t, uint16(3306), p.DstPort)
+		assert.Equal(t, uint8(unix.IPPROTO_TCP), p.Protocol)
+	case <-ctx.Done():
+		t.Fatal(`no packet logged`)
+	}
+}
+
+func TestNetnsBanFlushFlows(t *testing.T) {
+	n, err := nftest.NewNetwork(`nftest`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+
+	probe := nftest.Probe{Proto: nftest.ProbeUDP, Port: 5353}
+	assert.NoError(t, n.Listen(probe))
+	cfg := Config{
+		Enabled:          true,
+		NetworkNamespace: n.Host,
+		DefaultPolicy:    `drop`,
+		MyPort:           5353,
+		BanFlushFlows:    true,
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	assert.NoError(t, nft.ApplyDefault(RULE_ALL))
+	defer nft.Cleanup()
+	assert.True(t, n.Probe(time.Second, probe).Reachable(probe.Proto, probe.Port))
+
+	ct, err := nft.Conntrack()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ct.Close()
+	peer, err := conntrack.ParseAddrs([]string{n.PeerIP.String()})
+	assert.NoError(t, err)
+	filter := conntrack.Filter{Sources: peer, Protocol: unix.IPPROTO_UDP, DstPort: 5353}
+	flows, err := ct.List(unix.AF_INET, filter)
+	assert.NoError(t, err)
+	assert.Len(t, flows, 1)
+
+	assert.NoError(t, nft.Ban([]string{n.PeerIP.String()}, time.Minute))
+	flows, err = ct.List(unix.AF_INET, filter)
+	assert.NoError(t, err)
+	assert.Len(t, flows, 0)
+	assert.Equal(t, uint64(1), nft.Stats().Bans)
+}
+
+func TestNetnsCtZoneForward(t *testing.T) {
+	n, err := nftest.NewNetwork(`nftzone`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+
+	// a LAN namespace behind the host, which routes it to the peer as its WAN
+	lanIP := net.IPv4(10, 202, 0, 2).To4()
+	gwIP := net.IPv4(10, 202, 0, 1).To4()
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	require.NoError(t, err)
+	lanNS, err := netns.NewNamed(`nftzone-lan`)
+	require.NoError(t, netns.Set(origin))
+	runtime.UnlockOSThread()
+	origin.Close()
+	require.NoError(t, err)
+	defer netns.DeleteNamed(`nftzone-lan`)
+	defer lanNS.Close()
+
+	require.NoError(t, n.InHost(func() error {
+		link := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: `lan0`}, PeerName: `lan1`}
+		if err := netlink.LinkAdd(link); err != nil {
+			return err
+		}
+		peer, err := netlink.LinkByName(`lan1`)
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetNsFd(peer, int(lanNS)); err != nil {
+			return err
+		}
+		if err = netlink.AddrAdd(link, &netlink.Addr{IPNet: &net.IPNet{IP: gwIP, Mask: net.CIDRMask(24, 32)}}); err != nil {
+			return err
+		}
+		if err = netlink.LinkSetUp(link); err != nil {
+			return err
+		}
+		return os.WriteFile(`/proc/sys/net/ipv4/ip_forward`, []byte(`1`), 0644)
+	}))
+	h, err := netlink.NewHandleAt(lanNS)
+	require.NoError(t, err)
+	defer h.Delete()
+	lan, err := h.LinkByName(`lan1`)
+	require.NoError(t, err)
+	require.NoError(t, h.AddrAdd(lan, &netlink.Addr{IPNet: &net.IPNet{IP: lanIP, Mask: net.CIDRMask(24, 32)}}))
+	require.NoError(t, h.LinkSetUp(lan))
+	require.NoError(t, h.RouteAdd(&netlink.Route{LinkIndex: lan.Attrs().Index, Gw: gwIP}))
+
+	// the peer answers the LAN through the host
+	var l net.Listener
+	require.NoError(t, n.InPeer(func() error {
+		link, err := netlink.LinkByName(n.PeerIface)
+		if err != nil {
+			return err
+		}
+		dst := &net.IPNet{IP: net.IPv4(10, 202, 0, 0).To4(), Mask: net.CIDRMask(24, 32)}
+		if err = netlink.RouteAdd(&netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Gw: n.HostIP}); err != nil {
+			return err
+		}
+		l, err = net.Listen(`tcp4`, `:8080`)
+		return err
+	}))
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := Config{
+		Enabled:          true,
+		NetworkNamespace: n.Host,
+		DefaultPolicy:    `drop`,
+		Zones: []Zone{
+			{Name: `lan`, Ifaces: []string{`lan0`}, CtZone: 1},
+		},
+		// the replies are accepted in the established state only
+		Services: []Service{
+			{Name: `web`, Ports: []uint16{8080}, Forward: true},
+		},
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, nil)
+	require.NoError(t, nft.ApplyDefault(RULE_ALL))
+	defer nft.Cleanup()
+
+	// the replies received on the WAN, which has no zone, find the connection
+	// of the LAN zone
+	err = inNetNS(lanNS, func() error {
+		conn, err := net.DialTimeout(`tcp4`, net.JoinHostPort(n.PeerIP.String(), `8080`), 3*time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+	assert.NoError(t, err)
+}
+
+// inNetNS runs fn with the current thread switched to ns.
+func inNetNS(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	if err = netns.Set(ns); err != nil {
+		return err
+	}
+	defer netns.Set(origin)
+	return fn()
+}
@@ -0,0 +1,298 @@
+package biz
+
+import (
+	"fmt"
+	"os/user"
+	"sort"
+	"strconv"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// outboundOwner matches the sockets of a kind of owners of an Outbound.
+type outboundOwner struct {
+	id    string // suffix of the rule IDs: uid / gid / cgroup<level>
+	match func(c *nftables.Conn) ([]expr.Any, error)
+}
+
+// outboundSetName returns the name of the destination set of the allowlist.
+func outboundSetName(name string) string {
+	return `outbound_` + name + `_ipset`
+}
+
+// initOutbound creates the destination sets of the outbound allowlists.
+func (nft *NFTables) initOutbound() {
+	nft.outboundSets = map[string]*nftables.Set{}
+	keyType := nftables.TypeIPAddr
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	for _, ob := range nft.cfg.Outbound {
+		if _, ok := nft.outboundSets[ob.Name]; ok || len(ob.Name) == 0 {
+			continue
+		}
+		set := &nftables.Set{
+			Name:     outboundSetName(ob.Name),
+			Table:    nft.tFilter,
+			KeyType:  keyType,
+			Interval: true,
+		}
+		nft.outboundSets[ob.Name] = set
+		nft.sets = append(nft.sets, set)
+	}
+}
+
+// validateOutbound checks the names, the owners and the protocols of the
+// outbound allowlists.
+func (nft *NFTables) validateOutbound() error {
+	names := map[string]struct{}{}
+	for _, ob := range nft.cfg.Outbound {
+		if len(ob.Name) == 0 {
+			return fmt.Errorf(`outbound name is required`)
+		}
+		if _, ok := names[ob.Name]; ok {
+			return fmt.Errorf(`duplicate outbound %q`, ob.Name)
+		}
+		names[ob.Name] = struct{}{}
+		if len(ob.Users) == 0 && len(ob.Groups) == 0 && len(ob.Cgroups) == 0 {
+			return fmt.Errorf(`outbound %q: users, groups or cgroups are required`, ob.Name)
+		}
+		if _, err := serviceProtocol(ob.Protocol); err != nil {
+			return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+		}
+		countries, _, err := splitGeoSources(ob.Destinations)
+		if err != nil {
+			return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+		}
+		if len(countries) > 0 {
+			return fmt.Errorf(`outbound %q: country destinations are not supported`, ob.Name)
+		}
+	}
+	return nil
+}
+
+// lookupID returns the numeric ID, or the ID of the name resolved by lookup.
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf(`invalid id %q of %q`, id, name)
+	}
+	return uint32(n), nil
+}
+
+// outboundOwners resolves the users, the groups and the cgroups of ob. The
+// cgroups are grouped by level, which is a parameter of their expression.
+func (nft *NFTables) outboundOwners(ob *Outbound) ([]outboundOwner, error) {
+	var owners []outboundOwner
+	if len(ob.Users) > 0 {
+		uids := make([]uint32, len(ob.Users))
+		for i, name := range ob.Users {
+			uid, err := lookupID(name, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return ``, err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			uids[i] = uid
+		}
+		owners = append(owners, outboundOwner{id: `uid`, match: func(c *nftables.Conn) ([]expr.Any, error) {
+			set := utils.GetUIDSet(nft.tFilter)
+			if err := c.AddSet(set, utils.GetIDSetElems(uids)); err != nil {
+				return nil, err
+			}
+			return utils.SetSkUIDSet(set), nil
+		}})
+	}
+	if len(ob.Groups) > 0 {
+		gids := make([]uint32, len(ob.Groups))
+		for i, name := range ob.Groups {
+			gid, err := lookupID(name, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return ``, err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			gids[i] = gid
+		}
+		owners = append(owners, outboundOwner{id: `gid`, match: func(c *nftables.Conn) ([]expr.Any, error) {
+			set := utils.GetGIDSet(nft.tFilter)
+			if err := c.AddSet(set, utils.GetIDSetElems(gids)); err != nil {
+				return nil, err
+			}
+			return utils.SetSkGIDSet(set), nil
+		}})
+	}
+	cgroups := map[uint32][]uint64{}
+	for _, path := range ob.Cgroups {
+		id, level, err := utils.CgroupV2ID(path)
+		if err != nil {
+			return nil, err
+		}
+		cgroups[level] = append(cgroups[level], id)
+	}
+	levels := make([]uint32, 0, len(cgroups))
+	for level := range cgroups {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+	for _, level := range levels {
+		level, ids := level, cgroups[level]
+		owners = append(owners, outboundOwner{id: `cgroup` + strconv.FormatUint(uint64(level), 10), match: func(c *nftables.Conn) ([]expr.Any, error) {
+			set := utils.GetCgroupV2Set(nft.tFilter)
+			if err := c.AddSet(set, utils.GetCgroupV2SetElems(ids)); err != nil {
+				return nil, err
+			}
+			return utils.SetSocketCgroupV2Set(level, set), nil
+		}})
+	}
+	return owners, nil
+}
+
+// outboundRules accepts the new outbound connections of the owners to the
+// destinations of their allowlists and drops the others. All the accept rules
+// precede the drop rules, an owner of several allowlists gets their union.
+func (nft *NFTables) outboundRules(c *nftables.Conn) error {
+	if len(nft.cfg.Outbound) == 0 {
+		return nil
+	}
+	if err := nft.validateOutbound(); err != nil {
+		return err
+	}
+	type outboundDrop struct {
+		id    string
+		owner outboundOwner
+	}
+	var drops []outboundDrop
+	for i := range nft.cfg.Outbound {
+		ob := &nft.cfg.Outbound[i]
+		owners, err := nft.outboundOwners(ob)
+		if err != nil {
+			return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+		}
+		set := nft.outboundSets[ob.Name]
+		if err = nft.loadOutboundSet(c, set, ob.Destinations); err != nil {
+			return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+		}
+		for _, owner := range owners {
+			id := `outbound_` + ob.Name + `_` + owner.id
+			// cmd: nft add rule ip filter OUTPUT meta skuid { 1000 } \
+			// ip daddr @outbound_build_ipset tcp dport { 443 } \
+			// ct state { new, established } accept
+			exprs, err := owner.match(c)
+			if err != nil {
+				return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+			}
+			exprs = append(exprs, nft.addrSetExprs(set, utils.ExprDirectionDestination)...)
+			if len(ob.Ports) > 0 {
+				protocol, _ := serviceProtocol(ob.Protocol)
+				portExprs, err := nft.portSetExprs(c, nft.tFilter, servicePorts{protocol: protocol, ports: ob.Ports}, utils.ExprDirectionDestination)
+				if err != nil {
+					return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+				}
+				exprs = append(exprs, portExprs...)
+			}
+			ctStateSet := utils.GetConntrackStateSet(nft.tFilter)
+			if err = c.AddSet(ctStateSet, utils.GetConntrackStateSetElems(defaultStateWithNew)); err != nil {
+				return fmt.Errorf(`outbound %q: %w`, ob.Name, err)
+			}
+			exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
+			exprs = append(exprs, utils.ExprAccept())
+			rule := &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    nft.cOutput,
+				Exprs:    exprs,
+				UserData: []byte(id),
+			}
+			nft.addRule(c, rule)
+			drops = append(drops, outboundDrop{id: id + `_drop`, owner: owner})
+		}
+	}
+	for _, drop := range drops {
+		// cmd: nft add rule ip filter OUTPUT meta skuid { 1000 } \
+		// oifname != "lo" ct state new drop
+		exprs, err := drop.owner.match(c)
+		if err != nil {
+			return err
+		}
+		exprs = append(exprs, utils.SetNOIF(loIface)...)
+		exprs = append(exprs, utils.SetConntrackStateNew()...)
+		exprs = append(exprs, utils.ExprDrop())
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cOutput,
+			Exprs:    exprs,
+			UserData: []byte(drop.id),
+		}
+		nft.addRule(c, rule)
+	}
+	return nil
+}
+
+// loadOutboundSet replaces the elements of the destination set.
+func (nft *NFTables) loadOutboundSet(c *nftables.Conn, set *nftables.Set, destinations []string) error {
+	// cmd: nft add set ip filter outbound_build_ipset { type ipv4_addr \; flags interval \; }
+	if err := nft.addSet(c, set, nil); err != nil {
+		return fmt.Errorf(`nft.AddSet(%q): %w`, set.Name, err)
+	}
+	c.FlushSet(set)
+	elems, err := nft.zoneSourceElems(destinations)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	return c.SetAddElements(set, elems)
+}
+
+// AddOutboundDestinations allows the owners of the outbound allowlist name to
+// connect to the addresses, e.g. 10.0.0.0/8, 192.168.1.10-192.168.1.20, until
+// the rules are applied again.
+func (nft *NFTables) AddOutboundDestinations(name string, addresses []string) error {
+	return nft.updateOutboundSet(name, addresses, true)
+}
+
+// DeleteOutboundDestinations removes the addresses added to the outbound
+// allowlist name, they must match the added ranges.
+func (nft *NFTables) DeleteOutboundDestinations(name string, addresses []string) error {
+	return nft.updateOutboundSet(name, addresses, false)
+}
+
+func (nft *NFTables) updateOutboundSet(name string, addresses []string, add bool) error {
+	if !nft.applied {
+		return nil
+	}
+	set, ok := nft.outboundSets[name]
+	if !ok {
+		return fmt.Errorf(`outbound %q not found`, name)
+	}
+	elems, err := nft.zoneSourceElems(addresses)
+	if err != nil || len(elems) == 0 {
+		return err
+	}
+	return nft.Do(func(c *nftables.Conn) error {
+		if add {
+			err = c.SetAddElements(set, elems)
+		} else {
+			err = c.SetDeleteElements(set, elems)
+		}
+		if err != nil {
+			return fmt.Errorf(`outbound %q: %w`, name, err)
+		}
+		return c.Flush()
+	})
+}
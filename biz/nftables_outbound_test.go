@@ -0,0 +1,83 @@
+package biz
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboundRules(t *testing.T) {
+	root := utils.CgroupV2Root
+	defer func() { utils.CgroupV2Root = root }()
+	utils.CgroupV2Root = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(utils.CgroupV2Root, `system.slice`, `build.service`), 0o755))
+	assert.NoError(t, os.MkdirAll(filepath.Join(utils.CgroupV2Root, `ci.slice`), 0o755))
+
+	cfg := Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		Outbound: []Outbound{
+			{Name: `build`, Users: []string{`1000`, `root`}, Cgroups: []string{`system.slice/build.service`, `ci.slice`}, Destinations: []string{`10.0.0.0/8`}, Ports: []uint16{443}},
+			{Name: `mirror`, Groups: []string{`0`}, Destinations: []string{`192.168.1.10-192.168.1.20`}},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_OUTBOUND)
+
+	// the accept rules of all allowlists precede the drop rules
+	assert.Equal(t, []string{
+		`outbound_build_uid`, `outbound_build_cgroup1`, `outbound_build_cgroup2`, `outbound_mirror_gid`,
+		`outbound_build_uid_drop`, `outbound_build_cgroup1_drop`, `outbound_build_cgroup2_drop`, `outbound_mirror_gid_drop`,
+	}, ruleIDsOf(t, k, nft.cOutput))
+	assert.Equal(t, []string{`10.0.0.0`, `-11.0.0.0`}, setElemKeys(t, k, nft.tFilter, `outbound_build_ipset`))
+
+	r, err := k.RuleByID(nft.tFilter, nft.cOutput, []byte(`outbound_build_uid`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, &expr.Meta{Key: expr.MetaKeySKUID, Register: 1}, r.Exprs[0])
+		lookup := r.Exprs[1].(*expr.Lookup)
+		elems, err := k.SetElements(nft.tFilter, lookup.SetName)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, utils.GetIDSetElems([]uint32{1000, 0}), elems)
+		assert.Equal(t, `outbound_build_ipset`, r.Exprs[3].(*expr.Lookup).SetName)
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cOutput, []byte(`outbound_build_cgroup2`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		// the socket expressions are not decoded by github.com/google/nftables
+		assert.Equal(t, &expr.Socket{Key: expr.SocketKeyCgroupv2, Level: 2, Register: 1}, nft.appliedExprs(r)[0])
+	}
+
+	assert.NoError(t, nft.AddOutboundDestinations(`mirror`, []string{`172.16.0.0/12`}))
+	assert.Equal(t, []string{`192.168.1.10`, `-192.168.1.21`, `172.16.0.0`, `-172.32.0.0`}, setElemKeys(t, k, nft.tFilter, `outbound_mirror_ipset`))
+	assert.NoError(t, nft.DeleteOutboundDestinations(`mirror`, []string{`172.16.0.0/12`}))
+	assert.Equal(t, []string{`192.168.1.10`, `-192.168.1.21`}, setElemKeys(t, k, nft.tFilter, `outbound_mirror_ipset`))
+	assert.EqualError(t, nft.AddOutboundDestinations(`none`, []string{`10.0.0.1`}), `outbound "none" not found`)
+
+	// applying again resets the destinations
+	assert.NoError(t, nft.AddOutboundDestinations(`mirror`, []string{`172.16.0.0/12`}))
+	assert.NoError(t, nft.ApplyDefault(RULE_OUTBOUND))
+	assert.Equal(t, []string{`192.168.1.10`, `-192.168.1.21`}, setElemKeys(t, k, nft.tFilter, `outbound_mirror_ipset`))
+}
+
+func TestValidateOutbound(t *testing.T) {
+	for _, c := range []struct {
+		outbound Outbound
+		err      string
+	}{
+		{Outbound{Users: []string{`0`}}, `outbound name is required`},
+		{Outbound{Name: `a`}, `outbound "a": users, groups or cgroups are required`},
+		{Outbound{Name: `a`, Users: []string{`0`}, Protocol: `icmp`}, `outbound "a": unsupported protocol "icmp"`},
+		{Outbound{Name: `a`, Users: []string{`0`}, Destinations: []string{`country:CN`}}, `outbound "a": country destinations are not supported`},
+	} {
+		nft := New(nftables.TableFamilyIPv4, Config{Outbound: []Outbound{c.outbound}}, nil)
+		assert.EqualError(t, nft.validateOutbound(), c.err)
+	}
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, Config{Enabled: true, Outbound: []Outbound{{Name: `a`, Users: []string{`no-such-user`}}}}, nil, nftest.New())
+	assert.ErrorContains(t, nft.ApplyDefault(RULE_OUTBOUND), `outbound "a": user: unknown user no-such-user`)
+}
@@ -0,0 +1,215 @@
+package biz
+
+import (
+	"fmt"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const dnsPort = 53
+
+// needRaw reports whether a raw table is required by the configuration.
+func (nft *NFTables) needRaw() bool {
+	if nft.cfg.NotrackLoopback || nft.cfg.NotrackDNS {
+		return true
+	}
+	if nft.cfg.SynFlood == SynFloodSynproxy && len(nft.cfg.Services) > 0 {
+		return true
+	}
+	for _, zone := range nft.cfg.Zones {
+		if zone.CtZone > 0 && len(zone.Ifaces) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rawTable returns the raw table of the firewall.
+func (nft *NFTables) rawTable() *nftables.Table {
+	return &nftables.Table{
+		Family: nft.tableFamily,
+		Name:   nft.cfg.TablePrefix + TableRaw + nft.cfg.TableSuffix,
+	}
+}
+
+// initRaw creates the raw table and its chains, which run before conntrack.
+func (nft *NFTables) initRaw() {
+	nft.tRaw, nft.cRawPrerouting, nft.cRawOutput = nil, nil, nil
+	if !nft.needRaw() {
+		return
+	}
+	nft.tRaw = nft.rawTable()
+	nft.cRawPrerouting = &nftables.Chain{
+		Name:     ChainPreRouting,
+		Table:    nft.tRaw,
+		Type:     nftables.ChainTypeFilter,
+		Priority: priority(nftables.ChainPriorityRaw, nft.cfg.Priorities.Raw),
+		Hooknum:  nftables.ChainHookPrerouting,
+	}
+	nft.cRawOutput = &nftables.Chain{
+		Name:     ChainOutput,
+		Table:    nft.tRaw,
+		Type:     nftables.ChainTypeFilter,
+		Priority: priority(nftables.ChainPriorityRaw, nft.cfg.Priorities.Raw),
+		Hooknum:  nftables.ChainHookOutput,
+	}
+	nft.tables = append(nft.tables, nft.tRaw)
+	nft.chains = append(nft.chains, nft.cRawPrerouting, nft.cRawOutput)
+}
+
+// rawRules skips conntrack for the stateless traffic and assigns the
+// conntrack zones of the interfaces.
+func (nft *NFTables) rawRules(c *nftables.Conn) error {
+	if nft.tRaw == nil {
+		return nil
+	}
+	if nft.cfg.NotrackLoopback {
+		nft.notrackLoopbackRules(c)
+	}
+	if nft.cfg.NotrackDNS {
+		nft.notrackDNSRules(c)
+	}
+	return nft.ctZoneRules(c)
+}
+
+// notrackLoopbackRules skips conntrack on the loopback interface, the filter
+// chains accept it regardless of the ct state.
+func (nft *NFTables) notrackLoopbackRules(c *nftables.Conn) {
+	// cmd: nft add rule ip raw prerouting meta iifname "lo" notrack
+	rule := &nftables.Rule{
+		Table:    nft.tRaw,
+		Chain:    nft.cRawPrerouting,
+		Exprs:    utils.SetIIF(loIface).Add(utils.ExprNotrack()),
+		UserData: []byte(`raw_notrack_lo`),
+	}
+	nft.addRule(c, rule)
+
+	// cmd: nft add rule ip raw output meta oifname "lo" notrack
+	rule = &nftables.Rule{
+		Table:    nft.tRaw,
+		Chain:    nft.cRawOutput,
+		Exprs:    utils.SetOIF(loIface).Add(utils.ExprNotrack()),
+		UserData: []byte(`raw_notrack_lo_output`),
+	}
+	nft.addRule(c, rule)
+}
+
+// notrackDNSRules skips conntrack for the queries to the DNS server of this
+// host and its replies, and accepts them untracked.
+func (nft *NFTables) notrackDNSRules(c *nftables.Conn) {
+	for _, proto := range []string{`udp`, `tcp`} {
+		protoExprs := utils.SetProtoUDP()
+		if proto == `tcp` {
+			protoExprs = utils.SetProtoTCP()
+		}
+
+		// cmd: nft add rule ip raw prerouting fib daddr type local \
+		// udp dport 53 notrack
+		exprs := make([]expr.Any, 0, 7)
+		exprs = append(exprs, utils.SetFibDAddrTypeLocal()...)
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs, utils.SetDPort(dnsPort)...)
+		exprs = append(exprs, utils.ExprNotrack())
+		rule := &nftables.Rule{
+			Table:    nft.tRaw,
+			Chain:    nft.cRawPrerouting,
+			Exprs:    exprs,
+			UserData: []byte(`raw_notrack_dns_` + proto),
+		}
+		nft.addRule(c, rule)
+
+		// cmd: nft add rule ip raw output udp sport 53 notrack
+		exprs = make([]expr.Any, 0, 5)
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs, utils.SetSPort(dnsPort)...)
+		exprs = append(exprs, utils.ExprNotrack())
+		rule = &nftables.Rule{
+			Table:    nft.tRaw,
+			Chain:    nft.cRawOutput,
+			Exprs:    exprs,
+			UserData: []byte(`raw_notrack_dns_` + proto + `_reply`),
+		}
+		nft.addRule(c, rule)
+
+		// cmd: nft add rule ip filter input udp dport 53 ct state untracked accept
+		exprs = make([]expr.Any, 0, 8)
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs, utils.SetDPort(dnsPort)...)
+		exprs = append(exprs, utils.SetConntrackStateUntracked()...)
+		exprs = append(exprs, utils.ExprAccept())
+		rule = &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cInput,
+			Exprs:    exprs,
+			UserData: []byte(`input_dns_untracked_` + proto),
+		}
+		nft.addRule(c, rule)
+
+		// cmd: nft add rule ip filter output udp sport 53 ct state untracked accept
+		exprs = make([]expr.Any, 0, 8)
+		exprs = append(exprs, protoExprs...)
+		exprs = append(exprs, utils.SetSPort(dnsPort)...)
+		exprs = append(exprs, utils.SetConntrackStateUntracked()...)
+		exprs = append(exprs, utils.ExprAccept())
+		rule = &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    nft.cOutput,
+			Exprs:    exprs,
+			UserData: []byte(`output_dns_untracked_` + proto),
+		}
+		nft.addRule(c, rule)
+	}
+}
+
+// ctZoneRules assigns the conntrack zones of the zone interfaces, so that the
+// connections of overlapping address spaces are tracked apart.
+func (nft *NFTables) ctZoneRules(c *nftables.Conn) error {
+	for _, zone := range nft.cfg.Zones {
+		if zone.CtZone == 0 {
+			continue
+		}
+		if nft.tRaw.Name != TableRaw {
+			// the CT target of utils.SetCtOriginalZone is only valid in it
+			return fmt.Errorf(`zone %q: the conntrack zones require the raw table to be named %q, not %q`, zone.Name, TableRaw, nft.tRaw.Name)
+		}
+		for _, iface := range zone.Ifaces {
+			nft.ctZoneIfaceRules(c, iface, zone.CtZone)
+		}
+	}
+	return nil
+}
+
+// ctZoneOf returns the conntrack zone of iface, 0 if it has none.
+func (nft *NFTables) ctZoneOf(iface string) uint16 {
+	for _, zone := range nft.cfg.Zones {
+		if zone.CtZone > 0 && inStrings(zone.Ifaces, iface) {
+			return zone.CtZone
+		}
+	}
+	return 0
+}
+
+// ctZoneIfaceRules assigns the conntrack zone of iface to the original
+// direction of the connections, so that their replies received on the
+// interfaces of other zones, e.g. a WAN without zone, find them.
+func (nft *NFTables) ctZoneIfaceRules(c *nftables.Conn, iface string, zone uint16) {
+	// cmd: nft add rule ip raw prerouting meta iifname "eth1" ct original zone set 1
+	rule := &nftables.Rule{
+		Table:    nft.tRaw,
+		Chain:    nft.cRawPrerouting,
+		Exprs:    utils.JoinExprs(utils.SetIIF(iface), utils.SetCtOriginalZone(zone)),
+		UserData: ifaceRuleID(`raw_ct_zone`, iface),
+	}
+	nft.addRule(c, rule)
+
+	// cmd: nft add rule ip raw output meta oifname "eth1" ct original zone set 1
+	rule = &nftables.Rule{
+		Table:    nft.tRaw,
+		Chain:    nft.cRawOutput,
+		Exprs:    utils.JoinExprs(utils.SetOIF(iface), utils.SetCtOriginalZone(zone)),
+		UserData: ifaceRuleID(`raw_ct_zone_output`, iface),
+	}
+	nft.addRule(c, rule)
+}
@@ -0,0 +1,143 @@
+package biz
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRawConfig() Config {
+	return Config{
+		Enabled:         true,
+		DefaultPolicy:   `drop`,
+		DisableInitSet:  true,
+		NotrackLoopback: true,
+		NotrackDNS:      true,
+		Zones: []Zone{
+			{Name: `tenant1`, Ifaces: []string{`eth1`}, CtZone: 1},
+			{Name: `tenant2`, Ifaces: []string{`eth2`, `eth3`}, CtZone: 2},
+			{Name: `wan`, Ifaces: []string{`eth0`}},
+		},
+	}
+}
+
+func TestRawRules(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testRawConfig(), nil, RULE_RAW)
+	if assert.NotNil(t, nft.TableRaw()) {
+		assert.Equal(t, `raw`, nft.tRaw.Name)
+		assert.Equal(t, *nftables.ChainPriorityRaw, *nft.cRawPrerouting.Priority)
+	}
+
+	ids := func(chain *nftables.Chain) []string {
+		rules, err := k.Rules(chain.Table, chain)
+		assert.NoError(t, err)
+		r := make([]string, len(rules))
+		for i, rule := range rules {
+			r[i] = string(rule.UserData)
+		}
+		return r
+	}
+	assert.Equal(t, []string{
+		`raw_notrack_lo`,
+		`raw_notrack_dns_udp`, `raw_notrack_dns_tcp`,
+		`raw_ct_zone@eth1`, `raw_ct_zone@eth2`, `raw_ct_zone@eth3`,
+	}, ids(nft.cRawPrerouting))
+	assert.Equal(t, []string{
+		`raw_notrack_lo_output`,
+		`raw_notrack_dns_udp_reply`, `raw_notrack_dns_tcp_reply`,
+		`raw_ct_zone_output@eth1`, `raw_ct_zone_output@eth2`, `raw_ct_zone_output@eth3`,
+	}, ids(nft.cRawOutput))
+	assert.Equal(t, []string{`input_dns_untracked_udp`, `input_dns_untracked_tcp`}, ids(nft.cInput))
+	assert.Equal(t, []string{`output_dns_untracked_udp`, `output_dns_untracked_tcp`}, ids(nft.cOutput))
+
+	r, err := k.RuleByID(nft.tRaw, nft.cRawPrerouting, []byte(`raw_ct_zone@eth3`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		// the zone is assigned to the original direction only
+		assert.Equal(t, []expr.Any(utils.SetCtOriginalZone(2)), r.Exprs[len(r.Exprs)-1:])
+	}
+	r, err = k.RuleByID(nft.tRaw, nft.cRawPrerouting, []byte(`raw_notrack_dns_udp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.IsType(t, &expr.Fib{}, r.Exprs[0])
+		assert.Equal(t, utils.ExprNotrack(), r.Exprs[len(r.Exprs)-1])
+	}
+
+	// no raw table without a raw option
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, testRawConfig(), func(cfg *Config) {
+		cfg.NotrackLoopback = false
+		cfg.NotrackDNS = false
+		cfg.Zones = cfg.Zones[2:]
+	}, nil)
+	assert.Nil(t, nft.TableRaw())
+	assert.Len(t, nft.tables, 2)
+
+	// the CT target is only valid in a table named raw
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, testRawConfig(), func(cfg *Config) {
+		cfg.TablePrefix = `fw_`
+	}, nftest.New())
+	assert.EqualError(t, nft.ApplyDefault(RULE_RAW), `nft.rawRules: zone "tenant1": the conntrack zones require the raw table to be named "raw", not "fw_raw"`)
+}
+
+func TestRawTableToggle(t *testing.T) {
+	k := nftest.New()
+	cfg := testRawConfig()
+	cfg.DisableInitSet = false
+	cfg.NotrackLoopback = false
+	cfg.NotrackDNS = false
+	cfg.Zones = cfg.Zones[2:]
+	apply := func(cfg Config) *NFTables {
+		nft := newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+		require.NoError(t, nft.ApplyDefault(RULE_ALL))
+		return nft
+	}
+	apply(cfg)
+
+	// enabling the raw table over the existing filter table
+	cfg.NotrackDNS = true
+	nft := apply(cfg)
+	rules, err := k.Rules(nft.tFilter, nft.cInput)
+	assert.NoError(t, err)
+	ids := map[string]int{}
+	for _, rule := range rules {
+		ids[string(rule.UserData)]++
+	}
+	assert.Equal(t, 1, ids[`input_dns_untracked_udp`])
+	for id, n := range ids {
+		assert.Equal(t, 1, n, id)
+	}
+	tables, err := k.Tables(nftables.TableFamilyIPv4)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 3)
+
+	// disabling it deletes the table
+	cfg.NotrackDNS = false
+	apply(cfg)
+	tables, err = k.Tables(nftables.TableFamilyIPv4)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 2)
+	for _, table := range tables {
+		assert.NotEqual(t, TableRaw, table.Name)
+	}
+}
+
+func TestRawCtZoneReapply(t *testing.T) {
+	for _, ifaces := range [][]string{nil, {`eth1`}} {
+		nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testRawConfig(), func(cfg *Config) {
+			cfg.Ifaces = ifaces
+		}, RULE_RAW)
+		before := ruleIDsOf(t, k, nft.cRawPrerouting)
+
+		// the conntrack zone of a recreated interface is assigned again
+		assert.NoError(t, nft.ReapplyIface(`eth1`))
+		assert.Equal(t, before, ruleIDsOf(t, k, nft.cRawPrerouting), ifaces)
+		r, err := k.RuleByID(nft.tRaw, nft.cRawOutput, []byte(`raw_ct_zone_output@eth1`))
+		assert.NoError(t, err)
+		assert.NotNil(t, r, ifaces)
+	}
+}
@@ -0,0 +1,535 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/admpub/log"
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/rule"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+const oneDay = 24 * time.Hour
+
+// schedule is a compiled Schedule.
+type schedule struct {
+	cfg    *Schedule
+	loc    *time.Location
+	window bool          // has a daily window
+	from   time.Duration // start of the daily window, since midnight
+	length time.Duration // length of the daily window
+
+	kernel     bool           // the time is matched in the kernel
+	kernelDays []time.Weekday // active days in the clock of the kernel
+	kernelFrom time.Duration  // daily window in the clock of the kernel
+	kernelTo   time.Duration
+	kernelHour bool
+}
+
+// scheduledRule is a rule inserted and removed by the scheduler.
+type scheduledRule struct {
+	schedule *schedule
+	table    *nftables.Table
+	chain    *nftables.Chain
+	id       string
+	// removed rule and its anonymous sets, nil if the rule is active
+	removed *nftables.Rule
+	sets    map[string]*anonymousSet
+}
+
+func parseClock(v string) (time.Duration, error) {
+	for _, layout := range []string{`15:04`, `15:04:05`} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf(`invalid time of day %q`, v)
+}
+
+// compileSchedule checks the schedule and tells whether its time can be
+// matched in the kernel, whose clock is UTC: the offset of the time zone
+// must not change and, if the days are restricted, the daily window must
+// not cross midnight UTC.
+func compileSchedule(cfg *Schedule, now time.Time) (*schedule, error) {
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf(`rules are required`)
+	}
+	s := &schedule{cfg: cfg, loc: time.Local}
+	if len(cfg.Location) > 0 {
+		loc, err := time.LoadLocation(cfg.Location)
+		if err != nil {
+			return nil, err
+		}
+		s.loc = loc
+	}
+	for _, d := range cfg.Days {
+		if d < time.Sunday || d > time.Saturday {
+			return nil, fmt.Errorf(`invalid day %d`, d)
+		}
+	}
+	if !cfg.Start.IsZero() && !cfg.End.IsZero() && !cfg.Start.Before(cfg.End) {
+		return nil, fmt.Errorf(`start %s is not before end %s`, cfg.Start, cfg.End)
+	}
+	var to time.Duration
+	if len(cfg.From) > 0 || len(cfg.To) > 0 {
+		var err error
+		if len(cfg.From) > 0 {
+			if s.from, err = parseClock(cfg.From); err != nil {
+				return nil, err
+			}
+		}
+		if len(cfg.To) > 0 {
+			if to, err = parseClock(cfg.To); err != nil {
+				return nil, err
+			}
+		}
+		s.window = true
+	}
+	s.length = ((to-s.from)%oneDay + oneDay) % oneDay
+	if s.length == 0 {
+		s.length = oneDay
+	}
+	if cfg.Scheduler {
+		return s, nil
+	}
+
+	year := now.In(s.loc).Year()
+	_, offJan := time.Date(year, time.January, 1, 0, 0, 0, 0, s.loc).Zone()
+	_, offJul := time.Date(year, time.July, 1, 0, 0, 0, 0, s.loc).Zone()
+	if offJan != offJul {
+		return s, nil
+	}
+	// start of the window in the clock of the kernel and the days it shifts
+	start := s.from - time.Duration(offJan)*time.Second
+	shift := int(start / oneDay)
+	if start < 0 && start%oneDay != 0 {
+		shift--
+	}
+	start -= time.Duration(shift) * oneDay
+	if len(cfg.Days) > 0 {
+		if start+s.length > oneDay {
+			return s, nil
+		}
+		for _, d := range cfg.Days {
+			s.kernelDays = append(s.kernelDays, time.Weekday((int(d)+shift%7+7)%7))
+		}
+		sort.Slice(s.kernelDays, func(i, j int) bool { return s.kernelDays[i] < s.kernelDays[j] })
+	}
+	if s.length < oneDay {
+		s.kernelHour = true
+		s.kernelFrom, s.kernelTo = start, (start+s.length)%oneDay
+	}
+	s.kernel = true
+	return s, nil
+}
+
+// ruleIDSuffixes are the suffixes appended to the ID of a rule group by the
+// rules generated for it, e.g. the protocol of service_ssh_tcp, the direction
+// of service_ssh_tcp_reply and the owner of outbound_build_uid_drop.
+var ruleIDSuffixes = []string{`tcp`, `udp`, `reply`, `output`, `forward`, `accept`, `drop`, `uid`, `gid`}
+
+// matches tells whether the rule ID belongs to a rule group of the schedule:
+// the group itself, <group>_<suffix>... or <group>@<iface>.
+func (s *schedule) matches(id string) bool {
+	for _, group := range s.cfg.Rules {
+		if !strings.HasPrefix(id, group) {
+			continue
+		}
+		rest := id[len(group):]
+		if pos := strings.IndexByte(rest, '@'); pos >= 0 && !strings.Contains(group, `@`) {
+			rest = rest[:pos]
+		}
+		if isRuleIDSuffix(rest) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRuleIDSuffix tells whether s is empty or made of the ruleIDSuffixes, each
+// one preceded by an underscore.
+func isRuleIDSuffix(s string) bool {
+	for len(s) > 0 {
+		if s[0] != '_' {
+			return false
+		}
+		s = s[1:]
+		suffix := s
+		if pos := strings.IndexByte(s, '_'); pos >= 0 {
+			suffix = s[:pos]
+		}
+		s = s[len(suffix):]
+		if inStrings(ruleIDSuffixes, suffix) {
+			continue
+		}
+		// the cgroup level of outbound_build_cgroup2
+		level := strings.TrimPrefix(suffix, `cgroup`)
+		if len(level) == len(suffix) || len(level) == 0 || strings.Trim(level, `0123456789`) != `` {
+			return false
+		}
+	}
+	return true
+}
+
+// activeAt tells whether the rules are active at now.
+func (s *schedule) activeAt(now time.Time) bool {
+	if !s.cfg.Start.IsZero() && now.Before(s.cfg.Start) {
+		return false
+	}
+	if !s.cfg.End.IsZero() && !now.Before(s.cfg.End) {
+		return false
+	}
+	now = now.In(s.loc)
+	weekday := now.Weekday()
+	if s.window {
+		clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+		if ((clock-s.from)%oneDay+oneDay)%oneDay >= s.length {
+			return false
+		}
+		if clock < s.from {
+			// the window started the day before
+			weekday = (weekday + 6) % 7
+		}
+	}
+	if len(s.cfg.Days) == 0 {
+		return true
+	}
+	for _, d := range s.cfg.Days {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// initSchedules compiles the schedules of the config.
+func (nft *NFTables) initSchedules(now time.Time) error {
+	nft.scheduleMu.Lock()
+	defer nft.scheduleMu.Unlock()
+	nft.schedules = nft.schedules[:0]
+	nft.scheduled = map[string]*scheduledRule{}
+	nft.ruleOrder = map[string][]string{}
+	for i := range nft.cfg.Schedules {
+		s, err := compileSchedule(&nft.cfg.Schedules[i], now)
+		if err != nil {
+			return fmt.Errorf(`schedule %d: %w`, i+1, err)
+		}
+		nft.schedules = append(nft.schedules, s)
+	}
+	return nil
+}
+
+func (nft *NFTables) scheduleOf(id []byte) *schedule {
+	if len(id) == 0 {
+		return nil
+	}
+	for _, s := range nft.schedules {
+		if s.matches(string(id)) {
+			return s
+		}
+	}
+	return nil
+}
+
+func (nft *NFTables) hasScheduler() bool {
+	for _, s := range nft.schedules {
+		if !s.kernel {
+			return true
+		}
+	}
+	return false
+}
+
+func chainKey(table *nftables.Table, chain *nftables.Chain) string {
+	return table.Name + `/` + chain.Name
+}
+
+// scheduleRule prepends the time matching of the schedule of the rule, or
+// registers it to the scheduler. It returns true if the rule is registered
+// to the scheduler and inactive at the moment.
+func (nft *NFTables) scheduleRule(c *nftables.Conn, r *nftables.Rule) bool {
+	if len(nft.schedules) == 0 {
+		return false
+	}
+	nft.scheduleMu.Lock()
+	defer nft.scheduleMu.Unlock()
+	id := string(r.UserData)
+	s := nft.scheduleOf(r.UserData)
+	if s == nil {
+		return false
+	}
+	if !s.kernel {
+		nft.scheduled[chainKey(r.Table, r.Chain)+`/`+id] = &scheduledRule{
+			schedule: s,
+			table:    r.Table,
+			chain:    r.Chain,
+			id:       id,
+		}
+		return !s.activeAt(time.Now())
+	}
+
+	// cmd: nft add rule ip filter forward meta time >= "2026-01-01 00:00:00" \
+	// meta day { "Monday", "Friday" } meta hour "08:00"-"18:00" ...
+	exprs := utils.SetTimeRange(s.cfg.Start, s.cfg.End)
+	switch len(s.kernelDays) {
+	case 0:
+	case 1:
+		exprs = append(exprs, utils.SetDay(s.kernelDays[0])...)
+	default:
+		set := utils.GetDaySet(r.Table)
+		if err := c.AddSet(set, utils.GetDaySetElems(s.kernelDays)); err != nil {
+			log.Errorf(`[nftables] failed to add the days of rule %q: %v`, id, err)
+			return false
+		}
+		exprs = append(exprs, utils.SetDaySet(set)...)
+	}
+	if s.kernelHour {
+		exprs = append(exprs, utils.SetHourRange(s.kernelFrom, s.kernelTo)...)
+	}
+	r.Exprs = append(exprs, r.Exprs...)
+	return false
+}
+
+// inactiveExprs never match. The inactive scheduled rules are added behind
+// them, then removed by syncSchedules: leaving the rules out of the batch
+// would leave their anonymous sets unbound, which fails the batch.
+func inactiveExprs() []expr.Any {
+	return []expr.Any{
+		// cmd: nft add rule ip filter input 0 != 0 ...
+		&expr.Immediate{Register: 1, Data: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+	}
+}
+
+// SyncSchedules inserts the scheduled rules which became active and removes
+// the ones which became inactive.
+func (nft *NFTables) SyncSchedules() error {
+	return nft.Do(func(c *nftables.Conn) error {
+		// applied is read under the apply lock, the scheduler races with apply
+		if !nft.applied {
+			return nil
+		}
+		if err := nft.syncSchedules(c, time.Now()); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+}
+
+// syncSchedules removes the inactive scheduled rules and inserts the active
+// ones back before the rules following them. The caller holds applyMu, so
+// that no reapply deletes the listed rules before the batch is flushed.
+func (nft *NFTables) syncSchedules(c *nftables.Conn, now time.Time) error {
+	nft.scheduleMu.Lock()
+	defer nft.scheduleMu.Unlock()
+	if len(nft.scheduled) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(nft.scheduled))
+	for key := range nft.scheduled {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// handles of the rules staying in the chains, by chain and ID
+	present := map[string]map[string]uint64{}
+	rulesOf := func(sr *scheduledRule) (map[string]uint64, error) {
+		key := chainKey(sr.table, sr.chain)
+		if handles, ok := present[key]; ok {
+			return handles, nil
+		}
+		rules, err := c.GetRules(sr.table, sr.chain)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list rules of chain %q: %w`, sr.chain.Name, err)
+		}
+		handles := map[string]uint64{}
+		for _, r := range rules {
+			if len(r.UserData) > 0 {
+				handles[string(r.UserData)] = r.Handle
+			}
+		}
+		present[key] = handles
+		return handles, nil
+	}
+
+	for _, key := range keys {
+		sr := nft.scheduled[key]
+		if sr.schedule.activeAt(now) {
+			continue
+		}
+		handles, err := rulesOf(sr)
+		if err != nil {
+			return err
+		}
+		if _, ok := handles[sr.id]; !ok {
+			continue
+		}
+		if err = nft.removeScheduledRule(c, sr); err != nil {
+			return err
+		}
+		delete(handles, sr.id)
+	}
+	// the rules are restored in the order of the chains, so that a rule is
+	// inserted after the restored rules preceding it
+	nft.sortScheduledKeys(keys)
+	for _, key := range keys {
+		sr := nft.scheduled[key]
+		if sr.removed == nil || !sr.schedule.activeAt(now) {
+			continue
+		}
+		handles, err := rulesOf(sr)
+		if err != nil {
+			return err
+		}
+		if err = nft.restoreScheduledRule(c, sr, handles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortScheduledKeys sorts the keys of the scheduled rules by table, chain and
+// index of the rule in its chain.
+func (nft *NFTables) sortScheduledKeys(keys []string) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := nft.scheduled[keys[i]], nft.scheduled[keys[j]]
+		if a.table.Name != b.table.Name {
+			return a.table.Name < b.table.Name
+		}
+		if a.chain.Name != b.chain.Name {
+			return a.chain.Name < b.chain.Name
+		}
+		return nft.ruleIndex(a) < nft.ruleIndex(b)
+	})
+}
+
+// ruleIndex returns the index of the rule in the order of its chain.
+func (nft *NFTables) ruleIndex(sr *scheduledRule) int {
+	for i, id := range nft.ruleOrder[chainKey(sr.table, sr.chain)] {
+		if id == sr.id {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordRuleOrder appends the ID of r to the order of its chain.
+func (nft *NFTables) recordRuleOrder(r *nftables.Rule) {
+	nft.scheduleMu.Lock()
+	defer nft.scheduleMu.Unlock()
+	if nft.ruleOrder == nil {
+		nft.ruleOrder = map[string][]string{}
+	}
+	key := chainKey(r.Table, r.Chain)
+	if id := string(r.UserData); !inStrings(nft.ruleOrder[key], id) {
+		nft.ruleOrder[key] = append(nft.ruleOrder[key], id)
+	}
+}
+
+// nextRuleHandle returns the handle of the first rule of handles following r
+// in the order of its chain, 0 if there is none.
+func (nft *NFTables) nextRuleHandle(r *nftables.Rule, handles map[string]uint64) uint64 {
+	nft.scheduleMu.Lock()
+	defer nft.scheduleMu.Unlock()
+	order := nft.ruleOrder[chainKey(r.Table, r.Chain)]
+	for i, id := range order {
+		if id != string(r.UserData) {
+			continue
+		}
+		for _, next := range order[i+1:] {
+			if handle, ok := handles[next]; ok {
+				return handle
+			}
+		}
+		break
+	}
+	return 0
+}
+
+// removeScheduledRule saves the rule and its anonymous sets and deletes it.
+func (nft *NFTables) removeScheduledRule(c *nftables.Conn, sr *scheduledRule) error {
+	target := rule.New(sr.table, sr.chain)
+	r, err := target.FindRuleByID(c, rule.RuleData{ID: []byte(sr.id)})
+	if err != nil || r == nil {
+		return err
+	}
+	r.Table, r.Chain = sr.table, sr.chain
+	r.Exprs = nft.appliedExprs(r)
+	sets, err := getRuleAnonymousSets(c, r)
+	if err != nil {
+		return err
+	}
+	// cmd: nft delete rule ip filter forward handle 12
+	if _, err = target.Delete(c, rule.RuleData{ID: []byte(sr.id)}); err != nil {
+		return err
+	}
+	sr.removed, sr.sets = r, sets
+	return nil
+}
+
+// restoreScheduledRule inserts the removed rule before the first rule
+// following it which is in the chain, or appends it.
+func (nft *NFTables) restoreScheduledRule(c *nftables.Conn, sr *scheduledRule, handles map[string]uint64) error {
+	exprs := sr.removed.Exprs
+	for _, e := range exprs {
+		lookup, ok := e.(*expr.Lookup)
+		if !ok {
+			continue
+		}
+		anon, ok := sr.sets[lookup.SetName]
+		if !ok {
+			continue
+		}
+		set, err := anon.add(c)
+		if err != nil {
+			return err
+		}
+		lookup.SetName, lookup.SetID = set.Name, set.ID
+	}
+	var position uint64
+	if i := nft.ruleIndex(sr); i >= 0 {
+		for _, next := range nft.ruleOrder[chainKey(sr.table, sr.chain)][i+1:] {
+			if handle, ok := handles[next]; ok {
+				position = handle
+				break
+			}
+		}
+	}
+	target := rule.New(sr.table, sr.chain)
+	data := rule.NewData([]byte(sr.id), exprs, 0, position)
+	var err error
+	// cmd: nft insert rule ip filter forward position 12 ...
+	if position > 0 {
+		_, err = target.Insert(c, data)
+	} else {
+		_, err = target.Add(c, data)
+	}
+	if err != nil {
+		return err
+	}
+	sr.removed, sr.sets = nil, nil
+	return nil
+}
+
+// RunScheduler synchronizes the scheduled rules at the start of every minute
+// until ctx is done.
+func (nft *NFTables) RunScheduler(ctx context.Context) {
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			if err := nft.SyncSchedules(); err != nil {
+				log.Errorf(`[nftables] SyncSchedules: %v`, err)
+			}
+		}
+	}
+}
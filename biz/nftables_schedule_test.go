@@ -0,0 +1,265 @@
+package biz
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCompileSchedule(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	weekdays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+	// Asia/Shanghai has a fixed offset of +8
+	s, err := compileSchedule(&Schedule{Rules: []string{`a`}, Days: weekdays, From: `08:00`, To: `18:00`, Location: `Asia/Shanghai`}, now)
+	assert.NoError(t, err)
+	assert.True(t, s.kernel)
+	assert.Equal(t, weekdays, s.kernelDays)
+	assert.Equal(t, time.Duration(0), s.kernelFrom)
+	assert.Equal(t, 10*time.Hour, s.kernelTo)
+
+	// the window starts the day before in UTC
+	s, err = compileSchedule(&Schedule{Rules: []string{`a`}, Days: []time.Weekday{time.Monday}, From: `07:00`, To: `07:30`, Location: `Asia/Shanghai`}, now)
+	assert.NoError(t, err)
+	assert.True(t, s.kernel)
+	assert.Equal(t, []time.Weekday{time.Sunday}, s.kernelDays)
+	assert.Equal(t, 23*time.Hour, s.kernelFrom)
+	assert.Equal(t, 23*time.Hour+30*time.Minute, s.kernelTo)
+
+	// the window crosses midnight UTC
+	s, err = compileSchedule(&Schedule{Rules: []string{`a`}, Days: weekdays, From: `06:00`, To: `18:00`, Location: `Asia/Shanghai`}, now)
+	assert.NoError(t, err)
+	assert.False(t, s.kernel)
+	// which is matched in the kernel if all days are active
+	s, err = compileSchedule(&Schedule{Rules: []string{`a`}, From: `06:00`, To: `18:00`, Location: `Asia/Shanghai`}, now)
+	assert.NoError(t, err)
+	assert.True(t, s.kernel)
+	assert.Equal(t, 22*time.Hour, s.kernelFrom)
+	assert.Equal(t, 10*time.Hour, s.kernelTo)
+
+	// the daylight saving time changes the offset
+	s, err = compileSchedule(&Schedule{Rules: []string{`a`}, From: `08:00`, To: `18:00`, Location: `Europe/Berlin`}, now)
+	assert.NoError(t, err)
+	assert.False(t, s.kernel)
+	s, err = compileSchedule(&Schedule{Rules: []string{`a`}, Start: now, End: now.Add(time.Hour), Location: `UTC`}, now)
+	assert.NoError(t, err)
+	assert.True(t, s.kernel)
+	assert.False(t, s.kernelHour)
+
+	_, err = compileSchedule(&Schedule{Rules: []string{`a`}, From: `8h`}, now)
+	assert.EqualError(t, err, `invalid time of day "8h"`)
+	_, err = compileSchedule(&Schedule{}, now)
+	assert.EqualError(t, err, `rules are required`)
+}
+
+func TestScheduleActiveAt(t *testing.T) {
+	s, err := compileSchedule(&Schedule{Rules: []string{`a`}, Days: []time.Weekday{time.Friday}, From: `22:00`, To: `06:00`, Location: `UTC`}, time.Now())
+	assert.NoError(t, err)
+	friday := time.Date(2026, 10, 23, 0, 0, 0, 0, time.UTC)
+	assert.False(t, s.activeAt(friday.Add(21*time.Hour)))
+	assert.True(t, s.activeAt(friday.Add(23*time.Hour)))
+	// the window of Friday ends on Saturday morning
+	assert.True(t, s.activeAt(friday.Add(29*time.Hour)))
+	assert.False(t, s.activeAt(friday.Add(30*time.Hour)))
+	assert.False(t, s.activeAt(friday.Add(-time.Hour)))
+
+	assert.False(t, s.matches(`service_ssh`))
+	s.cfg.Rules = []string{`service_ssh`}
+	assert.True(t, s.matches(`service_ssh_tcp_reply`))
+	assert.True(t, s.matches(`service_ssh@eth0`))
+	assert.True(t, s.matches(`service_ssh_udp@eth0`))
+	assert.False(t, s.matches(`service_sshd_tcp`))
+	// a service whose name starts with the scheduled one
+	assert.False(t, s.matches(`service_ssh_admin_tcp`))
+	assert.False(t, s.matches(`service_ssh_admin@eth0`))
+	s.cfg.Rules = []string{`outbound_build`, `input_icmp@eth1`}
+	assert.True(t, s.matches(`outbound_build_cgroup2_drop`))
+	assert.False(t, s.matches(`outbound_build_cgroup_drop`))
+	assert.True(t, s.matches(`input_icmp@eth1`))
+	assert.False(t, s.matches(`input_icmp@eth10`))
+}
+
+func TestSortScheduledKeys(t *testing.T) {
+	nft, _ := applyTestNFTables(t, nftables.TableFamilyIPv4, testScheduleConfig(), func(cfg *Config) {
+		cfg.Schedules = []Schedule{{
+			Rules:     []string{`service_web`, `service_ssh`, `service_db`},
+			End:       time.Now().Add(-time.Hour),
+			Scheduler: true,
+		}}
+	}, RULE_SERVICE)
+	keys := make([]string, 0, len(nft.scheduled))
+	for key := range nft.scheduled {
+		keys = append(keys, key)
+	}
+	// the keys of the input and output chains are mixed
+	for i := 0; i < 10; i++ {
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		nft.sortScheduledKeys(keys)
+		assert.Equal(t, []string{
+			`filter/INPUT/service_web_tcp`, `filter/INPUT/service_ssh_tcp`, `filter/INPUT/service_db_tcp`,
+			`filter/OUTPUT/service_web_tcp_reply`, `filter/OUTPUT/service_ssh_tcp_reply`, `filter/OUTPUT/service_db_tcp_reply`,
+		}, keys)
+	}
+}
+
+func testScheduleConfig() Config {
+	return Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		Services: []Service{
+			{Name: `web`, Ports: []uint16{80}},
+			{Name: `ssh`, Ports: []uint16{22}, Sources: []string{`10.0.0.0/8`}},
+			{Name: `db`, Ports: []uint16{3306}},
+		},
+	}
+}
+
+func TestScheduleKernel(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testScheduleConfig(), func(cfg *Config) {
+		cfg.Schedules = []Schedule{{
+			Rules:    []string{`service_ssh`},
+			Days:     []time.Weekday{time.Monday, time.Friday},
+			From:     `08:00`,
+			To:       `18:00`,
+			Location: `UTC`,
+		}}
+	}, RULE_SERVICE)
+
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_ssh_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, &expr.Meta{Key: utils.MetaKeyDAY, Register: 1}, r.Exprs[0])
+		assert.IsType(t, &expr.Lookup{}, r.Exprs[1])
+		assert.Equal(t, &expr.Meta{Key: utils.MetaKeyHOUR, Register: 1}, r.Exprs[2])
+		// the byteorder expressions are not decoded by github.com/google/nftables
+		assert.IsType(t, &expr.Range{}, r.Exprs[3])
+		assert.IsType(t, &expr.Byteorder{}, nft.appliedExprs(r)[3])
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_web_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.NotEqual(t, &expr.Meta{Key: utils.MetaKeyDAY, Register: 1}, r.Exprs[0])
+	}
+}
+
+func TestScheduleScheduler(t *testing.T) {
+	start := time.Now().Add(time.Hour)
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testScheduleConfig(), func(cfg *Config) {
+		cfg.Schedules = []Schedule{{
+			Rules:     []string{`service_ssh`, `service_web`},
+			Start:     start,
+			Scheduler: true,
+		}}
+	}, RULE_SERVICE)
+
+	// the rules are inactive until start
+	assert.Equal(t, []string{`service_db_tcp`}, ruleIDsOf(t, k, nft.cInput))
+	assert.Equal(t, []string{`service_db_tcp_reply`}, ruleIDsOf(t, k, nft.cOutput))
+
+	// and inserted back in their order
+	sync := func(now time.Time) {
+		assert.NoError(t, nft.Do(func(c *nftables.Conn) error {
+			if err := nft.syncSchedules(c, now); err != nil {
+				return err
+			}
+			return c.Flush()
+		}))
+	}
+	sync(start)
+	assert.Equal(t, []string{`service_web_tcp`, `service_ssh_tcp`, `service_db_tcp`}, ruleIDsOf(t, k, nft.cInput))
+	assert.Equal(t, []string{`service_web_tcp_reply`, `service_ssh_tcp_reply`, `service_db_tcp_reply`}, ruleIDsOf(t, k, nft.cOutput))
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_ssh_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		// restored without the inactive guard
+		assert.NotEqual(t, inactiveExprs(), r.Exprs[:2])
+		// the anonymous sets of the sources, the ports and the ct states are restored
+		var lookups int
+		for _, e := range r.Exprs {
+			if _, ok := e.(*expr.Lookup); ok {
+				lookups++
+			}
+		}
+		assert.Equal(t, 3, lookups)
+	}
+	sync(start.Add(time.Minute))
+	assert.Len(t, ruleIDsOf(t, k, nft.cInput), 3)
+
+	// the ended schedule removes them again
+	nft.cfg.Schedules[0].End = start.Add(time.Hour)
+	sync(start.Add(2 * time.Hour))
+	assert.Equal(t, []string{`service_db_tcp`}, ruleIDsOf(t, k, nft.cInput))
+}
+
+func TestScheduleInactiveGuard(t *testing.T) {
+	k := nftest.New()
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, testScheduleConfig(), func(cfg *Config) {
+		cfg.Schedules = []Schedule{{
+			Rules:     []string{`service_ssh`},
+			Start:     time.Now().Add(time.Hour),
+			Scheduler: true,
+		}}
+	}, k)
+
+	// the batch removing the inactive rules fails, the rules of the first
+	// batch never match
+	k.FailNext(unix.NFT_MSG_DELRULE, unix.EPERM)
+	assert.Error(t, nft.ApplyDefault(RULE_SERVICE))
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_ssh_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, inactiveExprs(), r.Exprs[:2])
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_web_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.NotEqual(t, inactiveExprs(), r.Exprs[:2])
+	}
+}
+
+func TestScheduleConcurrentReapply(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testScheduleConfig(), func(cfg *Config) {
+		cfg.Ifaces = []string{`eth1`}
+		cfg.Schedules = []Schedule{{
+			Rules:     []string{`service_ssh`, `input_icmp@eth1`},
+			End:       time.Now().Add(-time.Hour),
+			Scheduler: true,
+		}}
+	}, RULE_SERVICE)
+	ids := ruleIDsOf(t, k, nft.cInput)
+
+	// the interface watcher, the scheduler and the reconcile loop run in their
+	// own goroutines, their listings and batches must not interleave
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, nft.ReapplyIface(`eth1`))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		r := &nftables.Rule{Table: nft.tFilter, Chain: nft.cInput, UserData: []byte(`input_icmp@eth1`)}
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, nft.SyncSchedules())
+			nft.appliedExprs(r)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, nft.ApplyDefault(RULE_SERVICE))
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, ids, ruleIDsOf(t, k, nft.cInput))
+}
@@ -0,0 +1,310 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/object"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// servicePorts are the control ports of a service on a protocol.
+type servicePorts struct {
+	protocol uint8
+	ports    []uint16
+	helper   string // kernel helper name, empty if no helper is assigned
+}
+
+func (p servicePorts) protocolName() string {
+	if p.protocol == unix.IPPROTO_UDP {
+		return `udp`
+	}
+	return `tcp`
+}
+
+// helperObjName returns the name of the ct helper object of the service.
+func (p servicePorts) helperObjName(service string) string {
+	return service + `_` + helperIDName(p.helper) + `_` + p.protocolName()
+}
+
+// helperIDName returns the kernel helper name in the IDs, e.g. q931 for Q.931.
+func helperIDName(helper string) string {
+	return strings.ToLower(strings.ReplaceAll(helper, `.`, ``))
+}
+
+func serviceProtocol(name string) (uint8, error) {
+	switch strings.ToLower(name) {
+	case ``, `tcp`:
+		return unix.IPPROTO_TCP, nil
+	case `udp`:
+		return unix.IPPROTO_UDP, nil
+	}
+	return 0, fmt.Errorf(`unsupported protocol %q`, name)
+}
+
+// servicePortsOf returns the control ports of the service by protocol.
+func servicePortsOf(svc *Service) ([]servicePorts, error) {
+	if len(svc.Helper) == 0 {
+		if len(svc.Ports) == 0 {
+			return nil, fmt.Errorf(`service %q: ports are required`, svc.Name)
+		}
+		protocol, err := serviceProtocol(svc.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf(`service %q: %w`, svc.Name, err)
+		}
+		return []servicePorts{{protocol: protocol, ports: svc.Ports}}, nil
+	}
+	helpers, ok := object.CtHelpers[strings.ToLower(svc.Helper)]
+	if !ok {
+		return nil, fmt.Errorf(`service %q: unsupported helper %q`, svc.Name, svc.Helper)
+	}
+	var protocol uint8
+	if len(svc.Protocol) > 0 {
+		var err error
+		protocol, err = serviceProtocol(svc.Protocol)
+		if err != nil {
+			return nil, fmt.Errorf(`service %q: %w`, svc.Name, err)
+		}
+	}
+	list := make([]servicePorts, 0, len(helpers))
+	for _, helper := range helpers {
+		if protocol > 0 && helper.Protocol != protocol {
+			continue
+		}
+		ports := svc.Ports
+		if len(ports) == 0 {
+			ports = []uint16{helper.Port}
+		}
+		list = append(list, servicePorts{protocol: helper.Protocol, ports: ports, helper: helper.Name})
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf(`service %q: helper %q does not support protocol %q`, svc.Name, svc.Helper, svc.Protocol)
+	}
+	return list, nil
+}
+
+// validateServices checks the service names, protocols and helpers.
+func (nft *NFTables) validateServices() error {
+	names := map[string]struct{}{}
+	for i := range nft.cfg.Services {
+		svc := &nft.cfg.Services[i]
+		if len(svc.Name) == 0 {
+			return fmt.Errorf(`service name is required`)
+		}
+		if _, ok := names[svc.Name]; ok {
+			return fmt.Errorf(`duplicate service %q`, svc.Name)
+		}
+		names[svc.Name] = struct{}{}
+		if _, err := servicePortsOf(svc); err != nil {
+			return err
+		}
+		if err := validateKnock(svc.Knock); err != nil {
+			return fmt.Errorf(`service %q: %w`, svc.Name, err)
+		}
+	}
+	return nil
+}
+
+// hasServiceHelper reports whether a ct helper is assigned to a service.
+func (nft *NFTables) hasServiceHelper() bool {
+	for _, svc := range nft.cfg.Services {
+		if len(svc.Helper) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceRules accepts the declared services and assigns their ct helpers.
+func (nft *NFTables) serviceRules(c *nftables.Conn) error {
+	if len(nft.cfg.Services) == 0 {
+		return nil
+	}
+	if err := nft.validateServices(); err != nil {
+		return err
+	}
+	var inputHelpers, forwardHelpers []string
+	for i := range nft.cfg.Services {
+		svc := &nft.cfg.Services[i]
+		if err := nft.serviceKnockRules(c, svc); err != nil {
+			return fmt.Errorf(`service %q: %w`, svc.Name, err)
+		}
+		list, _ := servicePortsOf(svc)
+		for _, ports := range list {
+			if err := nft.serviceHelperRules(c, svc, ports); err != nil {
+				return fmt.Errorf(`service %q: %w`, svc.Name, err)
+			}
+			if err := nft.synFloodRules(c, svc, ports); err != nil {
+				return fmt.Errorf(`service %q: %w`, svc.Name, err)
+			}
+			if err := nft.serviceAcceptRules(c, svc, ports); err != nil {
+				return fmt.Errorf(`service %q: %w`, svc.Name, err)
+			}
+			if len(ports.helper) == 0 {
+				continue
+			}
+			if svc.Forward {
+				if !inStrings(forwardHelpers, ports.helper) {
+					forwardHelpers = append(forwardHelpers, ports.helper)
+				}
+			} else if !inStrings(inputHelpers, ports.helper) {
+				inputHelpers = append(inputHelpers, ports.helper)
+			}
+		}
+	}
+
+	// the connections expected by the helpers of the services
+	// cmd: nft add rule ip filter input ct state related ct helper "ftp" accept
+	for _, v := range []struct {
+		chain   *nftables.Chain
+		helpers []string
+	}{
+		{nft.cInput, inputHelpers},
+		{nft.cOutput, inputHelpers},
+		{nft.cForward, forwardHelpers},
+	} {
+		for _, helper := range v.helpers {
+			rule := &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    v.chain,
+				Exprs:    utils.JoinExprs(utils.SetConntrackStateRelated(), utils.SetCtHelper(helper)).Add(utils.Accept()),
+				UserData: []byte(`service_related_` + strings.ToLower(v.chain.Name) + `_` + helperIDName(helper)),
+			}
+			nft.addRule(c, rule)
+		}
+	}
+	return nil
+}
+
+// portSetExprs adds an anonymous set of the ports to t and returns the
+// expressions matching the protocol and the ports.
+func (nft *NFTables) portSetExprs(c *nftables.Conn, t *nftables.Table, ports servicePorts, dir utils.ExprDirection) ([]expr.Any, error) {
+	portSet := utils.GetPortSet(t)
+	if err := c.AddSet(portSet, utils.GetPortElems(ports.ports)); err != nil {
+		return nil, err
+	}
+	exprs := make([]expr.Any, 0, 6)
+	if ports.protocol == unix.IPPROTO_UDP {
+		exprs = append(exprs, utils.SetProtoUDP()...)
+	} else {
+		exprs = append(exprs, utils.SetProtoTCP()...)
+	}
+	if dir == utils.ExprDirectionSource {
+		exprs = append(exprs, utils.SetSPortSet(portSet)...)
+	} else {
+		exprs = append(exprs, utils.SetDPortSet(portSet)...)
+	}
+	return exprs, nil
+}
+
+// serviceHelperRules creates the ct helper object of the service and assigns
+// it to the new connections to the control ports.
+func (nft *NFTables) serviceHelperRules(c *nftables.Conn, svc *Service, ports servicePorts) error {
+	if len(ports.helper) == 0 {
+		return nil
+	}
+	// cmd: nft add ct helper ip filter ftp_ftp_tcp { type "ftp" protocol tcp \; }
+	name := ports.helperObjName(svc.Name)
+	obj, err := object.CtHelperObj(nft.tFilter, name, ports.helper, ports.protocol)
+	if err != nil {
+		return err
+	}
+	c.AddObj(obj)
+
+	// cmd: nft add rule ip filter PREROUTING \
+	// tcp dport { 21 } ct helper set "ftp_ftp_tcp"
+	exprs, err := nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.ExprCtHelperSet(name))
+	rule := &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cFilterPrerouting,
+		Exprs:    exprs,
+		UserData: []byte(`helper_` + name),
+	}
+	nft.addRule(c, rule)
+	if svc.Forward || nft.cOutputHelper == nil {
+		return nil
+	}
+
+	// the locally originated control connections
+	// cmd: nft add rule ip filter OUTPUT_HELPER \
+	// tcp dport { 21 } ct helper set "ftp_ftp_tcp"
+	exprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.ExprCtHelperSet(name))
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cOutputHelper,
+		Exprs:    exprs,
+		UserData: []byte(`helper_` + name + `_output`),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
+
+// serviceAcceptRules accepts the connections to the control ports and their replies.
+func (nft *NFTables) serviceAcceptRules(c *nftables.Conn, svc *Service, ports servicePorts) error {
+	chain, replyChain := nft.cInput, nft.cOutput
+	if svc.Forward {
+		chain, replyChain = nft.cForward, nft.cForward
+	}
+	id := `service_` + svc.Name + `_` + ports.protocolName()
+
+	// cmd: nft add rule ip filter input ip saddr { 10.0.0.0/8 } \
+	// tcp dport { 21 } ct state { new, established } accept
+	// cmd: nft add rule ip filter input tcp dport { 22 } ip saddr @knock_svc_ssh_2 \
+	// ct state { new, established } accept
+	exprs, err := nft.zoneAddrSet(c, nft.tFilter, utils.ExprDirectionSource, svc.Sources)
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	exprs = append(exprs, nft.knockGrantExprs(serviceKnockName(svc))...)
+	portExprs, err := nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	ctStateSet := utils.GetConntrackStateSet(nft.tFilter)
+	err = c.AddSet(ctStateSet, utils.GetConntrackStateSetElems(defaultStateWithNew))
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule := &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: []byte(id),
+	}
+	nft.addRule(c, rule)
+
+	// cmd: nft add rule ip filter output \
+	// tcp sport { 21 } ct state established accept
+	exprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionSource)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetConntrackStateEstablished()...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    replyChain,
+		Exprs:    exprs,
+		UserData: []byte(id + `_reply`),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
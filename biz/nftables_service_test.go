@@ -0,0 +1,149 @@
+package biz
+
+import (
+	"slices"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/object"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testServiceConfig() Config {
+	return Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		Services: []Service{
+			{Name: `ftp`, Helper: `ftp`, Sources: []string{`10.0.0.0/8`}},
+			{Name: `voip`, Helper: `h323`, Forward: true},
+			{Name: `pbx`, Helper: `sip`, Protocol: `udp`, Ports: []uint16{5060, 5080}},
+			{Name: `web`, Ports: []uint16{80, 443}},
+		},
+	}
+}
+
+func TestServiceRules(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testServiceConfig(), nil, RULE_SERVICE)
+	if assert.NotNil(t, nft.cFilterPrerouting) {
+		assert.Equal(t, nftables.ChainHookPrerouting, nft.cFilterPrerouting.Hooknum)
+	}
+	if assert.NotNil(t, nft.cOutputHelper) {
+		assert.Equal(t, nftables.ChainHookOutput, nft.cOutputHelper.Hooknum)
+	}
+
+	objs, err := object.List(object.NewConn(k.NetlinkConn()), nft.tFilter, nftables.ObjTypeCtHelper)
+	assert.NoError(t, err)
+	names := make([]string, len(objs))
+	for i, obj := range objs {
+		names[i] = obj.Name()
+	}
+	assert.ElementsMatch(t, []string{`ftp_ftp_tcp`, `voip_ras_udp`, `voip_q931_tcp`, `pbx_sip_udp`}, names)
+
+	rules, err := k.Rules(nft.tFilter, nft.cFilterPrerouting)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 4)
+	r, err := k.RuleByID(nft.tFilter, nft.cFilterPrerouting, []byte(`helper_voip_q931_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.ExprCtHelperSet(`voip_q931_tcp`), r.Exprs[len(r.Exprs)-1])
+		data, err := k.SetElements(nft.tFilter, r.Exprs[len(r.Exprs)-2].(*expr.Lookup).SetName)
+		assert.NoError(t, err)
+		assert.Equal(t, utils.GetPortElems([]uint16{1720})[0].Key, data[0].Key)
+	}
+
+	for chain, ids := range map[*nftables.Chain][]string{
+		nft.cInput: {`service_ftp_tcp`, `service_pbx_udp`, `service_web_tcp`,
+			`service_related_input_ftp`, `service_related_input_sip`},
+		nft.cOutput: {`service_ftp_tcp_reply`, `service_pbx_udp_reply`, `service_web_tcp_reply`,
+			`service_related_output_ftp`, `service_related_output_sip`},
+		nft.cForward: {`service_voip_udp`, `service_voip_udp_reply`, `service_voip_tcp`, `service_voip_tcp_reply`,
+			`service_related_forward_ras`, `service_related_forward_q931`},
+		// the locally originated control connections
+		nft.cOutputHelper: {`helper_ftp_ftp_tcp_output`, `helper_pbx_sip_udp_output`},
+	} {
+		rules, err := k.Rules(nft.tFilter, chain)
+		assert.NoError(t, err)
+		ruleIDs := make([]string, len(rules))
+		for i, r := range rules {
+			ruleIDs[i] = string(r.UserData)
+		}
+		assert.ElementsMatch(t, ids, ruleIDs, chain.Name)
+	}
+
+	// the related connections of the other helpers are not accepted
+	r, err = k.RuleByID(nft.tFilter, nft.cForward, []byte(`service_related_forward_q931`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.SetCtHelper(`Q.931`), utils.Exprs(r.Exprs[3:5]))
+	}
+
+	// the control connections are accepted from the sources only
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`service_ftp_tcp`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}, r.Exprs[0])
+	}
+	// applying again keeps the helpers
+	assert.NoError(t, nft.ApplyDefault(RULE_SERVICE))
+	objs, err = object.List(object.NewConn(k.NetlinkConn()), nft.tFilter, nftables.ObjTypeCtHelper)
+	assert.NoError(t, err)
+	assert.Len(t, objs, 4)
+}
+
+func TestServiceZoneDrop(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testServiceConfig(), func(cfg *Config) {
+		cfg.Zones = []Zone{{Name: `wan`, Ifaces: []string{`veth0`}, Input: `drop`, Forward: `drop`}}
+		cfg.Services = append(cfg.Services, Service{Name: `ssh`, Ports: []uint16{22}, Knock: []KnockStep{{Port: 7000}}})
+	}, RULE_ZONE|RULE_SERVICE)
+
+	// the services are accepted before the zone drops them
+	ids := ruleIDsOf(t, k, nft.cInput)
+	zone := slices.Index(ids, `zone_dispatch_input_iif`)
+	if assert.GreaterOrEqual(t, zone, 0) {
+		for _, id := range []string{`knock_svc_ssh_1`, `service_ssh_tcp`, `service_web_tcp`, `service_related_input_ftp`} {
+			assert.Contains(t, ids[:zone], id)
+		}
+	}
+	ids = ruleIDsOf(t, k, nft.cForward)
+	zone = slices.Index(ids, `zone_dispatch_forward_iif`)
+	if assert.GreaterOrEqual(t, zone, 0) {
+		assert.Contains(t, ids[:zone], `service_voip_tcp`)
+	}
+}
+
+func TestServiceOtherFamilySources(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv6, testServiceConfig(), nil, RULE_SERVICE)
+
+	// the IPv4 sources of ftp do not open the port to every IPv6 source
+	ids := ruleIDsOf(t, k, nft.cInput)
+	assert.NotContains(t, ids, `service_ftp_tcp`)
+	assert.Contains(t, ids, `service_web_tcp`)
+	assert.NotContains(t, ruleIDsOf(t, k, nft.cOutput), `service_ftp_tcp_reply`)
+}
+
+func TestServicePortsOf(t *testing.T) {
+	list, err := servicePortsOf(&Service{Name: `pbx`, Helper: `sip`})
+	assert.NoError(t, err)
+	assert.Equal(t, []servicePorts{
+		{protocol: unix.IPPROTO_UDP, ports: []uint16{5060}, helper: `sip`},
+		{protocol: unix.IPPROTO_TCP, ports: []uint16{5060}, helper: `sip`},
+	}, list)
+
+	_, err = servicePortsOf(&Service{Name: `tftp`, Helper: `tftp`, Protocol: `tcp`})
+	assert.EqualError(t, err, `service "tftp": helper "tftp" does not support protocol "tcp"`)
+	_, err = servicePortsOf(&Service{Name: `pptp`, Helper: `pptp`})
+	assert.EqualError(t, err, `service "pptp": unsupported helper "pptp"`)
+	_, err = servicePortsOf(&Service{Name: `web`})
+	assert.EqualError(t, err, `service "web": ports are required`)
+	_, err = servicePortsOf(&Service{Name: `web`, Protocol: `sctp`, Ports: []uint16{80}})
+	assert.EqualError(t, err, `service "web": unsupported protocol "sctp"`)
+
+	cfg := testServiceConfig()
+	cfg.Services = append(cfg.Services, Service{Name: `ftp`, Ports: []uint16{2121}})
+	nft := New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateServices(), `duplicate service "ftp"`)
+}
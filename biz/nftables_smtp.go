@@ -19,10 +19,11 @@ func (nft *NFTables) forwardSMTPRules(c *nftables.Conn) error {
 	exprs = append(exprs, utils.SetSPort(25)...)
 	exprs = append(exprs, utils.ExprDrop())
 	rule := &nftables.Rule{
-		Table: nft.tFilter,
-		Chain: nft.cForward,
-		Exprs: exprs,
+		Table:    nft.tFilter,
+		Chain:    nft.cForward,
+		Exprs:    exprs,
+		UserData: []byte(`forward_smtp`),
 	}
-	c.AddRule(rule)
+	nft.addRule(c, rule)
 	return nil
 }
@@ -0,0 +1,178 @@
+package biz
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// Stats of the firewall operations.
+type Stats struct {
+	Applies           uint64 // number of applies, including the failed ones
+	ApplyErrors       uint64
+	LastApply         time.Time // start of the last apply, zero if never applied
+	LastApplyDuration time.Duration
+	LastApplyError    error
+	Bans              uint64 // number of addresses banned
+	Drifts            uint64 // number of missing tables, chains and sets found by Reconcile
+}
+
+type statsRecorder struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (r *statsRecorder) applied(start time.Time, err error) {
+	r.mu.Lock()
+	r.stats.Applies++
+	if err != nil {
+		r.stats.ApplyErrors++
+	}
+	r.stats.LastApply = start
+	r.stats.LastApplyDuration = time.Since(start)
+	r.stats.LastApplyError = err
+	r.mu.Unlock()
+}
+
+func (r *statsRecorder) banned(n int) {
+	r.mu.Lock()
+	r.stats.Bans += uint64(n)
+	r.mu.Unlock()
+}
+
+func (r *statsRecorder) drifted(n int) {
+	r.mu.Lock()
+	r.stats.Drifts += uint64(n)
+	r.mu.Unlock()
+}
+
+// Stats returns a snapshot of the stats.
+func (nft *NFTables) Stats() Stats {
+	nft.stats.mu.Lock()
+	defer nft.stats.mu.Unlock()
+	return nft.stats.stats
+}
+
+// SetSizes returns the number of elements of the named sets of the filter
+// table added by the last apply, such as the trust, manager, forward and
+// blacklist sets, by set name. An interval counts as one element.
+func (nft *NFTables) SetSizes() (map[string]int, error) {
+	applied := nft.appliedSets()
+	sizes := make(map[string]int, len(applied))
+	err := nft.Do(func(c *nftables.Conn) error {
+		for _, set := range applied {
+			elems, err := c.GetSetElements(set)
+			if err != nil {
+				return fmt.Errorf(`failed to list elements of set %q: %w`, set.Name, err)
+			}
+			var size int
+			for _, elem := range elems {
+				if !elem.IntervalEnd {
+					size++
+				}
+			}
+			sizes[set.Name] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`nft.SetSizes: %w`, err)
+	}
+	return sizes, nil
+}
+
+// Reconcile applies the rules again if tables, chains or sets created by the
+// last apply were removed behind our back, e.g. by `nft flush ruleset`. It
+// returns the number of missing objects found.
+func (nft *NFTables) Reconcile() (int, error) {
+	if !nft.applied {
+		return 0, nil
+	}
+	var drifts int
+	err := nft.Do(func(c *nftables.Conn) (err error) {
+		drifts, err = nft.drifts(c)
+		return
+	})
+	if err != nil {
+		return 0, fmt.Errorf(`nft.Reconcile: %w`, err)
+	}
+	if drifts == 0 {
+		return 0, nil
+	}
+	nft.stats.drifted(drifts)
+	if err = nft.apply(nft.appliedFlag); err != nil {
+		return drifts, fmt.Errorf(`nft.Reconcile: %w`, err)
+	}
+	return drifts, nil
+}
+
+// drifts returns the number of missing tables, chains and sets.
+func (nft *NFTables) drifts(c *nftables.Conn) (int, error) {
+	// the netdev and bridge tables are listed with their own families
+	existing := map[string]bool{}
+	listed := map[nftables.TableFamily]bool{}
+	for _, table := range nft.tables {
+		if listed[table.Family] {
+			continue
+		}
+		listed[table.Family] = true
+		tables, err := c.ListTablesOfFamily(table.Family)
+		if err != nil {
+			return 0, fmt.Errorf(`failed to list tables: %w`, err)
+		}
+		chains, err := c.ListChainsOfTableFamily(table.Family)
+		if err != nil {
+			return 0, fmt.Errorf(`failed to list chains: %w`, err)
+		}
+		for _, t := range tables {
+			existing[tableKey(t)] = true
+		}
+		for _, chain := range chains {
+			existing[tableKey(chain.Table)+`/`+chain.Name] = true
+		}
+	}
+	var drifts int
+	for _, table := range nft.tables {
+		if !existing[tableKey(table)] {
+			drifts++
+		}
+	}
+	for _, chain := range nft.chains {
+		if !existing[tableKey(chain.Table)+`/`+chain.Name] {
+			drifts++
+		}
+	}
+	// the sets of the rule groups which did not run are not expected
+	applied := nft.appliedSets()
+	if len(applied) == 0 {
+		return drifts, nil
+	}
+	if !existing[tableKey(nft.tFilter)] {
+		// the sets were removed with the table
+		return drifts + len(applied), nil
+	}
+	sets, err := c.GetSets(nft.tFilter)
+	if err != nil {
+		return 0, fmt.Errorf(`failed to list sets: %w`, err)
+	}
+	for _, set := range applied {
+		var found bool
+		for _, v := range sets {
+			if v.Name == set.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			drifts++
+		}
+	}
+	return drifts, nil
+}
+
+// tableKey identifies table among the tables of all families.
+func tableKey(table *nftables.Table) string {
+	return fmt.Sprintf(`%d/%s`, table.Family, table.Name)
+}
@@ -0,0 +1,126 @@
+package biz
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcile(t *testing.T) {
+	cfg := Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_LOCAL_IFACE)
+	stats := nft.Stats()
+	assert.Equal(t, uint64(1), stats.Applies)
+	assert.NoError(t, stats.LastApplyError)
+	assert.False(t, stats.LastApply.IsZero())
+
+	drifts, err := nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drifts)
+
+	// removed by someone else
+	c := k.Conn()
+	c.DelTable(nft.tNAT)
+	c.DelSet(nft.filterSetTrustIP)
+	assert.NoError(t, c.Flush())
+
+	drifts, err = nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, drifts) // nat table, its two chains and trust_ipset
+	stats = nft.Stats()
+	assert.Equal(t, uint64(4), stats.Drifts)
+	assert.Equal(t, uint64(2), stats.Applies)
+
+	drifts, err = nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drifts)
+
+	sizes, err := nft.SetSizes()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, sizes[nft.filterSetTrustIP.Name])
+}
+
+func TestReconcileOtherFamilies(t *testing.T) {
+	cfg := Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		WanIface:      `eth0`,
+		EarlyDrop:     true,
+		Mirrors: []Mirror{
+			{Name: `all`, Iface: `eth1`, To: loIface},
+		},
+		Bridges: []Bridge{{
+			Name:  `br0`,
+			Ports: []BridgePort{{Iface: `vnet0`, MACs: []string{`52:54:00:00:00:01`}}},
+		}},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_EARLY_DROP|RULE_BRIDGE)
+	assert.NotNil(t, nft.tBridge)
+
+	// the netdev and bridge tables and their chains are not counted as missing
+	drifts, err := nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drifts)
+
+	c := k.Conn()
+	c.DelChain(nft.ingressChain(`eth1`))
+	c.DelTable(nft.tBridge)
+	assert.NoError(t, c.Flush())
+	drifts, err = nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, drifts) // INGRESS_eth1, the bridge table and its two chains
+}
+
+func TestReconcileRuleGroupSets(t *testing.T) {
+	cfg := Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		SynFlood:      SynFloodLimit,
+		Services:      []Service{{Name: `web`, Ports: []uint16{80}}},
+		AntiSpoof:     []AntiSpoof{{Iface: `eth0`, Bogons: true}},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_LOCAL_IFACE)
+
+	// syn_limit and bogon_ipset are not created without their rule groups
+	drifts, err := nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drifts)
+	sizes, err := nft.SetSizes()
+	assert.NoError(t, err)
+	assert.Len(t, sizes, 4)
+	assert.NotContains(t, sizes, nft.filterSetSynLimit.Name)
+
+	assert.NoError(t, nft.ApplyDefault(RULE_SERVICE|RULE_ANTISPOOF))
+	sizes, err = nft.SetSizes()
+	assert.NoError(t, err)
+	assert.Contains(t, sizes, nft.filterSetSynLimit.Name)
+	assert.Contains(t, sizes, nft.filterSetBogonIP.Name)
+
+	// only the sets created by the rule groups are expected
+	cfg.DisableInitSet = true
+	k.Reset()
+	nft = newTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, k)
+	require.NoError(t, nft.ApplyDefault(RULE_SERVICE))
+	sizes, err = nft.SetSizes()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{nft.filterSetSynLimit.Name: 0}, sizes)
+	drifts, err = nft.Reconcile()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, drifts)
+}
+
+func TestBanStats(t *testing.T) {
+	cfg := Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+	}
+	nft, _ := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_LOCAL_IFACE)
+	// the IPv6 address is not added to the IPv4 blacklist
+	assert.NoError(t, nft.Ban([]string{`10.0.0.1`, `10.0.1.0/24`, `10.0.2.1-10.0.2.9`, `2001:db8::1`}, 0))
+	assert.Equal(t, uint64(3), nft.Stats().Bans)
+}
@@ -0,0 +1,252 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultSynProxyMSS    = 1460
+	defaultSynProxyWscale = 7
+	defaultSynLimitRate   = `25/p/s`
+	synLimitTimeout       = time.Minute
+)
+
+// initSynFlood creates the dynamic set of the SYN rate limits by source and
+// destination port, the services don't share the limit of a source.
+func (nft *NFTables) initSynFlood() {
+	nft.filterSetSynLimit = nil
+	if nft.cfg.SynFlood != SynFloodLimit || len(nft.cfg.Services) == 0 {
+		return
+	}
+	addrType := nftables.TypeIPAddr
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		addrType = nftables.TypeIP6Addr
+	}
+	keyType, _ := nftables.ConcatSetType(addrType, nftables.TypeInetService)
+	nft.filterSetSynLimit = &nftables.Set{
+		Name:          `syn_limit`,
+		Table:         nft.tFilter,
+		KeyType:       keyType,
+		Concatenation: true,
+		Dynamic:       true,
+		HasTimeout:    true,
+		Timeout:       synLimitTimeout,
+	}
+	nft.sets = append(nft.sets, nft.filterSetSynLimit)
+}
+
+// synLimitRate returns the rate over which the SYNs of a source are dropped.
+func (nft *NFTables) synLimitRate() string {
+	rate := nft.cfg.SynLimitRate
+	if len(rate) == 0 {
+		rate = defaultSynLimitRate
+	}
+	parts := strings.SplitN(rate, `/`, 2)
+	if !strings.HasSuffix(parts[0], `+`) {
+		parts[0] += `+`
+	}
+	return strings.Join(parts, `/`)
+}
+
+// synFloodRules protects the TCP ports of the service against SYN floods
+// with the per-source limit, see synProxyServiceRules for synproxy.
+func (nft *NFTables) synFloodRules(c *nftables.Conn, svc *Service, ports servicePorts) error {
+	if ports.protocol != unix.IPPROTO_TCP || nft.cfg.SynFlood != SynFloodLimit {
+		return nil
+	}
+	return nft.synLimitRules(c, svc, ports)
+}
+
+// synProxyServiceRules protects the TCP ports of the services with synproxy.
+// The rules precede the zone and service rules, which would otherwise drop
+// the untracked SYNs before synproxy answers them.
+//
+// synproxy requires the ACKs of unknown connections to be seen as invalid:
+//
+//	sysctl -w net.netfilter.nf_conntrack_tcp_loose=0
+func (nft *NFTables) synProxyServiceRules(c *nftables.Conn) error {
+	if nft.cfg.SynFlood != SynFloodSynproxy || len(nft.cfg.Services) == 0 {
+		return nil
+	}
+	for i := range nft.cfg.Services {
+		svc := &nft.cfg.Services[i]
+		list, err := servicePortsOf(svc)
+		if err != nil {
+			return err
+		}
+		for _, ports := range list {
+			if ports.protocol != unix.IPPROTO_TCP {
+				continue
+			}
+			if err := nft.synProxyRules(c, svc, ports); err != nil {
+				return fmt.Errorf(`service %q: %w`, svc.Name, err)
+			}
+		}
+	}
+	nft.synProxyInvalidRules(c)
+	return nil
+}
+
+// synProxyRules answers the SYNs to the ports with syncookies, the connections
+// reach the service once the handshake is completed. Like the accept rule of
+// the service, synproxy only answers the allowed sources which knocked: the
+// other SYNs are left tracked, or dropped if they could not be told apart
+// before conntrack, so the port does not show as open.
+func (nft *NFTables) synProxyRules(c *nftables.Conn, svc *Service, ports servicePorts) error {
+	// cmd: nft add rule ip raw prerouting fib daddr type local ip saddr { 10.0.0.0/8 } \
+	// tcp dport { 80, 443 } tcp flags syn notrack
+	exprs, err := nft.zoneAddrSet(c, nft.tRaw, utils.ExprDirectionSource, svc.Sources)
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	if !svc.Forward {
+		// the SYNs forwarded to the same port stay tracked for DNAT and masquerade
+		exprs = append(utils.SetFibDAddrTypeLocal(), exprs...)
+	}
+	portExprs, err := nft.portSetExprs(c, nft.tRaw, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, utils.SetTCPFlagSYN()...)
+	exprs = append(exprs, utils.ExprNotrack())
+	rule := &nftables.Rule{
+		Table:    nft.tRaw,
+		Chain:    nft.cRawPrerouting,
+		Exprs:    exprs,
+		UserData: []byte(`raw_synproxy_` + svc.Name),
+	}
+	nft.addRule(c, rule)
+
+	// cmd: nft add rule ip filter input ip saddr { 10.0.0.0/8 } ip saddr @knock_svc_ssh_2 \
+	// tcp dport { 80, 443 } ct state invalid,untracked \
+	// synproxy mss 1460 wscale 7 timestamp sack-perm
+	mss := nft.cfg.SynProxyMSS
+	if mss == 0 {
+		mss = defaultSynProxyMSS
+	}
+	wscale := nft.cfg.SynProxyWscale
+	if wscale == 0 {
+		wscale = defaultSynProxyWscale
+	}
+	exprs, err = nft.zoneAddrSet(c, nft.tFilter, utils.ExprDirectionSource, svc.Sources)
+	if err != nil {
+		return err
+	}
+	if seq, ok := nft.knocks[serviceKnockName(svc)]; ok {
+		// the knocking rules of the service follow the synproxy rules
+		if err = nft.addSet(c, seq.grantSet(), nil); err != nil {
+			return fmt.Errorf(`nft.AddSet(%q): %w`, seq.grantSet().Name, err)
+		}
+	}
+	knockExprs := nft.knockGrantExprs(serviceKnockName(svc))
+	exprs = append(exprs, knockExprs...)
+	portExprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, utils.SetSynProxy(mss, wscale, true, true)...)
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.serviceChain(svc),
+		Exprs:    exprs,
+		UserData: []byte(`synproxy_` + svc.Name),
+	}
+	nft.addRule(c, rule)
+	if len(knockExprs) == 0 {
+		return nil
+	}
+
+	// the knock grant cannot be matched in the raw table
+	// cmd: nft add rule ip filter input tcp dport { 22 } ct state untracked drop
+	exprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetConntrackStateUntracked()...)
+	exprs = append(exprs, utils.Drop())
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.serviceChain(svc),
+		Exprs:    exprs,
+		UserData: []byte(`synproxy_untracked_` + svc.Name),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
+
+// synProxyInvalidRules drops the invalid packets which were not taken by synproxy.
+func (nft *NFTables) synProxyInvalidRules(c *nftables.Conn) {
+	var chains []*nftables.Chain
+	for i := range nft.cfg.Services {
+		chain := nft.serviceChain(&nft.cfg.Services[i])
+		if !inChains(chains, chain) {
+			chains = append(chains, chain)
+		}
+	}
+	for _, chain := range chains {
+		// cmd: nft add rule ip filter input ct state invalid drop
+		rule := &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    chain,
+			Exprs:    utils.SetConntrackStateInvalid().Add(utils.Drop()),
+			UserData: []byte(`synproxy_invalid_` + strings.ToLower(chain.Name)),
+		}
+		nft.addRule(c, rule)
+	}
+}
+
+// synLimitRules drops the SYNs to the ports over the rate of the source by port.
+func (nft *NFTables) synLimitRules(c *nftables.Conn, svc *Service, ports servicePorts) error {
+	if err := nft.addSet(c, nft.filterSetSynLimit, nil); err != nil {
+		return err
+	}
+	// cmd: nft add rule ip filter input tcp dport { 80, 443 } tcp flags syn \
+	// add @syn_limit { ip saddr . tcp dport limit rate over 25/second } drop
+	exprs, err := nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetTCPFlagSYN()...)
+	exprs = append(exprs, utils.SetSAddrDPort(nft.tableFamily == nftables.TableFamilyIPv6)...)
+	limitExprs, err := utils.SetDynamicLimitDropSet(nft.filterSetSynLimit, nft.synLimitRate(), nft.cfg.SynLimitBurst)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, limitExprs...)
+	rule := &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.serviceChain(svc),
+		Exprs:    exprs,
+		UserData: []byte(`syn_limit_` + svc.Name),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
+
+func (nft *NFTables) serviceChain(svc *Service) *nftables.Chain {
+	if svc.Forward {
+		return nft.cForward
+	}
+	return nft.cInput
+}
+
+func inChains(chains []*nftables.Chain, chain *nftables.Chain) bool {
+	for _, v := range chains {
+		if v == chain {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package biz
+
+import (
+	"slices"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSynFloodConfig(mode string) Config {
+	return Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		SynFlood:       mode,
+		Services: []Service{
+			{Name: `web`, Ports: []uint16{80, 443}},
+			{Name: `dns`, Protocol: `udp`, Ports: []uint16{53}},
+			{Name: `backend`, Ports: []uint16{8080}, Forward: true},
+		},
+	}
+}
+
+func ruleIDsOf(t *testing.T, k *nftest.Kernel, chain *nftables.Chain) []string {
+	rules, err := k.Rules(chain.Table, chain)
+	assert.NoError(t, err)
+	ids := make([]string, len(rules))
+	for i, r := range rules {
+		ids[i] = string(r.UserData)
+	}
+	return ids
+}
+
+func TestSynProxyRules(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testSynFloodConfig(SynFloodSynproxy), nil, RULE_SERVICE)
+	assert.NotNil(t, nft.tRaw)
+	assert.Nil(t, nft.filterSetSynLimit)
+
+	assert.Equal(t, []string{`raw_synproxy_web`, `raw_synproxy_backend`}, ruleIDsOf(t, k, nft.cRawPrerouting))
+	assert.Equal(t, []string{
+		`synproxy_web`, `synproxy_invalid_input`,
+		`service_web_tcp`,
+		`service_dns_udp`,
+	}, ruleIDsOf(t, k, nft.cInput))
+	assert.Equal(t, []string{
+		`synproxy_backend`, `synproxy_invalid_forward`,
+		`service_backend_tcp`, `service_backend_tcp_reply`,
+	}, ruleIDsOf(t, k, nft.cForward))
+
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`synproxy_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, &expr.SynProxy{Mss: 1460, Wscale: 7, Timestamp: true, SackPerm: true, MssValueSet: true, WscaleValueSet: true}, r.Exprs[len(r.Exprs)-1])
+	}
+	r, err = k.RuleByID(nft.tRaw, nft.cRawPrerouting, []byte(`raw_synproxy_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		exprs := r.Exprs[len(r.Exprs)-4:]
+		assert.Equal(t, []expr.Any(utils.SetTCPFlagSYN().Add(utils.ExprNotrack())), exprs)
+		// the SYNs forwarded through the host are left tracked
+		assert.Equal(t, []expr.Any(utils.SetFibDAddrTypeLocal()), r.Exprs[:len(utils.SetFibDAddrTypeLocal())])
+	}
+	r, err = k.RuleByID(nft.tRaw, nft.cRawPrerouting, []byte(`raw_synproxy_backend`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.NotContains(t, r.Exprs, utils.SetFibDAddrTypeLocal()[0])
+	}
+}
+
+func TestSynProxyZoneDrop(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testSynFloodConfig(SynFloodSynproxy), func(cfg *Config) {
+		cfg.Zones = []Zone{{Name: `public`, Ifaces: []string{`eth0`}, Input: `drop`}}
+	}, RULE_ZONE|RULE_SERVICE)
+
+	// the untracked SYNs reach synproxy before the zone drops them
+	ids := ruleIDsOf(t, k, nft.cInput)
+	if assert.GreaterOrEqual(t, len(ids), 3) {
+		assert.Equal(t, []string{`synproxy_web`, `synproxy_invalid_input`}, ids[:2])
+		assert.Less(t, slices.Index(ids, `service_web_tcp`), slices.Index(ids, `zone_dispatch_input_iif`))
+	}
+}
+
+func TestSynLimitRules(t *testing.T) {
+	cfg := testSynFloodConfig(SynFloodLimit)
+	cfg.SynLimitRate = `10/p/s`
+	cfg.SynLimitBurst = 20
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_SERVICE)
+	assert.Nil(t, nft.tRaw)
+	assert.Equal(t, `10+/p/s`, nft.synLimitRate())
+
+	assert.Equal(t, []string{`syn_limit_web`, `service_web_tcp`, `service_dns_udp`}, ruleIDsOf(t, k, nft.cInput))
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`syn_limit_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		var dynset *expr.Dynset
+		for i, e := range r.Exprs {
+			if v, ok := e.(*expr.Dynset); ok {
+				dynset = v
+				// the limits are kept by source and port
+				assert.Equal(t, utils.SetSAddrDPort(false), utils.Exprs(r.Exprs[i-2:i]))
+			}
+		}
+		if assert.NotNil(t, dynset) {
+			assert.Equal(t, `syn_limit`, dynset.SetName)
+			assert.Equal(t, &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Over: true, Unit: expr.LimitTimeSecond, Burst: 20}, dynset.Exprs[0])
+		}
+		assert.Equal(t, utils.Drop(), r.Exprs[len(r.Exprs)-1])
+	}
+	sets, err := k.Sets(nft.tFilter)
+	assert.NoError(t, err)
+	var found bool
+	for _, set := range sets {
+		if set.Name == `syn_limit` {
+			found = true
+			assert.True(t, set.Dynamic)
+			assert.True(t, set.Concatenation)
+			assert.Equal(t, `ipv4_addr . inet_service`, set.KeyType.Name)
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestSynProxyRestrictedService(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, testSynFloodConfig(SynFloodSynproxy), func(cfg *Config) {
+		cfg.Services = []Service{
+			{Name: `web`, Ports: []uint16{80}, Sources: []string{`10.0.0.0/8`}},
+			{Name: `ssh`, Ports: []uint16{22}, Knock: []KnockStep{{Port: 7000}, {Port: 8000}}},
+		}
+	}, RULE_SERVICE)
+
+	ids := ruleIDsOf(t, k, nft.cInput)
+	if assert.GreaterOrEqual(t, len(ids), 4) {
+		assert.Equal(t, []string{`synproxy_web`, `synproxy_ssh`, `synproxy_untracked_ssh`, `synproxy_invalid_input`}, ids[:4])
+	}
+	lookups := func(r *nftables.Rule) []string {
+		var names []string
+		for _, e := range r.Exprs {
+			if v, ok := e.(*expr.Lookup); ok {
+				names = append(names, v.SetName)
+			}
+		}
+		return names
+	}
+
+	// the sources are restricted before conntrack
+	r, err := k.RuleByID(nft.tRaw, nft.cRawPrerouting, []byte(`raw_synproxy_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Len(t, lookups(r), 2) // sources and ports
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`synproxy_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Len(t, lookups(r), 2)
+	}
+
+	// only the sources which knocked get a SYN-ACK
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`synproxy_ssh`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Contains(t, lookups(r), `knock_svc_ssh_2`)
+	}
+	r, err = k.RuleByID(nft.tFilter, nft.cInput, []byte(`synproxy_untracked_ssh`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.Drop(), r.Exprs[len(r.Exprs)-1])
+	}
+}
+
+func TestSynProxyOtherFamilySources(t *testing.T) {
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv6, testSynFloodConfig(SynFloodSynproxy), func(cfg *Config) {
+		cfg.Services = []Service{{Name: `web`, Ports: []uint16{80}, Sources: []string{`10.0.0.0/8`}}}
+	}, RULE_SERVICE)
+
+	assert.NotContains(t, ruleIDsOf(t, k, nft.cRawPrerouting), `raw_synproxy_web`)
+	ids := ruleIDsOf(t, k, nft.cInput)
+	assert.NotContains(t, ids, `synproxy_web`)
+	assert.NotContains(t, ids, `service_web_tcp`)
+}
@@ -10,12 +10,45 @@ import (
 	"time"
 
 	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
 	"github.com/admpub/nftablesutils/rule"
 	setutils "github.com/admpub/nftablesutils/set"
 	"github.com/google/nftables"
+	"github.com/mdlayher/netlink/nltest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// setTestDial makes nft use a fake netlink connection, such as nftest.Kernel.Dial.
+func setTestDial(nft *NFTables, dial nltest.Func) {
+	WithConnOptions(nftables.WithTestDial(dial))(nft)
+}
+
+// newTestNFTables returns an initialised NFTables of cfg adjusted by mutate,
+// which talks to the fake kernel k unless k is nil.
+func newTestNFTables(t *testing.T, family nftables.TableFamily, cfg Config, mutate func(*Config), k *nftest.Kernel, managerPorts ...uint16) *NFTables {
+	t.Helper()
+	if mutate != nil {
+		mutate(&cfg)
+	}
+	nft := New(family, cfg, managerPorts)
+	require.NoError(t, nft.Init())
+	if k != nil {
+		setTestDial(nft, k.Dial)
+	}
+	return nft
+}
+
+// applyTestNFTables applies the rule groups of flag to a new fake kernel with
+// the NFTables returned by newTestNFTables.
+func applyTestNFTables(t *testing.T, family nftables.TableFamily, cfg Config, mutate func(*Config), flag int, managerPorts ...uint16) (*NFTables, *nftest.Kernel) {
+	t.Helper()
+	k := nftest.New()
+	nft := newTestNFTables(t, family, cfg, mutate, k, managerPorts...)
+	require.NoError(t, nft.ApplyDefault(flag))
+	return nft, k
+}
+
 func testServer() {
 	err := http.ListenAndServe(`:14444`, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
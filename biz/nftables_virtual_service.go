@@ -0,0 +1,286 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// virtualService is a parsed VirtualService.
+type virtualService struct {
+	*VirtualService
+	ip       net.IP
+	port     uint16
+	protocol uint8
+	backends []utils.Backend
+}
+
+func (vs *virtualService) isIPv6() bool {
+	return vs.ip.To4() == nil
+}
+
+// backendPorts returns the distinct ports of the backends.
+func (vs *virtualService) backendPorts() []uint16 {
+	var ports []uint16
+	seen := map[uint16]struct{}{}
+	for _, b := range vs.backends {
+		if _, ok := seen[b.Port]; ok {
+			continue
+		}
+		seen[b.Port] = struct{}{}
+		ports = append(ports, b.Port)
+	}
+	return ports
+}
+
+// backendAddrs returns the addresses of the backends.
+func (vs *virtualService) backendAddrs() []string {
+	addrs := make([]string, len(vs.backends))
+	for i, b := range vs.backends {
+		addrs[i] = b.IP.String()
+	}
+	return addrs
+}
+
+// selectorExprs returns the expressions selecting the key of the backend map.
+func (vs *virtualService) selectorExprs(mod uint32) []expr.Any {
+	switch vs.Scheduler {
+	case SchedulerRandom:
+		return utils.SetNumgenRandom(mod)
+	case SchedulerHash:
+		return utils.SetJhashSAddrSPort(vs.isIPv6(), mod, 0)
+	default:
+		return utils.SetNumgenInc(mod)
+	}
+}
+
+// splitHostPort splits ip:port, or returns the IP and defaultPort if address
+// has no port.
+func splitHostPort(address string, defaultPort uint16) (net.IP, uint16, error) {
+	host, port := address, defaultPort
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || n == 0 {
+			return nil, 0, fmt.Errorf(`invalid port of %q`, address)
+		}
+		host, port = h, uint16(n)
+	}
+	ip := net.ParseIP(strings.Trim(host, `[]`))
+	if ip == nil {
+		return nil, 0, fmt.Errorf(`invalid address %q`, address)
+	}
+	return ip, port, nil
+}
+
+// parseVirtualService checks the frontend, the scheduler and the backends of vs.
+func parseVirtualService(vs *VirtualService) (*virtualService, error) {
+	protocol, err := serviceProtocol(vs.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	switch vs.Scheduler {
+	case ``, SchedulerRoundRobin, SchedulerRandom, SchedulerHash:
+	default:
+		return nil, fmt.Errorf(`unsupported scheduler %q`, vs.Scheduler)
+	}
+	ip, port, err := splitHostPort(vs.Frontend, 0)
+	if err != nil {
+		return nil, fmt.Errorf(`frontend: %w`, err)
+	}
+	if port == 0 {
+		return nil, fmt.Errorf(`frontend: port of %q is required`, vs.Frontend)
+	}
+	if len(vs.Backends) == 0 {
+		return nil, fmt.Errorf(`backends are required`)
+	}
+	p := &virtualService{VirtualService: vs, ip: ip, port: port, protocol: protocol}
+	for _, backend := range vs.Backends {
+		bip, bport, err := splitHostPort(backend.Address, port)
+		if err != nil {
+			return nil, fmt.Errorf(`backend: %w`, err)
+		}
+		if (bip.To4() == nil) != p.isIPv6() {
+			return nil, fmt.Errorf(`backend %q: address family differs from the frontend`, backend.Address)
+		}
+		p.backends = append(p.backends, utils.Backend{IP: bip, Port: bport, Weight: backend.Weight})
+	}
+	return p, nil
+}
+
+// virtualServices returns the parsed virtual services of the table family.
+func (nft *NFTables) virtualServices() ([]*virtualService, error) {
+	names := map[string]struct{}{}
+	var list []*virtualService
+	for i := range nft.cfg.VirtualServices {
+		vs := &nft.cfg.VirtualServices[i]
+		if len(vs.Name) == 0 {
+			return nil, fmt.Errorf(`virtual service name is required`)
+		}
+		if _, ok := names[vs.Name]; ok {
+			return nil, fmt.Errorf(`duplicate virtual service %q`, vs.Name)
+		}
+		names[vs.Name] = struct{}{}
+		p, err := parseVirtualService(vs)
+		if err != nil {
+			return nil, fmt.Errorf(`virtual service %q: %w`, vs.Name, err)
+		}
+		if p.isIPv6() == (nft.tableFamily == nftables.TableFamilyIPv6) {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
+
+// virtualServiceRules translates the connections to the frontends to the
+// backends selected by the schedulers, and accepts them in the forward chain.
+func (nft *NFTables) virtualServiceRules(c *nftables.Conn) error {
+	list, err := nft.virtualServices()
+	if err != nil {
+		return err
+	}
+	for _, vs := range list {
+		if err = nft.virtualServiceDNATRule(c, vs); err != nil {
+			return fmt.Errorf(`virtual service %q: %w`, vs.Name, err)
+		}
+		if err = nft.virtualServiceForwardRules(c, vs); err != nil {
+			return fmt.Errorf(`virtual service %q: %w`, vs.Name, err)
+		}
+	}
+	return nil
+}
+
+// virtualServiceDNATRule adds the map of the backends and the DNAT rule of
+// the frontend.
+func (nft *NFTables) virtualServiceDNATRule(c *nftables.Conn, vs *virtualService) error {
+	m, err := utils.GetDNATMap(nft.tNAT, vs.isIPv6(), true)
+	if err != nil {
+		return err
+	}
+	elems, err := utils.GetDNATMapElems(vs.backends, vs.isIPv6(), true)
+	if err != nil {
+		return err
+	}
+	if err = c.AddSet(m, elems); err != nil {
+		return err
+	}
+
+	// cmd: nft add rule ip nat prerouting ip daddr 203.0.113.1 tcp dport 80 \
+	// dnat to numgen inc mod 3 map { 0 : 10.0.0.1 . 8080, 1 : 10.0.0.1 . 8080, 2 : 10.0.0.2 . 8080 }
+	exprs, err := utils.SetCIDRMatcher(utils.ExprDirectionDestination, vs.ip.String(), false)
+	if err != nil {
+		return err
+	}
+	portExprs, err := nft.portSetExprs(c, nft.tNAT, servicePorts{protocol: vs.protocol, ports: []uint16{vs.port}}, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, vs.selectorExprs(uint32(len(elems)))...)
+	exprs = append(exprs, utils.SetDNATMap(m, vs.isIPv6(), true)...)
+	rule := &nftables.Rule{
+		Table:    nft.tNAT,
+		Chain:    nft.cPrerouting,
+		Exprs:    exprs,
+		UserData: []byte(`virtual_service_` + vs.Name),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
+
+// virtualServiceForwardRules accepts the translated connections to the
+// backends and their replies, and masquerades them if required.
+func (nft *NFTables) virtualServiceForwardRules(c *nftables.Conn, vs *virtualService) error {
+	id := `virtual_service_` + vs.Name
+	ports := servicePorts{protocol: vs.protocol, ports: vs.backendPorts()}
+
+	// cmd: nft add rule ip filter FORWARD ct status dnat ip daddr { 10.0.0.1, 10.0.0.2 } \
+	// tcp dport { 8080 } ct state { new, established } accept
+	exprs := utils.SetConntrackStatusDNAT()
+	addrExprs, err := nft.zoneAddrSet(c, nft.tFilter, utils.ExprDirectionDestination, vs.backendAddrs())
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	exprs = append(exprs, addrExprs...)
+	portExprs, err := nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	ctStateSet := utils.GetConntrackStateSet(nft.tFilter)
+	if err = c.AddSet(ctStateSet, utils.GetConntrackStateSetElems(defaultStateWithNew)); err != nil {
+		return err
+	}
+	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule := &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cForward,
+		Exprs:    exprs,
+		UserData: []byte(id + `_forward`),
+	}
+	nft.addRule(c, rule)
+
+	// cmd: nft add rule ip filter FORWARD ct status dnat ip saddr { 10.0.0.1, 10.0.0.2 } \
+	// tcp sport { 8080 } ct state established accept
+	exprs = utils.SetConntrackStatusDNAT()
+	addrExprs, err = nft.zoneAddrSet(c, nft.tFilter, utils.ExprDirectionSource, vs.backendAddrs())
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	exprs = append(exprs, addrExprs...)
+	portExprs, err = nft.portSetExprs(c, nft.tFilter, ports, utils.ExprDirectionSource)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, utils.SetConntrackStateEstablished()...)
+	exprs = append(exprs, utils.ExprAccept())
+	rule = &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    nft.cForward,
+		Exprs:    exprs,
+		UserData: []byte(id + `_reply`),
+	}
+	nft.addRule(c, rule)
+
+	if !vs.Masquerade {
+		return nil
+	}
+	// cmd: nft add rule ip nat postrouting ct status dnat ip daddr { 10.0.0.1, 10.0.0.2 } \
+	// tcp dport { 8080 } masquerade
+	exprs = utils.SetConntrackStatusDNAT()
+	addrExprs, err = nft.zoneAddrSet(c, nft.tNAT, utils.ExprDirectionDestination, vs.backendAddrs())
+	if err != nil {
+		if errors.Is(err, errNoFamilySource) {
+			return nil
+		}
+		return err
+	}
+	exprs = append(exprs, addrExprs...)
+	portExprs, err = nft.portSetExprs(c, nft.tNAT, ports, utils.ExprDirectionDestination)
+	if err != nil {
+		return err
+	}
+	exprs = append(exprs, portExprs...)
+	exprs = append(exprs, utils.ExprMasquerade(0, 0))
+	rule = &nftables.Rule{
+		Table:    nft.tNAT,
+		Chain:    nft.cPostrouting,
+		Exprs:    exprs,
+		UserData: []byte(id + `_masq`),
+	}
+	nft.addRule(c, rule)
+	return nil
+}
@@ -0,0 +1,99 @@
+package biz
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestVirtualServiceRules(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		VirtualServices: []VirtualService{
+			{Name: `web`, Frontend: `203.0.113.1:80`, Backends: []VirtualBackend{
+				{Address: `10.0.0.1:8080`, Weight: 2},
+				{Address: `10.0.0.2`},
+			}, Masquerade: true},
+			{Name: `dns`, Frontend: `203.0.113.1:53`, Protocol: `udp`, Scheduler: SchedulerHash, Backends: []VirtualBackend{
+				{Address: `10.0.0.3`},
+			}},
+			{Name: `web6`, Frontend: `[2001:db8::1]:80`, Backends: []VirtualBackend{{Address: `[2001:db8::2]:80`}}},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_VIRTUAL_SERVICE)
+
+	// the IPv6 virtual service is left to the IPv6 table
+	assert.Equal(t, []string{`virtual_service_web`, `virtual_service_dns`}, ruleIDsOf(t, k, nft.cPrerouting))
+	assert.Equal(t, []string{
+		`virtual_service_web_forward`, `virtual_service_web_reply`,
+		`virtual_service_dns_forward`, `virtual_service_dns_reply`,
+	}, ruleIDsOf(t, k, nft.cForward))
+	assert.Equal(t, []string{`virtual_service_web_masq`}, ruleIDsOf(t, k, nft.cPostrouting))
+
+	r, err := k.RuleByID(nft.tNAT, nft.cPrerouting, []byte(`virtual_service_web`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		n := len(r.Exprs)
+		assert.Equal(t, &expr.Numgen{Register: 1, Modulus: 3, Type: unix.NFT_NG_INCREMENTAL}, r.Exprs[n-3])
+		m := r.Exprs[n-2].(*expr.Lookup)
+		elems, err := k.SetElements(nft.tNAT, m.SetName)
+		assert.NoError(t, err)
+		if assert.Len(t, elems, 3) {
+			// the port of the frontend is used if a backend has no port
+			assert.Equal(t, []byte{10, 0, 0, 2, 0, 80, 0, 0}, elems[2].Val)
+		}
+		assert.Equal(t, &expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 9}, r.Exprs[n-1])
+	}
+	r, err = k.RuleByID(nft.tNAT, nft.cPrerouting, []byte(`virtual_service_dns`))
+	assert.NoError(t, err)
+	if assert.NotNil(t, r) {
+		assert.Equal(t, utils.ExprJhash(1, 1, 8, 1, 0), r.Exprs[len(r.Exprs)-3])
+	}
+}
+
+func TestParseVirtualService(t *testing.T) {
+	for _, c := range []struct {
+		vs  VirtualService
+		err string
+	}{
+		{VirtualService{Frontend: `10.0.0.1:80`, Scheduler: `lc`}, `unsupported scheduler "lc"`},
+		{VirtualService{Frontend: `10.0.0.1`}, `frontend: port of "10.0.0.1" is required`},
+		{VirtualService{Frontend: `host:80`}, `frontend: invalid address "host:80"`},
+		{VirtualService{Frontend: `10.0.0.1:80`}, `backends are required`},
+		{VirtualService{Frontend: `10.0.0.1:80`, Backends: []VirtualBackend{{Address: `10.0.0.2:0`}}}, `backend: invalid port of "10.0.0.2:0"`},
+		{VirtualService{Frontend: `10.0.0.1:80`, Backends: []VirtualBackend{{Address: `2001:db8::2`}}}, `backend "2001:db8::2": address family differs from the frontend`},
+	} {
+		_, err := parseVirtualService(&c.vs)
+		assert.EqualError(t, err, c.err)
+	}
+	vs, err := parseVirtualService(&VirtualService{Frontend: `[2001:db8::1]:443`, Backends: []VirtualBackend{{Address: `2001:db8::2`}, {Address: `[2001:db8::3]:8443`}}})
+	assert.NoError(t, err)
+	assert.True(t, vs.isIPv6())
+	assert.Equal(t, []uint16{443, 8443}, vs.backendPorts())
+}
+
+func TestVirtualServiceZoneForward(t *testing.T) {
+	cfg := Config{
+		Enabled:        true,
+		DefaultPolicy:  `drop`,
+		DisableInitSet: true,
+		Zones:          []Zone{{Name: `wan`, Ifaces: []string{`eth0`}, Forward: `drop`}},
+		VirtualServices: []VirtualService{
+			{Name: `web`, Frontend: `203.0.113.1:80`, Backends: []VirtualBackend{{Address: `10.0.0.1:8080`}}},
+		},
+	}
+	nft, k := applyTestNFTables(t, nftables.TableFamilyIPv4, cfg, nil, RULE_ZONE|RULE_VIRTUAL_SERVICE)
+
+	// the translated connections are accepted before the zone drops them
+	ids := ruleIDsOf(t, k, nft.cForward)
+	if assert.GreaterOrEqual(t, len(ids), 3) {
+		assert.Equal(t, []string{`virtual_service_web_forward`, `virtual_service_web_reply`}, ids[:2])
+		assert.Equal(t, `zone_dispatch_forward_iif`, ids[2])
+	}
+}
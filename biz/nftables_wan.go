@@ -0,0 +1,170 @@
+package biz
+
+import (
+	"fmt"
+	"net"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// defaultRoutes of the table family in the configured network namespace.
+func (nft *NFTables) defaultRoutes() ([]utils.DefaultRoute, error) {
+	family := unix.AF_INET
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		family = unix.AF_INET6
+	}
+	if len(nft.cfg.NetworkNamespace) == 0 {
+		return utils.DefaultRoutes(family)
+	}
+	ns, err := netns.GetFromName(nft.cfg.NetworkNamespace)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to netns.GetFromName(%q): %w`, nft.cfg.NetworkNamespace, err)
+	}
+	defer ns.Close()
+	return utils.DefaultRoutesAt(ns, family)
+}
+
+// selectWans picks the WAN interfaces from the default routes.
+// The first one is the primary WAN: Config.WanIface if set, otherwise the
+// route with the lowest metric. Config.WanIfaces are appended for multi-WAN
+// SNAT. Named interfaces without a default route are kept with an empty
+// gateway. Only the routes of the main table are used, unless Config.WanTable
+// names another table, so that the default routes of policy routing and VRF
+// tables are not taken for the WAN.
+func selectWans(routes []utils.DefaultRoute, cfg *Config) ([]utils.DefaultRoute, error) {
+	table := cfg.WanTable
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	var tableRoutes []utils.DefaultRoute
+	for _, r := range routes {
+		if r.Table == table {
+			tableRoutes = append(tableRoutes, r)
+		}
+	}
+	routes = tableRoutes
+	byName := func(name string) utils.DefaultRoute {
+		for _, r := range routes {
+			if r.Iface == name {
+				return r
+			}
+		}
+		return utils.DefaultRoute{Iface: name}
+	}
+	var wans []utils.DefaultRoute
+	add := func(r utils.DefaultRoute) {
+		for _, w := range wans {
+			if w.Iface == r.Iface {
+				return
+			}
+		}
+		wans = append(wans, r)
+	}
+	switch {
+	case len(cfg.WanIface) > 0:
+		add(byName(cfg.WanIface))
+	case len(routes) > 0:
+		add(routes[0])
+	}
+	for _, name := range cfg.WanIfaces {
+		if name == `*` {
+			for _, r := range routes {
+				add(r)
+			}
+			continue
+		}
+		add(byName(name))
+	}
+	if len(wans) == 0 {
+		return nil, fmt.Errorf(`no default route found in routing table %d`, table)
+	}
+	return wans, nil
+}
+
+// setWans updates the WAN interfaces and resolves their addresses.
+func (nft *NFTables) setWans(wans []utils.DefaultRoute) error {
+	var err error
+	for i := range wans {
+		if len(wans[i].Src) == 0 {
+			var ip net.IP
+			ip, err = nft.ifaceIP(wans[i].Iface)
+			if err != nil {
+				err = fmt.Errorf(`failed to obtain ip address of %q: %w`, wans[i].Iface, err)
+				continue
+			}
+			wans[i].Src = ip
+		} else if ip := wans[i].Src.To4(); ip != nil {
+			wans[i].Src = ip
+		}
+	}
+	nft.wans = wans
+	if len(wans) > 0 {
+		nft.wanIface = wans[0].Iface
+		nft.wanIP = wans[0].Src
+	}
+	return err
+}
+
+// isWanIface reports whether iface is one of the WAN interfaces.
+func (nft *NFTables) isWanIface(iface string) bool {
+	if len(iface) == 0 {
+		return false
+	}
+	if iface == nft.wanIface {
+		return true
+	}
+	for _, w := range nft.wans {
+		if w.Iface == iface {
+			return true
+		}
+	}
+	return false
+}
+
+// wanIfaces returns the names of the WAN interfaces, the primary one first.
+func (nft *NFTables) wanIfaces() []string {
+	if len(nft.wans) == 0 {
+		if len(nft.wanIface) == 0 {
+			return nil
+		}
+		return []string{nft.wanIface}
+	}
+	names := make([]string, len(nft.wans))
+	for i, w := range nft.wans {
+		names[i] = w.Iface
+	}
+	return names
+}
+
+// wanIPOf returns the address of the WAN interface iface.
+func (nft *NFTables) wanIPOf(iface string) net.IP {
+	if iface == nft.wanIface {
+		return nft.wanIP
+	}
+	for _, w := range nft.wans {
+		if w.Iface == iface {
+			return w.Src
+		}
+	}
+	return nil
+}
+
+// updateWanIP sets the address of the WAN interface iface.
+func (nft *NFTables) updateWanIP(iface string, ip net.IP) {
+	if iface == nft.wanIface {
+		nft.wanIP = ip
+	}
+	for i := range nft.wans {
+		if nft.wans[i].Iface == iface {
+			nft.wans[i].Src = ip
+		}
+	}
+}
+
+// Wans returns the WAN interfaces, the primary one first.
+func (nft *NFTables) Wans() []utils.DefaultRoute {
+	return nft.wans
+}
@@ -0,0 +1,81 @@
+package biz
+
+import (
+	"net"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSelectWans(t *testing.T) {
+	routes := []utils.DefaultRoute{
+		{Iface: `eth1`, Metric: 50, Src: net.ParseIP(`10.0.0.2`), Table: unix.RT_TABLE_MAIN},
+		{Iface: `eth0`, Metric: 100, Src: net.ParseIP(`192.168.1.2`), Table: unix.RT_TABLE_MAIN},
+		{Iface: `eth1`, Metric: 200, Table: 100},
+		{Iface: `ppp0`, Metric: 300, Table: unix.RT_TABLE_MAIN},
+	}
+
+	wans, err := selectWans(routes, &Config{})
+	assert.NoError(t, err)
+	assert.Len(t, wans, 1)
+	assert.Equal(t, `eth1`, wans[0].Iface)
+
+	wans, err = selectWans(routes, &Config{WanIface: `eth0`})
+	assert.NoError(t, err)
+	assert.Len(t, wans, 1)
+	assert.Equal(t, `eth0`, wans[0].Iface)
+
+	wans, err = selectWans(routes, &Config{WanIface: `eth0`, WanIfaces: []string{`*`}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`eth0`, `eth1`, `ppp0`}, routeIfaces(wans))
+	assert.Equal(t, 50, wans[1].Metric)
+
+	wans, err = selectWans(routes, &Config{WanIfaces: []string{`ppp0`, `wwan0`}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`eth1`, `ppp0`, `wwan0`}, routeIfaces(wans))
+	assert.Nil(t, wans[2].Gateway)
+
+	_, err = selectWans(nil, &Config{})
+	assert.Error(t, err)
+
+	// the default routes of the other tables are only used if named
+	vrf := []utils.DefaultRoute{
+		{Iface: `wg0`, Metric: 0, Table: 100},
+		{Iface: `eth0`, Metric: 100, Table: unix.RT_TABLE_MAIN},
+	}
+	wans, err = selectWans(vrf, &Config{WanIfaces: []string{`*`}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`eth0`}, routeIfaces(wans))
+	wans, err = selectWans(vrf, &Config{WanTable: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`wg0`}, routeIfaces(wans))
+	_, err = selectWans(vrf[:1], &Config{})
+	assert.EqualError(t, err, `no default route found in routing table 254`)
+}
+
+func TestWanIfaces(t *testing.T) {
+	nft := New(nftables.TableFamilyIPv4, Config{}, nil)
+	assert.NoError(t, nft.setWans([]utils.DefaultRoute{
+		{Iface: `eth0`, Src: net.ParseIP(`192.168.1.2`)},
+		{Iface: `eth1`, Src: net.ParseIP(`10.0.0.2`)},
+	}))
+	assert.Equal(t, `eth0`, nft.wanIface)
+	assert.Equal(t, net.IP{192, 168, 1, 2}, nft.WanIP())
+	assert.Equal(t, []string{`eth0`, `eth1`}, nft.wanIfaces())
+	assert.True(t, nft.isWanIface(`eth1`))
+	assert.False(t, nft.isWanIface(`wg0`))
+
+	nft.updateWanIP(`eth1`, net.ParseIP(`10.0.0.3`))
+	assert.Equal(t, `10.0.0.3`, nft.wanIPOf(`eth1`).String())
+}
+
+func routeIfaces(routes []utils.DefaultRoute) []string {
+	names := make([]string, len(routes))
+	for i, r := range routes {
+		names[i] = r.Iface
+	}
+	return names
+}
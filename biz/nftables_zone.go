@@ -0,0 +1,528 @@
+package biz
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	utils "github.com/admpub/nftablesutils"
+	setutils "github.com/admpub/nftablesutils/set"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// zoneChains are the regular chains generated for a zone.
+type zoneChains struct {
+	zone    *Zone
+	input   *nftables.Chain
+	forward *nftables.Chain
+}
+
+// initZones creates the chains of the configured zones.
+func (nft *NFTables) initZones() {
+	nft.zones = make([]*zoneChains, 0, len(nft.cfg.Zones))
+	for i := range nft.cfg.Zones {
+		zone := &nft.cfg.Zones[i]
+		zc := &zoneChains{
+			zone: zone,
+			input: &nftables.Chain{
+				Name:  `zone_` + zone.Name + `_input`,
+				Table: nft.tFilter,
+			},
+			forward: &nftables.Chain{
+				Name:  `zone_` + zone.Name + `_forward`,
+				Table: nft.tFilter,
+			},
+		}
+		nft.zones = append(nft.zones, zc)
+		nft.chains = append(nft.chains, zc.input, zc.forward)
+	}
+}
+
+func (nft *NFTables) zoneChainsOf(name string) *zoneChains {
+	for _, zc := range nft.zones {
+		if zc.zone.Name == name {
+			return zc
+		}
+	}
+	return nil
+}
+
+// validateZones checks the zone names, interfaces, sources and the zone policies.
+func (nft *NFTables) validateZones() error {
+	names := map[string]struct{}{}
+	ifaces := map[string]string{}
+	var sources []zoneSource
+	for _, zone := range nft.cfg.Zones {
+		if len(zone.Name) == 0 {
+			return fmt.Errorf(`zone name is required`)
+		}
+		if _, ok := names[zone.Name]; ok {
+			return fmt.Errorf(`duplicate zone %q`, zone.Name)
+		}
+		names[zone.Name] = struct{}{}
+		// the interfaces are literal keys of the dispatch verdict maps
+		for _, iface := range zone.Ifaces {
+			if strings.Contains(iface, `*`) {
+				return fmt.Errorf(`zone %q: wildcard interface %q is not supported`, zone.Name, iface)
+			}
+			if other, ok := ifaces[iface]; ok {
+				return fmt.Errorf(`zone %q: interface %q already belongs to zone %q`, zone.Name, iface, other)
+			}
+			ifaces[iface] = zone.Name
+		}
+		for _, policy := range []string{zone.Input, zone.Forward} {
+			if _, err := zoneVerdict(policy); err != nil {
+				return fmt.Errorf(`zone %q: %w`, zone.Name, err)
+			}
+		}
+		// the sources are keys of the saddr dispatch verdict maps, a packet
+		// can be dispatched to one zone only
+		_, literals, err := splitGeoSources(zone.Sources)
+		if err != nil {
+			return fmt.Errorf(`zone %q: %w`, zone.Name, err)
+		}
+		for _, literal := range literals {
+			src, err := parseZoneSource(literal)
+			if err != nil {
+				return fmt.Errorf(`zone %q: %w`, zone.Name, err)
+			}
+			for _, other := range sources {
+				if other.zone != zone.Name && src.overlaps(other) {
+					return fmt.Errorf(`zone %q: source %q overlaps source %q of zone %q`, zone.Name, literal, other.source, other.zone)
+				}
+			}
+			src.zone = zone.Name
+			sources = append(sources, src)
+		}
+	}
+	for _, policy := range nft.cfg.ZonePolicies {
+		if _, ok := names[policy.From]; !ok {
+			return fmt.Errorf(`zone policy: zone %q not found`, policy.From)
+		}
+		if _, ok := names[policy.To]; !ok {
+			return fmt.Errorf(`zone policy: zone %q not found`, policy.To)
+		}
+		switch policy.Action {
+		case ZonePolicyAllow, ZonePolicyDeny, ZonePolicyMasquerade:
+		default:
+			return fmt.Errorf(`zone policy %s->%s: unsupported action %q`, policy.From, policy.To, policy.Action)
+		}
+	}
+	return nil
+}
+
+// zoneSource is a literal source of a zone: an address or a prefix, or a
+// range of addresses from first to last.
+type zoneSource struct {
+	zone        string
+	source      string
+	prefix      netip.Prefix
+	first, last netip.Addr
+}
+
+func parseZoneSource(source string) (zoneSource, error) {
+	src := zoneSource{source: source}
+	if from, to, ok := strings.Cut(source, `-`); ok {
+		first, err := netip.ParseAddr(from)
+		if err != nil {
+			return src, fmt.Errorf(`invalid source %q: %w`, source, err)
+		}
+		last, err := netip.ParseAddr(to)
+		if err != nil {
+			return src, fmt.Errorf(`invalid source %q: %w`, source, err)
+		}
+		if first.Is4() != last.Is4() || last.Less(first) {
+			return src, fmt.Errorf(`invalid source %q: invalid range`, source)
+		}
+		src.first, src.last = first, last
+		return src, nil
+	}
+	var err error
+	if strings.Contains(source, `/`) {
+		src.prefix, err = netip.ParsePrefix(source)
+	} else {
+		var addr netip.Addr
+		addr, err = netip.ParseAddr(source)
+		src.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if err != nil {
+		return src, fmt.Errorf(`invalid source %q: %w`, source, err)
+	}
+	src.prefix = src.prefix.Masked()
+	src.first, src.last = src.prefix.Addr(), lastAddr(src.prefix)
+	return src, nil
+}
+
+// overlaps reports whether the sources have addresses in common.
+func (s zoneSource) overlaps(other zoneSource) bool {
+	if s.prefix.IsValid() && other.prefix.IsValid() {
+		return s.prefix.Overlaps(other.prefix)
+	}
+	if s.first.Is4() != other.first.Is4() {
+		return false
+	}
+	return !s.last.Less(other.first) && !other.last.Less(s.first)
+}
+
+// lastAddr returns the last address of the masked prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for i := prefix.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// zoneVerdict returns the verdict expressions of a default zone policy.
+func zoneVerdict(policy string) ([]expr.Any, error) {
+	switch strings.ToLower(policy) {
+	case ``:
+		return nil, nil
+	case `accept`:
+		return []expr.Any{utils.ExprAccept()}, nil
+	case `drop`:
+		return []expr.Any{utils.ExprDrop()}, nil
+	case `reject`:
+		return []expr.Any{utils.Reject()}, nil
+	}
+	return nil, fmt.Errorf(`unsupported policy %q`, policy)
+}
+
+// zoneSourceElems returns the interval elements of the sources of the table family.
+func (nft *NFTables) zoneSourceElems(sources []string) ([]nftables.SetElement, error) {
+	_, literals, err := splitGeoSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(literals))
+	for _, source := range literals {
+		isIPv6 := strings.Contains(source, `:`)
+		if isIPv6 == (nft.tableFamily == nftables.TableFamilyIPv6) {
+			list = append(list, source)
+		}
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		return setutils.GenerateElementsFromIPv6Address(list)
+	}
+	return setutils.GenerateElementsFromIPv4Address(list)
+}
+
+// errNoFamilySource is returned by zoneAddrSet when none of the sources is of
+// the table family, the rule restricted to them must be skipped since it
+// would match every address without the set.
+var errNoFamilySource = errors.New(`no source of the table family`)
+
+// zoneAddrSet adds an anonymous interval set of the sources and returns the
+// expressions matching it, nil if there is no source. The sources having
+// countries are matched by a named set, see geoAddrSet.
+func (nft *NFTables) zoneAddrSet(c *nftables.Conn, t *nftables.Table, dir utils.ExprDirection, sources []string) ([]expr.Any, error) {
+	countries, literals, err := splitGeoSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	if len(countries) > 0 {
+		return nft.geoAddrSet(c, t, dir, countries, literals)
+	}
+	elems, err := nft.zoneSourceElems(sources)
+	if err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		if len(sources) > 0 {
+			return nil, errNoFamilySource
+		}
+		return nil, nil
+	}
+	var set *nftables.Set
+	if nft.tableFamily == nftables.TableFamilyIPv6 {
+		set = utils.GetIPv6AddrSet(t, true)
+	} else {
+		set = utils.GetIPv4AddrSet(t, true)
+	}
+	if err = c.AddSet(set, elems); err != nil {
+		return nil, err
+	}
+	return nft.addrSetExprs(set, dir), nil
+}
+
+// addrSetExprs returns the expressions matching the source or destination
+// address in set.
+func (nft *NFTables) addrSetExprs(set *nftables.Set, dir utils.ExprDirection) []expr.Any {
+	switch {
+	case dir == utils.ExprDirectionSource && nft.tableFamily == nftables.TableFamilyIPv6:
+		return utils.SetSAddrIPv6Set(set)
+	case dir == utils.ExprDirectionSource:
+		return utils.SetSAddrSet(set)
+	case nft.tableFamily == nftables.TableFamilyIPv6:
+		return utils.SetDAddrIPv6Set(set)
+	default:
+		return utils.SetDAddrSet(set)
+	}
+}
+
+// ifnameExprs returns the expressions matching the input or output interfaces,
+// by an anonymous ifname set of t if there are several ones or wildcards.
+func (nft *NFTables) ifnameExprs(c *nftables.Conn, t *nftables.Table, dir utils.ExprDirection, ifaces []string) ([]expr.Any, error) {
+	if len(ifaces) == 0 {
+		return nil, nil
+	}
+	if len(ifaces) == 1 && !strings.HasSuffix(ifaces[0], `*`) {
+		if dir == utils.ExprDirectionSource {
+			return utils.SetIIF(ifaces[0]), nil
+		}
+		return utils.SetOIF(ifaces[0]), nil
+	}
+	elems, err := setutils.GenerateElementsFromIface(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	set := utils.GetIfnameSet(t, true)
+	if err = c.AddSet(set, elems); err != nil {
+		return nil, err
+	}
+	if dir == utils.ExprDirectionSource {
+		return utils.SetIIFSet(set), nil
+	}
+	return utils.SetOIFSet(set), nil
+}
+
+// zoneMatchers returns the alternative expressions matching the members of zone.
+func (nft *NFTables) zoneMatchers(c *nftables.Conn, t *nftables.Table, dir utils.ExprDirection, zone *Zone) ([][]expr.Any, error) {
+	matchers := make([][]expr.Any, 0, len(zone.Ifaces)+1)
+	for _, iface := range zone.Ifaces {
+		if dir == utils.ExprDirectionSource {
+			matchers = append(matchers, utils.SetIIF(iface))
+		} else {
+			matchers = append(matchers, utils.SetOIF(iface))
+		}
+	}
+	addrExprs, err := nft.zoneAddrSet(c, t, dir, zone.Sources)
+	if err != nil && !errors.Is(err, errNoFamilySource) {
+		return nil, fmt.Errorf(`zone %q: %w`, zone.Name, err)
+	}
+	if len(addrExprs) > 0 {
+		matchers = append(matchers, addrExprs)
+	}
+	return matchers, nil
+}
+
+// zoneRules compiles the zones into per-zone chains dispatched from the base
+// chains by verdict maps.
+func (nft *NFTables) zoneRules(c *nftables.Conn) error {
+	if len(nft.zones) == 0 {
+		return nil
+	}
+	if err := nft.validateZones(); err != nil {
+		return err
+	}
+	for _, zc := range nft.zones {
+		if err := nft.zoneInputRules(c, zc); err != nil {
+			return err
+		}
+		if err := nft.zoneForwardRules(c, zc); err != nil {
+			return err
+		}
+	}
+	if err := nft.zoneDispatchRules(c, nft.cInput, func(zc *zoneChains) *nftables.Chain { return zc.input }); err != nil {
+		return fmt.Errorf(`nft.zoneDispatchRules(%q): %w`, nft.cInput.Name, err)
+	}
+	if err := nft.zoneDispatchRules(c, nft.cForward, func(zc *zoneChains) *nftables.Chain { return zc.forward }); err != nil {
+		return fmt.Errorf(`nft.zoneDispatchRules(%q): %w`, nft.cForward.Name, err)
+	}
+	return nft.zoneMasqueradeRules(c)
+}
+
+// zoneDispatchRules jumps from the base chain to the zone chains.
+func (nft *NFTables) zoneDispatchRules(c *nftables.Conn, base *nftables.Chain, target func(*zoneChains) *nftables.Chain) error {
+	// cmd: nft add rule ip filter input \
+	// iifname vmap { "eth1" : jump zone_lan_input, "wg0" : jump zone_vpn_input }
+	vmap := utils.GetIfnameVerdictMap(nft.tFilter)
+	var elems []nftables.SetElement
+	for _, zc := range nft.zones {
+		elems = append(elems, utils.GetIfnameVerdictElems(zc.zone.Ifaces, utils.ExprJump(target(zc).Name))...)
+	}
+	if len(elems) > 0 {
+		if err := c.AddSet(vmap, elems); err != nil {
+			return err
+		}
+		nft.addRule(c, &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    base,
+			Exprs:    utils.SetIIFVerdictMap(vmap),
+			UserData: []byte(`zone_dispatch_` + strings.ToLower(base.Name) + `_iif`),
+		})
+	}
+
+	// cmd: nft add rule ip filter input \
+	// ip saddr vmap { 10.8.0.0/24 : jump zone_vpn_input }
+	isIPv6 := nft.tableFamily == nftables.TableFamilyIPv6
+	keyType := nftables.TypeIPAddr
+	if isIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	vmap = utils.GetVerdictMap(nft.tFilter, keyType, true)
+	elems = elems[:0]
+	for _, zc := range nft.zones {
+		srcElems, err := nft.zoneSourceElems(zc.zone.Sources)
+		if err != nil {
+			return fmt.Errorf(`zone %q: %w`, zc.zone.Name, err)
+		}
+		elems = append(elems, utils.SetVerdictElems(srcElems, utils.ExprJump(target(zc).Name))...)
+	}
+	if len(elems) > 0 {
+		if err := c.AddSet(vmap, elems); err != nil {
+			return err
+		}
+		exprs := utils.SetSAddrVerdictMap(vmap)
+		if isIPv6 {
+			exprs = utils.SetSAddrIPv6VerdictMap(vmap)
+		}
+		nft.addRule(c, &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    base,
+			Exprs:    exprs,
+			UserData: []byte(`zone_dispatch_` + strings.ToLower(base.Name) + `_saddr`),
+		})
+	}
+
+	// cmd: nft add rule ip filter input ip saddr @geo_cn_a jump zone_cn_input
+	for _, zc := range nft.zones {
+		countries, _, _ := splitGeoSources(zc.zone.Sources)
+		if len(countries) == 0 {
+			continue
+		}
+		geoExprs, err := nft.geoAddrSet(c, nft.tFilter, utils.ExprDirectionSource, countries, nil)
+		if err != nil {
+			return fmt.Errorf(`zone %q: %w`, zc.zone.Name, err)
+		}
+		exprs := make([]expr.Any, 0, len(geoExprs)+1)
+		exprs = append(exprs, geoExprs...)
+		exprs = append(exprs, utils.ExprJump(target(zc).Name))
+		nft.addRule(c, &nftables.Rule{
+			Table:    nft.tFilter,
+			Chain:    base,
+			Exprs:    exprs,
+			UserData: []byte(`zone_dispatch_` + strings.ToLower(base.Name) + `_` + zc.zone.Name + `_geo`),
+		})
+	}
+	return nil
+}
+
+// zoneInputRules adds the default input policy of the zone.
+func (nft *NFTables) zoneInputRules(c *nftables.Conn, zc *zoneChains) error {
+	verdict, _ := zoneVerdict(zc.zone.Input)
+	if len(verdict) == 0 {
+		return nil
+	}
+	// cmd: nft add rule ip filter zone_lan_input accept
+	nft.addRule(c, &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    zc.input,
+		Exprs:    verdict,
+		UserData: []byte(zc.input.Name + `_policy`),
+	})
+	return nil
+}
+
+// zoneForwardRules adds the inter-zone policies of the source zone.
+func (nft *NFTables) zoneForwardRules(c *nftables.Conn, zc *zoneChains) error {
+	// cmd: nft add rule ip filter zone_lan_forward \
+	// ct state { established, related } accept
+	ctStateSet := utils.GetConntrackStateSet(nft.tFilter)
+	elems := utils.GetConntrackStateSetElems(defaultStateWithOld)
+	if err := c.AddSet(ctStateSet, elems); err != nil {
+		return err
+	}
+	exprs := make([]expr.Any, 0, 3)
+	exprs = append(exprs, utils.SetConntrackStateSet(ctStateSet)...)
+	exprs = append(exprs, utils.ExprAccept())
+	nft.addRule(c, &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    zc.forward,
+		Exprs:    exprs,
+		UserData: []byte(zc.forward.Name + `_ct`),
+	})
+
+	// cmd: nft add rule ip filter zone_lan_forward oifname "eth0" accept
+	for _, policy := range nft.cfg.ZonePolicies {
+		if policy.From != zc.zone.Name {
+			continue
+		}
+		verdict := utils.ExprAccept()
+		if policy.Action == ZonePolicyDeny {
+			verdict = utils.ExprDrop()
+		}
+		to := nft.zoneChainsOf(policy.To)
+		matchers, err := nft.zoneMatchers(c, nft.tFilter, utils.ExprDirectionDestination, to.zone)
+		if err != nil {
+			return err
+		}
+		for i, matcher := range matchers {
+			exprs := make([]expr.Any, 0, len(matcher)+1)
+			exprs = append(exprs, matcher...)
+			exprs = append(exprs, verdict)
+			nft.addRule(c, &nftables.Rule{
+				Table:    nft.tFilter,
+				Chain:    zc.forward,
+				Exprs:    exprs,
+				UserData: []byte(fmt.Sprintf(`%s_%s_%d`, zc.forward.Name, policy.To, i)),
+			})
+		}
+	}
+
+	verdict, _ := zoneVerdict(zc.zone.Forward)
+	if len(verdict) == 0 {
+		return nil
+	}
+	// cmd: nft add rule ip filter zone_lan_forward drop
+	nft.addRule(c, &nftables.Rule{
+		Table:    nft.tFilter,
+		Chain:    zc.forward,
+		Exprs:    verdict,
+		UserData: []byte(zc.forward.Name + `_policy`),
+	})
+	return nil
+}
+
+// zoneMasqueradeRules masquerades the traffic of the masquerade zone policies.
+func (nft *NFTables) zoneMasqueradeRules(c *nftables.Conn) error {
+	for _, policy := range nft.cfg.ZonePolicies {
+		if policy.Action != ZonePolicyMasquerade {
+			continue
+		}
+		from := nft.zoneChainsOf(policy.From)
+		to := nft.zoneChainsOf(policy.To)
+		srcMatchers, err := nft.zoneMatchers(c, nft.tNAT, utils.ExprDirectionSource, from.zone)
+		if err != nil {
+			return err
+		}
+		dstMatchers, err := nft.zoneMatchers(c, nft.tNAT, utils.ExprDirectionDestination, to.zone)
+		if err != nil {
+			return err
+		}
+
+		// cmd: nft add rule ip nat postrouting \
+		// meta iifname "eth1" meta oifname "eth0" masquerade
+		for i, src := range srcMatchers {
+			for j, dst := range dstMatchers {
+				exprs := make([]expr.Any, 0, len(src)+len(dst)+1)
+				exprs = append(exprs, src...)
+				exprs = append(exprs, dst...)
+				exprs = append(exprs, utils.ExprMasquerade(0, 0))
+				nft.addRule(c, &nftables.Rule{
+					Table:    nft.tNAT,
+					Chain:    nft.cPostrouting,
+					Exprs:    exprs,
+					UserData: []byte(fmt.Sprintf(`zone_masquerade_%s_%s_%d_%d`, policy.From, policy.To, i, j)),
+				})
+			}
+		}
+	}
+	return nil
+}
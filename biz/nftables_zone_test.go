@@ -0,0 +1,134 @@
+package biz
+
+import (
+	"testing"
+
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func testZoneConfig() Config {
+	return Config{
+		Zones: []Zone{
+			{Name: `wan`, Ifaces: []string{`eth0`}, Input: `drop`, Forward: `drop`},
+			{Name: `lan`, Ifaces: []string{`eth1`, `eth2`}, Input: `accept`, Forward: `reject`},
+			{Name: `vpn`, Ifaces: []string{`wg0`}, Sources: []string{`10.8.0.0/24`, `fd00::/64`}},
+		},
+		ZonePolicies: []ZonePolicy{
+			{From: `lan`, To: `wan`, Action: ZonePolicyMasquerade},
+			{From: `vpn`, To: `lan`, Action: ZonePolicyAllow},
+			{From: `wan`, To: `vpn`, Action: ZonePolicyDeny},
+		},
+	}
+}
+
+func testCountDial(t *testing.T, counts map[int]int) *nftables.Conn {
+	c, err := nftables.New(nftables.WithTestDial(
+		func(req []netlink.Message) ([]netlink.Message, error) {
+			for _, msg := range req {
+				counts[int(msg.Header.Type)&0xff]++
+			}
+			return req, nil
+		}))
+	assert.NoError(t, err)
+	return c
+}
+
+func TestZoneRules(t *testing.T) {
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, testZoneConfig(), nil, nil)
+	assert.Len(t, nft.zones, 3)
+	assert.Equal(t, `zone_lan_forward`, nft.zoneChainsOf(`lan`).forward.Name)
+	assert.Len(t, nft.chains, 5+6)
+
+	counts := map[int]int{}
+	c := testCountDial(t, counts)
+	assert.NoError(t, nft.zoneRules(c))
+	assert.NoError(t, c.Flush())
+	// input: 2 policies + 2 dispatches
+	// forward: 3 ct + 2 policies + 1 (lan->eth0) + 2 (vpn->eth1,eth2) + 2 (wan->wg0,vpn sources) + 2 dispatches
+	// nat: 2 masquerades (eth1,eth2->eth0)
+	assert.Equal(t, 4+12+2, counts[unix.NFT_MSG_NEWRULE])
+	// 3 ct state sets, 2 ifname vmaps, 2 saddr vmaps, 1 vpn daddr set
+	assert.Equal(t, 8, counts[unix.NFT_MSG_NEWSET])
+}
+
+func TestValidateZones(t *testing.T) {
+	cfg := testZoneConfig()
+	nft := New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.NoError(t, nft.validateZones())
+
+	cfg.ZonePolicies = append(cfg.ZonePolicies, ZonePolicy{From: `lan`, To: `dmz`, Action: ZonePolicyAllow})
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone policy: zone "dmz" not found`)
+
+	cfg = testZoneConfig()
+	cfg.ZonePolicies[0].Action = `snat`
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone policy lan->wan: unsupported action "snat"`)
+
+	cfg = testZoneConfig()
+	cfg.Zones[0].Input = `pass`
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone "wan": unsupported policy "pass"`)
+
+	cfg = testZoneConfig()
+	cfg.Zones[1].Ifaces = append(cfg.Zones[1].Ifaces, `eth*`)
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone "lan": wildcard interface "eth*" is not supported`)
+
+	cfg = testZoneConfig()
+	cfg.Zones[1].Ifaces = append(cfg.Zones[1].Ifaces, cfg.Zones[0].Ifaces[0])
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone "lan": interface "eth0" already belongs to zone "wan"`)
+
+	cfg = testZoneConfig()
+	cfg.Zones[1].Sources = []string{`10.8.0.128/25`}
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone "vpn": source "10.8.0.0/24" overlaps source "10.8.0.128/25" of zone "lan"`)
+
+	cfg = testZoneConfig()
+	cfg.Zones[1].Sources = []string{`10.8.0.250-10.8.1.10`, `fd01::1`}
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.EqualError(t, nft.validateZones(), `zone "vpn": source "10.8.0.0/24" overlaps source "10.8.0.250-10.8.1.10" of zone "lan"`)
+
+	// the adjacent sources and the sources of the other family don't overlap
+	cfg = testZoneConfig()
+	cfg.Zones[1].Sources = []string{`10.8.1.0-10.8.1.10`, `10.8.2.0/24`, `fd01::/64`}
+	nft = New(nftables.TableFamilyIPv4, cfg, nil)
+	assert.NoError(t, nft.validateZones())
+}
+
+func TestZoneRulesApplied(t *testing.T) {
+	k := nftest.New()
+	nft := newTestNFTables(t, nftables.TableFamilyIPv4, testZoneConfig(), nil, k)
+	err := nft.Do(func(c *nftables.Conn) error {
+		if err := nft.ApplyBase(c); err != nil {
+			return err
+		}
+		if err := nft.zoneRules(c); err != nil {
+			return err
+		}
+		return c.Flush()
+	})
+	require.NoError(t, err)
+
+	chains, err := k.Chains(nft.tFilter)
+	assert.NoError(t, err)
+	names := map[string]bool{}
+	for _, c := range chains {
+		names[c.Name] = true
+	}
+	assert.True(t, names[`zone_lan_input`])
+	assert.True(t, names[`zone_vpn_forward`])
+
+	r, err := k.RuleByID(nft.tFilter, nft.cInput, []byte(`zone_dispatch_input_iif`))
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	rules, err := k.Rules(nft.tNAT, nft.cPostrouting)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 2)
+}
@@ -0,0 +1,39 @@
+package nftablesutils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupV2Root is the mount point of the cgroup v2 hierarchy.
+var CgroupV2Root = `/sys/fs/cgroup`
+
+// CgroupV2ID returns the ID and the level of the cgroup v2 at path, which is
+// relative to CgroupV2Root or absolute under it, e.g. system.slice/sshd.service
+// is at level 2. Like nft, the ID is the inode number of the cgroup directory,
+// so the cgroup must exist when the rule is added and a recreated cgroup has a
+// new ID.
+func CgroupV2ID(path string) (id uint64, level uint32, err error) {
+	root := filepath.Clean(CgroupV2Root)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	rel, err := filepath.Rel(root, filepath.Clean(path))
+	if err != nil || rel == `..` || strings.HasPrefix(rel, `..`+string(filepath.Separator)) {
+		return 0, 0, fmt.Errorf("cgroup %q is not under %q", path, root)
+	}
+	if rel != `.` {
+		level = uint32(len(strings.Split(rel, string(filepath.Separator))))
+	}
+	var st unix.Stat_t
+	if err = unix.Stat(path, &st); err != nil {
+		return 0, 0, fmt.Errorf("can't stat cgroup %q: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return 0, 0, fmt.Errorf("cgroup %q is not a directory", path)
+	}
+	return st.Ino, level, nil
+}
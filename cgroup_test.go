@@ -0,0 +1,39 @@
+package nftablesutils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestCgroupV2ID(t *testing.T) {
+	root := CgroupV2Root
+	defer func() { CgroupV2Root = root }()
+	CgroupV2Root = t.TempDir()
+	path := filepath.Join(CgroupV2Root, `system.slice`, `build.service`)
+	assert.NoError(t, os.MkdirAll(path, 0o755))
+	var st unix.Stat_t
+	assert.NoError(t, unix.Stat(path, &st))
+
+	id, level, err := CgroupV2ID(`system.slice/build.service`)
+	assert.NoError(t, err)
+	assert.Equal(t, st.Ino, id)
+	assert.Equal(t, uint32(2), level)
+	id, level, err = CgroupV2ID(path + `/`)
+	assert.NoError(t, err)
+	assert.Equal(t, st.Ino, id)
+	assert.Equal(t, uint32(2), level)
+	_, _, err = CgroupV2ID(`/`)
+	assert.Error(t, err)
+	_, level, err = CgroupV2ID(CgroupV2Root)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), level)
+
+	_, _, err = CgroupV2ID(`../etc`)
+	assert.ErrorContains(t, err, `is not under`)
+	_, _, err = CgroupV2ID(`user.slice`)
+	assert.ErrorContains(t, err, `can't stat cgroup`)
+}
@@ -0,0 +1,192 @@
+// Package conntrack lists and deletes conntrack flows through ctnetlink, e.g.
+// to cut the established connections of a banned address, which the
+// `ct state established` accept rules would keep flowing otherwise.
+//
+//	ct, err := conntrack.Open(``)
+//	addrs, err := conntrack.ParseAddrs([]string{`192.0.2.1`})
+//	n, err := ct.Delete(0, conntrack.Filter{Addrs: addrs})
+package conntrack
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	setutils "github.com/admpub/nftablesutils/set"
+	"github.com/gaissmai/extnetip"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Flow is a conntrack entry.
+type Flow = netlink.ConntrackFlow
+
+// Filter selects flows by their original direction. The zero value matches
+// all flows.
+type Filter struct {
+	Addrs    []netip.Prefix // source or destination in one of the prefixes
+	Sources  []netip.Prefix
+	Dests    []netip.Prefix
+	Protocol uint8  // unix.IPPROTO_TCP, unix.IPPROTO_UDP ...
+	Port     uint16 // source or destination port
+	SrcPort  uint16
+	DstPort  uint16
+	Zone     *uint16 // ct zone
+	Mark     uint32  // ct mark, compared if MarkMask is not 0
+	MarkMask uint32
+}
+
+// MarkFilter returns a filter of the flows with ct mark.
+func MarkFilter(mark uint32) Filter {
+	return Filter{Mark: mark, MarkMask: 0xffffffff}
+}
+
+// ZoneFilter returns a filter of the flows in ct zone.
+func ZoneFilter(zone uint16) Filter {
+	return Filter{Zone: &zone}
+}
+
+// MatchConntrackFlow reports whether the flow matches the filter, it
+// implements netlink.CustomConntrackFilter.
+func (f Filter) MatchConntrackFlow(flow *Flow) bool {
+	t := flow.Forward
+	if f.Protocol != 0 && t.Protocol != f.Protocol {
+		return false
+	}
+	if f.Port != 0 && t.SrcPort != f.Port && t.DstPort != f.Port {
+		return false
+	}
+	if f.SrcPort != 0 && t.SrcPort != f.SrcPort {
+		return false
+	}
+	if f.DstPort != 0 && t.DstPort != f.DstPort {
+		return false
+	}
+	if f.Zone != nil && flow.Zone != *f.Zone {
+		return false
+	}
+	if f.MarkMask != 0 && flow.Mark&f.MarkMask != f.Mark&f.MarkMask {
+		return false
+	}
+	if len(f.Addrs) > 0 && !contains(f.Addrs, t.SrcIP) && !contains(f.Addrs, t.DstIP) {
+		return false
+	}
+	if len(f.Sources) > 0 && !contains(f.Sources, t.SrcIP) {
+		return false
+	}
+	if len(f.Dests) > 0 && !contains(f.Dests, t.DstIP) {
+		return false
+	}
+	return true
+}
+
+func contains(prefixes []netip.Prefix, ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAddrs parses addresses, prefixes and ranges (192.0.2.1-192.0.2.9) as
+// accepted by biz.NFTables.Ban.
+func ParseAddrs(addrs []string) ([]netip.Prefix, error) {
+	data, err := setutils.AddressStringsToSetData(addrs)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]netip.Prefix, 0, len(data))
+	for _, v := range data {
+		switch {
+		case v.Prefix.IsValid():
+			prefixes = append(prefixes, v.Prefix.Masked())
+		case v.AddressRangeStart.IsValid():
+			prefixes = extnetip.PrefixesAppend(prefixes, v.AddressRangeStart, v.AddressRangeEnd)
+		default:
+			prefixes = append(prefixes, netip.PrefixFrom(v.Address, v.Address.BitLen()))
+		}
+	}
+	return prefixes, nil
+}
+
+// Conntrack is a ctnetlink connection.
+type Conntrack struct {
+	h *netlink.Handle
+}
+
+// Open connects to the conntrack table of the named network namespace, or of
+// the current one if netNS is empty. It requires CAP_NET_ADMIN.
+func Open(netNS string) (*Conntrack, error) {
+	if len(netNS) == 0 {
+		h, err := netlink.NewHandle(unix.NETLINK_NETFILTER)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to create netlink handle: %w`, err)
+		}
+		return &Conntrack{h: h}, nil
+	}
+	ns, err := netns.GetFromName(netNS)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to netns.GetFromName(%q): %w`, netNS, err)
+	}
+	defer ns.Close()
+	h, err := netlink.NewHandleAt(ns, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to create netlink handle: %w`, err)
+	}
+	return &Conntrack{h: h}, nil
+}
+
+// Close the connection.
+func (c *Conntrack) Close() {
+	c.h.Close()
+}
+
+func families(family netlink.InetFamily) []netlink.InetFamily {
+	if family == 0 {
+		return []netlink.InetFamily{unix.AF_INET, unix.AF_INET6}
+	}
+	return []netlink.InetFamily{family}
+}
+
+// List returns the flows matching filter. family is unix.AF_INET or
+// unix.AF_INET6, both if 0.
+func (c *Conntrack) List(family netlink.InetFamily, filter Filter) ([]*Flow, error) {
+	var flows []*Flow
+	for _, fam := range families(family) {
+		list, err := c.h.ConntrackTableList(netlink.ConntrackTable, fam)
+		if err != nil {
+			return nil, fmt.Errorf(`failed to list conntrack flows: %w`, err)
+		}
+		for _, flow := range list {
+			if filter.MatchConntrackFlow(flow) {
+				flows = append(flows, flow)
+			}
+		}
+	}
+	return flows, nil
+}
+
+// Delete deletes the flows matching any of the filters and returns their
+// number. family is unix.AF_INET or unix.AF_INET6, both if 0.
+func (c *Conntrack) Delete(family netlink.InetFamily, filters ...Filter) (uint, error) {
+	custom := make([]netlink.CustomConntrackFilter, len(filters))
+	for i, f := range filters {
+		custom[i] = f
+	}
+	var deleted uint
+	for _, fam := range families(family) {
+		n, err := c.h.ConntrackDeleteFilters(netlink.ConntrackTable, fam, custom...)
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf(`failed to delete conntrack flows: %w`, err)
+		}
+	}
+	return deleted, nil
+}
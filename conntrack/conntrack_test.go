@@ -0,0 +1,67 @@
+package conntrack
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestFilter(t *testing.T) {
+	flow := &Flow{
+		FamilyType: unix.AF_INET,
+		Forward: netlink.IPTuple{
+			Protocol: unix.IPPROTO_TCP,
+			SrcIP:    net.ParseIP(`192.0.2.1`),
+			SrcPort:  40000,
+			DstIP:    net.ParseIP(`198.51.100.1`),
+			DstPort:  22,
+		},
+		Mark: 0x12,
+		Zone: 3,
+	}
+	src := []netip.Prefix{netip.MustParsePrefix(`192.0.2.0/24`)}
+	dst := []netip.Prefix{netip.MustParsePrefix(`198.51.100.1/32`)}
+	var zone uint16 = 3
+	for _, f := range []Filter{
+		{},
+		{Addrs: src},
+		{Addrs: dst},
+		{Sources: src, Dests: dst},
+		{Protocol: unix.IPPROTO_TCP, Port: 22},
+		{Port: 40000, DstPort: 22},
+		{Zone: &zone},
+		MarkFilter(0x12),
+		{Mark: 0x10, MarkMask: 0xf0},
+	} {
+		assert.True(t, f.MatchConntrackFlow(flow), `%+v`, f)
+	}
+	for _, f := range []Filter{
+		{Sources: dst},
+		{Dests: src},
+		{Protocol: unix.IPPROTO_UDP},
+		{Port: 80},
+		{SrcPort: 22},
+		ZoneFilter(0),
+		MarkFilter(0x10),
+	} {
+		assert.False(t, f.MatchConntrackFlow(flow), `%+v`, f)
+	}
+}
+
+func TestParseAddrs(t *testing.T) {
+	prefixes, err := ParseAddrs([]string{`192.0.2.1`, `10.1.2.3/8`, `192.0.2.8-192.0.2.11`, `2001:db8::1`})
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix(`192.0.2.1/32`),
+		netip.MustParsePrefix(`10.0.0.0/8`),
+		netip.MustParsePrefix(`192.0.2.8/30`),
+		netip.MustParsePrefix(`2001:db8::1/128`),
+	}, prefixes)
+
+	_, err = ParseAddrs([]string{`invalid`})
+	assert.Error(t, err)
+}
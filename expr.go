@@ -70,6 +70,17 @@ func ExprPayloadNetHeader(reg, offset, l uint32) *expr.Payload {
 	}
 }
 
+// ExprPayloadLinkHeader wrapper
+func ExprPayloadLinkHeader(reg, offset, l uint32) *expr.Payload {
+	// [ payload load 6b @ link header + 6 => reg 1 ]
+	return &expr.Payload{
+		DestRegister: reg,
+		Base:         expr.PayloadBaseLLHeader,
+		Offset:       offset,
+		Len:          l,
+	}
+}
+
 // ExprPayloadTransportHeader wrapper
 func ExprPayloadTransportHeader(reg, offset, l uint32) *expr.Payload {
 	// [ payload load 1b @ transport header + 0 => reg 1 ]
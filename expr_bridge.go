@@ -0,0 +1,284 @@
+package nftablesutils
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Returns a ether source address payload expression
+func EtherSourceAddress(reg uint32) *expr.Payload {
+	return ExprPayloadLinkHeader(reg, EtherSrcOffset, EtherAddrLen)
+}
+
+// Returns a ether destination address payload expression
+func EtherDestinationAddress(reg uint32) *expr.Payload {
+	return ExprPayloadLinkHeader(reg, EtherDstOffset, EtherAddrLen)
+}
+
+// ExprIBrName wrapper
+func ExprIBrName() *expr.Meta {
+	// [ meta load bri_iifname => reg 1 ]
+	return ExprMeta(expr.MetaKeyBRIIIFNAME, defaultRegister)
+}
+
+// ExprOBrName wrapper
+func ExprOBrName() *expr.Meta {
+	// [ meta load bri_oifname => reg 1 ]
+	return ExprMeta(expr.MetaKeyBRIOIFNAME, defaultRegister)
+}
+
+// SetIBrName helper.
+// matches the bridge of the input port in the bridge family.
+func SetIBrName(bridge string, isEq ...bool) Exprs {
+	// meta ibrname "br0"
+	exprs := []expr.Any{
+		ExprIBrName(),
+		ExprCmp(GetCmpOp(isEq...), ifname(bridge)),
+	}
+	return exprs
+}
+
+// SetOBrName helper.
+// matches the bridge of the output port in the bridge family.
+func SetOBrName(bridge string, isEq ...bool) Exprs {
+	// meta obrname "br0"
+	exprs := []expr.Any{
+		ExprOBrName(),
+		ExprCmp(GetCmpOp(isEq...), ifname(bridge)),
+	}
+	return exprs
+}
+
+// SetEtherSAddr helper.
+func SetEtherSAddr(mac net.HardwareAddr, isEq ...bool) Exprs {
+	// ether saddr 52:54:00:12:34:56
+	exprs := []expr.Any{
+		// [ payload load 6b @ link header + 6 => reg 1 ]
+		EtherSourceAddress(defaultRegister),
+		// [ cmp eq reg 1 0x00545452 0x00005634 ]
+		ExprCmp(GetCmpOp(isEq...), mac),
+	}
+	return exprs
+}
+
+// SetEtherDAddr helper.
+func SetEtherDAddr(mac net.HardwareAddr, isEq ...bool) Exprs {
+	// ether daddr 52:54:00:12:34:56
+	exprs := []expr.Any{
+		// [ payload load 6b @ link header + 0 => reg 1 ]
+		EtherDestinationAddress(defaultRegister),
+		// [ cmp eq reg 1 0x00545452 0x00005634 ]
+		ExprCmp(GetCmpOp(isEq...), mac),
+	}
+	return exprs
+}
+
+// SetEtherSAddrSet helper.
+func SetEtherSAddrSet(s *nftables.Set, isEq ...bool) Exprs {
+	exprs := []expr.Any{
+		EtherSourceAddress(defaultRegister),
+		ExprLookupSet(defaultRegister, s.Name, s.ID, isEq...),
+	}
+	return exprs
+}
+
+// SetEtherDAddrSet helper.
+func SetEtherDAddrSet(s *nftables.Set, isEq ...bool) Exprs {
+	exprs := []expr.Any{
+		EtherDestinationAddress(defaultRegister),
+		ExprLookupSet(defaultRegister, s.Name, s.ID, isEq...),
+	}
+	return exprs
+}
+
+// GetEtherAddrSet helper.
+func GetEtherAddrSet(t *nftables.Table, isInterval ...bool) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeEtherAddr,
+		Interval:  len(isInterval) > 0 && isInterval[0],
+	}
+	return s
+}
+
+// GetEtherAddrSetElems returns the elements of a set of GetEtherAddrSet, which
+// is not an interval set.
+func GetEtherAddrSetElems(macs []net.HardwareAddr) ([]nftables.SetElement, error) {
+	elems := make([]nftables.SetElement, len(macs))
+	for i, mac := range macs {
+		if len(mac) != EtherAddrLen {
+			return nil, fmt.Errorf("invalid ether address %q", mac)
+		}
+		elems[i] = nftables.SetElement{Key: mac}
+	}
+	return elems, nil
+}
+
+// SetEtherType helper.
+// matches the ethertype of the frame, e.g. unix.ETH_P_ARP in the bridge family.
+// the tagged frames have the ethertype unix.ETH_P_8021Q.
+func SetEtherType(etherType uint16, isEq ...bool) Exprs {
+	// ether type arp
+	exprs := []expr.Any{
+		// [ payload load 2b @ link header + 12 => reg 1 ]
+		ExprPayloadLinkHeader(defaultRegister, EtherTypeOffset, EtherTypeLen),
+		// [ cmp eq reg 1 0x00000608 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.BigEndian.PutUint16(etherType)),
+	}
+	return exprs
+}
+
+// SetVlanID helper.
+// matches the VLAN id of the tagged frames, the untagged frames never match.
+func SetVlanID(id uint16, isEq ...bool) Exprs {
+	// ether type vlan vlan id 100
+	exprs := SetEtherType(unix.ETH_P_8021Q)
+	exprs = append(exprs,
+		// [ payload load 2b @ link header + 14 => reg 1 ]
+		ExprPayloadLinkHeader(defaultRegister, VlanTCIOffset, VlanTCILen),
+		// [ bitwise reg 1 = (reg=1 & 0x0000ff0f ) ^ 0x00000000 ]
+		ExprBitwise(defaultRegister, defaultRegister, VlanTCILen,
+			binaryutil.BigEndian.PutUint16(VlanIDMask),
+			[]byte{0x00, 0x00},
+		),
+		// [ cmp eq reg 1 0x00006400 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.BigEndian.PutUint16(id&VlanIDMask)),
+	)
+	return exprs
+}
+
+// SetVlanType helper.
+// matches the ether type encapsulated by the tagged frames.
+func SetVlanType(etherType uint16, isEq ...bool) Exprs {
+	// ether type vlan vlan type ip
+	exprs := SetEtherType(unix.ETH_P_8021Q)
+	exprs = append(exprs,
+		// [ payload load 2b @ link header + 16 => reg 1 ]
+		ExprPayloadLinkHeader(defaultRegister, VlanTypeOffset, EtherTypeLen),
+		// [ cmp eq reg 1 0x00000008 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.BigEndian.PutUint16(etherType)),
+	)
+	return exprs
+}
+
+// SetVlanPCP helper.
+// matches the priority code point (0 to 7) of the tagged frames.
+func SetVlanPCP(pcp uint8, isEq ...bool) Exprs {
+	// ether type vlan vlan pcp 5
+	exprs := SetEtherType(unix.ETH_P_8021Q)
+	exprs = append(exprs,
+		// [ payload load 1b @ link header + 14 => reg 1 ]
+		ExprPayloadLinkHeader(defaultRegister, VlanTCIOffset, 1),
+		// [ bitwise reg 1 = (reg=1 & 0x000000e0 ) ^ 0x00000000 ]
+		ExprBitwise(defaultRegister, defaultRegister, 1, []byte{VlanPCPMask}, []byte{0x00}),
+		// [ cmp eq reg 1 0x000000a0 ]
+		ExprCmp(GetCmpOp(isEq...), []byte{pcp << 5 & VlanPCPMask}),
+	)
+	return exprs
+}
+
+// SetARPOp helper.
+// matches the operation of the ARP packets, e.g. unix.ARPOP_REPLY. In the
+// bridge family, the ARP helpers follow SetEtherType(unix.ETH_P_ARP).
+func SetARPOp(op uint16, isEq ...bool) Exprs {
+	// arp operation reply
+	exprs := []expr.Any{
+		// [ payload load 2b @ network header + 6 => reg 1 ]
+		ExprPayloadNetHeader(defaultRegister, ARPOpOffset, ARPOpLen),
+		// [ cmp eq reg 1 0x00000200 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.BigEndian.PutUint16(op)),
+	}
+	return exprs
+}
+
+// SetARPSAddrIP helper.
+// matches the sender IPv4 address of the ARP packets.
+func SetARPSAddrIP(ip net.IP, isEq ...bool) Exprs {
+	// arp saddr ip 10.0.0.5
+	exprs := []expr.Any{
+		// [ payload load 4b @ network header + 14 => reg 1 ]
+		ExprPayloadNetHeader(defaultRegister, ARPSPAOffset, IPv4AddrLen),
+		// [ cmp eq reg 1 0x0500000a ]
+		ExprCmp(GetCmpOp(isEq...), ip.To4()),
+	}
+	return exprs
+}
+
+// SetARPSAddrEther helper.
+// matches the sender hardware address of the ARP packets.
+func SetARPSAddrEther(mac net.HardwareAddr, isEq ...bool) Exprs {
+	// arp saddr ether 52:54:00:12:34:56
+	exprs := []expr.Any{
+		// [ payload load 6b @ network header + 8 => reg 1 ]
+		ExprPayloadNetHeader(defaultRegister, ARPSHAOffset, EtherAddrLen),
+		// [ cmp eq reg 1 0x00545452 0x00005634 ]
+		ExprCmp(GetCmpOp(isEq...), mac),
+	}
+	return exprs
+}
+
+// ARPBinding binds an IPv4 address to a MAC address.
+type ARPBinding struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// GetARPBindingSet returns an anonymous set of the concatenated IPv4 and MAC
+// addresses of the ARP senders.
+func GetARPBindingSet(t *nftables.Table) (*nftables.Set, error) {
+	keyType, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeEtherAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &nftables.Set{
+		Anonymous:     true,
+		Constant:      true,
+		Table:         t,
+		KeyType:       keyType,
+		Concatenation: true,
+	}
+	return s, nil
+}
+
+// GetARPBindingSetElems returns the elements of a set of GetARPBindingSet.
+func GetARPBindingSetElems(bindings []ARPBinding) ([]nftables.SetElement, error) {
+	elems := make([]nftables.SetElement, len(bindings))
+	for i, b := range bindings {
+		ip := b.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ARP address %q", b.IP)
+		}
+		if len(b.MAC) != EtherAddrLen {
+			return nil, fmt.Errorf("invalid ether address %q", b.MAC)
+		}
+		key := append([]byte{}, ip...)
+		// the concatenated ether address is padded to 8 bytes
+		key = append(key, b.MAC...)
+		key = append(key, 0, 0)
+		elems[i] = nftables.SetElement{Key: key}
+	}
+	return elems, nil
+}
+
+// SetARPBindingSet helper.
+// matches the ARP packets whose sender addresses are bound in the set of
+// GetARPBindingSet, e.g. drops the spoofed senders with isEq false.
+func SetARPBindingSet(s *nftables.Set, isEq ...bool) Exprs {
+	// arp saddr ip . arp saddr ether { 10.0.0.5 . 52:54:00:12:34:56 }
+	exprs := []expr.Any{
+		// [ payload load 4b @ network header + 14 => reg 1 ]
+		ExprPayloadNetHeader(defaultRegister, ARPSPAOffset, IPv4AddrLen),
+		// [ payload load 6b @ network header + 8 => reg 9 ]
+		ExprPayloadNetHeader(reg32(defaultRegister, IPv4AddrLen), ARPSHAOffset, EtherAddrLen),
+		// [ lookup reg 1 set __set%d ]
+		ExprLookupSet(defaultRegister, s.Name, s.ID, isEq...),
+	}
+	return exprs
+}
@@ -0,0 +1,67 @@
+package nftablesutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetEther(t *testing.T) {
+	mac, _ := net.ParseMAC(`52:54:00:12:34:56`)
+	assert.Equal(t, Exprs{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte(mac)},
+	}, SetEtherSAddr(mac, false))
+	assert.Equal(t, []byte{0x08, 0x06}, SetEtherType(unix.ETH_P_ARP)[1].(*expr.Cmp).Data)
+
+	exprs := SetVlanID(100)
+	if assert.Len(t, exprs, 5) {
+		assert.Equal(t, []byte{0x81, 0x00}, exprs[1].(*expr.Cmp).Data)
+		assert.Equal(t, []byte{0x0f, 0xff}, exprs[3].(*expr.Bitwise).Mask)
+		assert.Equal(t, []byte{0x00, 0x64}, exprs[4].(*expr.Cmp).Data)
+	}
+	exprs = SetVlanType(unix.ETH_P_IP)
+	if assert.Len(t, exprs, 4) {
+		assert.Equal(t, []byte{0x81, 0x00}, exprs[1].(*expr.Cmp).Data)
+		assert.Equal(t, uint32(16), exprs[2].(*expr.Payload).Offset)
+		assert.Equal(t, []byte{0x08, 0x00}, exprs[3].(*expr.Cmp).Data)
+	}
+	exprs = SetVlanPCP(5)
+	if assert.Len(t, exprs, 5) {
+		assert.Equal(t, []byte{0xa0}, exprs[4].(*expr.Cmp).Data)
+	}
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeyBRIIIFNAME, Register: 1}, SetIBrName(`br0`)[0])
+
+	elems, err := GetEtherAddrSetElems([]net.HardwareAddr{mac})
+	assert.NoError(t, err)
+	assert.Equal(t, []nftables.SetElement{{Key: []byte(mac)}}, elems)
+	_, err = GetEtherAddrSetElems([]net.HardwareAddr{{1, 2}})
+	assert.Error(t, err)
+}
+
+func TestARPBindingSet(t *testing.T) {
+	mac, _ := net.ParseMAC(`52:54:00:12:34:56`)
+	s, err := GetARPBindingSet(&nftables.Table{Family: nftables.TableFamilyBridge})
+	assert.NoError(t, err)
+	assert.True(t, s.Concatenation)
+	assert.Equal(t, uint32(12), s.KeyType.Bytes)
+
+	elems, err := GetARPBindingSetElems([]ARPBinding{{IP: net.ParseIP(`10.0.0.5`), MAC: mac}})
+	assert.NoError(t, err)
+	if assert.Len(t, elems, 1) {
+		assert.Equal(t, []byte{10, 0, 0, 5, 0x52, 0x54, 0x00, 0x12, 0x34, 0x56, 0, 0}, elems[0].Key)
+	}
+	_, err = GetARPBindingSetElems([]ARPBinding{{IP: net.ParseIP(`2001:db8::1`), MAC: mac}})
+	assert.EqualError(t, err, `invalid ARP address "2001:db8::1"`)
+
+	exprs := SetARPBindingSet(s, false)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, ExprPayloadNetHeader(1, 14, 4), exprs[0])
+		assert.Equal(t, ExprPayloadNetHeader(unix.NFT_REG32_01, 8, 6), exprs[1])
+		assert.True(t, exprs[2].(*expr.Lookup).Invert)
+	}
+}
@@ -35,6 +35,21 @@ func MatchUnknown(name string, revision uint32, info []byte) *expr.Match {
 	return Match(name, revision, &infoBytes)
 }
 
+// Returns a xtables target expression
+func Target(name string, revision uint32, info xt.InfoAny) *expr.Target {
+	return &expr.Target{
+		Name: name,
+		Rev:  revision,
+		Info: info,
+	}
+}
+
+// Returns a xtables target expression of unknown type
+func TargetUnknown(name string, revision uint32, info []byte) *expr.Target {
+	infoBytes := xt.Unknown(info)
+	return Target(name, revision, &infoBytes)
+}
+
 // Returns a xtables match bpf expression
 func MatchBPF(info []byte) *expr.Match {
 	return MatchUnknown("bpf", bpfRevision, info)
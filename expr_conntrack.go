@@ -2,6 +2,7 @@ package nftablesutils
 
 import (
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 )
 
@@ -53,6 +54,133 @@ func SetConntrackStateRelated() Exprs {
 	return exprs
 }
 
+// ExprCtStatus wrapper
+func ExprCtStatus(reg uint32) *expr.Ct {
+	// [ ct load status => reg 1 ]
+	return &expr.Ct{
+		Key:      expr.CtKeySTATUS,
+		Register: reg,
+	}
+}
+
+// SetConntrackStatusDNAT helper.
+// matches the connections whose destination was translated, e.g. by DNAT.
+func SetConntrackStatusDNAT() Exprs {
+	// ct status dnat
+	exprs := []expr.Any{
+		ExprCtStatus(defaultRegister),
+		// [ bitwise reg 1 = (reg=1 & 0x00000020 ) ^ 0x00000000 ]
+		ExprBitwise(defaultRegister, defaultRegister, 4,
+			binaryutil.NativeEndian.PutUint32(CtStatusDstNAT),
+			[]byte{0x00, 0x00, 0x00, 0x00},
+		),
+		ExprCmpNeq(defaultRegister, []byte{0x00, 0x00, 0x00, 0x00}),
+	}
+	return exprs
+}
+
+// ExprCtHelper wrapper
+func ExprCtHelper(reg uint32) *expr.Ct {
+	// [ ct load helper => reg 1 ]
+	return &expr.Ct{
+		Key:      expr.CtKeyHELPER,
+		Register: reg,
+	}
+}
+
+// SetCtHelper helper.
+// matches the connections whose kernel helper is name, e.g. "ftp", the
+// related connections match the helper of their master.
+func SetCtHelper(name string) Exprs {
+	// ct helper "ftp"
+	data := make([]byte, CtHelperNameLen)
+	copy(data, name)
+	exprs := []expr.Any{
+		ExprCtHelper(defaultRegister),
+		ExprCmpEq(defaultRegister, data),
+	}
+	return exprs
+}
+
+// SetConntrackStateInvalid helper.
+func SetConntrackStateInvalid() Exprs {
+	exprs := []expr.Any{
+		ExprCtState(defaultRegister),
+		ExprBitwise(defaultRegister, defaultRegister, ConnTrackStateLen,
+			TypeConntrackStateInvalid(),
+			[]byte{0x00, 0x00, 0x00, 0x00},
+		),
+		ExprCmpNeq(defaultRegister, []byte{0x00, 0x00, 0x00, 0x00}),
+	}
+	return exprs
+}
+
+// SetConntrackStateUntracked helper.
+func SetConntrackStateUntracked() Exprs {
+	exprs := []expr.Any{
+		ExprCtState(defaultRegister),
+		ExprBitwise(defaultRegister, defaultRegister, ConnTrackStateLen,
+			TypeConntrackStateUntracked(),
+			[]byte{0x00, 0x00, 0x00, 0x00},
+		),
+		ExprCmpNeq(defaultRegister, []byte{0x00, 0x00, 0x00, 0x00}),
+	}
+	return exprs
+}
+
+// ExprNotrack wrapper
+// skips connection tracking for the packet, in a chain of raw priority.
+func ExprNotrack() *expr.Notrack {
+	// [ notrack ]
+	return &expr.Notrack{}
+}
+
+// SetNotrack helper.
+func SetNotrack() Exprs {
+	// notrack
+	return Exprs{ExprNotrack()}
+}
+
+// ExprCtZoneSet wrapper
+// sets the conntrack zone to the value of reg.
+func ExprCtZoneSet(reg uint32) *expr.Ct {
+	// [ ct set zone with reg 1 ]
+	return &expr.Ct{
+		Key:            expr.CtKeyZONE,
+		Register:       reg,
+		SourceRegister: true,
+	}
+}
+
+// SetCtZone helper.
+// assigns the conntrack zone to the connection, in a chain of raw priority.
+func SetCtZone(zone uint16) Exprs {
+	exprs := []expr.Any{
+		// [ immediate reg 1 0x00000001 ]
+		&expr.Immediate{
+			Register: defaultRegister,
+			Data:     binaryutil.NativeEndian.PutUint16(zone),
+		},
+		ExprCtZoneSet(defaultRegister),
+	}
+	return exprs
+}
+
+// SetCtOriginalZone helper.
+// assigns the conntrack zone to the original direction of the connection,
+// like `ct original zone set`: the replies are looked up in the zone of the
+// interface they are received on, e.g. the default zone of a WAN.
+// github.com/google/nftables does not encode the direction of ct zone set, the
+// xtables CT target is used instead, which is only valid in a table named raw.
+func SetCtOriginalZone(zone uint16) Exprs {
+	// struct xt_ct_target_info_v1 { flags, proto, zone, ct_events, exp_events, helper, timeout, ct }
+	info := make([]byte, ctTargetInfoLen)
+	copy(info[0:2], binaryutil.NativeEndian.PutUint16(ctZoneDirOrig))
+	copy(info[4:6], binaryutil.NativeEndian.PutUint16(zone))
+	// [ target name CT rev 2 ]
+	return Exprs{TargetUnknown(`CT`, ctTargetRevision, info)}
+}
+
 // GetConntrackStateSet helper.
 func GetConntrackStateSet(t *nftables.Table) *nftables.Set {
 	s := &nftables.Set{
@@ -68,6 +196,8 @@ const (
 	StateNew         = `new`
 	StateEstablished = `established`
 	StateRelated     = `related`
+	StateInvalid     = `invalid`
+	StateUntracked   = `untracked`
 )
 
 // GetConntrackStateSetElems helper.
@@ -84,6 +214,12 @@ func GetConntrackStateSetElems(states []string) []nftables.SetElement {
 		case StateRelated:
 			elems = append(elems,
 				nftables.SetElement{Key: TypeConntrackStateRelated()})
+		case StateInvalid:
+			elems = append(elems,
+				nftables.SetElement{Key: TypeConntrackStateInvalid()})
+		case StateUntracked:
+			elems = append(elems,
+				nftables.SetElement{Key: TypeConntrackStateUntracked()})
 		}
 	}
 
@@ -0,0 +1,45 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetCtZone(t *testing.T) {
+	exprs := SetCtZone(0x0102)
+	if assert.Len(t, exprs, 2) {
+		assert.Len(t, exprs[0].(*expr.Immediate).Data, 2)
+		assert.Equal(t, &expr.Ct{Key: expr.CtKeyZONE, Register: 1, SourceRegister: true}, exprs[1])
+	}
+	assert.Equal(t, Exprs{&expr.Notrack{}}, SetNotrack())
+
+	exprs = SetCtOriginalZone(0x0102)
+	if assert.Len(t, exprs, 1) {
+		target := exprs[0].(*expr.Target)
+		assert.Equal(t, `CT`, target.Name)
+		assert.Equal(t, uint32(2), target.Rev)
+		info := []byte(*target.Info.(*xt.Unknown))
+		if assert.Len(t, info, 72) {
+			assert.Equal(t, binaryutil.NativeEndian.PutUint16(4), info[0:2])
+			assert.Equal(t, binaryutil.NativeEndian.PutUint16(0x0102), info[4:6])
+		}
+	}
+
+	elems := GetConntrackStateSetElems([]string{StateInvalid, StateUntracked, `unknown`})
+	if assert.Len(t, elems, 2) {
+		assert.Equal(t, []byte{0x01, 0, 0, 0}, elems[0].Key)
+		assert.Equal(t, []byte{0x40, 0, 0, 0}, elems[1].Key)
+	}
+}
+
+func TestSetCtHelper(t *testing.T) {
+	exprs := SetCtHelper(`Q.931`)
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, &expr.Ct{Key: expr.CtKeyHELPER, Register: 1}, exprs[0])
+		assert.Equal(t, []byte("Q.931\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), exprs[1].(*expr.Cmp).Data)
+	}
+}
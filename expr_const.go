@@ -23,8 +23,37 @@ const (
 	IPv6AddrLen   = net.IPv6len
 )
 
+// IPv4 fragment offset field, with the MF flag, and IPv6 fragment header
+const (
+	IPv4FragOffset  = 6
+	IPv4FragLen     = 2
+	IPv4FragMask    = 0x3fff
+	IPv6FragNexthdr = 44
+)
+
+// Ethernet, VLAN and ARP lengths and offsets
+const (
+	EtherDstOffset  = 0
+	EtherSrcOffset  = 6
+	EtherAddrLen    = 6
+	EtherTypeOffset = 12
+	EtherTypeLen    = 2
+	VlanTCIOffset   = 14
+	VlanTCILen      = 2
+	VlanTypeOffset  = 16
+	VlanIDMask      = 0x0fff
+	VlanPCPMask     = 0xe0
+	ARPOpOffset     = 6
+	ARPOpLen        = 2
+	ARPSHAOffset    = 8
+	ARPSPAOffset    = 14
+	ARPTHAOffset    = 18
+	ARPTPAOffset    = 24
+)
+
 const (
 	ConnTrackStateLen = 4
+	CtHelperNameLen   = 16 // NF_CT_HELPER_NAME_LEN
 )
 
 const (
@@ -37,6 +66,25 @@ const (
 	ProtoUDPLen    = 1
 )
 
+// TCP flags offset and bits
+const (
+	TCPFlagsOffset = 13
+	TCPFlagsLen    = 1
+	TCPFlagFIN     = 0x01
+	TCPFlagSYN     = 0x02
+	TCPFlagRST     = 0x04
+	TCPFlagACK     = 0x10
+)
+
+// DynsetOpDelete is NFT_DYNSET_OP_DELETE, missing from unix.
+const DynsetOpDelete = 0x2
+
+// Conntrack status bits (IPS_*)
+const (
+	CtStatusSrcNAT = 0x10
+	CtStatusDstNAT = 0x20
+)
+
 const (
 	ProtoICMPOffset = 9
 	ProtoICMPLen    = 1
@@ -52,3 +100,10 @@ const (
 	defaultRegister = 1
 	bpfRevision     = 1
 )
+
+// xt_CT target, see linux/netfilter/xt_CT.h
+const (
+	ctTargetRevision = 2
+	ctTargetInfoLen  = 72     // sizeof(struct xt_ct_target_info_v1), the kernel pointer is 8-byte aligned
+	ctZoneDirOrig    = 1 << 2 // XT_CT_ZONE_DIR_ORIG
+)
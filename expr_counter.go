@@ -0,0 +1,67 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ExprCounterRef wrapper
+// references the named counter object.
+func ExprCounterRef(name string) *expr.Objref {
+	// [ objref type 1 name counter_name ]
+	return &expr.Objref{
+		Type: unix.NFT_OBJECT_COUNTER,
+		Name: name,
+	}
+}
+
+// WithCounter helper.
+// inserts counter before the final statement (verdict, reject, nat, dup and
+// drop, synproxy, flow offload...) of exprs and the immediates loading its
+// registers, or appends it if there is none.
+func WithCounter(exprs []expr.Any, counter expr.Any) Exprs {
+	idx := finalStatementIndex(exprs)
+	result := make([]expr.Any, 0, len(exprs)+1)
+	result = append(result, exprs[:idx]...)
+	result = append(result, counter)
+	result = append(result, exprs[idx:]...)
+	return result
+}
+
+// finalStatementIndex returns the index of the final statement of exprs,
+// len(exprs) if there is none.
+func finalStatementIndex(exprs []expr.Any) int {
+	idx := len(exprs)
+	if idx == 0 || !isFinalStatement(exprs[idx-1]) {
+		return idx
+	}
+	idx--
+	// dup and drop: the packet is duplicated to the device, then dropped
+	if v, ok := exprs[idx].(*expr.Verdict); ok && v.Kind == expr.VerdictDrop && idx > 0 {
+		if _, ok := exprs[idx-1].(*expr.Dup); ok {
+			idx--
+		}
+	}
+	// [ immediate reg 1 0x00000003 ] of the addresses and devices
+	for idx > 0 {
+		v, ok := exprs[idx-1].(*expr.Immediate)
+		if !ok || v.Register == unix.NFT_REG_VERDICT {
+			break
+		}
+		idx--
+	}
+	return idx
+}
+
+func isFinalStatement(e expr.Any) bool {
+	switch v := e.(type) {
+	case *expr.Verdict, *expr.Reject, *expr.Masq, *expr.NAT, *expr.Redir, *expr.Queue,
+		*expr.SynProxy, *expr.FlowOffload:
+		return true
+	case *expr.Objref:
+		return v.Type == unix.NFT_OBJECT_SYNPROXY
+	case *expr.Lookup:
+		return v.IsDestRegSet && v.DestRegister == 0 // verdict map
+	}
+	return false
+}
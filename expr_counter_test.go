@@ -0,0 +1,59 @@
+package nftablesutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestWithCounter(t *testing.T) {
+	counter := ExprCounterRef(`ssh`)
+	exprs := WithCounter(JoinExprs(SetProtoTCP(), SetDPort(22)).Add(Accept()), counter)
+	assert.Len(t, exprs, 6)
+	assert.Equal(t, counter, exprs[4])
+	assert.IsType(t, &expr.Verdict{}, exprs[5])
+
+	// no final statement
+	exprs = WithCounter(SetProtoTCP(), counter)
+	assert.Equal(t, counter, exprs[len(exprs)-1])
+}
+
+func TestWithCounterFinalStatements(t *testing.T) {
+	match := JoinExprs(SetProtoTCP(), SetDPort(22))
+	vmap := &nftables.Set{Name: `vmap`, ID: 1, IsMap: true}
+	cases := []struct {
+		name  string
+		final Exprs
+		last  bool // the counter is appended
+	}{
+		{name: `accept`, final: Exprs{Accept()}},
+		{name: `reject`, final: Exprs{Reject()}},
+		{name: `masquerade`, final: Exprs{ExprMasquerade(0, 0)}},
+		{name: `snat`, final: SetSNAT(net.ParseIP(`192.168.1.1`), 1024, 2048)},
+		{name: `dnat`, final: SetDNAT(net.ParseIP(`10.0.0.2`), 8080)},
+		{name: `redirect`, final: SetRedirect(8080)},
+		{name: `queue`, final: Exprs{ExprQueue(1)}},
+		{name: `vmap`, final: SetSAddrVerdictMap(vmap)[1:]},
+		{name: `dup and drop`, final: SetDupToDevAndDrop(3)},
+		{name: `synproxy`, final: Exprs{ExprSynProxy(1460, 7, true, true)}},
+		{name: `synproxy object`, final: Exprs{ExprObjref(unix.NFT_OBJECT_SYNPROXY, `sp`)}},
+		{name: `flow offload`, final: Exprs{ExprFlowOffload(`ft`)}},
+		{name: `dup`, final: SetDupToDev(3), last: true},
+		{name: `dup to`, final: SetDupTo(net.ParseIP(`10.0.0.2`), 3), last: true},
+		{name: `ct helper`, final: Exprs{ExprCtHelperSet(`ftp`)}, last: true},
+		{name: `none`, last: true},
+	}
+	counter := ExprCounter()
+	for _, c := range cases {
+		exprs := WithCounter(JoinExprs(match, c.final), counter)
+		if c.last {
+			assert.Equal(t, JoinExprs(match, c.final).Add(counter), exprs, c.name)
+			continue
+		}
+		assert.Equal(t, JoinExprs(match, Exprs{counter}, c.final), exprs, c.name)
+	}
+}
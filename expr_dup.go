@@ -0,0 +1,86 @@
+package nftablesutils
+
+import (
+	"net"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// ExprDup wrapper
+// sends a copy of the packet to the address in regAddr, through the device
+// whose index is in regDev if it is not 0.
+func ExprDup(regAddr uint32, regDev uint32) *expr.Dup {
+	// [ dup sreg_addr 1 sreg_dev 2 ]
+	return &expr.Dup{
+		RegAddr:     regAddr,
+		RegDev:      regDev,
+		IsRegDevSet: regDev != 0,
+	}
+}
+
+// ExprDupDev wrapper
+// sends a copy of the packet to the egress of the device whose index is in
+// regDev, in the netdev family.
+func ExprDupDev(regDev uint32) *expr.Dup {
+	// [ dup sreg_dev 1 ]
+	return &expr.Dup{
+		RegDev:      regDev,
+		IsRegDevSet: true,
+	}
+}
+
+// SetDupTo helper.
+// sends a copy of the packet to addr through the device of index ifindex, or
+// through the route to addr if ifindex is 0. For the ip, ip6 and inet families.
+func SetDupTo(addr net.IP, ifindex uint32) Exprs {
+	// dup to 10.0.0.1 device "eth1"
+	if ip := addr.To4(); ip != nil {
+		addr = ip
+	}
+	exprs := []expr.Any{
+		// [ immediate reg 1 0x0100000a ]
+		ExprImmediate(defaultRegister, addr),
+	}
+	if ifindex == 0 {
+		// [ dup sreg_addr 1 ]
+		return append(exprs, ExprDup(defaultRegister, 0))
+	}
+	exprs = append(exprs,
+		// [ immediate reg 2 0x00000003 ]
+		&expr.Immediate{
+			Register: defaultRegister + 1,
+			Data:     binaryutil.NativeEndian.PutUint32(ifindex),
+		},
+		// [ dup sreg_addr 1 sreg_dev 2 ]
+		ExprDup(defaultRegister, defaultRegister+1),
+	)
+	return exprs
+}
+
+// SetDupToDev helper.
+// sends a copy of the packet to the egress of the device of index ifindex.
+// For the ingress chains of the netdev family.
+func SetDupToDev(ifindex uint32) Exprs {
+	// dup to "eth1"
+	exprs := []expr.Any{
+		// [ immediate reg 1 0x00000003 ]
+		&expr.Immediate{
+			Register: defaultRegister,
+			Data:     binaryutil.NativeEndian.PutUint32(ifindex),
+		},
+		// [ dup sreg_dev 1 ]
+		ExprDupDev(defaultRegister),
+	}
+	return exprs
+}
+
+// SetDupToDevAndDrop helper.
+// sends a copy of the packet to the device of index ifindex and drops the
+// original. This is not the fwd statement, which github.com/google/nftables
+// does not provide: the packet is cloned, and the copy skips the egress
+// hooks of the device.
+func SetDupToDevAndDrop(ifindex uint32) Exprs {
+	// dup to "eth1" drop
+	return append(SetDupToDev(ifindex), ExprDrop())
+}
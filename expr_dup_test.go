@@ -0,0 +1,30 @@
+package nftablesutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetDupTo(t *testing.T) {
+	assert.Equal(t, Exprs{
+		&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+		&expr.Immediate{Register: 2, Data: binaryutil.NativeEndian.PutUint32(3)},
+		&expr.Dup{RegAddr: 1, RegDev: 2, IsRegDevSet: true},
+	}, SetDupTo(net.ParseIP(`10.0.0.1`), 3))
+	assert.Equal(t, Exprs{
+		&expr.Immediate{Register: 1, Data: net.ParseIP(`2001:db8::1`)},
+		&expr.Dup{RegAddr: 1},
+	}, SetDupTo(net.ParseIP(`2001:db8::1`), 0))
+
+	exprs := SetDupToDevAndDrop(3)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, &expr.Dup{RegDev: 1, IsRegDevSet: true}, exprs[1])
+		assert.Equal(t, ExprDrop(), exprs[2])
+	}
+	assert.Equal(t, []byte{0x08, 0x00}, SetMetaProtocol(unix.ETH_P_IP)[1].(*expr.Cmp).Data)
+}
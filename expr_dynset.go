@@ -0,0 +1,59 @@
+package nftablesutils
+
+import (
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ExprDynsetAdd wrapper
+func ExprDynsetAdd(reg uint32, set *nftables.Set, timeout time.Duration) *expr.Dynset {
+	// [ dynset add reg_key 1 set knock_1 timeout 10000ms ]
+	return &expr.Dynset{
+		SrcRegKey: reg,
+		SetID:     set.ID,
+		SetName:   set.Name,
+		Operation: uint32(unix.NFT_DYNSET_OP_ADD),
+		Timeout:   timeout,
+	}
+}
+
+// SetAddSAddrToSet helper.
+// adds the source address to the dynamic set, the element expires after
+// timeout, or after the timeout of the set if timeout is 0.
+func SetAddSAddrToSet(set *nftables.Set, timeout time.Duration) Exprs {
+	exprs := make([]expr.Any, 0, 2)
+	if set.KeyType == nftables.TypeIP6Addr {
+		exprs = append(exprs, IPv6SourceAddress(defaultRegister))
+	} else {
+		exprs = append(exprs, IPv4SourceAddress(defaultRegister))
+	}
+	exprs = append(exprs, ExprDynsetAdd(defaultRegister, set, timeout))
+	return exprs
+}
+
+// ExprDynsetDelete wrapper
+func ExprDynsetDelete(reg uint32, set *nftables.Set) *expr.Dynset {
+	// [ dynset delete reg_key 1 set knock_1 ]
+	return &expr.Dynset{
+		SrcRegKey: reg,
+		SetID:     set.ID,
+		SetName:   set.Name,
+		Operation: DynsetOpDelete,
+	}
+}
+
+// SetDelSAddrFromSet helper.
+// deletes the source address from the dynamic set.
+func SetDelSAddrFromSet(set *nftables.Set) Exprs {
+	exprs := make([]expr.Any, 0, 2)
+	if set.KeyType == nftables.TypeIP6Addr {
+		exprs = append(exprs, IPv6SourceAddress(defaultRegister))
+	} else {
+		exprs = append(exprs, IPv4SourceAddress(defaultRegister))
+	}
+	exprs = append(exprs, ExprDynsetDelete(defaultRegister, set))
+	return exprs
+}
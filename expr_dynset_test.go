@@ -0,0 +1,36 @@
+package nftablesutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetAddSAddrToSet(t *testing.T) {
+	set := &nftables.Set{Name: `knock_1`, KeyType: nftables.TypeIP6Addr, Dynamic: true, HasTimeout: true}
+	exprs := SetAddSAddrToSet(set, 10*time.Second)
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, IPv6SourceAddress(1), exprs[0])
+		assert.Equal(t, &expr.Dynset{
+			SrcRegKey: 1,
+			SetName:   `knock_1`,
+			Operation: uint32(unix.NFT_DYNSET_OP_ADD),
+			Timeout:   10 * time.Second,
+		}, exprs[1])
+	}
+	set.KeyType = nftables.TypeIPAddr
+	assert.Equal(t, IPv4SourceAddress(1), SetAddSAddrToSet(set, 0)[0])
+}
+
+func TestSetDelSAddrFromSet(t *testing.T) {
+	set := &nftables.Set{Name: `knock_1`, KeyType: nftables.TypeIPAddr, Dynamic: true, HasTimeout: true}
+	exprs := SetDelSAddrFromSet(set)
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, IPv4SourceAddress(1), exprs[0])
+		assert.Equal(t, &expr.Dynset{SrcRegKey: 1, SetName: `knock_1`, Operation: DynsetOpDelete}, exprs[1])
+	}
+}
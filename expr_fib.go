@@ -0,0 +1,54 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ExprFibDAddrType wrapper
+func ExprFibDAddrType(reg uint32) *expr.Fib {
+	// [ fib daddr type => reg 1 ]
+	return &expr.Fib{
+		Register:       reg,
+		FlagDADDR:      true,
+		ResultADDRTYPE: true,
+	}
+}
+
+// SetFibDAddrTypeLocal helper.
+// matches the packets to the addresses of this host.
+func SetFibDAddrTypeLocal(isEq ...bool) Exprs {
+	exprs := []expr.Any{
+		ExprFibDAddrType(defaultRegister),
+		// [ cmp eq reg 1 0x00000002 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)),
+	}
+	return exprs
+}
+
+// ExprFibSAddrOIFPresent wrapper
+func ExprFibSAddrOIFPresent(reg uint32, iif bool) *expr.Fib {
+	// [ fib saddr . iif oif present => reg 1 ]
+	return &expr.Fib{
+		Register:    reg,
+		FlagSADDR:   true,
+		FlagIIF:     iif,
+		ResultOIF:   true,
+		FlagPRESENT: true,
+	}
+}
+
+// SetFibSAddrOIFMissing helper.
+// matches the packets whose source address is not routable, the reverse path
+// filter. strict: the route back to the source must go through the input
+// interface (fib saddr . iif oif missing), otherwise any route does
+// (fib saddr oif missing).
+func SetFibSAddrOIFMissing(strict bool) Exprs {
+	exprs := []expr.Any{
+		ExprFibSAddrOIFPresent(defaultRegister, strict),
+		// [ cmp eq reg 1 0x00000000 ]
+		ExprCmp(expr.CmpOpEq, binaryutil.NativeEndian.PutUint32(0)),
+	}
+	return exprs
+}
@@ -0,0 +1,18 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetFibSAddrOIFMissing(t *testing.T) {
+	exprs := SetFibSAddrOIFMissing(true)
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, &expr.Fib{Register: 1, FlagSADDR: true, FlagIIF: true, ResultOIF: true, FlagPRESENT: true}, exprs[0])
+		assert.Equal(t, []byte{0, 0, 0, 0}, exprs[1].(*expr.Cmp).Data)
+	}
+	exprs = SetFibSAddrOIFMissing(false)
+	assert.False(t, exprs[0].(*expr.Fib).FlagIIF)
+}
@@ -0,0 +1,41 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// GetFlowtable returns a flowtable of the devices. Flowtables are always
+// attached to the ingress hook of their devices, the flows are added to them
+// by the `flow add` rules of the forward chain.
+// hwOffload offloads the flows to the devices, which must support it.
+func GetFlowtable(t *nftables.Table, name string, devices []string, hwOffload bool) *nftables.Flowtable {
+	// cmd: nft add flowtable ip filter ft \
+	// { hook ingress priority 0 \; devices = { eth0, eth1 } \; flags offload \; }
+	ft := &nftables.Flowtable{
+		Table:    t,
+		Name:     name,
+		Hooknum:  nftables.FlowtableHookIngress,
+		Priority: nftables.FlowtablePriorityFilter,
+		Devices:  devices,
+	}
+	if hwOffload {
+		ft.Flags = nftables.FlowtableFlagsHWOffload
+	}
+	return ft
+}
+
+// ExprFlowOffload wrapper
+func ExprFlowOffload(name string) *expr.FlowOffload {
+	// [ flow_offload ft ]
+	return &expr.FlowOffload{
+		Name: name,
+	}
+}
+
+// SetFlowOffload helper.
+// adds the established flows to the flowtable.
+func SetFlowOffload(name string) Exprs {
+	// ct state established flow add @ft
+	return SetConntrackStateEstablished().Add(ExprFlowOffload(name))
+}
@@ -0,0 +1,22 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlowtable(t *testing.T) {
+	table := &nftables.Table{Name: `filter`, Family: nftables.TableFamilyIPv4}
+	ft := GetFlowtable(table, `ft`, []string{`eth0`}, false)
+	assert.Equal(t, nftables.FlowtableFlags(0), ft.Flags)
+	assert.Equal(t, nftables.FlowtableHookIngress, ft.Hooknum)
+	ft = GetFlowtable(table, `ft`, []string{`eth0`}, true)
+	assert.Equal(t, nftables.FlowtableFlagsHWOffload, ft.Flags)
+
+	exprs := SetFlowOffload(`ft`)
+	assert.Equal(t, &expr.FlowOffload{Name: `ft`}, exprs[len(exprs)-1])
+	assert.Equal(t, JoinExprs(SetConntrackStateEstablished(), []expr.Any{ExprFlowOffload(`ft`)}), exprs)
+}
@@ -0,0 +1,44 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// SetIPv4Fragment helper.
+// matches the fragments of the IPv4 packets, including the first one.
+func SetIPv4Fragment() Exprs {
+	// ip frag-off & 0x3fff != 0
+	exprs := []expr.Any{
+		// [ payload load 2b @ network header + 6 => reg 1 ]
+		ExprPayloadNetHeader(defaultRegister, IPv4FragOffset, IPv4FragLen),
+		// [ bitwise reg 1 = (reg=1 & 0x0000ff3f ) ^ 0x00000000 ]
+		ExprBitwise(defaultRegister, defaultRegister, IPv4FragLen,
+			binaryutil.BigEndian.PutUint16(IPv4FragMask),
+			[]byte{0x00, 0x00},
+		),
+		// [ cmp neq reg 1 0x00000000 ]
+		ExprCmpNeq(defaultRegister, []byte{0x00, 0x00}),
+	}
+	return exprs
+}
+
+// SetIPv6Fragment helper.
+// matches the IPv6 packets having a fragment header.
+func SetIPv6Fragment() Exprs {
+	// exthdr frag exists
+	exprs := []expr.Any{
+		// [ exthdr load ipv6 1b @ 44 + 0 present => reg 1 ]
+		&expr.Exthdr{
+			DestRegister: defaultRegister,
+			Type:         IPv6FragNexthdr,
+			Len:          1,
+			Flags:        unix.NFT_EXTHDR_F_PRESENT,
+			Op:           expr.ExthdrOpIpv6,
+		},
+		// [ cmp eq reg 1 0x00000001 ]
+		ExprCmp(expr.CmpOpEq, []byte{0x01}),
+	}
+	return exprs
+}
@@ -0,0 +1,21 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetFragment(t *testing.T) {
+	assert.Equal(t, Exprs{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 6, Len: 2},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 2, Mask: []byte{0x3f, 0xff}, Xor: []byte{0x00, 0x00}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x00, 0x00}},
+	}, SetIPv4Fragment())
+	exprs := SetIPv6Fragment()
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, uint8(44), exprs[0].(*expr.Exthdr).Type)
+		assert.Equal(t, []byte{0x01}, exprs[1].(*expr.Cmp).Data)
+	}
+}
@@ -0,0 +1,205 @@
+package nftablesutils
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// reg32 returns the 32 bit register at offset bytes of the 128 bit register reg.
+func reg32(reg uint32, offset uint32) uint32 {
+	return unix.NFT_REG32_00 + (reg-unix.NFT_REG_1)*4 + offset/4
+}
+
+// ExprNumgenInc wrapper
+func ExprNumgenInc(reg uint32, mod uint32) *expr.Numgen {
+	// [ numgen reg 1 = inc mod 3 ]
+	return &expr.Numgen{
+		Register: reg,
+		Modulus:  mod,
+		Type:     unix.NFT_NG_INCREMENTAL,
+	}
+}
+
+// ExprNumgenRandom wrapper
+func ExprNumgenRandom(reg uint32, mod uint32) *expr.Numgen {
+	// [ numgen reg 1 = random mod 3 ]
+	return &expr.Numgen{
+		Register: reg,
+		Modulus:  mod,
+		Type:     unix.NFT_NG_RANDOM,
+	}
+}
+
+// ExprJhash wrapper
+// hashes length bytes from sreg, the components of a concatenation are
+// padded to 4 bytes.
+func ExprJhash(sreg, dreg uint32, length uint32, mod uint32, seed uint32) *expr.Hash {
+	// [ hash reg 1 = jhash(reg 1, 8, 0x0) % mod 3 ]
+	return &expr.Hash{
+		SourceRegister: sreg,
+		DestRegister:   dreg,
+		Length:         length,
+		Modulus:        mod,
+		Seed:           seed,
+		Type:           expr.HashTypeJenkins,
+	}
+}
+
+// SetNumgenInc helper.
+// selects the numbers 0 to mod-1 in turn, e.g. the key of SetDNATMap.
+func SetNumgenInc(mod uint32) Exprs {
+	// numgen inc mod 3
+	return []expr.Any{ExprNumgenInc(defaultRegister, mod)}
+}
+
+// SetNumgenRandom helper.
+// selects a random number from 0 to mod-1.
+func SetNumgenRandom(mod uint32) Exprs {
+	// numgen random mod 3
+	return []expr.Any{ExprNumgenRandom(defaultRegister, mod)}
+}
+
+// SetJhashSAddrSPort helper.
+// selects a number from 0 to mod-1 by the hash of the source address and
+// port of the transport header, the same flow always gets the same number.
+func SetJhashSAddrSPort(isIPv6 bool, mod uint32, seed uint32) Exprs {
+	// jhash ip saddr . tcp sport mod 3 seed 0x0
+	addrLen := uint32(IPv4AddrLen)
+	saddr := IPv4SourceAddress(defaultRegister)
+	if isIPv6 {
+		addrLen = IPv6AddrLen
+		saddr = IPv6SourceAddress(defaultRegister)
+	}
+	exprs := []expr.Any{
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		saddr,
+		// [ payload load 2b @ transport header + 0 => reg 9 ]
+		SourcePort(reg32(defaultRegister, addrLen)),
+		// [ hash reg 1 = jhash(reg 1, 8, 0x0) % mod 3 ]
+		ExprJhash(defaultRegister, defaultRegister, addrLen+4, mod, seed),
+	}
+	return exprs
+}
+
+// Backend is a backend of a load balanced service.
+type Backend struct {
+	IP     net.IP
+	Port   uint16 // the original port if 0
+	Weight uint32 // 1 if 0
+}
+
+// GetDNATMap returns an anonymous map of the selected numbers to the
+// addresses, or to the addresses and ports if withPort.
+func GetDNATMap(t *nftables.Table, isIPv6 bool, withPort bool) (*nftables.Set, error) {
+	dataType := nftables.TypeIPAddr
+	if isIPv6 {
+		dataType = nftables.TypeIP6Addr
+	}
+	if withPort {
+		var err error
+		dataType, err = nftables.ConcatSetType(dataType, nftables.TypeInetService)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		IsMap:     true,
+		KeyType:   nftables.TypeInteger,
+		DataType:  dataType,
+	}
+	return s, nil
+}
+
+// GetDNATMapElems returns the elements of a map of GetDNATMap. A backend
+// takes Weight consecutive numbers, divided by the greatest common divisor of
+// the weights, so the modulus of the selector is the number of elements.
+func GetDNATMapElems(backends []Backend, isIPv6 bool, withPort bool) ([]nftables.SetElement, error) {
+	var divisor uint32
+	for _, b := range backends {
+		divisor = gcd(divisor, weightOf(b))
+	}
+	var elems []nftables.SetElement
+	for _, b := range backends {
+		ip := b.IP.To4()
+		if isIPv6 {
+			ip = b.IP.To16()
+			if b.IP.To4() != nil {
+				ip = nil
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("invalid backend address %q", b.IP)
+		}
+		val := append([]byte{}, ip...)
+		if withPort {
+			if b.Port == 0 {
+				return nil, fmt.Errorf("port of backend %q is required", b.IP)
+			}
+			// the concatenated port is padded to 4 bytes
+			val = append(val, binaryutil.BigEndian.PutUint16(b.Port)...)
+			val = append(val, 0, 0)
+		}
+		for i := uint32(0); i < weightOf(b)/divisor; i++ {
+			elems = append(elems, nftables.SetElement{
+				Key: binaryutil.NativeEndian.PutUint32(uint32(len(elems))),
+				Val: val,
+			})
+		}
+	}
+	return elems, nil
+}
+
+func weightOf(b Backend) uint32 {
+	if b.Weight == 0 {
+		return 1
+	}
+	return b.Weight
+}
+
+func gcd(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// SetDNATMap helper.
+// translates the destination to the backend of the number selected by
+// SetNumgenInc, SetNumgenRandom or SetJhashSAddrSPort in the map of
+// GetDNATMap.
+func SetDNATMap(m *nftables.Set, isIPv6 bool, withPort bool) Exprs {
+	// dnat to numgen inc mod 2 map { 0 : 10.0.0.1 . 8080, 1 : 10.0.0.2 . 8080 }
+	exprs := []expr.Any{
+		// [ lookup reg 1 set __map%d dreg 1 ]
+		&expr.Lookup{
+			SourceRegister: defaultRegister,
+			DestRegister:   defaultRegister,
+			IsDestRegSet:   true,
+			SetName:        m.Name,
+			SetID:          m.ID,
+		},
+	}
+	var regPort uint32
+	if withPort {
+		addrLen := uint32(IPv4AddrLen)
+		if isIPv6 {
+			addrLen = IPv6AddrLen
+		}
+		regPort = reg32(defaultRegister, addrLen)
+	}
+	// [ nat dnat ip addr_min reg 1 proto_min reg 9 ]
+	if isIPv6 {
+		exprs = append(exprs, ExprDNATv6(defaultRegister, 0, regPort))
+	} else {
+		exprs = append(exprs, ExprDNAT(defaultRegister, 0, regPort))
+	}
+	return exprs
+}
@@ -0,0 +1,67 @@
+package nftablesutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetJhashSAddrSPort(t *testing.T) {
+	assert.Equal(t, Exprs{&expr.Numgen{Register: 1, Modulus: 3, Type: unix.NFT_NG_INCREMENTAL}}, SetNumgenInc(3))
+
+	exprs := SetJhashSAddrSPort(false, 3, 7)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, uint32(9), exprs[1].(*expr.Payload).DestRegister)
+		assert.Equal(t, &expr.Hash{SourceRegister: 1, DestRegister: 1, Length: 8, Modulus: 3, Seed: 7, Type: expr.HashTypeJenkins}, exprs[2])
+	}
+	exprs = SetJhashSAddrSPort(true, 3, 7)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, uint32(12), exprs[1].(*expr.Payload).DestRegister)
+		assert.Equal(t, uint32(20), exprs[2].(*expr.Hash).Length)
+	}
+}
+
+func TestGetDNATMapElems(t *testing.T) {
+	backends := []Backend{
+		{IP: net.ParseIP(`10.0.0.1`), Port: 8080, Weight: 4},
+		{IP: net.ParseIP(`10.0.0.2`), Port: 8081, Weight: 2},
+		{IP: net.ParseIP(`10.0.0.3`), Port: 8082},
+	}
+	elems, err := GetDNATMapElems(backends, false, true)
+	assert.NoError(t, err)
+	// the weights 4:2:1 take 4, 2 and 1 numbers
+	if assert.Len(t, elems, 7) {
+		for i, elem := range elems {
+			assert.Equal(t, binaryutil.NativeEndian.PutUint32(uint32(i)), elem.Key)
+		}
+		assert.Equal(t, []byte{10, 0, 0, 1, 0x1f, 0x90, 0, 0}, elems[3].Val)
+		assert.Equal(t, []byte{10, 0, 0, 2, 0x1f, 0x91, 0, 0}, elems[4].Val)
+		assert.Equal(t, []byte{10, 0, 0, 3, 0x1f, 0x92, 0, 0}, elems[6].Val)
+	}
+	backends[2].Weight = 2
+	elems, err = GetDNATMapElems(backends, false, false)
+	assert.NoError(t, err)
+	// divided by the greatest common divisor 2
+	if assert.Len(t, elems, 4) {
+		assert.Equal(t, []byte{10, 0, 0, 3}, elems[3].Val)
+	}
+
+	_, err = GetDNATMapElems(backends, true, false)
+	assert.EqualError(t, err, `invalid backend address "10.0.0.1"`)
+	_, err = GetDNATMapElems([]Backend{{IP: net.ParseIP(`10.0.0.1`)}}, false, true)
+	assert.EqualError(t, err, `port of backend "10.0.0.1" is required`)
+
+	m, err := GetDNATMap(&nftables.Table{}, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(8), m.DataType.Bytes)
+	exprs := SetDNATMap(m, false, true)
+	if assert.Len(t, exprs, 2) {
+		assert.True(t, exprs[0].(*expr.Lookup).IsDestRegSet)
+		assert.Equal(t, &expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 9}, exprs[1])
+	}
+}
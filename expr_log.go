@@ -0,0 +1,73 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// LogPrefixMaxLen is the maximum length of a log prefix (NF_LOG_PREFIXLEN - 1).
+const LogPrefixMaxLen = 127
+
+func logPrefix(prefix string) []byte {
+	if len(prefix) > LogPrefixMaxLen {
+		prefix = prefix[:LogPrefixMaxLen]
+	}
+	return []byte(prefix)
+}
+
+// ExprLog wrapper
+// logs to the kernel log (syslog) with level.
+func ExprLog(prefix string, level expr.LogLevel, flags ...expr.LogFlags) *expr.Log {
+	// [ log prefix "prefix" level 4 flags 0 ]
+	e := &expr.Log{
+		Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_LEVEL,
+		Level: level,
+		Data:  logPrefix(prefix),
+	}
+	for _, f := range flags {
+		e.Flags |= f
+	}
+	if e.Flags != 0 {
+		e.Key |= 1 << unix.NFTA_LOG_FLAGS
+	}
+	return e
+}
+
+// ExprLogGroup wrapper
+// sends the packets to the NFLOG group. snaplen is the number of bytes of the
+// packet copied to userspace and qthreshold the number of packets queued in
+// the kernel before sending them, zero leaves them unset.
+func ExprLogGroup(prefix string, group uint16, snaplen uint32, qthreshold uint16) *expr.Log {
+	// [ log prefix "prefix" group 1 snaplen 0 qthreshold 0 ]
+	e := &expr.Log{
+		Key:   1<<unix.NFTA_LOG_PREFIX | 1<<unix.NFTA_LOG_GROUP,
+		Group: group,
+		Data:  logPrefix(prefix),
+	}
+	if snaplen > 0 {
+		e.Key |= 1 << unix.NFTA_LOG_SNAPLEN
+		e.Snaplen = snaplen
+	}
+	if qthreshold > 0 {
+		e.Key |= 1 << unix.NFTA_LOG_QTHRESHOLD
+		e.QThreshold = qthreshold
+	}
+	return e
+}
+
+// SetLog helper.
+// limit is optional, packets over the rate are not logged.
+func SetLog(log *expr.Log, limit *expr.Limit) Exprs {
+	exprs := make([]expr.Any, 0, 2)
+	if limit != nil {
+		exprs = append(exprs, limit)
+	}
+	exprs = append(exprs, log)
+	return exprs
+}
+
+// SetLogDrop helper.
+// Packets over the rate of limit are neither logged nor dropped by this rule.
+func SetLogDrop(log *expr.Log, limit *expr.Limit) Exprs {
+	return SetLog(log, limit).Add(Drop())
+}
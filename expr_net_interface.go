@@ -1,6 +1,9 @@
 package nftablesutils
 
-import "github.com/google/nftables/expr"
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
 
 // SetIIF equals input-interface
 func SetIIF(iface string) Exprs {
@@ -41,3 +44,36 @@ func SetNOIF(iface string) Exprs {
 
 	return exprs
 }
+
+// SetIIFSet helper.
+func SetIIFSet(s *nftables.Set, isEq ...bool) Exprs {
+	exprs := []expr.Any{
+		ExprIIFName(),
+		ExprLookupSet(defaultRegister, s.Name, s.ID, isEq...),
+	}
+
+	return exprs
+}
+
+// SetOIFSet helper.
+func SetOIFSet(s *nftables.Set, isEq ...bool) Exprs {
+	exprs := []expr.Any{
+		ExprOIFName(),
+		ExprLookupSet(defaultRegister, s.Name, s.ID, isEq...),
+	}
+
+	return exprs
+}
+
+// GetIfnameSet helper.
+// the interval sets match the wildcard names, see set.GenerateElementsFromIface.
+func GetIfnameSet(t *nftables.Table, isInterval ...bool) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeIFName,
+		Interval:  len(isInterval) > 0 && isInterval[0],
+	}
+	return s
+}
@@ -0,0 +1,94 @@
+package nftablesutils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ExprObjref wrapper
+// references the named stateful object of type (unix.NFT_OBJECT_*).
+func ExprObjref(typ uint32, name string) *expr.Objref {
+	// [ objref type 2 name obj_name ]
+	return &expr.Objref{
+		Type: int(typ),
+		Name: name,
+	}
+}
+
+// ExprQuotaRef wrapper
+func ExprQuotaRef(name string) *expr.Objref {
+	// [ objref type 2 name quota_name ]
+	return ExprObjref(unix.NFT_OBJECT_QUOTA, name)
+}
+
+// ExprLimitRef wrapper
+func ExprLimitRef(name string) *expr.Objref {
+	// [ objref type 4 name limit_name ]
+	return ExprObjref(unix.NFT_OBJECT_LIMIT, name)
+}
+
+// ExprCtTimeoutSet wrapper
+// assigns the ct timeout policy to the connection.
+func ExprCtTimeoutSet(name string) *expr.Objref {
+	// [ objref type 7 name timeout_name ]
+	return ExprObjref(unix.NFT_OBJECT_CT_TIMEOUT, name)
+}
+
+// ExprCtHelperSet wrapper
+// assigns the ct helper object to the connection.
+func ExprCtHelperSet(name string) *expr.Objref {
+	// [ objref type 3 name helper_name ]
+	return ExprObjref(unix.NFT_OBJECT_CT_HELPER, name)
+}
+
+// ExprQuota wrapper
+// matches until bytes are consumed, or once they are if over is true.
+func ExprQuota(bytes uint64, over bool) *expr.Quota {
+	// [ quota bytes 1000 consumed 0 flags 1 ]
+	return &expr.Quota{
+		Bytes: bytes,
+		Over:  over,
+	}
+}
+
+// ParseQuota parse expr.Quota
+// quotaStr := `500m`  // until 500 MiB
+// quotaStr := `10g+`  // over 10 GiB
+// units: b, k(b), m(b), g(b), t(b), 1024-based as in nft
+func ParseQuota(quotaStr string) (*expr.Quota, error) {
+	s := strings.ToLower(strings.TrimSpace(quotaStr))
+	over := strings.HasSuffix(s, `+`)
+	if over {
+		s = strings.TrimSpace(strings.TrimSuffix(s, `+`))
+	}
+	s = strings.TrimSuffix(s, `bytes`)
+	s = strings.TrimSuffix(s, `b`)
+	var shift uint
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'k':
+			shift = 10
+		case 'm':
+			shift = 20
+		case 'g':
+			shift = 30
+		case 't':
+			shift = 40
+		}
+		if shift > 0 {
+			s = s[:len(s)-1]
+		}
+	}
+	bytes, err := strconv.ParseUint(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to ParseUint(%q) from %q: %w`, s, quotaStr, err)
+	}
+	if bytes > (1<<64-1)>>shift {
+		return nil, fmt.Errorf(`quota %q overflows`, quotaStr)
+	}
+	return ExprQuota(bytes<<shift, over), nil
+}
@@ -0,0 +1,31 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuota(t *testing.T) {
+	for s, want := range map[string]struct {
+		bytes uint64
+		over  bool
+	}{
+		`1000`:      {1000, false},
+		`500m`:      {500 << 20, false},
+		`10 GB+`:    {10 << 30, true},
+		`2kbytes`:   {2 << 10, false},
+		` 1t + `:    {1 << 40, true},
+		`100 bytes`: {100, false},
+	} {
+		q, err := ParseQuota(s)
+		if assert.NoError(t, err, s) {
+			assert.Equal(t, want.bytes, q.Bytes, s)
+			assert.Equal(t, want.over, q.Over, s)
+		}
+	}
+	for _, s := range []string{``, `g`, `-1m`, `99999999999t`} {
+		_, err := ParseQuota(s)
+		assert.Error(t, err, s)
+	}
+}
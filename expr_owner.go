@@ -0,0 +1,173 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// ExprMetaSkUID wrapper
+func ExprMetaSkUID(reg uint32) *expr.Meta {
+	// [ meta load skuid => reg 1 ]
+	return ExprMeta(expr.MetaKeySKUID, reg)
+}
+
+// ExprMetaSkGID wrapper
+func ExprMetaSkGID(reg uint32) *expr.Meta {
+	// [ meta load skgid => reg 1 ]
+	return ExprMeta(expr.MetaKeySKGID, reg)
+}
+
+// ExprMetaCgroup wrapper
+func ExprMetaCgroup(reg uint32) *expr.Meta {
+	// [ meta load cgroup => reg 1 ]
+	return ExprMeta(expr.MetaKeyCGROUP, reg)
+}
+
+// ExprSocketCgroupV2 wrapper
+func ExprSocketCgroupV2(reg uint32, level uint32) *expr.Socket {
+	// [ socket load cgroupv2 => reg 1 , level 2 ]
+	return &expr.Socket{
+		Key:      expr.SocketKeyCgroupv2,
+		Level:    level,
+		Register: reg,
+	}
+}
+
+// SetSkUID helper.
+// matches the packets of the sockets owned by the user.
+func SetSkUID(uid uint32, isEq ...bool) Exprs {
+	// meta skuid 1000
+	exprs := []expr.Any{
+		ExprMetaSkUID(defaultRegister),
+		// [ cmp eq reg 1 0x000003e8 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.NativeEndian.PutUint32(uid)),
+	}
+	return exprs
+}
+
+// SetSkGID helper.
+// matches the packets of the sockets owned by the group.
+func SetSkGID(gid uint32, isEq ...bool) Exprs {
+	// meta skgid 1000
+	exprs := []expr.Any{
+		ExprMetaSkGID(defaultRegister),
+		// [ cmp eq reg 1 0x000003e8 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.NativeEndian.PutUint32(gid)),
+	}
+	return exprs
+}
+
+// GetUIDSet helper.
+func GetUIDSet(t *nftables.Table) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeUID,
+	}
+	return s
+}
+
+// GetGIDSet helper.
+func GetGIDSet(t *nftables.Table) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeGID,
+	}
+	return s
+}
+
+// GetIDSetElems helper.
+// returns the elements of the UIDs or GIDs, in host byte order.
+func GetIDSetElems(ids []uint32) []nftables.SetElement {
+	elems := make([]nftables.SetElement, len(ids))
+	for i, id := range ids {
+		elems[i] = nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(id)}
+	}
+	return elems
+}
+
+// SetSkUIDSet helper.
+// matches the packets of the sockets owned by the users in set.
+func SetSkUIDSet(set *nftables.Set, isEq ...bool) Exprs {
+	// meta skuid { 1000, 1001 }
+	exprs := []expr.Any{
+		ExprMetaSkUID(defaultRegister),
+		// [ lookup reg 1 set __set%d ]
+		ExprLookupSet(defaultRegister, set.Name, set.ID, isEq...),
+	}
+	return exprs
+}
+
+// SetSkGIDSet helper.
+// matches the packets of the sockets owned by the groups in set.
+func SetSkGIDSet(set *nftables.Set, isEq ...bool) Exprs {
+	// meta skgid { 1000, 1001 }
+	exprs := []expr.Any{
+		ExprMetaSkGID(defaultRegister),
+		// [ lookup reg 1 set __set%d ]
+		ExprLookupSet(defaultRegister, set.Name, set.ID, isEq...),
+	}
+	return exprs
+}
+
+// SetMetaCgroup helper.
+// matches the packets of the cgroup v1 net_cls classid.
+func SetMetaCgroup(classid uint32, isEq ...bool) Exprs {
+	// meta cgroup 1048577
+	exprs := []expr.Any{
+		ExprMetaCgroup(defaultRegister),
+		// [ cmp eq reg 1 0x00100001 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.NativeEndian.PutUint32(classid)),
+	}
+	return exprs
+}
+
+// SetSocketCgroupV2 helper.
+// matches the packets of the sockets in the cgroup v2 id at level, or in its
+// descendants. See CgroupV2ID.
+func SetSocketCgroupV2(level uint32, id uint64, isEq ...bool) Exprs {
+	// socket cgroupv2 level 2 "system.slice/build.service"
+	exprs := []expr.Any{
+		ExprSocketCgroupV2(defaultRegister, level),
+		// [ cmp eq reg 1 0x00001b4e 0x00000000 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.NativeEndian.PutUint64(id)),
+	}
+	return exprs
+}
+
+// GetCgroupV2Set helper.
+func GetCgroupV2Set(t *nftables.Table) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeCGroupV2,
+	}
+	return s
+}
+
+// GetCgroupV2SetElems helper.
+func GetCgroupV2SetElems(ids []uint64) []nftables.SetElement {
+	elems := make([]nftables.SetElement, len(ids))
+	for i, id := range ids {
+		elems[i] = nftables.SetElement{Key: binaryutil.NativeEndian.PutUint64(id)}
+	}
+	return elems
+}
+
+// SetSocketCgroupV2Set helper.
+// matches the packets of the sockets in the cgroups v2 of set at level, or in
+// their descendants.
+func SetSocketCgroupV2Set(level uint32, set *nftables.Set, isEq ...bool) Exprs {
+	// socket cgroupv2 level 2 { "system.slice/a.service", "system.slice/b.service" }
+	exprs := []expr.Any{
+		ExprSocketCgroupV2(defaultRegister, level),
+		// [ lookup reg 1 set __set%d ]
+		ExprLookupSet(defaultRegister, set.Name, set.ID, isEq...),
+	}
+	return exprs
+}
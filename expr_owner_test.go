@@ -0,0 +1,20 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSocketCgroupV2(t *testing.T) {
+	exprs := SetSocketCgroupV2(2, 0x1b4e)
+	if assert.Len(t, exprs, 2) {
+		assert.Equal(t, &expr.Socket{Key: expr.SocketKeyCgroupv2, Level: 2, Register: 1}, exprs[0])
+		assert.Len(t, exprs[1].(*expr.Cmp).Data, 8)
+	}
+	exprs = SetSkUID(1000, false)
+	assert.Equal(t, &expr.Meta{Key: expr.MetaKeySKUID, Register: 1}, exprs[0])
+	assert.Equal(t, expr.CmpOpNeq, exprs[1].(*expr.Cmp).Op)
+	assert.Len(t, GetIDSetElems([]uint32{1000, 1001}), 2)
+}
@@ -48,6 +48,26 @@ func SetDPort(p uint16, isEq ...bool) Exprs {
 	return exprs
 }
 
+// SetSAddrDPort helper.
+// loads the source address and the destination port concatenated in the
+// registers, e.g. the key of a set of type ipv4_addr . inet_service.
+func SetSAddrDPort(isIPv6 bool) Exprs {
+	// ip saddr . tcp dport
+	addrLen := uint32(IPv4AddrLen)
+	saddr := IPv4SourceAddress(defaultRegister)
+	if isIPv6 {
+		addrLen = IPv6AddrLen
+		saddr = IPv6SourceAddress(defaultRegister)
+	}
+	exprs := []expr.Any{
+		// [ payload load 4b @ network header + 12 => reg 1 ]
+		saddr,
+		// [ payload load 2b @ transport header + 2 => reg 9 ]
+		DestinationPort(reg32(defaultRegister, addrLen)),
+	}
+	return exprs
+}
+
 // SetSPortSet helper.
 func SetSPortSet(s *nftables.Set, isEq ...bool) Exprs {
 	exprs := []expr.Any{
@@ -1,6 +1,9 @@
 package nftablesutils
 
-import "github.com/google/nftables/expr"
+import (
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
 
 func ProtoTCP(reg uint32) *expr.Payload {
 	return ExprPayloadNetHeader(reg, ProtoTCPOffset, ProtoTCPLen)
@@ -61,3 +64,16 @@ func SetProtoTCP(isEq ...bool) Exprs {
 	}
 	return exprs
 }
+
+// SetMetaProtocol helper.
+// matches the ethertype of the packet, e.g. unix.ETH_P_IP in the netdev family.
+func SetMetaProtocol(etherType uint16, isEq ...bool) Exprs {
+	// meta protocol ip
+	exprs := []expr.Any{
+		// [ meta load protocol => reg 1 ]
+		ExprMeta(expr.MetaKeyPROTOCOL, defaultRegister),
+		// [ cmp eq reg 1 0x00000008 ]
+		ExprCmp(GetCmpOp(isEq...), binaryutil.BigEndian.PutUint16(etherType)),
+	}
+	return exprs
+}
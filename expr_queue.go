@@ -0,0 +1,32 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+// ExprQueue wrapper
+// sends the packets to the NFQUEUE num, see package nfqueue. With
+// expr.QueueFlagBypass the packets are accepted if no process listens on the
+// queue, otherwise they are dropped.
+func ExprQueue(num uint16, flags ...expr.QueueFlag) *expr.Queue {
+	// [ queue num 1 bypass ]
+	return ExprQueueRange(num, num, flags...)
+}
+
+// ExprQueueRange wrapper
+// balances the packets over the NFQUEUEs from to to by flow hash, or by CPU
+// with expr.QueueFlagFanout.
+func ExprQueueRange(from, to uint16, flags ...expr.QueueFlag) *expr.Queue {
+	// [ queue num 1-4 fanout ]
+	e := &expr.Queue{
+		Num:   from,
+		Total: 1,
+	}
+	if to > from {
+		e.Total = to - from + 1
+	}
+	for _, f := range flags {
+		e.Flag |= f
+	}
+	return e
+}
@@ -0,0 +1,14 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExprQueue(t *testing.T) {
+	assert.Equal(t, &expr.Queue{Num: 1, Total: 1, Flag: expr.QueueFlagBypass}, ExprQueue(1, expr.QueueFlagBypass))
+	assert.Equal(t, &expr.Queue{Num: 2, Total: 3, Flag: expr.QueueFlagBypass | expr.QueueFlagFanout}, ExprQueueRange(2, 4, expr.QueueFlagBypass, expr.QueueFlagFanout))
+	assert.Equal(t, uint16(1), ExprQueueRange(4, 2).Total)
+}
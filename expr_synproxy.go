@@ -0,0 +1,54 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables/expr"
+)
+
+// SetTCPFlagSYN helper.
+// matches the TCP packets whose only flag of FIN, SYN, RST and ACK is SYN.
+func SetTCPFlagSYN() Exprs {
+	exprs := []expr.Any{
+		// [ payload load 1b @ transport header + 13 => reg 1 ]
+		ExprPayloadTransportHeader(defaultRegister, TCPFlagsOffset, TCPFlagsLen),
+		// [ bitwise reg 1 = ( reg 1 & 0x00000017 ) ^ 0x00000000 ]
+		ExprBitwise(defaultRegister, defaultRegister, TCPFlagsLen,
+			[]byte{TCPFlagFIN | TCPFlagSYN | TCPFlagRST | TCPFlagACK},
+			[]byte{0x00},
+		),
+		// [ cmp eq reg 1 0x00000002 ]
+		ExprCmp(expr.CmpOpEq, []byte{TCPFlagSYN}),
+	}
+	return exprs
+}
+
+// ExprSynProxy wrapper
+// mss and wscale are the options of the backend, e.g. 1460 and 7.
+func ExprSynProxy(mss uint16, wscale uint8, timestamp bool, sackPerm bool) *expr.SynProxy {
+	// [ synproxy mss 1460 wscale 7 ]
+	return &expr.SynProxy{
+		Mss:            mss,
+		Wscale:         wscale,
+		Timestamp:      timestamp,
+		SackPerm:       sackPerm,
+		MssValueSet:    true,
+		WscaleValueSet: true,
+	}
+}
+
+// SetSynProxy helper.
+// answers the untracked SYNs and the following ACKs with syncookies and
+// connects to the backend once the handshake is completed. The SYNs must be
+// untracked by a raw notrack rule, and net.ipv4.tcp_syncookies must be enabled.
+func SetSynProxy(mss uint16, wscale uint8, timestamp bool, sackPerm bool) Exprs {
+	exprs := []expr.Any{
+		// ct state invalid,untracked
+		ExprCtState(defaultRegister),
+		ExprBitwise(defaultRegister, defaultRegister, ConnTrackStateLen,
+			[]byte{TypeConntrackStateInvalid()[0] | TypeConntrackStateUntracked()[0], 0x00, 0x00, 0x00},
+			[]byte{0x00, 0x00, 0x00, 0x00},
+		),
+		ExprCmpNeq(defaultRegister, []byte{0x00, 0x00, 0x00, 0x00}),
+		ExprSynProxy(mss, wscale, timestamp, sackPerm),
+	}
+	return exprs
+}
@@ -0,0 +1,20 @@
+package nftablesutils
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSynProxy(t *testing.T) {
+	exprs := SetSynProxy(1460, 7, true, false)
+	if assert.Len(t, exprs, 4) {
+		assert.Equal(t, []byte{0x41, 0, 0, 0}, exprs[1].(*expr.Bitwise).Mask)
+		assert.Equal(t, &expr.SynProxy{Mss: 1460, Wscale: 7, Timestamp: true, MssValueSet: true, WscaleValueSet: true}, exprs[3])
+	}
+	exprs = SetTCPFlagSYN()
+	assert.Equal(t, uint32(TCPFlagsOffset), exprs[0].(*expr.Payload).Offset)
+	assert.Equal(t, []byte{0x17}, exprs[1].(*expr.Bitwise).Mask)
+	assert.Equal(t, []byte{TCPFlagSYN}, exprs[2].(*expr.Cmp).Data)
+}
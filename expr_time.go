@@ -0,0 +1,142 @@
+package nftablesutils
+
+import (
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Meta keys of the time, which are not declared by github.com/google/nftables.
+// The kernel computes the day and the hour in UTC, unless its timezone was set
+// by settimeofday.
+const (
+	MetaKeyTIME expr.MetaKey = 30 // NFT_META_TIME_NS: nanoseconds since the epoch, 64 bit host byte order
+	MetaKeyDAY  expr.MetaKey = 31 // NFT_META_TIME_DAY: day of the week, Sunday is 0
+	MetaKeyHOUR expr.MetaKey = 32 // NFT_META_TIME_HOUR: seconds since midnight, 32 bit host byte order
+)
+
+// ExprMetaTime wrapper
+func ExprMetaTime(reg uint32) *expr.Meta {
+	// [ meta load time => reg 1 ]
+	return ExprMeta(MetaKeyTIME, reg)
+}
+
+// ExprMetaDay wrapper
+func ExprMetaDay(reg uint32) *expr.Meta {
+	// [ meta load day => reg 1 ]
+	return ExprMeta(MetaKeyDAY, reg)
+}
+
+// ExprMetaHour wrapper
+func ExprMetaHour(reg uint32) *expr.Meta {
+	// [ meta load hour => reg 1 ]
+	return ExprMeta(MetaKeyHOUR, reg)
+}
+
+// ExprHton wrapper
+func ExprHton(reg uint32, size uint32) *expr.Byteorder {
+	// [ byteorder reg 1 = hton(reg 1, 8, 8) ]
+	return &expr.Byteorder{
+		SourceRegister: reg,
+		DestRegister:   reg,
+		Op:             expr.ByteorderHton,
+		Len:            size,
+		Size:           size,
+	}
+}
+
+// SetTimeRange helper.
+// matches the packets from start until end, the zero times are unbounded.
+func SetTimeRange(start, end time.Time) Exprs {
+	if start.IsZero() && end.IsZero() {
+		return nil
+	}
+	// meta time >= "2026-01-01 00:00:00" meta time < "2027-01-01 00:00:00"
+	exprs := []expr.Any{
+		ExprMetaTime(defaultRegister),
+		ExprHton(defaultRegister, 8),
+	}
+	if !start.IsZero() {
+		// [ cmp gte reg 1 0x1882aa8f 0x0c800000 ]
+		exprs = append(exprs, ExprCmp(expr.CmpOpGte, binaryutil.BigEndian.PutUint64(uint64(start.UnixNano()))))
+	}
+	if !end.IsZero() {
+		// [ cmp lt reg 1 0x18ba57d9 0xe0200000 ]
+		exprs = append(exprs, ExprCmp(expr.CmpOpLt, binaryutil.BigEndian.PutUint64(uint64(end.UnixNano()))))
+	}
+	return exprs
+}
+
+// SetDay helper.
+// matches the packets of the day of the week.
+func SetDay(day time.Weekday, isEq ...bool) Exprs {
+	// meta day "Monday"
+	exprs := []expr.Any{
+		ExprMetaDay(defaultRegister),
+		// [ cmp eq reg 1 0x00000001 ]
+		ExprCmp(GetCmpOp(isEq...), []byte{byte(day)}),
+	}
+	return exprs
+}
+
+// GetDaySet helper.
+func GetDaySet(t *nftables.Table) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		KeyType:   nftables.TypeTimeDay,
+	}
+	return s
+}
+
+// GetDaySetElems helper.
+func GetDaySetElems(days []time.Weekday) []nftables.SetElement {
+	elems := make([]nftables.SetElement, 0, len(days))
+	for _, day := range days {
+		elems = append(elems, nftables.SetElement{Key: []byte{byte(day)}})
+	}
+	return elems
+}
+
+// SetDaySet helper.
+// matches the packets of the days of the week in set.
+func SetDaySet(set *nftables.Set, isEq ...bool) Exprs {
+	// meta day { "Monday", "Tuesday" }
+	exprs := []expr.Any{
+		ExprMetaDay(defaultRegister),
+		// [ lookup reg 1 set __set%d ]
+		ExprLookupSet(defaultRegister, set.Name, set.ID, isEq...),
+	}
+	return exprs
+}
+
+// SetHourRange helper.
+// matches the packets from the time of day from until to (excluded), in the
+// clock of the kernel. The range wraps midnight if to is before from.
+func SetHourRange(from, to time.Duration) Exprs {
+	start, end := uint32(from/time.Second)%86400, uint32(to/time.Second)%86400
+	op := expr.CmpOpEq
+	if end < start {
+		// meta hour "22:00"-"06:00" is meta hour != "06:00"-"21:59:59"
+		start, end = end, start
+		op = expr.CmpOpNeq
+	}
+	if start == end {
+		return nil
+	}
+	exprs := []expr.Any{
+		ExprMetaHour(defaultRegister),
+		ExprHton(defaultRegister, 4),
+		// [ range eq reg 1 0x80700000 0x6f2e0000 ]
+		&expr.Range{
+			Op:       op,
+			Register: defaultRegister,
+			FromData: binaryutil.BigEndian.PutUint32(start),
+			ToData:   binaryutil.BigEndian.PutUint32(end - 1),
+		},
+	}
+	return exprs
+}
@@ -0,0 +1,46 @@
+package nftablesutils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetHourRange(t *testing.T) {
+	exprs := SetHourRange(8*time.Hour, 17*time.Hour+30*time.Minute)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, &expr.Meta{Key: MetaKeyHOUR, Register: 1}, exprs[0])
+		assert.Equal(t, &expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 4, Size: 4}, exprs[1])
+		assert.Equal(t, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: []byte{0, 0, 0x70, 0x80}, ToData: []byte{0, 0, 0xf6, 0x17}}, exprs[2])
+	}
+	// 22:00-06:00 wraps midnight
+	exprs = SetHourRange(22*time.Hour, 6*time.Hour)
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, &expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: []byte{0, 0, 0x54, 0x60}, ToData: []byte{0, 1, 0x35, 0x5f}}, exprs[2])
+	}
+	assert.Nil(t, SetHourRange(time.Hour, time.Hour))
+}
+
+func TestSetTimeRange(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	exprs := SetTimeRange(start, time.Time{})
+	if assert.Len(t, exprs, 3) {
+		assert.Equal(t, &expr.Meta{Key: MetaKeyTIME, Register: 1}, exprs[0])
+		assert.Equal(t, uint32(8), exprs[1].(*expr.Byteorder).Size)
+		assert.Equal(t, expr.CmpOpGte, exprs[2].(*expr.Cmp).Op)
+	}
+	exprs = SetTimeRange(start, start.AddDate(1, 0, 0))
+	if assert.Len(t, exprs, 4) {
+		assert.Equal(t, expr.CmpOpLt, exprs[3].(*expr.Cmp).Op)
+	}
+	assert.Nil(t, SetTimeRange(time.Time{}, time.Time{}))
+}
+
+func TestSetDay(t *testing.T) {
+	exprs := SetDay(time.Monday, false)
+	assert.Equal(t, &expr.Meta{Key: MetaKeyDAY, Register: 1}, exprs[0])
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{1}}, exprs[1])
+	assert.Equal(t, []byte{6}, GetDaySetElems([]time.Weekday{time.Saturday})[0].Key)
+}
@@ -0,0 +1,124 @@
+package nftablesutils
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ExprJump wrapper
+func ExprJump(chain string) *expr.Verdict {
+	// [ immediate reg 0 jump -> chain ]
+	return &expr.Verdict{
+		Kind:  expr.VerdictJump,
+		Chain: chain,
+	}
+}
+
+// ExprGoto wrapper
+func ExprGoto(chain string) *expr.Verdict {
+	// [ immediate reg 0 goto -> chain ]
+	return &expr.Verdict{
+		Kind:  expr.VerdictGoto,
+		Chain: chain,
+	}
+}
+
+// ExprReturn wrapper
+func ExprReturn() *expr.Verdict {
+	// [ immediate reg 0 return ]
+	return &expr.Verdict{
+		Kind: expr.VerdictReturn,
+	}
+}
+
+// ExprLookupVerdictMap wrapper
+func ExprLookupVerdictMap(m *nftables.Set, reg uint32) *expr.Lookup {
+	// [ lookup reg 1 set __map%d dreg 0 ]
+	return &expr.Lookup{
+		SourceRegister: reg,
+		DestRegister:   0,
+		IsDestRegSet:   true,
+		SetName:        m.Name,
+		SetID:          m.ID,
+	}
+}
+
+// SetIIFVerdictMap helper.
+func SetIIFVerdictMap(m *nftables.Set) Exprs {
+	exprs := []expr.Any{
+		ExprIIFName(),
+		ExprLookupVerdictMap(m, defaultRegister),
+	}
+	return exprs
+}
+
+// SetOIFVerdictMap helper.
+func SetOIFVerdictMap(m *nftables.Set) Exprs {
+	exprs := []expr.Any{
+		ExprOIFName(),
+		ExprLookupVerdictMap(m, defaultRegister),
+	}
+	return exprs
+}
+
+// SetSAddrVerdictMap helper.
+func SetSAddrVerdictMap(m *nftables.Set) Exprs {
+	exprs := []expr.Any{
+		IPv4SourceAddress(defaultRegister),
+		ExprLookupVerdictMap(m, defaultRegister),
+	}
+	return exprs
+}
+
+// SetSAddrIPv6VerdictMap helper.
+func SetSAddrIPv6VerdictMap(m *nftables.Set) Exprs {
+	exprs := []expr.Any{
+		IPv6SourceAddress(defaultRegister),
+		ExprLookupVerdictMap(m, defaultRegister),
+	}
+	return exprs
+}
+
+// GetVerdictMap returns an anonymous verdict map.
+func GetVerdictMap(t *nftables.Table, keyType nftables.SetDatatype, isInterval ...bool) *nftables.Set {
+	s := &nftables.Set{
+		Anonymous: true,
+		Constant:  true,
+		Table:     t,
+		IsMap:     true,
+		KeyType:   keyType,
+		DataType:  nftables.TypeVerdict,
+		Interval:  len(isInterval) > 0 && isInterval[0],
+	}
+	return s
+}
+
+// GetIfnameVerdictMap returns an anonymous verdict map keyed by interface name.
+func GetIfnameVerdictMap(t *nftables.Table) *nftables.Set {
+	return GetVerdictMap(t, nftables.TypeIFName)
+}
+
+// GetIfnameVerdictElems returns the elements of a verdict map keyed by
+// interface name.
+func GetIfnameVerdictElems(ifaces []string, verdict *expr.Verdict) []nftables.SetElement {
+	elems := make([]nftables.SetElement, len(ifaces))
+	for i, iface := range ifaces {
+		elems[i] = nftables.SetElement{
+			Key:         ifname(iface),
+			VerdictData: verdict,
+		}
+	}
+	return elems
+}
+
+// SetVerdictElems sets the verdict of the interval elements generated by
+// the set package. The end elements of the intervals are left untouched.
+func SetVerdictElems(elems []nftables.SetElement, verdict *expr.Verdict) []nftables.SetElement {
+	for i := range elems {
+		if elems[i].IntervalEnd {
+			continue
+		}
+		elems[i].VerdictData = verdict
+	}
+	return elems
+}
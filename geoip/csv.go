@@ -0,0 +1,148 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/gaissmai/extnetip"
+)
+
+// ReadCSV reads the CSV country databases into db. The supported formats are:
+//
+//   - DB-IP: start_ip,end_ip,country
+//   - network,country, e.g. 1.0.0.0/24,AU
+//   - MaxMind GeoLite2 / GeoIP2: the Blocks-IPv4 / Blocks-IPv6 files with their
+//     Locations file, whose geoname_id are resolved to the country_iso_code
+func (db *DB) ReadCSV(readers ...io.Reader) error {
+	locations := map[string]string{}
+	var blocks [][][]string
+	for i, r := range readers {
+		rows, err := readCSVRows(r)
+		if err != nil {
+			return fmt.Errorf(`csv %d: %w`, i+1, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		header := rows[0]
+		switch {
+		case indexOf(header, `geoname_id`) >= 0 && indexOf(header, `country_iso_code`) >= 0:
+			id, code := indexOf(header, `geoname_id`), indexOf(header, `country_iso_code`)
+			for _, row := range rows[1:] {
+				if id < len(row) && code < len(row) {
+					locations[row[id]] = row[code]
+				}
+			}
+		case indexOf(header, `network`) == 0 && indexOf(header, `geoname_id`) > 0:
+			blocks = append(blocks, rows)
+		default:
+			if err = db.addRangeRows(rows); err != nil {
+				return fmt.Errorf(`csv %d: %w`, i+1, err)
+			}
+		}
+	}
+	for _, rows := range blocks {
+		if err := db.addBlockRows(rows, locations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) readCSV(paths []string) error {
+	readers := make([]io.Reader, 0, len(paths))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	return db.ReadCSV(readers...)
+}
+
+func readCSVRows(r io.Reader) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = false
+	var rows [][]string
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+		rows = append(rows, row)
+	}
+}
+
+// addBlockRows adds the networks of a MaxMind Blocks file.
+func (db *DB) addBlockRows(rows [][]string, locations map[string]string) error {
+	header := rows[0]
+	ids := []int{indexOf(header, `geoname_id`), indexOf(header, `registered_country_geoname_id`)}
+	for _, row := range rows[1:] {
+		prefix, err := netip.ParsePrefix(row[0])
+		if err != nil {
+			return err
+		}
+		for _, i := range ids {
+			if i < 0 || i >= len(row) || len(row[i]) == 0 {
+				continue
+			}
+			if country, ok := locations[row[i]]; ok && len(country) > 0 {
+				db.add(country, prefix)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// addRangeRows adds the rows of the start_ip,end_ip,country and
+// network,country formats. A header row is skipped.
+func (db *DB) addRangeRows(rows [][]string) error {
+	for i, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(row[0]); err == nil {
+			db.add(row[1], prefix)
+			continue
+		}
+		first, err := netip.ParseAddr(row[0])
+		if err != nil || len(row) < 3 {
+			if i == 0 {
+				continue
+			}
+			return fmt.Errorf(`line %d: invalid network %q`, i+1, row[0])
+		}
+		last, err := netip.ParseAddr(row[1])
+		if err != nil {
+			return fmt.Errorf(`line %d: %w`, i+1, err)
+		}
+		for _, prefix := range extnetip.Prefixes(first, last) {
+			db.add(row[2], prefix)
+		}
+	}
+	return nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,82 @@
+// Package geoip expands countries into the prefixes of local GeoIP
+// databases: the MaxMind GeoLite2 / GeoIP2 and DB-IP country databases, in
+// MMDB format or as CSV files.
+//
+//	db, err := geoip.Open(`/var/lib/GeoIP/GeoLite2-Country.mmdb`)
+//	prefixes := db.Prefixes(`CN`, `RU`)
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DB holds the prefixes of the countries, by upper-case ISO 3166-1 code.
+type DB struct {
+	countries map[string][]netip.Prefix
+}
+
+func newDB() *DB {
+	return &DB{countries: map[string][]netip.Prefix{}}
+}
+
+func (db *DB) add(country string, prefix netip.Prefix) {
+	if len(country) == 0 {
+		return
+	}
+	country = strings.ToUpper(country)
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	db.countries[country] = append(db.countries[country], prefix.Masked())
+}
+
+// Open reads and merges the databases. The files ending with .mmdb are read
+// as MMDB, the others as CSV, see ReadCSV.
+func Open(paths ...string) (*DB, error) {
+	db := newDB()
+	var csvPaths []string
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), `.mmdb`) {
+			if err := db.readMMDB(path); err != nil {
+				return nil, fmt.Errorf(`%s: %w`, path, err)
+			}
+			continue
+		}
+		csvPaths = append(csvPaths, path)
+	}
+	if len(csvPaths) > 0 {
+		if err := db.readCSV(csvPaths); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// Countries returns the codes of the countries having prefixes.
+func (db *DB) Countries() []string {
+	countries := make([]string, 0, len(db.countries))
+	for country := range db.countries {
+		countries = append(countries, country)
+	}
+	sort.Strings(countries)
+	return countries
+}
+
+// Prefixes returns the IPv4 and IPv6 prefixes of the countries, sorted.
+func (db *DB) Prefixes(countries ...string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, country := range countries {
+		prefixes = append(prefixes, db.countries[strings.ToUpper(country)]...)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Addr() == prefixes[j].Addr() {
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		}
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+	return prefixes
+}
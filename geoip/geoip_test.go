@@ -0,0 +1,229 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeString(s string) []byte {
+	return append([]byte{mmdbString<<5 | byte(len(s))}, s...)
+}
+
+func encodeMap(size int) []byte {
+	return []byte{mmdbMap<<5 | byte(size)}
+}
+
+// testMMDB builds an IPv6 MMDB file with 24 bit records. The IPv4 networks are
+// inserted under ::/96 and aliased by ::ffff:0:0/96.
+func testMMDB(networks map[string]string) []byte {
+	const (
+		empty = -1
+		alias = -2
+	)
+	// data section: a record per country
+	var data []byte
+	countryMaps := map[string]int{}
+	recordOffsets := map[string]int{}
+	for _, country := range []string{`CN`, `US`, `DE`} {
+		recordOffsets[country] = len(data)
+		data = append(data, encodeMap(1)...)
+		data = append(data, encodeString(`country`)...)
+		countryMaps[country] = len(data)
+		data = append(data, encodeMap(1)...)
+		data = append(data, encodeString(`iso_code`)...)
+		data = append(data, encodeString(country)...)
+	}
+	// the record of DE used by the tree has a registered country only,
+	// which refers to the country map of the first one by a pointer
+	recordOffsets[`DE`] = len(data)
+	data = append(data, encodeMap(1)...)
+	data = append(data, encodeString(`registered_country`)...)
+	data = append(data, mmdbPointer<<5, byte(countryMaps[`DE`]))
+
+	nodes := [][2]int{{empty, empty}}
+	insert := func(ip [16]byte, bits int, value int) {
+		node := 0
+		for i := 0; i < bits-1; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			next := nodes[node][bit]
+			if next < 0 {
+				nodes = append(nodes, [2]int{empty, empty})
+				next = len(nodes) - 1
+				nodes[node][bit] = next
+			}
+			node = next
+		}
+		bit := int(ip[(bits-1)/8]>>(7-(bits-1)%8)) & 1
+		nodes[node][bit] = value
+	}
+	values := map[int]string{}
+	for network, country := range networks {
+		prefix := netip.MustParsePrefix(network)
+		ip, bits := prefix.Addr().As16(), prefix.Bits()
+		if prefix.Addr().Is4() {
+			ip = [16]byte{}
+			copy(ip[12:], prefix.Addr().AsSlice())
+			bits += 96
+		}
+		value := -10 - len(values)
+		values[value] = country
+		insert(ip, bits, value)
+	}
+	// ::ffff:0:0/96 points to the node of ::/96
+	ipv4Node := 0
+	for i := 0; i < 96; i++ {
+		ipv4Node = nodes[ipv4Node][0]
+	}
+	insert(netip.MustParseAddr(`::ffff:0:0`).As16(), 96, alias)
+
+	nodeCount := len(nodes)
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, v := range node {
+			switch {
+			case v == empty:
+				v = nodeCount
+			case v == alias:
+				v = ipv4Node
+			case v <= -10:
+				v = nodeCount + dataSectionSeparator + recordOffsets[values[v]]
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data)
+	buf.Write(metadataMarker)
+	buf.Write(encodeMap(3))
+	buf.Write(encodeString(`node_count`))
+	buf.WriteByte(mmdbUint32<<5 | 4)
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(nodeCount)))
+	buf.Write(encodeString(`record_size`))
+	buf.Write([]byte{mmdbUint16<<5 | 2, 0, 24})
+	buf.Write(encodeString(`ip_version`))
+	buf.Write([]byte{mmdbUint16<<5 | 2, 0, 6})
+	return buf.Bytes()
+}
+
+func TestMMDB(t *testing.T) {
+	buf := testMMDB(map[string]string{
+		`1.0.0.0/24`:     `CN`,
+		`1.0.1.0/24`:     `CN`,
+		`8.8.8.0/24`:     `US`,
+		`2400::/12`:      `CN`,
+		`2a00:1450::/32`: `DE`,
+	})
+	path := filepath.Join(t.TempDir(), `country.mmdb`)
+	assert.NoError(t, os.WriteFile(path, buf, 0o600))
+	db, err := Open(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`CN`, `DE`, `US`}, db.Countries())
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix(`1.0.0.0/24`),
+		netip.MustParsePrefix(`1.0.1.0/24`),
+		netip.MustParsePrefix(`2400::/12`),
+	}, db.Prefixes(`cn`))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix(`8.8.8.0/24`)}, db.Prefixes(`US`))
+	// the country of DE is resolved through the registered country pointer
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix(`2a00:1450::/32`)}, db.Prefixes(`DE`))
+
+	_, err = Open(filepath.Join(t.TempDir(), `missing.mmdb`))
+	assert.Error(t, err)
+	assert.ErrorIs(t, new(DB).parseMMDB([]byte(`not a database`)), errInvalidMMDB)
+
+	// a pointer to itself
+	_, _, err = decodeMMDB([]byte{mmdbPointer << 5, 0}, 0)
+	assert.ErrorIs(t, err, errInvalidMMDB)
+	// arrays of one array nested too deep
+	nested := bytes.Repeat([]byte{1, mmdbArray - 7}, maxMMDBDepth+1)
+	_, _, err = decodeMMDB(append(nested, encodeString(`CN`)...), 0)
+	assert.ErrorIs(t, err, errInvalidMMDB)
+	_, _, err = decodeMMDB(append(nested[2:], encodeString(`CN`)...), 0)
+	assert.NoError(t, err)
+}
+
+// withNodeCount replaces the metadata of the MMDB file with an IPv6 one of 24
+// bit records and nodeCount nodes.
+func withNodeCount(buf []byte, nodeCount uint64) []byte {
+	buf = append([]byte{}, buf[:bytes.LastIndex(buf, metadataMarker)+len(metadataMarker)]...)
+	buf = append(buf, encodeMap(3)...)
+	buf = append(buf, encodeString(`node_count`)...)
+	buf = append(buf, 8, mmdbUint64-7)
+	buf = binary.BigEndian.AppendUint64(buf, nodeCount)
+	buf = append(buf, encodeString(`record_size`)...)
+	buf = append(buf, mmdbUint16<<5|2, 0, 24)
+	buf = append(buf, encodeString(`ip_version`)...)
+	return append(buf, mmdbUint16<<5|2, 0, 6)
+}
+
+func TestMMDBCorrupt(t *testing.T) {
+	buf := testMMDB(map[string]string{`1.0.0.0/24`: `CN`})
+	r, err := newMMDBReader(buf)
+	assert.NoError(t, err)
+	assert.NoError(t, newDB().parseMMDB(withNodeCount(buf, uint64(r.nodeCount))))
+
+	// 6 bytes by node wrap around to a tree of 0 byte
+	assert.ErrorIs(t, newDB().parseMMDB(withNodeCount(buf, 1<<63)), errInvalidMMDB)
+	assert.ErrorIs(t, newDB().parseMMDB(withNodeCount(buf, uint64(len(buf)))), errInvalidMMDB)
+
+	// the records of the nodes 1 and 2 point to each other
+	cyclic := []byte{
+		0, 0, 3, 0, 0, 1,
+		0, 0, 2, 0, 0, 2,
+		0, 0, 1, 0, 0, 1,
+	}
+	cyclic = append(cyclic, make([]byte, dataSectionSeparator)...)
+	cyclic = withNodeCount(append(cyclic, metadataMarker...), 3)
+	assert.ErrorIs(t, newDB().parseMMDB(cyclic), errInvalidMMDB)
+
+	// the containers larger than the data are not allocated
+	_, _, err = decodeMMDB([]byte{mmdbMap<<5 | 31, 0xff, 0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, errInvalidMMDB)
+	_, _, err = decodeMMDB([]byte{31, mmdbArray - 7, 0xff, 0xff, 0xff}, 0)
+	assert.ErrorIs(t, err, errInvalidMMDB)
+}
+
+func FuzzMMDB(f *testing.F) {
+	f.Add(testMMDB(map[string]string{
+		`1.0.0.0/24`: `CN`,
+		`2400::/12`:  `CN`,
+	}))
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		newDB().parseMMDB(buf)
+	})
+}
+
+func TestCSV(t *testing.T) {
+	dbip := "1.0.0.0,1.0.0.255,AU\n1.0.1.0,1.0.3.255,CN\n2001:200::,2001:200:ffff:ffff:ffff:ffff:ffff:ffff,JP\n"
+	networks := "network,country\n5.0.0.0/16,de\n"
+	blocks := "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider\n" +
+		"8.8.8.0/24,6252001,6252001,,0,0\n" +
+		"9.9.9.0/24,,2921044,,0,0\n"
+	locations := "geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union\n" +
+		"6252001,en,NA,\"North America\",US,\"United States\",0\n" +
+		"2921044,en,EU,Europe,DE,Germany,1\n"
+
+	db := newDB()
+	err := db.ReadCSV(strings.NewReader(dbip), strings.NewReader(networks), strings.NewReader(blocks), strings.NewReader(locations))
+	assert.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix(`1.0.1.0/24`),
+		netip.MustParsePrefix(`1.0.2.0/23`),
+	}, db.Prefixes(`CN`))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix(`2001:200::/32`)}, db.Prefixes(`JP`))
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix(`5.0.0.0/16`),
+		netip.MustParsePrefix(`9.9.9.0/24`),
+	}, db.Prefixes(`DE`))
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix(`8.8.8.0/24`)}, db.Prefixes(`US`))
+
+	err = newDB().ReadCSV(strings.NewReader("1.0.0.0,1.0.0.255,AU\nfoo,bar,AU\n"))
+	assert.EqualError(t, err, `csv 1: line 2: invalid network "foo"`)
+}
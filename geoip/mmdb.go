@@ -0,0 +1,397 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// metadataMarker precedes the metadata at the end of a MMDB file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const dataSectionSeparator = 16
+
+// MMDB data types.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+var errInvalidMMDB = errors.New(`invalid MMDB file`)
+
+// maxMMDBDepth is the maximum depth of the maps, arrays and pointers of a
+// value, the data of a malformed file can refer to itself.
+const maxMMDBDepth = 512
+
+// mmdbReader walks the search tree of a MMDB file.
+type mmdbReader struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	countries  map[uint]string // country of the data records by offset
+}
+
+func (db *DB) readMMDB(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return db.parseMMDB(buf)
+}
+
+func (db *DB) parseMMDB(buf []byte) error {
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return err
+	}
+	return r.walk(db)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	pos := bytes.LastIndex(buf, metadataMarker)
+	if pos < 0 {
+		return nil, errInvalidMMDB
+	}
+	meta := buf[pos+len(metadataMarker):]
+	v, _, err := decodeMMDB(meta, 0)
+	if err != nil {
+		return nil, fmt.Errorf(`metadata: %w`, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidMMDB
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(toUint64(m[`node_count`])),
+		recordSize: uint(toUint64(m[`record_size`])),
+		ipVersion:  uint(toUint64(m[`ip_version`])),
+		countries:  map[uint]string{},
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf(`unsupported record size %d`, r.recordSize)
+	}
+	// node_count is checked before the multiplication which could overflow
+	nodeSize := r.recordSize / 4
+	if r.nodeCount > uint(pos)/nodeSize {
+		return nil, errInvalidMMDB
+	}
+	treeSize := nodeSize * r.nodeCount
+	if treeSize+dataSectionSeparator > uint(pos) {
+		return nil, errInvalidMMDB
+	}
+	r.data = buf[treeSize+dataSectionSeparator : pos]
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the node.
+func (r *mmdbReader) record(node uint, bit uint) (uint, error) {
+	nodeSize := r.recordSize / 4
+	if node >= r.nodeCount || (node+1)*nodeSize > uint(len(r.buf)) {
+		return 0, fmt.Errorf(`%w: node %d out of range`, errInvalidMMDB, node)
+	}
+	b := r.buf[node*nodeSize : (node+1)*nodeSize]
+	switch r.recordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:])), nil
+	}
+}
+
+// walk adds the networks of the search tree to db.
+func (r *mmdbReader) walk(db *DB) error {
+	bits := 128
+	if r.ipVersion == 4 {
+		bits = 32
+	}
+	// the IPv4 networks are under ::/96 of an IPv6 tree, the aliases of the
+	// IPv4 subtree (::ffff:0:0/96, 2001::/32, 2002::/16) point to its node.
+	ipv4Node := uint(0)
+	if bits == 128 {
+		var err error
+		for i := 0; i < 96 && ipv4Node < r.nodeCount; i++ {
+			if ipv4Node, err = r.record(ipv4Node, 0); err != nil {
+				return err
+			}
+		}
+	}
+	// each node has a single parent apart from the aliased IPv4 node, the
+	// records of a malformed file can point back to the visited nodes.
+	visited := make([]bool, r.nodeCount)
+	var ip [16]byte
+	var visit func(node uint, depth int) error
+	visit = func(node uint, depth int) error {
+		if node > r.nodeCount {
+			country, err := r.country(node)
+			if err != nil {
+				return err
+			}
+			var prefix netip.Prefix
+			if bits == 32 {
+				prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[:4])), depth)
+			} else {
+				prefix = netip.PrefixFrom(netip.AddrFrom16(ip), depth)
+				if depth >= 96 && isIPv4Subtree(ip) {
+					prefix = netip.PrefixFrom(netip.AddrFrom4([4]byte(ip[12:])), depth-96)
+				}
+			}
+			db.add(country, prefix)
+			return nil
+		}
+		if node == r.nodeCount || depth >= bits {
+			return nil
+		}
+		if bits == 128 && node == ipv4Node && (depth != 96 || !isIPv4Subtree(ip)) {
+			return nil
+		}
+		if visited[node] {
+			return fmt.Errorf(`%w: node %d is reached twice`, errInvalidMMDB, node)
+		}
+		visited[node] = true
+		for bit := uint(0); bit < 2; bit++ {
+			if bit == 1 {
+				ip[depth/8] |= 0x80 >> (depth % 8)
+			}
+			record, err := r.record(node, bit)
+			if err != nil {
+				return err
+			}
+			if err = visit(record, depth+1); err != nil {
+				return err
+			}
+			if bit == 1 {
+				ip[depth/8] &^= 0x80 >> (depth % 8)
+			}
+		}
+		return nil
+	}
+	return visit(0, 0)
+}
+
+func isIPv4Subtree(ip [16]byte) bool {
+	for _, b := range ip[:12] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// country returns the country of the data record a search tree record points to.
+func (r *mmdbReader) country(record uint) (string, error) {
+	offset := record - r.nodeCount - dataSectionSeparator
+	if country, ok := r.countries[offset]; ok {
+		return country, nil
+	}
+	v, _, err := decodeMMDB(r.data, offset)
+	if err != nil {
+		return ``, err
+	}
+	var country string
+	if m, ok := v.(map[string]interface{}); ok {
+		for _, key := range []string{`country`, `registered_country`} {
+			if c, ok := m[key].(map[string]interface{}); ok {
+				if code, ok := c[`iso_code`].(string); ok {
+					country = code
+					break
+				}
+			}
+		}
+	}
+	r.countries[offset] = country
+	return country, nil
+}
+
+// decodeMMDB decodes the value at offset of the data section and returns it
+// with the offset following it.
+func decodeMMDB(data []byte, offset uint) (interface{}, uint, error) {
+	return decodeMMDBValue(data, offset, 0)
+}
+
+// decodeMMDBValue decodes the value at offset, nested at depth in the value
+// being decoded.
+func decodeMMDBValue(data []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, fmt.Errorf(`%w: data deeper than %d levels`, errInvalidMMDB, maxMMDBDepth)
+	}
+	if offset >= uint(len(data)) {
+		return nil, 0, errInvalidMMDB
+	}
+	ctrl := data[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == mmdbExtended {
+		if offset >= uint(len(data)) {
+			return nil, 0, errInvalidMMDB
+		}
+		typ = 7 + uint(data[offset])
+		offset++
+	}
+	if typ == mmdbPointer {
+		pointer, next, err := decodePointer(data, ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := decodeMMDBValue(data, pointer, depth+1)
+		return v, next, err
+	}
+	size, offset, err := decodeSize(data, ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	// each key and value takes one byte at least, the sizes are checked
+	// before the containers are allocated
+	switch typ {
+	case mmdbMap:
+		if size > (uint(len(data))-offset)/2 {
+			return nil, 0, errInvalidMMDB
+		}
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errInvalidMMDB
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case mmdbArray:
+		if size > uint(len(data))-offset {
+			return nil, 0, errInvalidMMDB
+		}
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], offset, err = decodeMMDBValue(data, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+	end := offset + size
+	if end > uint(len(data)) {
+		return nil, 0, errInvalidMMDB
+	}
+	b := data[offset:end]
+	switch typ {
+	case mmdbString:
+		return string(b), end, nil
+	case mmdbBytes:
+		return b, end, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errInvalidMMDB
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), end, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errInvalidMMDB
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), end, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbInt32:
+		var n uint64
+		for _, v := range b {
+			n = n<<8 | uint64(v)
+		}
+		if typ == mmdbInt32 {
+			return int32(n), end, nil
+		}
+		return n, end, nil
+	case mmdbUint128:
+		return b, end, nil
+	}
+	return nil, 0, fmt.Errorf(`unknown MMDB data type %d`, typ)
+}
+
+func decodeSize(data []byte, ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	n := size - 28
+	if offset+n > uint(len(data)) {
+		return 0, 0, errInvalidMMDB
+	}
+	var v uint
+	for _, b := range data[offset : offset+n] {
+		v = v<<8 | uint(b)
+	}
+	switch size {
+	case 29:
+		size = 29 + v
+	case 30:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return size, offset + n, nil
+}
+
+func decodePointer(data []byte, ctrl byte, offset uint) (uint, uint, error) {
+	ss := uint(ctrl>>3) & 0x3
+	n := ss + 1
+	if offset+n > uint(len(data)) {
+		return 0, 0, errInvalidMMDB
+	}
+	var v uint
+	if ss < 3 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, b := range data[offset : offset+n] {
+		v = v<<8 | uint(b)
+	}
+	switch ss {
+	case 1:
+		v += 2048
+	case 2:
+		v += 526336
+	}
+	return v, offset + n, nil
+}
+
+func toUint64(v interface{}) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -1,30 +1,32 @@
 module github.com/admpub/nftablesutils
 
-go 1.21
+// go 1.23.0 is required by github.com/mdlayher/netlink v1.8.0, the first
+// release after the commit github.com/google/nftables v0.3.0 depends on, and
+// by the golang.org/x/sys and golang.org/x/net versions it requires.
+go 1.23.0
 
 require (
 	github.com/admpub/log v1.3.6
 	github.com/admpub/pp v0.0.7
 	github.com/gaissmai/extnetip v0.4.0
-	github.com/google/nftables v0.2.0
-	github.com/mdlayher/netlink v1.7.2
+	github.com/google/nftables v0.3.0
+	github.com/mdlayher/netlink v1.8.0
 	github.com/stretchr/testify v1.8.4
-	github.com/vishvananda/netlink v1.1.0
+	github.com/vishvananda/netlink v1.3.0
 	github.com/vishvananda/netns v0.0.4
-	golang.org/x/sys v0.20.0
+	golang.org/x/sys v0.35.0
 )
 
 require (
 	github.com/admpub/color v1.8.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
-	github.com/josharian/native v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mdlayher/socket v0.5.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/net v0.25.0 // indirect
-	golang.org/x/sync v0.7.0 // indirect
-	golang.org/x/text v0.15.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -161,3 +161,12 @@ func GetNetInterface(interfaceName string) (ipv4NetInterfaces []NetInterface, ip
 
 	return ipv4NetInterfaces, ipv6NetInterfaces, nil
 }
+
+// IfIndex returns the index of the interface.
+func IfIndex(iface string) (uint32, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return 0, fmt.Errorf("%q can't find: %v", iface, err)
+	}
+	return uint32(ifi.Index), nil
+}
@@ -0,0 +1,135 @@
+// Package pktdecode decodes the IP packets and resolves the interfaces of the
+// packets received by the nflog and nfqueue packages.
+package pktdecode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Header is the network and transport header of an IP packet.
+type Header struct {
+	Protocol uint8
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Length   int // length of the IP packet
+}
+
+// IP decodes the addresses and ports of the IP packet b, the header is empty
+// if b is not an IPv4 or IPv6 packet.
+func IP(b []byte) (h Header) {
+	if len(b) == 0 {
+		return
+	}
+	var l4 []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return
+		}
+		ihl := int(b[0]&0x0f) * 4
+		h.Length = int(binary.BigEndian.Uint16(b[2:4]))
+		h.Protocol = b[9]
+		h.SrcIP = net.IP(append([]byte{}, b[12:16]...))
+		h.DstIP = net.IP(append([]byte{}, b[16:20]...))
+		// ports are only in the first fragment
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 && len(b) >= ihl {
+			l4 = b[ihl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return
+		}
+		h.Length = int(binary.BigEndian.Uint16(b[4:6])) + 40
+		h.Protocol = b[6]
+		h.SrcIP = net.IP(append([]byte{}, b[8:24]...))
+		h.DstIP = net.IP(append([]byte{}, b[24:40]...))
+		l4 = b[40:]
+	default:
+		return
+	}
+	switch h.Protocol {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP, unix.IPPROTO_UDPLITE:
+		if len(l4) >= 4 {
+			h.SrcPort = binary.BigEndian.Uint16(l4[0:2])
+			h.DstPort = binary.BigEndian.Uint16(l4[2:4])
+		}
+	}
+	return
+}
+
+// ifaceCacheTTL is the lifetime of the cached names, an index can be reused
+// by another interface once its interface is deleted.
+const ifaceCacheTTL = 30 * time.Second
+
+type ifaceName struct {
+	name    string
+	expires time.Time
+}
+
+// IfaceCache resolves interface indexes to names in a network namespace.
+type IfaceCache struct {
+	mu     sync.Mutex
+	handle *netlink.Handle
+	names  map[uint32]ifaceName
+}
+
+// NewIfaceCache returns an empty cache resolving the names in the network
+// namespace of the file descriptor netNS, in the current namespace if 0.
+func NewIfaceCache(netNS int) (*IfaceCache, error) {
+	c := &IfaceCache{names: map[uint32]ifaceName{}}
+	if netNS == 0 {
+		return c, nil
+	}
+	h, err := netlink.NewHandleAt(netns.NsHandle(netNS), unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to open rtnetlink in netns: %w`, err)
+	}
+	c.handle = h
+	return c, nil
+}
+
+// Name returns the name of the interface index, empty if it is not found.
+func (c *IfaceCache) Name(index uint32) string {
+	if index == 0 {
+		return ``
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if v, ok := c.names[index]; ok && now.Before(v.expires) {
+		return v.name
+	}
+	var (
+		link netlink.Link
+		err  error
+	)
+	if c.handle != nil {
+		link, err = c.handle.LinkByIndex(int(index))
+	} else {
+		link, err = netlink.LinkByIndex(int(index))
+	}
+	if err != nil {
+		delete(c.names, index)
+		return ``
+	}
+	name := link.Attrs().Name
+	c.names[index] = ifaceName{name: name, expires: now.Add(ifaceCacheTTL)}
+	return name
+}
+
+// Close releases the rtnetlink socket of the namespace.
+func (c *IfaceCache) Close() {
+	if c.handle != nil {
+		c.handle.Close()
+	}
+}
@@ -0,0 +1,102 @@
+package pktdecode
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestIP(t *testing.T) {
+	// IPv4 UDP 192.168.1.2:5353 -> 10.0.0.1:53
+	ip := []byte{
+		0x45, 0, 0, 28, 0, 0, 0, 0, 64, unix.IPPROTO_UDP, 0, 0,
+		192, 168, 1, 2,
+		10, 0, 0, 1,
+	}
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], 5353)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	h := IP(append(ip, udp...))
+	assert.Equal(t, uint8(unix.IPPROTO_UDP), h.Protocol)
+	assert.True(t, net.IPv4(192, 168, 1, 2).Equal(h.SrcIP))
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(h.DstIP))
+	assert.Equal(t, uint16(5353), h.SrcPort)
+	assert.Equal(t, uint16(53), h.DstPort)
+	assert.Equal(t, 28, h.Length)
+
+	// the ports of a non-first fragment are not decoded
+	ip[7] = 1
+	h = IP(append(ip, udp...))
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(h.DstIP))
+	assert.Zero(t, h.DstPort)
+
+	// IPv6 TCP 2001:db8::1:40000 -> 2001:db8::2:22
+	ip6 := make([]byte, 40)
+	ip6[0] = 0x60
+	binary.BigEndian.PutUint16(ip6[4:], 20)
+	ip6[6] = unix.IPPROTO_TCP
+	copy(ip6[8:], net.ParseIP(`2001:db8::1`))
+	copy(ip6[24:], net.ParseIP(`2001:db8::2`))
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 22)
+	h = IP(append(ip6, tcp...))
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), h.Protocol)
+	assert.Equal(t, `2001:db8::1`, h.SrcIP.String())
+	assert.Equal(t, `2001:db8::2`, h.DstIP.String())
+	assert.Equal(t, uint16(40000), h.SrcPort)
+	assert.Equal(t, uint16(22), h.DstPort)
+	assert.Equal(t, 60, h.Length)
+
+	assert.Equal(t, Header{}, IP(nil))
+	assert.Equal(t, Header{}, IP(ip[:10]))
+	assert.Equal(t, Header{}, IP([]byte{0x20}))
+}
+
+func TestIfaceCache(t *testing.T) {
+	c, err := NewIfaceCache(0)
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Empty(t, c.Name(0))
+	lo, err := net.InterfaceByName(`lo`)
+	if err != nil {
+		t.Skip(err)
+	}
+	assert.Equal(t, `lo`, c.Name(uint32(lo.Index)))
+
+	// the expired and missing names are resolved again
+	c.names[uint32(lo.Index)] = ifaceName{name: `stale`, expires: time.Now().Add(-time.Second)}
+	assert.Equal(t, `lo`, c.Name(uint32(lo.Index)))
+	c.names[1<<30] = ifaceName{name: `stale`}
+	assert.Empty(t, c.Name(1<<30))
+	assert.NotContains(t, c.names, uint32(1<<30))
+}
+
+func TestIfaceCacheNetNS(t *testing.T) {
+	n, err := nftest.NewNetwork(`pktdecode`)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer n.Close()
+	var index int
+	assert.NoError(t, n.InHost(func() error {
+		ifi, err := net.InterfaceByName(n.HostIface)
+		if err == nil {
+			index = ifi.Index
+		}
+		return err
+	}))
+	ns, err := netns.GetFromName(n.Host)
+	assert.NoError(t, err)
+	defer ns.Close()
+	c, err := NewIfaceCache(int(ns))
+	assert.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, n.HostIface, c.Name(uint32(index)))
+}
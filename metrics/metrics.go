@@ -0,0 +1,216 @@
+// Package metrics exposes the rule counters, set sizes and apply health of
+// biz.NFTables in the Prometheus text exposition format, without depending on
+// the Prometheus client library.
+//
+//	http.Handle(`/metrics`, metrics.New(nft))
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/admpub/nftablesutils/biz"
+	"github.com/admpub/nftablesutils/rule"
+)
+
+// ContentType of the Prometheus text exposition format.
+const ContentType = `text/plain; version=0.0.4; charset=utf-8`
+
+// DefaultNamespace is the prefix of the metric names.
+const DefaultNamespace = `nftables`
+
+// Source of the metrics, implemented by *biz.NFTables.
+type Source interface {
+	Counters(reset bool) (map[string]rule.Counter, error)
+	SetSizes() (map[string]int, error)
+	Stats() biz.Stats
+}
+
+var _ Source = &biz.NFTables{}
+
+// Collector renders the metrics of a Source. It implements http.Handler.
+type Collector struct {
+	Namespace string // prefix of the metric names, DefaultNamespace if empty
+	src       Source
+
+	mu     sync.Mutex
+	last   map[string]rule.Counter // counters of the last read by rule ID
+	totals map[string]rule.Counter // traffic accumulated since the first read by rule ID
+}
+
+// New returns a collector of src.
+func New(src Source) *Collector {
+	return &Collector{Namespace: DefaultNamespace, src: src}
+}
+
+// WriteTo writes the metrics to w. The rule counters are omitted if they are
+// disabled by biz.Config.Counters.
+//
+// The counters of the source go down when they are reset, by an apply which
+// recreates the rules or by Counters(true). The collector accumulates the
+// traffic counted between its reads instead, the rule counters it writes
+// never decrease and keep the rules which were removed.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	counters, err := c.src.Counters(false)
+	if err != nil && !errors.Is(err, biz.ErrCountersDisabled) {
+		return 0, err
+	}
+	if err == nil {
+		counters = c.accumulate(counters)
+	}
+	sizes, err := c.src.SetSizes()
+	if err != nil {
+		return 0, err
+	}
+	stats := c.src.Stats()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	tw := &textWriter{w: bw, ns: c.Namespace}
+	if len(tw.ns) == 0 {
+		tw.ns = DefaultNamespace
+	}
+
+	ids := make([]string, 0, len(counters))
+	for id := range counters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > 0 {
+		tw.header(`rule_packets_total`, `counter`, `Packets matched by the rules by rule ID.`)
+		for _, id := range ids {
+			tw.sample(`rule_packets_total`, float64(counters[id].Packets), `rule`, id)
+		}
+		tw.header(`rule_bytes_total`, `counter`, `Bytes matched by the rules by rule ID.`)
+		for _, id := range ids {
+			tw.sample(`rule_bytes_total`, float64(counters[id].Bytes), `rule`, id)
+		}
+	}
+
+	names := make([]string, 0, len(sizes))
+	for name := range sizes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw.header(`set_elements`, `gauge`, `Number of elements of the sets.`)
+	for _, name := range names {
+		tw.sample(`set_elements`, float64(sizes[name]), `set`, name)
+	}
+
+	tw.header(`bans_total`, `counter`, `Number of addresses banned.`)
+	tw.sample(`bans_total`, float64(stats.Bans))
+	tw.header(`applies_total`, `counter`, `Number of rule applies.`)
+	tw.sample(`applies_total`, float64(stats.Applies))
+	tw.header(`apply_errors_total`, `counter`, `Number of failed rule applies.`)
+	tw.sample(`apply_errors_total`, float64(stats.ApplyErrors))
+	if !stats.LastApply.IsZero() {
+		var success float64
+		if stats.LastApplyError == nil {
+			success = 1
+		}
+		tw.header(`last_apply_success`, `gauge`, `Whether the last rule apply succeeded.`)
+		tw.sample(`last_apply_success`, success)
+		tw.header(`last_apply_duration_seconds`, `gauge`, `Duration of the last rule apply.`)
+		tw.sample(`last_apply_duration_seconds`, stats.LastApplyDuration.Seconds())
+		tw.header(`last_apply_timestamp_seconds`, `gauge`, `Start time of the last rule apply.`)
+		tw.sample(`last_apply_timestamp_seconds`, float64(stats.LastApply.UnixNano())/1e9)
+	}
+	tw.header(`reconcile_drifts_total`, `counter`, `Number of missing tables, chains and sets found by reconcile.`)
+	tw.sample(`reconcile_drifts_total`, float64(stats.Drifts))
+
+	if tw.err == nil {
+		tw.err = bw.Flush()
+	}
+	return cw.n, tw.err
+}
+
+// accumulate adds the traffic counted since the last read to the totals and
+// returns a copy of them. A counter lower than at the last read was reset and
+// counted since the reset.
+func (c *Collector) accumulate(counters map[string]rule.Counter) map[string]rule.Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.totals == nil {
+		c.totals = map[string]rule.Counter{}
+	}
+	for id, v := range counters {
+		total := c.totals[id]
+		total.Add(v.Sub(c.last[id]))
+		c.totals[id] = total
+	}
+	c.last = counters
+	return maps.Clone(c.totals)
+}
+
+// ServeHTTP writes the metrics to the response.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	if _, err := c.WriteTo(buf); err != nil {
+		http.Error(w, fmt.Sprintf(`failed to collect metrics: %v`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(`Content-Type`, ContentType)
+	w.Write(buf.Bytes())
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// textWriter writes the Prometheus text format, keeping the first error.
+type textWriter struct {
+	w   *bufio.Writer
+	ns  string
+	err error
+}
+
+func (t *textWriter) header(name, typ, help string) {
+	if t.err != nil {
+		return
+	}
+	name = t.ns + `_` + name
+	_, t.err = fmt.Fprintf(t.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample, labels are name and value pairs.
+func (t *textWriter) sample(name string, value float64, labels ...string) {
+	if t.err != nil {
+		return
+	}
+	t.w.WriteString(t.ns + `_` + name)
+	if len(labels) > 0 {
+		t.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				t.w.WriteByte(',')
+			}
+			t.w.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+		}
+		t.w.WriteByte('}')
+	}
+	t.w.WriteByte(' ')
+	t.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	_, t.err = t.w.WriteString("\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/admpub/nftablesutils/biz"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/admpub/nftablesutils/rule"
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/assert"
+)
+
+func testNFTables(t *testing.T, counters string) *biz.NFTables {
+	cfg := biz.Config{
+		Enabled:       true,
+		DefaultPolicy: `drop`,
+		Counters:      counters,
+	}
+	nft := biz.New(nftables.TableFamilyIPv4, cfg, nil, biz.WithConnOptions(nftables.WithTestDial(nftest.New().Dial)))
+	nft.Init()
+	assert.NoError(t, nft.ApplyDefault(biz.RULE_LOCAL_IFACE|biz.RULE_BLACKLIST))
+	assert.NoError(t, nft.Ban([]string{`192.0.2.1`, `192.0.2.2`}, 0))
+	return nft
+}
+
+func TestWriteTo(t *testing.T) {
+	nft := testNFTables(t, biz.CounterModeNamed)
+	buf := &bytes.Buffer{}
+	n, err := New(nft).WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	out := buf.String()
+	for _, line := range []string{
+		`# TYPE nftables_rule_packets_total counter`,
+		`nftables_rule_packets_total{rule="input_lo"} 0`,
+		`nftables_rule_bytes_total{rule="input_blacklist"} 0`,
+		`# TYPE nftables_set_elements gauge`,
+		`nftables_set_elements{set="blacklist_ipset"} 2`,
+		`nftables_set_elements{set="trust_ipset"} 0`,
+		`nftables_bans_total 2`,
+		`nftables_applies_total 1`,
+		`nftables_apply_errors_total 0`,
+		`nftables_last_apply_success 1`,
+		`nftables_reconcile_drifts_total 0`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+	assert.Contains(t, out, `nftables_last_apply_duration_seconds `)
+}
+
+func TestCountersDisabled(t *testing.T) {
+	nft := testNFTables(t, ``)
+	c := New(nft)
+	c.Namespace = `fw`
+	buf := &bytes.Buffer{}
+	_, err := c.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.NotContains(t, buf.String(), `rule_packets_total`)
+	assert.True(t, strings.HasPrefix(buf.String(), `# HELP fw_set_elements `))
+}
+
+func TestServeHTTP(t *testing.T) {
+	nft := testNFTables(t, biz.CounterModeRule)
+	rec := httptest.NewRecorder()
+	New(nft).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/metrics`, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get(`Content-Type`))
+	assert.Contains(t, rec.Body.String(), `nftables_rule_packets_total{rule="output_lo"} 0`)
+}
+
+type testSource struct {
+	counters map[string]rule.Counter
+}
+
+func (s *testSource) Counters(reset bool) (map[string]rule.Counter, error) {
+	return s.counters, nil
+}
+
+func (s *testSource) SetSizes() (map[string]int, error) {
+	return nil, nil
+}
+
+func (s *testSource) Stats() biz.Stats {
+	return biz.Stats{}
+}
+
+func TestCountersMonotonic(t *testing.T) {
+	src := &testSource{}
+	c := New(src)
+	for _, step := range []struct {
+		counters map[string]rule.Counter
+		want     string
+	}{
+		{map[string]rule.Counter{`input_lo`: {Packets: 5, Bytes: 300}}, `nftables_rule_packets_total{rule="input_lo"} 5`},
+		{map[string]rule.Counter{`input_lo`: {Packets: 8, Bytes: 480}}, `nftables_rule_packets_total{rule="input_lo"} 8`},
+		// reset by Counters(true)
+		{map[string]rule.Counter{`input_lo`: {Packets: 2, Bytes: 120}}, `nftables_rule_bytes_total{rule="input_lo"} 600`},
+		// the rule is removed by an apply
+		{map[string]rule.Counter{}, `nftables_rule_packets_total{rule="input_lo"} 10`},
+		// and added again
+		{map[string]rule.Counter{`input_lo`: {Packets: 1, Bytes: 60}}, `nftables_rule_packets_total{rule="input_lo"} 11`},
+	} {
+		src.counters = step.counters
+		buf := &bytes.Buffer{}
+		_, err := c.WriteTo(buf)
+		assert.NoError(t, err)
+		assert.Contains(t, buf.String(), step.want+"\n")
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabel("a\"b\\c\nd"))
+}
@@ -0,0 +1,261 @@
+// Package nflog receives the packets logged by `log group N` rules
+// (utils.ExprLogGroup) through the NFLOG netlink subsystem and decodes them
+// into Packet structs, without depending on ulogd.
+//
+//	r, err := nflog.Open(nflog.Config{Group: 100})
+//	ch := make(chan nflog.Packet, 64)
+//	go r.Listen(ctx, ch)
+//	for p := range ch {
+//		fmt.Println(p.Prefix, p.SrcIP, p.SrcPort, p.DstIP, p.DstPort)
+//	}
+package nflog
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/admpub/nftablesutils/internal/pktdecode"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nfnetlink_log message types and attributes, missing in x/sys/unix.
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdUnbind = 2
+
+	nfulnlCopyPacket = 2
+
+	nfulaPacketHdr     = 1
+	nfulaMark          = 2
+	nfulaTimestamp     = 3
+	nfulaIfindexIndev  = 4
+	nfulaIfindexOutdev = 5
+	nfulaHwaddr        = 8
+	nfulaPayload       = 9
+	nfulaPrefix        = 10
+	nfulaUID           = 11
+	nfulaGID           = 14
+)
+
+// Packet is a logged packet.
+type Packet struct {
+	Group     uint16
+	Prefix    string
+	Hook      uint8
+	HwProto   uint16 // ethertype, e.g. unix.ETH_P_IP
+	Mark      uint32
+	Timestamp time.Time
+	InIndex   uint32
+	OutIndex  uint32
+	InIface   string // resolved in the network namespace of Config.NetNS
+	OutIface  string
+	HwAddr    net.HardwareAddr
+	UID       *uint32 // owner of the local socket, requires skuid logging
+	GID       *uint32
+
+	Protocol uint8 // unix.IPPROTO_TCP, unix.IPPROTO_UDP ...
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Length   int    // length of the IP packet
+	Payload  []byte // IP packet, truncated to the snaplen of the rule
+}
+
+// Config of Reader.
+type Config struct {
+	Group     uint16
+	CopyRange uint32 // bytes of the packets copied, 0xffff if 0
+	NetNS     int    // network namespace file descriptor, current namespace if 0
+}
+
+// Reader receives the packets of a NFLOG group.
+type Reader struct {
+	conn   *netlink.Conn
+	group  uint16
+	ifaces *pktdecode.IfaceCache
+}
+
+// Open binds a NFLOG group. It requires CAP_NET_ADMIN.
+func Open(cfg Config) (*Reader, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: cfg.NetNS})
+	if err != nil {
+		return nil, fmt.Errorf(`failed to dial netfilter netlink: %w`, err)
+	}
+	r, err := newReader(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func newReader(conn *netlink.Conn, cfg Config) (*Reader, error) {
+	ifaces, err := pktdecode.NewIfaceCache(cfg.NetNS)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{conn: conn, group: cfg.Group, ifaces: ifaces}
+	if err := r.config(nfulaCfgCmd, []byte{nfulnlCfgCmdBind}); err != nil {
+		ifaces.Close()
+		return nil, fmt.Errorf(`failed to bind nflog group %d: %w`, cfg.Group, err)
+	}
+	copyRange := cfg.CopyRange
+	if copyRange == 0 {
+		copyRange = 0xffff
+	}
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = nfulnlCopyPacket
+	if err := r.config(nfulaCfgMode, mode); err != nil {
+		ifaces.Close()
+		return nil, fmt.Errorf(`failed to set copy mode of nflog group %d: %w`, cfg.Group, err)
+	}
+	return r, nil
+}
+
+func (r *Reader) config(typ uint16, data []byte) error {
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: typ, Data: data}})
+	if err != nil {
+		return err
+	}
+	hdr := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(hdr[2:], r.group)
+	_, err = r.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(hdr, attrs...),
+	})
+	return err
+}
+
+// Listen sends the received packets to ch until ctx is done or the reader
+// is closed. Messages that can't be decoded are skipped.
+func (r *Reader) Listen(ctx context.Context, ch chan<- Packet) error {
+	stop := context.AfterFunc(ctx, func() {
+		r.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	for {
+		msgs, err := r.conn.Receive()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			var opErr *netlink.OpError
+			if errors.As(err, &opErr) && errors.Is(opErr.Err, unix.ENOBUFS) {
+				// the socket buffer overflowed, packets were lost
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			p, err := Decode(m)
+			if err != nil {
+				continue
+			}
+			p.InIface = r.ifaces.Name(p.InIndex)
+			p.OutIface = r.ifaces.Name(p.OutIndex)
+			select {
+			case ch <- p:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Close unbinds the group and closes the netlink connection.
+func (r *Reader) Close() error {
+	r.config(nfulaCfgCmd, []byte{nfulnlCfgCmdUnbind})
+	r.ifaces.Close()
+	return r.conn.Close()
+}
+
+// Decode decodes a NFULNL_MSG_PACKET message. The interface names are not
+// resolved.
+func Decode(m netlink.Message) (Packet, error) {
+	var p Packet
+	if m.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket) {
+		return p, fmt.Errorf(`unexpected message type: %#x`, uint16(m.Header.Type))
+	}
+	if len(m.Data) < 4 {
+		return p, fmt.Errorf(`message too short`)
+	}
+	p.Group = binary.BigEndian.Uint16(m.Data[2:4])
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	if err != nil {
+		return p, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPacketHdr:
+			b := ad.Bytes()
+			if len(b) >= 3 {
+				p.HwProto = binary.BigEndian.Uint16(b)
+				p.Hook = b[2]
+			}
+		case nfulaMark:
+			p.Mark = ad.Uint32()
+		case nfulaTimestamp:
+			b := ad.Bytes()
+			if len(b) >= 16 {
+				sec := binary.BigEndian.Uint64(b)
+				usec := binary.BigEndian.Uint64(b[8:])
+				p.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+			}
+		case nfulaIfindexIndev:
+			p.InIndex = ad.Uint32()
+		case nfulaIfindexOutdev:
+			p.OutIndex = ad.Uint32()
+		case nfulaHwaddr:
+			b := ad.Bytes()
+			if len(b) >= 4 {
+				size := int(binary.BigEndian.Uint16(b))
+				if size <= len(b)-4 {
+					p.HwAddr = net.HardwareAddr(append([]byte{}, b[4:4+size]...))
+				}
+			}
+		case nfulaPayload:
+			p.Payload = ad.Bytes()
+		case nfulaPrefix:
+			p.Prefix = ad.String()
+		case nfulaUID:
+			v := ad.Uint32()
+			p.UID = &v
+		case nfulaGID:
+			v := ad.Uint32()
+			p.GID = &v
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return p, err
+	}
+	decodeIP(&p)
+	return p, nil
+}
+
+// decodeIP fills the addresses and ports from the IP packet.
+func decodeIP(p *Packet) {
+	h := pktdecode.IP(p.Payload)
+	p.Protocol = h.Protocol
+	p.SrcIP = h.SrcIP
+	p.DstIP = h.DstIP
+	p.SrcPort = h.SrcPort
+	p.DstPort = h.DstPort
+	p.Length = h.Length
+}
@@ -0,0 +1,108 @@
+package nflog
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testPacketMessage(t *testing.T, group uint16, prefix string) netlink.Message {
+	// IPv4 TCP 192.168.1.2:40000 -> 10.0.0.1:22
+	ip := []byte{
+		0x45, 0, 0, 40, 0, 0, 0x40, 0, 64, unix.IPPROTO_TCP, 0, 0,
+		192, 168, 1, 2,
+		10, 0, 0, 1,
+	}
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 22)
+	hdr := []byte{0x08, 0x00, unix.NF_INET_LOCAL_IN, 0}
+	ts := make([]byte, 16)
+	binary.BigEndian.PutUint64(ts, 1700000000)
+	binary.BigEndian.PutUint64(ts[8:], 500)
+	hwaddr := []byte{0, 6, 0, 0, 0x52, 0x54, 0, 0x12, 0x34, 0x56, 0, 0}
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfulaPacketHdr, Data: hdr},
+		{Type: nfulaMark, Data: []byte{0, 0, 0, 7}},
+		{Type: nfulaTimestamp, Data: ts},
+		{Type: nfulaIfindexIndev, Data: []byte{0, 0, 0, 1}},
+		{Type: nfulaHwaddr, Data: hwaddr},
+		{Type: nfulaPrefix, Data: []byte(prefix + "\x00")},
+		{Type: nfulaPayload, Data: append(ip, tcp...)},
+	})
+	assert.NoError(t, err)
+	data := []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(data[2:], group)
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgPacket)},
+		Data:   append(data, attrs...),
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p, err := Decode(testPacketMessage(t, 100, `nft drop input: `))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(100), p.Group)
+	assert.Equal(t, `nft drop input: `, p.Prefix)
+	assert.Equal(t, uint8(unix.NF_INET_LOCAL_IN), p.Hook)
+	assert.Equal(t, uint16(unix.ETH_P_IP), p.HwProto)
+	assert.Equal(t, uint32(7), p.Mark)
+	assert.Equal(t, uint32(1), p.InIndex)
+	assert.Equal(t, `52:54:00:12:34:56`, p.HwAddr.String())
+	assert.Equal(t, time.Unix(1700000000, 500000), p.Timestamp)
+	assert.Equal(t, uint8(unix.IPPROTO_TCP), p.Protocol)
+	assert.True(t, net.IPv4(192, 168, 1, 2).Equal(p.SrcIP))
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(p.DstIP))
+	assert.Equal(t, uint16(40000), p.SrcPort)
+	assert.Equal(t, uint16(22), p.DstPort)
+	assert.Equal(t, 40, p.Length)
+
+	_, err = Decode(netlink.Message{Header: netlink.Header{Type: 1}})
+	assert.Error(t, err)
+}
+
+func TestListen(t *testing.T) {
+	var configs []netlink.Message
+	var sent bool
+	conn := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		if req != nil {
+			configs = append(configs, req...)
+			return nltest.Error(0, req)
+		}
+		if sent {
+			time.Sleep(10 * time.Millisecond)
+			return nil, nil
+		}
+		sent = true
+		return []netlink.Message{testPacketMessage(t, 100, `nft drop input: `)}, nil
+	})
+	r, err := newReader(conn, Config{Group: 100})
+	assert.NoError(t, err)
+	if assert.Len(t, configs, 2) {
+		assert.Equal(t, []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 100}, configs[0].Data[:4])
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan Packet, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Listen(ctx, ch)
+	}()
+	select {
+	case p := <-ch:
+		assert.Equal(t, uint16(22), p.DstPort)
+		assert.Equal(t, `lo`, p.InIface)
+	case <-time.After(time.Second):
+		t.Fatal(`no packet received`)
+	}
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.NoError(t, r.Close())
+}
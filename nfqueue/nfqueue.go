@@ -0,0 +1,380 @@
+// Package nfqueue receives the packets sent to userspace by `queue` rules
+// (utils.ExprQueue) through the NFQUEUE netlink subsystem, passes them to a
+// handler and sends back its verdicts, without depending on libnetfilter_queue.
+//
+//	q, err := nfqueue.Open(nfqueue.Config{Queue: 1})
+//	err = q.Serve(ctx, func(p nfqueue.Packet) nfqueue.Verdict {
+//		if bytes.Contains(p.Payload, []byte(`evil`)) {
+//			return nfqueue.Drop
+//		}
+//		return nfqueue.Accept.WithMark(1)
+//	})
+package nfqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/admpub/nftablesutils/internal/pktdecode"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nfnetlink_queue message types and attributes, missing in x/sys/unix.
+const (
+	nfqnlMsgPacket  = 0
+	nfqnlMsgVerdict = 1
+	nfqnlMsgConfig  = 2
+
+	nfqaCfgCmd         = 1
+	nfqaCfgParams      = 2
+	nfqaCfgQueueMaxlen = 3
+	nfqaCfgMask        = 4
+	nfqaCfgFlags       = 5
+
+	nfqnlCfgCmdBind   = 1
+	nfqnlCfgCmdUnbind = 2
+
+	nfqnlCopyPacket = 2
+
+	nfqaCfgFFailOpen = 1
+	nfqaCfgFUIDGID   = 8
+
+	nfqaPacketHdr     = 1
+	nfqaVerdictHdr    = 2
+	nfqaMark          = 3
+	nfqaTimestamp     = 4
+	nfqaIfindexIndev  = 5
+	nfqaIfindexOutdev = 6
+	nfqaHwaddr        = 9
+	nfqaPayload       = 10
+	nfqaUID           = 16
+	nfqaGID           = 17
+)
+
+// netfilter verdicts, missing in x/sys/unix.
+const (
+	nfDrop   = 0
+	nfAccept = 1
+	nfRepeat = 4
+)
+
+// Verdict of a packet.
+type Verdict struct {
+	code    uint32
+	mark    uint32
+	setMark bool
+}
+
+var (
+	// Accept lets the packet continue after the queue rule.
+	Accept = Verdict{code: nfAccept}
+	// Drop drops the packet.
+	Drop = Verdict{code: nfDrop}
+	// Repeat reinjects the packet at the start of the hook, it must be given
+	// a mark excluded by the queue rule or it is queued again.
+	Repeat = Verdict{code: nfRepeat}
+)
+
+// WithMark returns the verdict setting the mark of the packet.
+func (v Verdict) WithMark(mark uint32) Verdict {
+	v.mark = mark
+	v.setMark = true
+	return v
+}
+
+func (v Verdict) String() string {
+	var s string
+	switch v.code {
+	case nfAccept:
+		s = `accept`
+	case nfDrop:
+		s = `drop`
+	case nfRepeat:
+		s = `repeat`
+	default:
+		s = fmt.Sprintf(`verdict %d`, v.code)
+	}
+	if v.setMark {
+		s += fmt.Sprintf(` mark %#x`, v.mark)
+	}
+	return s
+}
+
+// Packet is a queued packet.
+type Packet struct {
+	ID        uint32 // packet ID of the verdict
+	Queue     uint16
+	Hook      uint8
+	HwProto   uint16 // ethertype, e.g. unix.ETH_P_IP
+	Mark      uint32
+	Timestamp time.Time // zero if the packet was not timestamped
+	InIndex   uint32
+	OutIndex  uint32
+	InIface   string // resolved in the network namespace of Config.NetNS
+	OutIface  string
+	HwAddr    net.HardwareAddr
+	UID       *uint32 // owner of the local socket, requires Config.UIDGID
+	GID       *uint32
+
+	Protocol uint8 // unix.IPPROTO_TCP, unix.IPPROTO_UDP ...
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Length   int    // length of the IP packet
+	Payload  []byte // IP packet, truncated to Config.CopyRange
+}
+
+// Handler returns the verdict of a packet.
+type Handler func(p Packet) Verdict
+
+// Config of Queue.
+type Config struct {
+	Queue     uint16
+	CopyRange uint32 // bytes of the packets copied, 0xffff if 0
+	MaxLen    uint32 // packets waiting for a verdict in the kernel, the kernel default (1024) if 0
+	FailOpen  bool   // accept the packets instead of dropping them when MaxLen is reached
+	UIDGID    bool   // receive the owner of the local sockets
+	NetNS     int    // network namespace file descriptor, current namespace if 0
+}
+
+// Queue receives the packets of a NFQUEUE and sends back their verdicts.
+type Queue struct {
+	conn   *netlink.Conn
+	num    uint16
+	ifaces *pktdecode.IfaceCache
+}
+
+// Open binds a NFQUEUE. It requires CAP_NET_ADMIN.
+func Open(cfg Config) (*Queue, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: cfg.NetNS})
+	if err != nil {
+		return nil, fmt.Errorf(`failed to dial netfilter netlink: %w`, err)
+	}
+	q, err := newQueue(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func newQueue(conn *netlink.Conn, cfg Config) (*Queue, error) {
+	ifaces, err := pktdecode.NewIfaceCache(cfg.NetNS)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{conn: conn, num: cfg.Queue, ifaces: ifaces}
+	// struct nfqnl_msg_config_cmd { u8 command; u8 pad; __be16 pf; }
+	if err := q.config(netlink.Attribute{Type: nfqaCfgCmd, Data: []byte{nfqnlCfgCmdBind, 0, 0, 0}}); err != nil {
+		ifaces.Close()
+		return nil, fmt.Errorf(`failed to bind nfqueue %d: %w`, cfg.Queue, err)
+	}
+	copyRange := cfg.CopyRange
+	if copyRange == 0 {
+		copyRange = 0xffff
+	}
+	// struct nfqnl_msg_config_params { __be32 copy_range; u8 copy_mode; }
+	params := make([]byte, 5)
+	binary.BigEndian.PutUint32(params, copyRange)
+	params[4] = nfqnlCopyPacket
+	attrs := []netlink.Attribute{{Type: nfqaCfgParams, Data: params}}
+	if cfg.MaxLen > 0 {
+		attrs = append(attrs, netlink.Attribute{Type: nfqaCfgQueueMaxlen, Data: binary.BigEndian.AppendUint32(nil, cfg.MaxLen)})
+	}
+	var flags uint32
+	if cfg.FailOpen {
+		flags |= nfqaCfgFFailOpen
+	}
+	if cfg.UIDGID {
+		flags |= nfqaCfgFUIDGID
+	}
+	if flags != 0 {
+		attrs = append(attrs,
+			netlink.Attribute{Type: nfqaCfgFlags, Data: binary.BigEndian.AppendUint32(nil, flags)},
+			netlink.Attribute{Type: nfqaCfgMask, Data: binary.BigEndian.AppendUint32(nil, flags)},
+		)
+	}
+	if err := q.config(attrs...); err != nil {
+		ifaces.Close()
+		return nil, fmt.Errorf(`failed to configure nfqueue %d: %w`, cfg.Queue, err)
+	}
+	return q, nil
+}
+
+// header returns the nfgenmsg header of the queue.
+func (q *Queue) header() []byte {
+	hdr := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(hdr[2:], q.num)
+	return hdr
+}
+
+func (q *Queue) config(attrs ...netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	_, err = q.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | nfqnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(q.header(), data...),
+	})
+	return err
+}
+
+// SetVerdict sends the verdict of the packet id.
+func (q *Queue) SetVerdict(id uint32, v Verdict) error {
+	// struct nfqnl_msg_verdict_hdr { __be32 verdict; __be32 id; }
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, v.code)
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	attrs := []netlink.Attribute{{Type: nfqaVerdictHdr, Data: hdr}}
+	if v.setMark {
+		attrs = append(attrs, netlink.Attribute{Type: nfqaMark, Data: binary.BigEndian.AppendUint32(nil, v.mark)})
+	}
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	_, err = q.conn.Send(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | nfqnlMsgVerdict),
+			Flags: netlink.Request,
+		},
+		Data: append(q.header(), data...),
+	})
+	return err
+}
+
+// Serve passes the received packets to h and sends its verdicts until ctx is
+// done or the queue is closed. The packets that can't be decoded are
+// accepted. h is called sequentially, the kernel queues the packets waiting
+// for a verdict up to Config.MaxLen.
+func (q *Queue) Serve(ctx context.Context, h Handler) error {
+	stop := context.AfterFunc(ctx, func() {
+		q.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+	for {
+		msgs, err := q.conn.Receive()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			var opErr *netlink.OpError
+			if errors.As(err, &opErr) && errors.Is(opErr.Err, unix.ENOBUFS) {
+				// the socket buffer overflowed, the lost packets are dropped
+				// by the kernel, or accepted with Config.FailOpen
+				continue
+			}
+			return err
+		}
+		for _, m := range msgs {
+			p, err := Decode(m)
+			if err != nil {
+				if p.ID > 0 {
+					q.SetVerdict(p.ID, Accept)
+				}
+				continue
+			}
+			p.InIface = q.ifaces.Name(p.InIndex)
+			p.OutIface = q.ifaces.Name(p.OutIndex)
+			if err = q.SetVerdict(p.ID, h(p)); err != nil {
+				return fmt.Errorf(`failed to set verdict of packet %d: %w`, p.ID, err)
+			}
+		}
+	}
+}
+
+// Close unbinds the queue and closes the netlink connection. The packets
+// waiting for a verdict are dropped by the kernel.
+func (q *Queue) Close() error {
+	q.config(netlink.Attribute{Type: nfqaCfgCmd, Data: []byte{nfqnlCfgCmdUnbind, 0, 0, 0}})
+	q.ifaces.Close()
+	return q.conn.Close()
+}
+
+// Decode decodes a NFQNL_MSG_PACKET message. The interface names are not
+// resolved.
+func Decode(m netlink.Message) (Packet, error) {
+	var p Packet
+	if m.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8|nfqnlMsgPacket) {
+		return p, fmt.Errorf(`unexpected message type: %#x`, uint16(m.Header.Type))
+	}
+	if len(m.Data) < 4 {
+		return p, fmt.Errorf(`message too short`)
+	}
+	p.Queue = binary.BigEndian.Uint16(m.Data[2:4])
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	if err != nil {
+		return p, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfqaPacketHdr:
+			// struct nfqnl_msg_packet_hdr { __be32 packet_id; __be16 hw_protocol; u8 hook; }
+			b := ad.Bytes()
+			if len(b) >= 7 {
+				p.ID = binary.BigEndian.Uint32(b)
+				p.HwProto = binary.BigEndian.Uint16(b[4:])
+				p.Hook = b[6]
+			}
+		case nfqaMark:
+			p.Mark = ad.Uint32()
+		case nfqaTimestamp:
+			b := ad.Bytes()
+			if len(b) >= 16 {
+				sec := binary.BigEndian.Uint64(b)
+				usec := binary.BigEndian.Uint64(b[8:])
+				p.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+			}
+		case nfqaIfindexIndev:
+			p.InIndex = ad.Uint32()
+		case nfqaIfindexOutdev:
+			p.OutIndex = ad.Uint32()
+		case nfqaHwaddr:
+			b := ad.Bytes()
+			if len(b) >= 4 {
+				size := int(binary.BigEndian.Uint16(b))
+				if size <= len(b)-4 {
+					p.HwAddr = net.HardwareAddr(append([]byte{}, b[4:4+size]...))
+				}
+			}
+		case nfqaPayload:
+			p.Payload = ad.Bytes()
+		case nfqaUID:
+			v := ad.Uint32()
+			p.UID = &v
+		case nfqaGID:
+			v := ad.Uint32()
+			p.GID = &v
+		}
+	}
+	if err = ad.Err(); err != nil {
+		return p, err
+	}
+	if p.ID == 0 {
+		return p, fmt.Errorf(`packet header is missing`)
+	}
+	decodeIP(&p)
+	return p, nil
+}
+
+// decodeIP fills the addresses and ports from the IP packet.
+func decodeIP(p *Packet) {
+	h := pktdecode.IP(p.Payload)
+	p.Protocol = h.Protocol
+	p.SrcIP = h.SrcIP
+	p.DstIP = h.DstIP
+	p.SrcPort = h.SrcPort
+	p.DstPort = h.DstPort
+	p.Length = h.Length
+}
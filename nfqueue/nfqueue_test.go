@@ -0,0 +1,160 @@
+package nfqueue
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testPacketMessage(t *testing.T, queue uint16, id uint32, dport uint16) netlink.Message {
+	// IPv4 TCP 192.168.1.2:40000 -> 10.0.0.1:dport
+	ip := []byte{
+		0x45, 0, 0, 40, 0, 0, 0x40, 0, 64, unix.IPPROTO_TCP, 0, 0,
+		192, 168, 1, 2,
+		10, 0, 0, 1,
+	}
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	hdr := make([]byte, 7)
+	binary.BigEndian.PutUint32(hdr, id)
+	binary.BigEndian.PutUint16(hdr[4:], unix.ETH_P_IP)
+	hdr[6] = unix.NF_INET_LOCAL_IN
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfqaPacketHdr, Data: hdr},
+		{Type: nfqaMark, Data: []byte{0, 0, 0, 7}},
+		{Type: nfqaIfindexIndev, Data: []byte{0, 0, 0, 1}},
+		{Type: nfqaUID, Data: []byte{0, 0, 0x03, 0xe8}},
+		{Type: nfqaPayload, Data: append(ip, tcp...)},
+	})
+	assert.NoError(t, err)
+	data := []byte{unix.AF_INET, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(data[2:], queue)
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8 | nfqnlMsgPacket)},
+		Data:   append(data, attrs...),
+	}
+}
+
+func TestDecode(t *testing.T) {
+	p, err := Decode(testPacketMessage(t, 1, 42, 22))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), p.ID)
+	assert.Equal(t, uint16(1), p.Queue)
+	assert.Equal(t, uint8(unix.NF_INET_LOCAL_IN), p.Hook)
+	assert.Equal(t, uint16(unix.ETH_P_IP), p.HwProto)
+	assert.Equal(t, uint32(7), p.Mark)
+	assert.Equal(t, uint32(1), p.InIndex)
+	if assert.NotNil(t, p.UID) {
+		assert.Equal(t, uint32(1000), *p.UID)
+	}
+	assert.Nil(t, p.GID)
+	assert.True(t, net.IPv4(192, 168, 1, 2).Equal(p.SrcIP))
+	assert.True(t, net.IPv4(10, 0, 0, 1).Equal(p.DstIP))
+	assert.Equal(t, uint16(40000), p.SrcPort)
+	assert.Equal(t, uint16(22), p.DstPort)
+	assert.Equal(t, 40, p.Length)
+
+	_, err = Decode(netlink.Message{Header: netlink.Header{Type: 1}})
+	assert.Error(t, err)
+}
+
+// verdictOf decodes a NFQNL_MSG_VERDICT message.
+func verdictOf(t *testing.T, m netlink.Message) (id uint32, v Verdict) {
+	assert.Equal(t, netlink.HeaderType(unix.NFNL_SUBSYS_QUEUE<<8|nfqnlMsgVerdict), m.Header.Type)
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	assert.NoError(t, err)
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfqaVerdictHdr:
+			b := ad.Bytes()
+			v.code = binary.BigEndian.Uint32(b)
+			id = binary.BigEndian.Uint32(b[4:])
+		case nfqaMark:
+			v = v.WithMark(ad.Uint32())
+		}
+	}
+	assert.NoError(t, ad.Err())
+	return id, v
+}
+
+func TestServe(t *testing.T) {
+	var mu sync.Mutex
+	var configs, verdicts []netlink.Message
+	var sent bool
+	conn := nltest.Dial(func(req []netlink.Message) ([]netlink.Message, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if req != nil {
+			if req[0].Header.Flags&netlink.Acknowledge == 0 {
+				verdicts = append(verdicts, req...)
+				return nil, nil
+			}
+			configs = append(configs, req...)
+			return nltest.Error(0, req)
+		}
+		if sent {
+			time.Sleep(10 * time.Millisecond)
+			return nil, nil
+		}
+		sent = true
+		return []netlink.Message{
+			testPacketMessage(t, 1, 1, 22),
+			testPacketMessage(t, 1, 2, 80),
+			testPacketMessage(t, 1, 3, 443),
+		}, nil
+	})
+	q, err := newQueue(conn, Config{Queue: 1, MaxLen: 4096, FailOpen: true})
+	assert.NoError(t, err)
+	if assert.Len(t, configs, 2) {
+		assert.Equal(t, []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 1}, configs[0].Data[:4])
+		ad, err := netlink.NewAttributeDecoder(configs[1].Data[4:])
+		assert.NoError(t, err)
+		ad.ByteOrder = binary.BigEndian
+		var types []uint16
+		for ad.Next() {
+			types = append(types, ad.Type())
+		}
+		assert.Equal(t, []uint16{nfqaCfgParams, nfqaCfgQueueMaxlen, nfqaCfgFlags, nfqaCfgMask}, types)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Serve(ctx, func(p Packet) Verdict {
+			switch p.DstPort {
+			case 22:
+				return Drop
+			case 80:
+				return Repeat.WithMark(0x10)
+			}
+			return Accept
+		})
+	}()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(verdicts) == 3
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+	assert.NoError(t, q.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, want := range []Verdict{Drop, Repeat.WithMark(0x10), Accept} {
+		id, v := verdictOf(t, verdicts[i])
+		assert.Equal(t, uint32(i+1), id)
+		assert.Equal(t, want, v, want.String())
+	}
+	assert.Equal(t, `repeat mark 0x10`, Repeat.WithMark(0x10).String())
+}
@@ -0,0 +1,894 @@
+// Package nftest provides test helpers: an in-memory fake of the nftables
+// kernel API and a network namespace harness (see Network).
+//
+// The netlink batches sent through nftables.WithTestDial are decoded into
+// tables, chains, rules, sets, elements, objects and flowtables, and the dump
+// requests of GetRules, GetSets, GetSetElements, ListTables, ListChains,
+// GetObjects and ListFlowtables are
+// answered from that state, so tests can assert on the resulting ruleset
+// instead of comparing raw bytes.
+//
+//	k := nftest.New()
+//	c := k.Conn()
+//	// ... c.AddTable(...); c.AddRule(...); c.Flush()
+//	rules, err := k.Rules(table, chain)
+package nftest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+const attrTypeMask = 0x3fff
+
+// missing in x/sys/unix
+const (
+	nftaTableHandle = 0x4
+	nftaSetHandle   = 0x10
+	nftaObjHandle   = 0x6
+)
+
+// Kernel is an in-memory nftables ruleset.
+type Kernel struct {
+	mu      sync.Mutex
+	tables  []*table
+	handle  uint64
+	batches [][]netlink.Message
+	fail    map[int]syscall.Errno
+}
+
+type table struct {
+	family byte
+	name   string
+	flags  []byte
+	handle uint64
+	chains []*chain
+	sets   []*set
+	objs   []*obj
+	fts    []*flowtable
+	anonID int
+}
+
+type chain struct {
+	name   string
+	handle uint64
+	attrs  []netlink.Attribute // hook, policy, type
+	rules  []*rule
+}
+
+type rule struct {
+	handle uint64
+	attrs  []netlink.Attribute // expressions, userdata, compat
+	sets   []string            // sets referenced by the expressions
+}
+
+type set struct {
+	name      string
+	handle    uint64
+	anonymous bool
+	attrs     []netlink.Attribute
+	elems     []*elem
+}
+
+type elem struct {
+	key         []byte
+	intervalEnd bool
+	data        []byte // attributes of NFTA_LIST_ELEM
+}
+
+type obj struct {
+	name  string
+	typ   uint32
+	attrs []netlink.Attribute
+}
+
+type flowtable struct {
+	name   string
+	handle uint64
+	attrs  []netlink.Attribute // hook, flags
+}
+
+// New returns an empty Kernel.
+func New() *Kernel {
+	return &Kernel{fail: map[int]syscall.Errno{}}
+}
+
+// Conn returns a nftables connection talking to k.
+func (k *Kernel) Conn() *nftables.Conn {
+	c, _ := nftables.New(nftables.WithTestDial(k.Dial))
+	return c
+}
+
+// NetlinkConn returns a netfilter netlink connection talking to k, for the
+// packages sending their own messages.
+func (k *Kernel) NetlinkConn() *netlink.Conn {
+	return nltest.Dial(k.Dial)
+}
+
+// Dial implements nltest.Func.
+func (k *Kernel) Dial(req []netlink.Message) ([]netlink.Message, error) {
+	if len(req) == 0 {
+		return nil, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if msgType(req[0]) == unix.NFNL_MSG_BATCH_BEGIN {
+		return k.batch(req)
+	}
+	return k.query(req[0])
+}
+
+// FailNext makes the next batch containing a message of msgType fail with errno.
+// msgType is one of unix.NFT_MSG_*.
+func (k *Kernel) FailNext(msgType int, errno syscall.Errno) {
+	k.mu.Lock()
+	k.fail[msgType] = errno
+	k.mu.Unlock()
+}
+
+// Batches returns the messages of the batches received so far, without the
+// batch begin and end messages.
+func (k *Kernel) Batches() [][]netlink.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	batches := make([][]netlink.Message, len(k.batches))
+	copy(batches, k.batches)
+	return batches
+}
+
+// Reset clears the ruleset and the recorded batches.
+func (k *Kernel) Reset() {
+	k.mu.Lock()
+	k.tables = nil
+	k.batches = nil
+	k.fail = map[int]syscall.Errno{}
+	k.mu.Unlock()
+}
+
+func msgType(m netlink.Message) int {
+	return int(m.Header.Type) & 0xff
+}
+
+func (k *Kernel) batch(req []netlink.Message) ([]netlink.Message, error) {
+	msgs := make([]netlink.Message, 0, len(req))
+	for _, m := range req {
+		switch msgType(m) {
+		case unix.NFNL_MSG_BATCH_BEGIN, unix.NFNL_MSG_BATCH_END:
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	k.batches = append(k.batches, msgs)
+
+	// a batch is atomic: the ruleset is restored if any message fails
+	snapshot := cloneTables(k.tables)
+	batchSets := map[uint32]*set{}
+	for _, m := range msgs {
+		err := k.apply(m, batchSets)
+		if err == nil {
+			if errno, ok := k.fail[msgType(m)]; ok {
+				delete(k.fail, msgType(m))
+				err = errno
+			}
+		}
+		if err != nil {
+			k.tables = snapshot
+			errno, ok := err.(syscall.Errno)
+			if !ok {
+				errno = unix.EINVAL
+			}
+			return nltest.Error(int(errno), []netlink.Message{m})
+		}
+	}
+	return nil, nil
+}
+
+func (k *Kernel) nextHandle() uint64 {
+	k.handle++
+	return k.handle
+}
+
+func (k *Kernel) apply(m netlink.Message, batchSets map[uint32]*set) error {
+	if len(m.Data) < 4 {
+		return unix.EINVAL
+	}
+	family := m.Data[0]
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		return unix.EINVAL
+	}
+	switch msgType(m) {
+	case unix.NFT_MSG_NEWTABLE:
+		return k.newTable(m, family, attrs)
+	case unix.NFT_MSG_DELTABLE:
+		return k.delTable(family, attrs)
+	case unix.NFT_MSG_NEWCHAIN:
+		return k.newChain(family, attrs)
+	case unix.NFT_MSG_DELCHAIN:
+		return k.delChain(family, attrs)
+	case unix.NFT_MSG_NEWRULE:
+		return k.newRule(m, family, attrs, batchSets)
+	case unix.NFT_MSG_DELRULE:
+		return k.delRule(family, attrs)
+	case unix.NFT_MSG_NEWSET:
+		return k.newSet(m, family, attrs, batchSets)
+	case unix.NFT_MSG_DELSET:
+		return k.delSet(family, attrs)
+	case unix.NFT_MSG_NEWSETELEM:
+		return k.newSetElem(family, attrs, batchSets)
+	case unix.NFT_MSG_DELSETELEM:
+		return k.delSetElem(family, attrs, batchSets)
+	case unix.NFT_MSG_NEWOBJ:
+		return k.newObj(m, family, attrs)
+	case unix.NFT_MSG_DELOBJ:
+		return k.delObj(family, attrs)
+	case nftables.NFT_MSG_NEWFLOWTABLE:
+		return k.newFlowtable(m, family, attrs)
+	case nftables.NFT_MSG_DELFLOWTABLE:
+		return k.delFlowtable(family, attrs)
+	}
+	return unix.EOPNOTSUPP
+}
+
+// -- attributes --
+
+func attr(attrs []netlink.Attribute, typ uint16) ([]byte, bool) {
+	for _, a := range attrs {
+		if a.Type&attrTypeMask == typ {
+			return a.Data, true
+		}
+	}
+	return nil, false
+}
+
+func attrString(attrs []netlink.Attribute, typ uint16) string {
+	b, _ := attr(attrs, typ)
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+func withoutAttrs(attrs []netlink.Attribute, types ...uint16) []netlink.Attribute {
+	r := make([]netlink.Attribute, 0, len(attrs))
+	for _, a := range attrs {
+		skip := false
+		for _, typ := range types {
+			if a.Type&attrTypeMask == typ {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+func stringAttr(typ uint16, s string) netlink.Attribute {
+	return netlink.Attribute{Type: typ, Data: []byte(s + "\x00")}
+}
+
+func uint32Attr(typ uint16, v uint32) netlink.Attribute {
+	return netlink.Attribute{Type: typ, Data: []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}}
+}
+
+func uint64Attr(typ uint16, v uint64) netlink.Attribute {
+	b := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		b[i] = byte(v >> (56 - 8*i))
+	}
+	return netlink.Attribute{Type: typ, Data: b}
+}
+
+func beUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func beUint64(b []byte) uint64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return uint64(beUint32(b[:4]))<<32 | uint64(beUint32(b[4:8]))
+}
+
+// -- tables --
+
+func (k *Kernel) findTable(family byte, name string) *table {
+	for _, t := range k.tables {
+		if t.family == family && t.name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) tableOf(family byte, attrs []netlink.Attribute, typ uint16) (*table, error) {
+	t := k.findTable(family, attrString(attrs, typ))
+	if t == nil {
+		return nil, unix.ENOENT
+	}
+	return t, nil
+}
+
+func (k *Kernel) newTable(m netlink.Message, family byte, attrs []netlink.Attribute) error {
+	name := attrString(attrs, unix.NFTA_TABLE_NAME)
+	if len(name) == 0 {
+		return unix.EINVAL
+	}
+	flags, _ := attr(attrs, unix.NFTA_TABLE_FLAGS)
+	if t := k.findTable(family, name); t != nil {
+		if m.Header.Flags&netlink.Excl != 0 {
+			return unix.EEXIST
+		}
+		t.flags = flags
+		return nil
+	}
+	k.tables = append(k.tables, &table{family: family, name: name, flags: flags, handle: k.nextHandle()})
+	return nil
+}
+
+func (k *Kernel) delTable(family byte, attrs []netlink.Attribute) error {
+	name := attrString(attrs, unix.NFTA_TABLE_NAME)
+	if len(name) == 0 { // flush ruleset
+		tables := k.tables[:0]
+		for _, t := range k.tables {
+			if family != unix.NFPROTO_UNSPEC && t.family != family {
+				tables = append(tables, t)
+			}
+		}
+		k.tables = tables
+		return nil
+	}
+	for i, t := range k.tables {
+		if t.family == family && t.name == name {
+			k.tables = append(k.tables[:i], k.tables[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ENOENT
+}
+
+// -- chains --
+
+func (t *table) findChain(name string) *chain {
+	for _, c := range t.chains {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) newChain(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_CHAIN_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_CHAIN_NAME)
+	if len(name) == 0 {
+		return unix.EINVAL
+	}
+	extra := withoutAttrs(attrs, unix.NFTA_CHAIN_TABLE, unix.NFTA_CHAIN_NAME, unix.NFTA_CHAIN_HANDLE)
+	if c := t.findChain(name); c != nil {
+		if len(extra) > 0 {
+			c.attrs = extra
+		}
+		return nil
+	}
+	t.chains = append(t.chains, &chain{name: name, handle: k.nextHandle(), attrs: extra})
+	return nil
+}
+
+func (k *Kernel) delChain(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_CHAIN_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_CHAIN_NAME)
+	for i, c := range t.chains {
+		if c.name != name {
+			continue
+		}
+		if len(c.rules) > 0 {
+			return unix.EBUSY
+		}
+		t.chains = append(t.chains[:i], t.chains[i+1:]...)
+		return nil
+	}
+	return unix.ENOENT
+}
+
+// -- rules --
+
+func (c *chain) ruleIndex(handle uint64) int {
+	for i, r := range c.rules {
+		if r.handle == handle {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *Kernel) newRule(m netlink.Message, family byte, attrs []netlink.Attribute, batchSets map[uint32]*set) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_RULE_TABLE)
+	if err != nil {
+		return err
+	}
+	c := t.findChain(attrString(attrs, unix.NFTA_RULE_CHAIN))
+	if c == nil {
+		return unix.ENOENT
+	}
+	r := &rule{attrs: withoutAttrs(attrs, unix.NFTA_RULE_TABLE, unix.NFTA_RULE_CHAIN, unix.NFTA_RULE_HANDLE, unix.NFTA_RULE_POSITION)}
+	if err = bindRuleSets(t, r, batchSets); err != nil {
+		return err
+	}
+
+	flags := m.Header.Flags
+	if handle, ok := attr(attrs, unix.NFTA_RULE_HANDLE); ok && flags&netlink.Replace != 0 {
+		idx := c.ruleIndex(beUint64(handle))
+		if idx < 0 {
+			return unix.ENOENT
+		}
+		old := c.rules[idx]
+		r.handle = old.handle
+		c.rules[idx] = r
+		t.releaseSets(old)
+		return nil
+	}
+
+	r.handle = k.nextHandle()
+	idx := len(c.rules)
+	if position, ok := attr(attrs, unix.NFTA_RULE_POSITION); ok && beUint64(position) != 0 {
+		idx = c.ruleIndex(beUint64(position))
+		if idx < 0 {
+			return unix.ENOENT
+		}
+		if flags&unix.NLM_F_APPEND != 0 {
+			idx++
+		}
+	} else if flags&unix.NLM_F_APPEND == 0 {
+		idx = 0
+	}
+	c.rules = append(c.rules, nil)
+	copy(c.rules[idx+1:], c.rules[idx:])
+	c.rules[idx] = r
+	return nil
+}
+
+// bindRuleSets resolves the sets referenced by lookup and dynset expressions
+// and replaces the set names allocated by the kernel for anonymous sets.
+func bindRuleSets(t *table, r *rule, batchSets map[uint32]*set) error {
+	for i, a := range r.attrs {
+		if a.Type&attrTypeMask != unix.NFTA_RULE_EXPRESSIONS {
+			continue
+		}
+		list, err := netlink.UnmarshalAttributes(a.Data)
+		if err != nil {
+			return unix.EINVAL
+		}
+		for j, e := range list {
+			eattrs, err := netlink.UnmarshalAttributes(e.Data)
+			if err != nil {
+				return unix.EINVAL
+			}
+			var nameType, idType uint16
+			switch attrString(eattrs, unix.NFTA_EXPR_NAME) {
+			case `lookup`:
+				nameType, idType = unix.NFTA_LOOKUP_SET, unix.NFTA_LOOKUP_SET_ID
+			case `dynset`:
+				nameType, idType = unix.NFTA_DYNSET_SET_NAME, unix.NFTA_DYNSET_SET_ID
+			default:
+				continue
+			}
+			for x, ea := range eattrs {
+				if ea.Type&attrTypeMask != unix.NFTA_EXPR_DATA {
+					continue
+				}
+				data, err := netlink.UnmarshalAttributes(ea.Data)
+				if err != nil {
+					return unix.EINVAL
+				}
+				s := t.resolveSet(attrString(data, nameType), data, idType, batchSets)
+				if s == nil {
+					return unix.ENOENT
+				}
+				r.sets = append(r.sets, s.name)
+				for y := range data {
+					if data[y].Type&attrTypeMask == nameType {
+						// the length is inferred again, the name may be longer
+						data[y].Data = []byte(s.name + "\x00")
+						data[y].Length = 0
+					}
+				}
+				if eattrs[x].Data, err = netlink.MarshalAttributes(data); err != nil {
+					return unix.EINVAL
+				}
+				eattrs[x].Length = 0
+			}
+			if list[j].Data, err = netlink.MarshalAttributes(eattrs); err != nil {
+				return unix.EINVAL
+			}
+			list[j].Length = 0
+		}
+		if r.attrs[i].Data, err = netlink.MarshalAttributes(list); err != nil {
+			return unix.EINVAL
+		}
+		r.attrs[i].Length = 0
+	}
+	return nil
+}
+
+// releaseSets deletes the anonymous sets bound to r.
+func (t *table) releaseSets(r *rule) {
+	for _, name := range r.sets {
+		for i, s := range t.sets {
+			if s.name == name && s.anonymous {
+				t.sets = append(t.sets[:i], t.sets[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (k *Kernel) delRule(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_RULE_TABLE)
+	if err != nil {
+		return err
+	}
+	chains := t.chains
+	if name := attrString(attrs, unix.NFTA_RULE_CHAIN); len(name) > 0 {
+		c := t.findChain(name)
+		if c == nil {
+			return unix.ENOENT
+		}
+		chains = []*chain{c}
+	}
+	if handle, ok := attr(attrs, unix.NFTA_RULE_HANDLE); ok {
+		c := chains[0]
+		idx := c.ruleIndex(beUint64(handle))
+		if idx < 0 {
+			return unix.ENOENT
+		}
+		t.releaseSets(c.rules[idx])
+		c.rules = append(c.rules[:idx], c.rules[idx+1:]...)
+		return nil
+	}
+	for _, c := range chains {
+		for _, r := range c.rules {
+			t.releaseSets(r)
+		}
+		c.rules = nil
+	}
+	return nil
+}
+
+// -- sets --
+
+func (t *table) findSet(name string) *set {
+	for _, s := range t.sets {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (t *table) resolveSet(name string, attrs []netlink.Attribute, idType uint16, batchSets map[uint32]*set) *set {
+	if id, ok := attr(attrs, idType); ok {
+		if s, ok := batchSets[beUint32(id)]; ok && t.findSet(s.name) == s {
+			return s
+		}
+	}
+	if strings.Contains(name, `%d`) {
+		return nil
+	}
+	return t.findSet(name)
+}
+
+func (t *table) setInUse(name string) bool {
+	for _, c := range t.chains {
+		for _, r := range c.rules {
+			for _, s := range r.sets {
+				if s == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (k *Kernel) newSet(m netlink.Message, family byte, attrs []netlink.Attribute, batchSets map[uint32]*set) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_SET_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_SET_NAME)
+	if len(name) == 0 {
+		return unix.EINVAL
+	}
+	flags, _ := attr(attrs, unix.NFTA_SET_FLAGS)
+	anonymous := beUint32(flags)&unix.NFT_SET_ANONYMOUS != 0
+	if strings.Contains(name, `%d`) {
+		name = fmt.Sprintf(name, t.anonID)
+		t.anonID++
+	}
+	id, _ := attr(attrs, unix.NFTA_SET_ID)
+	if s := t.findSet(name); s != nil {
+		if m.Header.Flags&netlink.Excl != 0 {
+			return unix.EEXIST
+		}
+		batchSets[beUint32(id)] = s
+		return nil
+	}
+	s := &set{
+		name:      name,
+		handle:    k.nextHandle(),
+		anonymous: anonymous,
+		attrs:     withoutAttrs(attrs, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME, nftaSetHandle),
+	}
+	t.sets = append(t.sets, s)
+	batchSets[beUint32(id)] = s
+	return nil
+}
+
+func (k *Kernel) delSet(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_SET_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_SET_NAME)
+	for i, s := range t.sets {
+		if s.name != name {
+			continue
+		}
+		if t.setInUse(name) {
+			return unix.EBUSY
+		}
+		t.sets = append(t.sets[:i], t.sets[i+1:]...)
+		return nil
+	}
+	return unix.ENOENT
+}
+
+func parseElems(attrs []netlink.Attribute) ([]*elem, bool, error) {
+	data, ok := attr(attrs, unix.NFTA_SET_ELEM_LIST_ELEMENTS)
+	if !ok {
+		return nil, false, nil
+	}
+	items, err := netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return nil, true, unix.EINVAL
+	}
+	elems := make([]*elem, 0, len(items))
+	for _, item := range items {
+		iattrs, err := netlink.UnmarshalAttributes(item.Data)
+		if err != nil {
+			return nil, true, unix.EINVAL
+		}
+		e := &elem{data: item.Data}
+		if key, ok := attr(iattrs, unix.NFTA_SET_ELEM_KEY); ok {
+			kattrs, err := netlink.UnmarshalAttributes(key)
+			if err != nil {
+				return nil, true, unix.EINVAL
+			}
+			e.key, _ = attr(kattrs, unix.NFTA_DATA_VALUE)
+		}
+		if flags, ok := attr(iattrs, unix.NFTA_SET_ELEM_FLAGS); ok {
+			e.intervalEnd = beUint32(flags)&unix.NFT_SET_ELEM_INTERVAL_END != 0
+		}
+		elems = append(elems, e)
+	}
+	return elems, true, nil
+}
+
+func (s *set) elemIndex(e *elem) int {
+	for i, v := range s.elems {
+		if v.intervalEnd == e.intervalEnd && bytes.Equal(v.key, e.key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *Kernel) elemSet(family byte, attrs []netlink.Attribute, batchSets map[uint32]*set) (*set, error) {
+	t, err := k.tableOf(family, attrs, unix.NFTA_SET_ELEM_LIST_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	s := t.resolveSet(attrString(attrs, unix.NFTA_SET_ELEM_LIST_SET), attrs, unix.NFTA_SET_ELEM_LIST_SET_ID, batchSets)
+	if s == nil {
+		return nil, unix.ENOENT
+	}
+	return s, nil
+}
+
+func (k *Kernel) newSetElem(family byte, attrs []netlink.Attribute, batchSets map[uint32]*set) error {
+	s, err := k.elemSet(family, attrs, batchSets)
+	if err != nil {
+		return err
+	}
+	elems, _, err := parseElems(attrs)
+	if err != nil {
+		return err
+	}
+	for _, e := range elems {
+		if idx := s.elemIndex(e); idx >= 0 {
+			s.elems[idx] = e
+			continue
+		}
+		s.elems = append(s.elems, e)
+	}
+	return nil
+}
+
+func (k *Kernel) delSetElem(family byte, attrs []netlink.Attribute, batchSets map[uint32]*set) error {
+	s, err := k.elemSet(family, attrs, batchSets)
+	if err != nil {
+		return err
+	}
+	elems, ok, err := parseElems(attrs)
+	if err != nil {
+		return err
+	}
+	if !ok { // flush set
+		s.elems = nil
+		return nil
+	}
+	for _, e := range elems {
+		idx := s.elemIndex(e)
+		if idx < 0 {
+			return unix.ENOENT
+		}
+		s.elems = append(s.elems[:idx], s.elems[idx+1:]...)
+	}
+	return nil
+}
+
+// -- objects --
+
+func (t *table) findObj(typ uint32, name string) *obj {
+	for _, o := range t.objs {
+		if o.name == name && (typ == 0 || o.typ == typ) {
+			return o
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) newObj(m netlink.Message, family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_OBJ_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_OBJ_NAME)
+	typ, _ := attr(attrs, unix.NFTA_OBJ_TYPE)
+	if len(name) == 0 {
+		return unix.EINVAL
+	}
+	if o := t.findObj(beUint32(typ), name); o != nil {
+		if m.Header.Flags&netlink.Excl != 0 {
+			return unix.EEXIST
+		}
+		if o.typ == unix.NFT_OBJECT_QUOTA {
+			// quotas are updated in place, keeping the consumed bytes
+			o.attrs = updateAttrs(o.attrs, attrs, unix.NFTA_OBJ_DATA, unix.NFTA_QUOTA_BYTES, unix.NFTA_QUOTA_FLAGS)
+		}
+		return nil
+	}
+	t.objs = append(t.objs, &obj{
+		name:  name,
+		typ:   beUint32(typ),
+		attrs: withoutAttrs(attrs, unix.NFTA_OBJ_TABLE, unix.NFTA_OBJ_NAME, unix.NFTA_OBJ_TYPE, nftaObjHandle),
+	})
+	return nil
+}
+
+func (k *Kernel) delObj(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, unix.NFTA_OBJ_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, unix.NFTA_OBJ_NAME)
+	typ, _ := attr(attrs, unix.NFTA_OBJ_TYPE)
+	for i, o := range t.objs {
+		if o.name == name && o.typ == beUint32(typ) {
+			t.objs = append(t.objs[:i], t.objs[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ENOENT
+}
+
+// -- flowtables --
+
+func (t *table) findFlowtable(name string) *flowtable {
+	for _, f := range t.fts {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func (k *Kernel) newFlowtable(m netlink.Message, family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, nftables.NFTA_FLOWTABLE_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, nftables.NFTA_FLOWTABLE_NAME)
+	if len(name) == 0 {
+		return unix.EINVAL
+	}
+	fattrs := withoutAttrs(attrs, nftables.NFTA_FLOWTABLE_TABLE, nftables.NFTA_FLOWTABLE_NAME, nftables.NFTA_FLOWTABLE_HANDLE)
+	if f := t.findFlowtable(name); f != nil {
+		if m.Header.Flags&netlink.Excl != 0 {
+			return unix.EEXIST
+		}
+		// the hook and the devices are replaced instead of merged
+		f.attrs = fattrs
+		return nil
+	}
+	t.fts = append(t.fts, &flowtable{name: name, handle: k.nextHandle(), attrs: fattrs})
+	return nil
+}
+
+func (k *Kernel) delFlowtable(family byte, attrs []netlink.Attribute) error {
+	t, err := k.tableOf(family, attrs, nftables.NFTA_FLOWTABLE_TABLE)
+	if err != nil {
+		return err
+	}
+	name := attrString(attrs, nftables.NFTA_FLOWTABLE_NAME)
+	for i, f := range t.fts {
+		if f.name == name {
+			t.fts = append(t.fts[:i], t.fts[i+1:]...)
+			return nil
+		}
+	}
+	return unix.ENOENT
+}
+
+// -- snapshot --
+
+func cloneTables(tables []*table) []*table {
+	r := make([]*table, len(tables))
+	for i, t := range tables {
+		ct := *t
+		ct.chains = make([]*chain, len(t.chains))
+		for j, c := range t.chains {
+			cc := *c
+			cc.rules = make([]*rule, len(c.rules))
+			copy(cc.rules, c.rules)
+			ct.chains[j] = &cc
+		}
+		ct.sets = make([]*set, len(t.sets))
+		for j, s := range t.sets {
+			cs := *s
+			cs.elems = make([]*elem, len(s.elems))
+			copy(cs.elems, s.elems)
+			ct.sets[j] = &cs
+		}
+		ct.objs = make([]*obj, len(t.objs))
+		for j, o := range t.objs {
+			co := *o
+			ct.objs[j] = &co
+		}
+		ct.fts = make([]*flowtable, len(t.fts))
+		for j, f := range t.fts {
+			cf := *f
+			ct.fts[j] = &cf
+		}
+		r[i] = &ct
+	}
+	return r
+}
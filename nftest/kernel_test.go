@@ -0,0 +1,281 @@
+package nftest_test
+
+import (
+	"net"
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/admpub/nftablesutils/rule"
+	"github.com/admpub/nftablesutils/set"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func msgType(m netlink.Message) int {
+	return int(m.Header.Type) & 0xff
+}
+
+func testBase(t *testing.T, k *nftest.Kernel) (*nftables.Table, *nftables.Chain) {
+	c := k.Conn()
+	table := &nftables.Table{Name: `filter`, Family: nftables.TableFamilyIPv4}
+	c.AddTable(table)
+	policy := nftables.ChainPolicyDrop
+	chain := c.AddChain(&nftables.Chain{
+		Name:     `input`,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	})
+	assert.NoError(t, c.Flush())
+	return table, chain
+}
+
+func TestTablesAndChains(t *testing.T) {
+	k := nftest.New()
+	table, _ := testBase(t, k)
+
+	tables, err := k.Tables(nftables.TableFamilyUnspecified)
+	assert.NoError(t, err)
+	if assert.Len(t, tables, 1) {
+		assert.Equal(t, `filter`, tables[0].Name)
+		assert.Equal(t, nftables.TableFamilyIPv4, tables[0].Family)
+	}
+
+	chains, err := k.Chains(table)
+	assert.NoError(t, err)
+	if assert.Len(t, chains, 1) {
+		assert.Equal(t, `input`, chains[0].Name)
+		assert.Equal(t, nftables.ChainTypeFilter, chains[0].Type)
+		assert.Equal(t, *nftables.ChainHookInput, *chains[0].Hooknum)
+		assert.Equal(t, nftables.ChainPolicyDrop, *chains[0].Policy)
+	}
+
+	c := k.Conn()
+	c.FlushRuleset()
+	assert.NoError(t, c.Flush())
+	tables, err = k.Tables(nftables.TableFamilyUnspecified)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 0)
+}
+
+func TestRules(t *testing.T) {
+	k := nftest.New()
+	table, chain := testBase(t, k)
+	target := rule.New(table, chain)
+	c := k.Conn()
+
+	for _, id := range []string{`a`, `b`} {
+		added, err := target.Add(c, rule.NewData([]byte(id), utils.SetProtoTCP()))
+		assert.NoError(t, err)
+		assert.True(t, added)
+	}
+	assert.NoError(t, c.Flush())
+	inserted, err := target.Insert(c, rule.NewData([]byte(`c`), utils.SetProtoUDP()))
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	assert.NoError(t, c.Flush())
+
+	// already exists
+	added, err := target.Add(c, rule.NewData([]byte(`a`), utils.SetProtoTCP()))
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	rules, err := k.Rules(table, chain)
+	assert.NoError(t, err)
+	ids := make([]string, len(rules))
+	for i, r := range rules {
+		ids[i] = string(r.UserData)
+	}
+	assert.Equal(t, []string{`c`, `a`, `b`}, ids)
+	assert.Equal(t, utils.SetProtoUDP()[1].(*expr.Cmp).Data, rules[0].Exprs[1].(*expr.Cmp).Data)
+
+	// insert after a
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Position: rules[1].Handle, UserData: []byte(`d`), Exprs: utils.SetProtoTCP()})
+	assert.NoError(t, c.Flush())
+	r, err := k.RuleByID(table, chain, []byte(`d`))
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	rules, _ = k.Rules(table, chain)
+	assert.Equal(t, `d`, string(rules[2].UserData))
+
+	deleted, err := target.Delete(c, rule.NewData([]byte(`a`), nil))
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NoError(t, c.Flush())
+	r, err = k.RuleByID(table, chain, []byte(`a`))
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	c.FlushChain(chain)
+	assert.NoError(t, c.Flush())
+	rules, err = k.Rules(table, chain)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+}
+
+func TestSets(t *testing.T) {
+	k := nftest.New()
+	table, chain := testBase(t, k)
+	c := k.Conn()
+
+	s, err := set.New(c, table, `blacklist`, nftables.TypeIPAddr)
+	assert.NoError(t, err)
+	elems, err := k.SetElements(table, `blacklist`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, 0)
+
+	data, err := set.AddressStringsToSetData([]string{`192.168.1.1`, `10.0.0.0/8`})
+	assert.NoError(t, err)
+	_, _, _, err = s.UpdateElements(c, data)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Flush())
+	elems, err = k.SetElements(table, `blacklist`)
+	assert.NoError(t, err)
+	assert.Len(t, elems, 4) // two intervals
+
+	_, _, removed, err := s.UpdateElements(c, data[1:])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoError(t, c.Flush())
+	elems, err = k.SetElements(table, `blacklist`)
+	assert.NoError(t, err)
+	if assert.Len(t, elems, 2) {
+		assert.Equal(t, []byte(net.IPv4(10, 0, 0, 0).To4()), elems[0].Key)
+	}
+
+	// a rule referencing the set and an anonymous one
+	anon := utils.GetPortSet(table)
+	assert.NoError(t, c.AddSet(anon, utils.GetPortElems([]uint16{22, 80})))
+	exprs := append(utils.SetSAddrSet(s.GetSet()), utils.SetDPortSet(anon)...)
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: []byte(`sets`), Exprs: exprs})
+	assert.NoError(t, c.Flush())
+
+	sets, err := k.Sets(table)
+	assert.NoError(t, err)
+	names := make([]string, len(sets))
+	for i, v := range sets {
+		names[i] = v.Name
+	}
+	assert.Equal(t, []string{`blacklist`, `__set0`}, names)
+	r, err := k.RuleByID(table, chain, []byte(`sets`))
+	assert.NoError(t, err)
+	lookup := r.Exprs[len(r.Exprs)-1].(*expr.Lookup)
+	assert.Equal(t, `__set0`, lookup.SetName)
+
+	// in use
+	c.DelSet(s.GetSet())
+	assert.Error(t, c.Flush())
+
+	// anonymous sets are released with their rule
+	c.DelRule(r)
+	assert.NoError(t, c.Flush())
+	sets, err = k.Sets(table)
+	assert.NoError(t, err)
+	assert.Len(t, sets, 1)
+}
+
+func TestAnonymousSetNames(t *testing.T) {
+	k := nftest.New()
+	table, chain := testBase(t, k)
+	c := k.Conn()
+
+	// the names allocated from __set100 on are longer than __set%d
+	for i := 0; i < 101; i++ {
+		anon := utils.GetPortSet(table)
+		assert.NoError(t, c.AddSet(anon, utils.GetPortElems([]uint16{22})))
+		c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.SetDPortSet(anon)})
+	}
+	assert.NoError(t, c.Flush())
+	rules, err := k.Rules(table, chain)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 101) {
+		lookup := rules[100].Exprs[len(rules[100].Exprs)-1].(*expr.Lookup)
+		assert.Equal(t, `__set100`, lookup.SetName)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	k := nftest.New()
+	table, _ := testBase(t, k)
+	c := k.Conn()
+
+	c.AddObj(&nftables.CounterObj{Table: table, Name: `hits`, Bytes: 10, Packets: 1})
+	assert.NoError(t, c.Flush())
+	objs, err := k.Objects(table)
+	assert.NoError(t, err)
+	if assert.Len(t, objs, 1) {
+		assert.Equal(t, uint64(10), objs[0].(*nftables.CounterObj).Bytes)
+	}
+
+	objs, err = c.ResetObjects(table)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), objs[0].(*nftables.CounterObj).Packets)
+	objs, err = k.Objects(table)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), objs[0].(*nftables.CounterObj).Packets)
+}
+
+func TestFlowtables(t *testing.T) {
+	k := nftest.New()
+	table, chain := testBase(t, k)
+	c := k.Conn()
+
+	c.AddFlowtable(utils.GetFlowtable(table, `ft`, []string{`eth0`, `eth1`}, true))
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.SetFlowOffload(`ft`)})
+	assert.NoError(t, c.Flush())
+	fts, err := k.Flowtables(table)
+	assert.NoError(t, err)
+	if assert.Len(t, fts, 1) {
+		assert.Equal(t, `ft`, fts[0].Name)
+		assert.Equal(t, []string{`eth0`, `eth1`}, fts[0].Devices)
+		assert.Equal(t, nftables.FlowtableFlagsHWOffload, fts[0].Flags)
+		assert.Equal(t, *nftables.FlowtableHookIngress, *fts[0].Hooknum)
+	}
+	rules, err := k.Rules(table, chain)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 1) {
+		assert.Equal(t, utils.ExprFlowOffload(`ft`), rules[0].Exprs[len(rules[0].Exprs)-1])
+	}
+
+	c.DelFlowtable(fts[0])
+	assert.NoError(t, c.Flush())
+	fts, err = k.Flowtables(table)
+	assert.NoError(t, err)
+	assert.Len(t, fts, 0)
+}
+
+func TestBatchError(t *testing.T) {
+	k := nftest.New()
+	table, chain := testBase(t, k)
+	c := k.Conn()
+
+	// unknown chain
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: []byte(`a`), Exprs: utils.SetProtoTCP()})
+	c.AddRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: `missing`}, Exprs: utils.SetProtoTCP()})
+	assert.Error(t, c.Flush())
+	rules, err := k.Rules(table, chain)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+
+	k.FailNext(unix.NFT_MSG_NEWRULE, unix.ENOMEM)
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.SetProtoTCP()})
+	assert.Error(t, c.Flush())
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.SetProtoTCP()})
+	assert.NoError(t, c.Flush())
+
+	batches := k.Batches()
+	assert.Len(t, batches, 4)
+	assert.Equal(t, unix.NFT_MSG_NEWTABLE, msgType(batches[0][0]))
+
+	k.Reset()
+	tables, err := k.Tables(nftables.TableFamilyUnspecified)
+	assert.NoError(t, err)
+	assert.Len(t, tables, 0)
+	assert.Len(t, k.Batches(), 0)
+}
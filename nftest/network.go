@@ -0,0 +1,406 @@
+package nftest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Probe protocols.
+const (
+	ProbeTCP  = `tcp`
+	ProbeUDP  = `udp`
+	ProbeICMP = `icmp`
+)
+
+// Probe is a connection attempt from the peer namespace to the host namespace.
+type Probe struct {
+	Proto string // tcp / udp / icmp
+	Port  uint16 // ignored for icmp
+}
+
+func (p Probe) String() string {
+	if p.Proto == ProbeICMP {
+		return p.Proto
+	}
+	return fmt.Sprintf(`%s/%d`, p.Proto, p.Port)
+}
+
+// Reachability is the result of the probes.
+type Reachability map[Probe]bool
+
+// Reachable reports whether the probe succeeded.
+func (r Reachability) Reachable(proto string, port uint16) bool {
+	return r[Probe{Proto: proto, Port: port}]
+}
+
+func (r Reachability) String() string {
+	lines := make([]string, 0, len(r))
+	for p, ok := range r {
+		state := `blocked`
+		if ok {
+			state = `open`
+		}
+		lines = append(lines, p.String()+`: `+state)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Network is a pair of throwaway network namespaces linked by a veth pair.
+// The firewall under test runs in the Host namespace, e.g. by setting
+// biz.Config.NetworkNamespace to Network.Host, and the probes are sent from
+// the Peer namespace, which is also the default gateway of Host.
+//
+// Creating a Network requires CAP_SYS_ADMIN and CAP_NET_ADMIN.
+type Network struct {
+	Host      string // name of the host namespace
+	Peer      string // name of the peer namespace
+	HostIface string
+	PeerIface string
+	HostIP    net.IP
+	PeerIP    net.IP
+
+	hostNS    netns.NsHandle
+	peerNS    netns.NsHandle
+	mu        sync.Mutex
+	listeners []io.Closer
+}
+
+// NewNetwork creates the namespaces <name>-host and <name>-peer.
+func NewNetwork(name string) (n *Network, err error) {
+	n = &Network{
+		Host:      name + `-host`,
+		Peer:      name + `-peer`,
+		HostIface: `veth0`,
+		PeerIface: `veth1`,
+		HostIP:    net.IPv4(10, 200, 0, 1).To4(),
+		PeerIP:    net.IPv4(10, 200, 0, 2).To4(),
+		hostNS:    -1,
+		peerNS:    -1,
+	}
+	defer func() {
+		if err != nil {
+			n.Close()
+			n = nil
+		}
+	}()
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return n, fmt.Errorf(`failed to netns.Get: %w`, err)
+	}
+	defer origin.Close()
+	// netns.NewNamed switches the current thread to the new namespace
+	n.hostNS, err = netns.NewNamed(n.Host)
+	if err == nil {
+		n.peerNS, err = netns.NewNamed(n.Peer)
+	}
+	if setErr := netns.Set(origin); setErr != nil {
+		// the thread is left locked, see inNS
+		return n, errors.Join(err, fmt.Errorf(`failed to restore the network namespace: %w`, setErr))
+	}
+	runtime.UnlockOSThread()
+	if err != nil {
+		return n, fmt.Errorf(`failed to create network namespace: %w`, err)
+	}
+	return n, n.setupLinks()
+}
+
+func (n *Network) setupLinks() error {
+	host, err := netlink.NewHandleAt(n.hostNS)
+	if err != nil {
+		return fmt.Errorf(`can't create netlink handle: %w`, err)
+	}
+	defer host.Delete()
+	peer, err := netlink.NewHandleAt(n.peerNS)
+	if err != nil {
+		return fmt.Errorf(`can't create netlink handle: %w`, err)
+	}
+	defer peer.Delete()
+
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: n.HostIface}, PeerName: n.PeerIface}
+	if err = host.LinkAdd(veth); err != nil {
+		return fmt.Errorf(`can't add veth pair: %w`, err)
+	}
+	peerLink, err := host.LinkByName(n.PeerIface)
+	if err != nil {
+		return fmt.Errorf(`can't get link %q: %w`, n.PeerIface, err)
+	}
+	if err = host.LinkSetNsFd(peerLink, int(n.peerNS)); err != nil {
+		return fmt.Errorf(`can't move link %q: %w`, n.PeerIface, err)
+	}
+
+	setup := func(h *netlink.Handle, iface string, ip net.IP) (netlink.Link, error) {
+		if lo, err := h.LinkByName(`lo`); err == nil {
+			if err = h.LinkSetUp(lo); err != nil {
+				return nil, fmt.Errorf(`can't set link lo up: %w`, err)
+			}
+		}
+		link, err := h.LinkByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf(`can't get link %q: %w`, iface, err)
+		}
+		addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}}
+		if err = h.AddrAdd(link, addr); err != nil {
+			return nil, fmt.Errorf(`can't add address to %q: %w`, iface, err)
+		}
+		if err = h.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf(`can't set link %q up: %w`, iface, err)
+		}
+		return link, nil
+	}
+	hostLink, err := setup(host, n.HostIface, n.HostIP)
+	if err != nil {
+		return err
+	}
+	if _, err = setup(peer, n.PeerIface, n.PeerIP); err != nil {
+		return err
+	}
+	// the veth has no carrier until both ends are up, the probes sent before
+	// are dropped
+	deadline := time.Now().Add(linkUpTimeout)
+	if err = waitOperUp(host, n.HostIface, deadline); err != nil {
+		return err
+	}
+	if err = waitOperUp(peer, n.PeerIface, deadline); err != nil {
+		return err
+	}
+	route := &netlink.Route{LinkIndex: hostLink.Attrs().Index, Gw: n.PeerIP}
+	if err = host.RouteAdd(route); err != nil {
+		return fmt.Errorf(`can't add default route: %w`, err)
+	}
+	return nil
+}
+
+const linkUpTimeout = 5 * time.Second
+
+// waitOperUp polls the link iface until its operational state is up.
+func waitOperUp(h *netlink.Handle, iface string, deadline time.Time) error {
+	for {
+		link, err := h.LinkByName(iface)
+		if err != nil {
+			return fmt.Errorf(`can't get link %q: %w`, iface, err)
+		}
+		if link.Attrs().OperState == netlink.OperUp {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf(`link %q is not up: %s`, iface, link.Attrs().OperState)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close stops the listeners and deletes the namespaces.
+func (n *Network) Close() error {
+	n.mu.Lock()
+	for _, l := range n.listeners {
+		l.Close()
+	}
+	n.listeners = nil
+	n.mu.Unlock()
+
+	var errs []error
+	if n.hostNS != -1 {
+		n.hostNS.Close()
+		errs = append(errs, netns.DeleteNamed(n.Host))
+		n.hostNS = -1
+	}
+	if n.peerNS != -1 {
+		n.peerNS.Close()
+		errs = append(errs, netns.DeleteNamed(n.Peer))
+		n.peerNS = -1
+	}
+	return errors.Join(errs...)
+}
+
+// inNS runs fn with the current thread switched to ns. If the thread cannot
+// be switched back, it is left locked so that the runtime terminates it with
+// the goroutine instead of reusing it in ns.
+func inNS(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf(`failed to netns.Get: %w`, err)
+	}
+	defer origin.Close()
+	if err = netns.Set(ns); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf(`failed to netns.Set: %w`, err)
+	}
+	err = fn()
+	if setErr := netns.Set(origin); setErr != nil {
+		return errors.Join(err, fmt.Errorf(`failed to restore the network namespace: %w`, setErr))
+	}
+	runtime.UnlockOSThread()
+	return err
+}
+
+// InHost runs fn in the host namespace.
+func (n *Network) InHost(fn func() error) error {
+	return inNS(n.hostNS, fn)
+}
+
+// InPeer runs fn in the peer namespace.
+func (n *Network) InPeer(fn func() error) error {
+	return inNS(n.peerNS, fn)
+}
+
+// Listen starts TCP and UDP servers in the host namespace for the probes.
+// TCP servers accept and close the connections, UDP servers echo the
+// datagrams. ICMP is answered by the kernel.
+func (n *Network) Listen(probes ...Probe) error {
+	return n.InHost(func() error {
+		for _, p := range probes {
+			addr := fmt.Sprintf(`:%d`, p.Port)
+			switch p.Proto {
+			case ProbeTCP:
+				l, err := net.Listen(`tcp4`, addr)
+				if err != nil {
+					return err
+				}
+				n.addListener(l)
+				go func() {
+					for {
+						conn, err := l.Accept()
+						if err != nil {
+							return
+						}
+						conn.Close()
+					}
+				}()
+			case ProbeUDP:
+				l, err := net.ListenPacket(`udp4`, addr)
+				if err != nil {
+					return err
+				}
+				n.addListener(l)
+				go func() {
+					buf := make([]byte, 64)
+					for {
+						size, from, err := l.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						l.WriteTo(buf[:size], from)
+					}
+				}()
+			}
+		}
+		return nil
+	})
+}
+
+func (n *Network) addListener(l io.Closer) {
+	n.mu.Lock()
+	n.listeners = append(n.listeners, l)
+	n.mu.Unlock()
+}
+
+// Probe sends the probes from the peer namespace to HostIP concurrently and
+// returns which of them got through. A probe is blocked when it fails or gets
+// no answer within timeout.
+func (n *Network) Probe(timeout time.Duration, probes ...Probe) Reachability {
+	r := Reachability{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range probes {
+		wg.Add(1)
+		go func(p Probe) {
+			defer wg.Done()
+			err := n.InPeer(func() error {
+				return probe(p, n.HostIP, timeout)
+			})
+			mu.Lock()
+			r[p] = err == nil
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return r
+}
+
+func probe(p Probe, ip net.IP, timeout time.Duration) error {
+	addr := net.JoinHostPort(ip.String(), fmt.Sprint(p.Port))
+	switch p.Proto {
+	case ProbeTCP:
+		conn, err := net.DialTimeout(`tcp4`, addr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ProbeUDP:
+		conn, err := net.DialTimeout(`udp4`, addr, timeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(timeout))
+		if _, err = conn.Write([]byte(`probe`)); err != nil {
+			return err
+		}
+		_, err = conn.Read(make([]byte, 64))
+		return err
+	case ProbeICMP:
+		return ping(ip, timeout)
+	}
+	return fmt.Errorf(`unsupported probe protocol: %q`, p.Proto)
+}
+
+// ping sends an ICMP echo request and waits for the reply.
+func ping(ip net.IP, timeout time.Duration) error {
+	conn, err := net.ListenPacket(`ip4:icmp`, `0.0.0.0`)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	const id, seq = 0x6e66, 1
+	// type 8 (echo request), code 0, checksum, identifier, sequence number
+	msg := []byte{8, 0, 0, 0, id >> 8, id & 0xff, 0, seq, 'p', 'i', 'n', 'g'}
+	sum := icmpChecksum(msg)
+	msg[2], msg[3] = byte(sum>>8), byte(sum)
+	if _, err = conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		size, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// type 0 (echo reply) with our identifier
+		if size >= 8 && buf[0] == 0 && buf[4] == id>>8 && buf[5] == id&0xff &&
+			from.(*net.IPAddr).IP.Equal(ip) {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
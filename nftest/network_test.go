@@ -0,0 +1,36 @@
+package nftest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+)
+
+func TestReachabilityString(t *testing.T) {
+	r := Reachability{
+		{Proto: ProbeTCP, Port: 22}: true,
+		{Proto: ProbeUDP, Port: 53}: false,
+		{Proto: ProbeICMP}:          true,
+	}
+	assert.Equal(t, "icmp: open\ntcp/22: open\nudp/53: blocked", r.String())
+	assert.True(t, r.Reachable(ProbeTCP, 22))
+	assert.False(t, r.Reachable(ProbeTCP, 80))
+}
+
+func TestICMPChecksum(t *testing.T) {
+	msg := []byte{8, 0, 0, 0, 0x12, 0x34, 0, 1}
+	sum := icmpChecksum(msg)
+	msg[2], msg[3] = byte(sum>>8), byte(sum)
+	assert.Equal(t, uint16(0), icmpChecksum(msg))
+}
+
+func TestInNSError(t *testing.T) {
+	called := false
+	err := inNS(netns.None(), func() error {
+		called = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, called)
+}
@@ -0,0 +1,434 @@
+package nftest
+
+import (
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// query answers a get or dump request.
+func (k *Kernel) query(m netlink.Message) ([]netlink.Message, error) {
+	if len(m.Data) < 4 {
+		return nltest.Error(int(unix.EINVAL), []netlink.Message{m})
+	}
+	family := m.Data[0]
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		return nltest.Error(int(unix.EINVAL), []netlink.Message{m})
+	}
+	var replies []netlink.Message
+	switch msgType(m) {
+	case unix.NFT_MSG_GETTABLE:
+		replies, err = k.getTables(family, attrs)
+	case unix.NFT_MSG_GETCHAIN:
+		replies, err = k.getChains(family, attrs)
+	case unix.NFT_MSG_GETRULE:
+		replies, err = k.getRules(family, attrs)
+	case unix.NFT_MSG_GETSET:
+		replies, err = k.getSets(family, attrs)
+	case unix.NFT_MSG_GETSETELEM:
+		replies, err = k.getSetElems(family, attrs)
+	case unix.NFT_MSG_GETOBJ:
+		replies, err = k.getObjs(family, attrs, false)
+	case unix.NFT_MSG_GETOBJ_RESET:
+		replies, err = k.getObjs(family, attrs, true)
+	case nftables.NFT_MSG_GETFLOWTABLE:
+		replies, err = k.getFlowtables(family, attrs)
+	default:
+		err = unix.EOPNOTSUPP
+	}
+	if err != nil {
+		return nltest.Error(int(err.(unix.Errno)), []netlink.Message{m})
+	}
+	for i := range replies {
+		replies[i].Header.Sequence = m.Header.Sequence
+		replies[i].Header.PID = m.Header.PID
+	}
+	return replies, nil
+}
+
+func reply(msgType int, family byte, attrs []netlink.Attribute) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return netlink.Message{}, unix.EINVAL
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type: netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | msgType),
+		},
+		Data: append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...),
+	}, nil
+}
+
+// tablesOf returns the tables matching family and the name attribute typ.
+func (k *Kernel) tablesOf(family byte, attrs []netlink.Attribute, typ uint16) ([]*table, error) {
+	name := attrString(attrs, typ)
+	var tables []*table
+	for _, t := range k.tables {
+		if family != unix.NFPROTO_UNSPEC && t.family != family {
+			continue
+		}
+		if len(name) > 0 && t.name != name {
+			continue
+		}
+		tables = append(tables, t)
+	}
+	if len(name) > 0 && len(tables) == 0 {
+		return nil, unix.ENOENT
+	}
+	return tables, nil
+}
+
+func (k *Kernel) getTables(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, unix.NFTA_TABLE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	var replies []netlink.Message
+	for _, t := range tables {
+		tattrs := []netlink.Attribute{
+			stringAttr(unix.NFTA_TABLE_NAME, t.name),
+			uint32Attr(unix.NFTA_TABLE_USE, uint32(len(t.chains))),
+			uint64Attr(nftaTableHandle, t.handle),
+		}
+		if t.flags != nil {
+			tattrs = append(tattrs, netlink.Attribute{Type: unix.NFTA_TABLE_FLAGS, Data: t.flags})
+		} else {
+			tattrs = append(tattrs, uint32Attr(unix.NFTA_TABLE_FLAGS, 0))
+		}
+		msg, err := reply(unix.NFT_MSG_NEWTABLE, t.family, tattrs)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, msg)
+	}
+	return replies, nil
+}
+
+func (k *Kernel) getChains(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, unix.NFTA_CHAIN_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	name := attrString(attrs, unix.NFTA_CHAIN_NAME)
+	var replies []netlink.Message
+	for _, t := range tables {
+		for _, c := range t.chains {
+			if len(name) > 0 && c.name != name {
+				continue
+			}
+			cattrs := append([]netlink.Attribute{
+				stringAttr(unix.NFTA_CHAIN_TABLE, t.name),
+				stringAttr(unix.NFTA_CHAIN_NAME, c.name),
+				uint64Attr(unix.NFTA_CHAIN_HANDLE, c.handle),
+				uint32Attr(unix.NFTA_CHAIN_USE, uint32(len(c.rules))),
+			}, c.attrs...)
+			msg, err := reply(unix.NFT_MSG_NEWCHAIN, t.family, cattrs)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, msg)
+		}
+	}
+	if len(name) > 0 && len(replies) == 0 {
+		return nil, unix.ENOENT
+	}
+	return replies, nil
+}
+
+func (k *Kernel) getRules(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, unix.NFTA_RULE_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	name := attrString(attrs, unix.NFTA_RULE_CHAIN)
+	var replies []netlink.Message
+	for _, t := range tables {
+		chains := t.chains
+		if len(name) > 0 {
+			c := t.findChain(name)
+			if c == nil {
+				return nil, unix.ENOENT
+			}
+			chains = []*chain{c}
+		}
+		for _, c := range chains {
+			for _, r := range c.rules {
+				rattrs := append([]netlink.Attribute{
+					stringAttr(unix.NFTA_RULE_TABLE, t.name),
+					stringAttr(unix.NFTA_RULE_CHAIN, c.name),
+					uint64Attr(unix.NFTA_RULE_HANDLE, r.handle),
+				}, r.attrs...)
+				msg, err := reply(unix.NFT_MSG_NEWRULE, t.family, rattrs)
+				if err != nil {
+					return nil, err
+				}
+				replies = append(replies, msg)
+			}
+		}
+	}
+	return replies, nil
+}
+
+func (k *Kernel) getSets(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, unix.NFTA_SET_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	name := attrString(attrs, unix.NFTA_SET_NAME)
+	var replies []netlink.Message
+	for _, t := range tables {
+		for _, s := range t.sets {
+			if len(name) > 0 && s.name != name {
+				continue
+			}
+			sattrs := append([]netlink.Attribute{
+				stringAttr(unix.NFTA_SET_TABLE, t.name),
+				stringAttr(unix.NFTA_SET_NAME, s.name),
+				uint64Attr(nftaSetHandle, s.handle),
+			}, s.attrs...)
+			msg, err := reply(unix.NFT_MSG_NEWSET, t.family, sattrs)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, msg)
+		}
+	}
+	if len(name) > 0 && len(replies) == 0 {
+		return nil, unix.ENOENT
+	}
+	return replies, nil
+}
+
+func (k *Kernel) getSetElems(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	t, err := k.tableOf(family, attrs, unix.NFTA_SET_ELEM_LIST_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	s := t.findSet(attrString(attrs, unix.NFTA_SET_ELEM_LIST_SET))
+	if s == nil {
+		return nil, unix.ENOENT
+	}
+	if len(s.elems) == 0 {
+		return nil, nil
+	}
+	list := make([]netlink.Attribute, len(s.elems))
+	for i, e := range s.elems {
+		list[i] = netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: e.data}
+	}
+	elems, err := netlink.MarshalAttributes(list)
+	if err != nil {
+		return nil, unix.EINVAL
+	}
+	msg, err := reply(unix.NFT_MSG_NEWSETELEM, t.family, []netlink.Attribute{
+		stringAttr(unix.NFTA_SET_ELEM_LIST_TABLE, t.name),
+		stringAttr(unix.NFTA_SET_ELEM_LIST_SET, s.name),
+		{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: elems},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []netlink.Message{msg}, nil
+}
+
+func (k *Kernel) getObjs(family byte, attrs []netlink.Attribute, reset bool) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, unix.NFTA_OBJ_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	name := attrString(attrs, unix.NFTA_OBJ_NAME)
+	typ, _ := attr(attrs, unix.NFTA_OBJ_TYPE)
+	var replies []netlink.Message
+	for _, t := range tables {
+		for _, o := range t.objs {
+			if len(name) > 0 && (o.name != name || o.typ != beUint32(typ)) {
+				continue
+			}
+			oattrs := append([]netlink.Attribute{
+				stringAttr(unix.NFTA_OBJ_TABLE, t.name),
+				stringAttr(unix.NFTA_OBJ_NAME, o.name),
+				uint32Attr(unix.NFTA_OBJ_TYPE, o.typ),
+			}, o.attrs...)
+			msg, err := reply(unix.NFT_MSG_NEWOBJ, t.family, oattrs)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, msg)
+			if reset {
+				o.reset()
+			}
+		}
+	}
+	if len(name) > 0 && len(replies) == 0 {
+		return nil, unix.ENOENT
+	}
+	return replies, nil
+}
+
+func (k *Kernel) getFlowtables(family byte, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	tables, err := k.tablesOf(family, attrs, nftables.NFTA_FLOWTABLE_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	var replies []netlink.Message
+	for _, t := range tables {
+		for _, f := range t.fts {
+			fattrs := append([]netlink.Attribute{
+				stringAttr(nftables.NFTA_FLOWTABLE_TABLE, t.name),
+				stringAttr(nftables.NFTA_FLOWTABLE_NAME, f.name),
+				uint64Attr(nftables.NFTA_FLOWTABLE_HANDLE, f.handle),
+			}, f.attrs...)
+			msg, err := reply(nftables.NFT_MSG_NEWFLOWTABLE, t.family, fattrs)
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, msg)
+		}
+	}
+	return replies, nil
+}
+
+// reset zeroes the bytes and packets of a counter or the consumed bytes of a
+// quota.
+func (o *obj) reset() {
+	var zero []uint16
+	switch o.typ {
+	case unix.NFT_OBJECT_COUNTER:
+		zero = []uint16{unix.NFTA_COUNTER_BYTES, unix.NFTA_COUNTER_PACKETS}
+	case unix.NFT_OBJECT_QUOTA:
+		zero = []uint16{unix.NFTA_QUOTA_CONSUMED}
+	default:
+		return
+	}
+	o.attrs = zeroAttrs(o.attrs, unix.NFTA_OBJ_DATA, zero...)
+}
+
+// zeroAttrs zeroes the nested attributes types of the attribute typ.
+func zeroAttrs(attrs []netlink.Attribute, typ uint16, types ...uint16) []netlink.Attribute {
+	r := make([]netlink.Attribute, len(attrs))
+	copy(r, attrs)
+	for i, a := range r {
+		if a.Type&attrTypeMask != typ {
+			continue
+		}
+		data, err := netlink.UnmarshalAttributes(a.Data)
+		if err != nil {
+			continue
+		}
+		for j := range data {
+			for _, t := range types {
+				if data[j].Type&attrTypeMask == t {
+					data[j].Data = make([]byte, len(data[j].Data))
+				}
+			}
+		}
+		if b, err := netlink.MarshalAttributes(data); err == nil {
+			r[i].Data, r[i].Length = b, 0
+		}
+	}
+	return r
+}
+
+// updateAttrs copies the nested attributes types of the attribute typ from
+// src to attrs.
+func updateAttrs(attrs, src []netlink.Attribute, typ uint16, types ...uint16) []netlink.Attribute {
+	from, ok := attr(src, typ)
+	if !ok {
+		return attrs
+	}
+	values, err := netlink.UnmarshalAttributes(from)
+	if err != nil {
+		return attrs
+	}
+	r := make([]netlink.Attribute, len(attrs))
+	copy(r, attrs)
+	for i, a := range r {
+		if a.Type&attrTypeMask != typ {
+			continue
+		}
+		data, err := netlink.UnmarshalAttributes(a.Data)
+		if err != nil {
+			continue
+		}
+		for _, t := range types {
+			for _, v := range values {
+				if v.Type&attrTypeMask != t {
+					continue
+				}
+				data = withoutAttrs(data, t)
+				data = append(data, v)
+			}
+		}
+		if b, err := netlink.MarshalAttributes(data); err == nil {
+			r[i].Data, r[i].Length = b, 0
+		}
+	}
+	return r
+}
+
+// -- accessors --
+
+// Tables returns the tables of family, nftables.TableFamilyUnspecified for all.
+func (k *Kernel) Tables(family nftables.TableFamily) ([]*nftables.Table, error) {
+	return k.Conn().ListTablesOfFamily(family)
+}
+
+// Chains returns the chains of t.
+func (k *Kernel) Chains(t *nftables.Table) ([]*nftables.Chain, error) {
+	chains, err := k.Conn().ListChainsOfTableFamily(t.Family)
+	if err != nil {
+		return nil, err
+	}
+	r := chains[:0]
+	for _, c := range chains {
+		if c.Table.Name == t.Name {
+			r = append(r, c)
+		}
+	}
+	return r, nil
+}
+
+// Rules returns the rules of the chain c of t.
+func (k *Kernel) Rules(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	return k.Conn().GetRules(t, c)
+}
+
+// RuleByID returns the rule of the chain c of t whose UserData is id.
+func (k *Kernel) RuleByID(t *nftables.Table, c *nftables.Chain, id []byte) (*nftables.Rule, error) {
+	rules, err := k.Rules(t, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if string(r.UserData) == string(id) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// Sets returns the sets of t, anonymous sets included.
+func (k *Kernel) Sets(t *nftables.Table) ([]*nftables.Set, error) {
+	return k.Conn().GetSets(t)
+}
+
+// SetElements returns the elements of the set name of t.
+func (k *Kernel) SetElements(t *nftables.Table, name string) ([]nftables.SetElement, error) {
+	c := k.Conn()
+	s, err := c.GetSetByName(t, name)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetSetElements(s)
+}
+
+// Flowtables returns the flowtables of t.
+func (k *Kernel) Flowtables(t *nftables.Table) ([]*nftables.Flowtable, error) {
+	return k.Conn().ListFlowtables(t)
+}
+
+// Objects returns the stateful objects of t.
+func (k *Kernel) Objects(t *nftables.Table) ([]nftables.Obj, error) {
+	return k.Conn().GetObjects(t)
+}
@@ -0,0 +1,255 @@
+package object
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Conn is a netfilter netlink connection managing the objects.
+//
+// The objects are not sent through nftables.Conn: expr.CtTimeout marshals and
+// unmarshals its policy through the default policies of package expr, which it
+// overwrites. The ct timeout policies are encoded here instead.
+//
+// Each object is committed in a batch of its own, so the objects and the rules
+// referencing them are not applied atomically: the objects are created before
+// the rules are flushed and stay if the flush fails, see FlushRules.
+type Conn struct {
+	conn *netlink.Conn
+}
+
+// Dial opens a connection in the network namespace of the file descriptor
+// netNS, the current one if 0
+func Dial(netNS int) (*Conn, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: netNS})
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial netfilter netlink: %w", err)
+	}
+	return NewConn(conn), nil
+}
+
+// NewConn wraps a netfilter netlink connection, e.g. one of nltest.Dial
+func NewConn(conn *netlink.Conn) *Conn {
+	return &Conn{conn: conn}
+}
+
+// Close the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func header(msgType uint16, flags netlink.HeaderFlags) netlink.Header {
+	return netlink.Header{
+		Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | msgType),
+		Flags: netlink.Request | flags,
+	}
+}
+
+// nfgenmsg is the netfilter header of the messages
+func nfgenmsg(family byte, resID uint16) []byte {
+	return []byte{family, unix.NFNETLINK_V0, byte(resID >> 8), byte(resID)}
+}
+
+// objAttrs returns the attributes identifying obj
+func objAttrs(obj *nftables.NamedObj) []netlink.Attribute {
+	return []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_TABLE, Data: []byte(obj.Table.Name + "\x00")},
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(obj.Name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(obj.Type))},
+	}
+}
+
+// exec sends a msgType message on obj in a batch of its own and waits for
+// its ack
+func (c *Conn) exec(msgType uint16, flags netlink.HeaderFlags, obj *nftables.NamedObj, attrs ...netlink.Attribute) error {
+	data, err := netlink.MarshalAttributes(append(objAttrs(obj), attrs...))
+	if err != nil {
+		return err
+	}
+	batch := func(typ uint16) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(typ), Flags: netlink.Request},
+			Data:   nfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES),
+		}
+	}
+	msgs := []netlink.Message{
+		batch(unix.NFNL_MSG_BATCH_BEGIN),
+		{
+			Header: header(msgType, netlink.Acknowledge|flags),
+			Data:   append(nfgenmsg(byte(obj.Table.Family), 0), data...),
+		},
+		batch(unix.NFNL_MSG_BATCH_END),
+	}
+	if _, err = c.conn.SendMessages(msgs); err != nil {
+		return err
+	}
+	_, err = c.conn.Receive()
+	return err
+}
+
+// query sends a msgType request on obj, or on all the objects of table if obj
+// is nil, and returns the objects of the replies
+func (c *Conn) query(msgType uint16, table *nftables.Table, obj *nftables.NamedObj) ([]*nftables.NamedObj, error) {
+	var attrs []netlink.Attribute
+	var flags netlink.HeaderFlags
+	if obj != nil {
+		attrs = objAttrs(obj)
+	} else {
+		flags = netlink.Dump
+		attrs = []netlink.Attribute{{Type: unix.NFTA_OBJ_TABLE, Data: []byte(table.Name + "\x00")}}
+	}
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = c.conn.Send(netlink.Message{
+		Header: header(msgType, flags),
+		Data:   append(nfgenmsg(byte(table.Family), 0), data...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.conn.Receive()
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]*nftables.NamedObj, 0, len(replies))
+	newObj := header(unix.NFT_MSG_NEWOBJ, 0).Type
+	for _, m := range replies {
+		if m.Header.Type != newObj {
+			continue
+		}
+		o, err := unmarshalObj(table, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+
+// unmarshalObj decodes a NFT_MSG_NEWOBJ message of table
+func unmarshalObj(table *nftables.Table, b []byte) (*nftables.NamedObj, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("malformed object message")
+	}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	obj := &nftables.NamedObj{Table: table}
+	var data []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_OBJ_NAME:
+			obj.Name = ad.String()
+		case unix.NFTA_OBJ_TYPE:
+			obj.Type = nftables.ObjType(ad.Uint32())
+		case unix.NFTA_OBJ_DATA:
+			data = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	obj.Obj, err = unmarshalData(byte(table.Family), obj.Type, data)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding object %v: %w", obj.Name, err)
+	}
+	return obj, nil
+}
+
+// marshalData encodes the NFTA_OBJ_DATA attribute of e
+func marshalData(fam byte, e expr.Any) ([]byte, error) {
+	if v, ok := e.(*expr.CtTimeout); ok {
+		return marshalCtTimeout(v)
+	}
+	return expr.MarshalExprData(fam, e)
+}
+
+// unmarshalData decodes the NFTA_OBJ_DATA attribute of an object of type typ,
+// the data of the unsupported types is left nil
+func unmarshalData(fam byte, typ nftables.ObjType, data []byte) (expr.Any, error) {
+	var e expr.Any
+	switch typ {
+	case nftables.ObjTypeCtTimeout:
+		return unmarshalCtTimeout(data)
+	case nftables.ObjTypeCounter:
+		e = &expr.Counter{}
+	case nftables.ObjTypeQuota:
+		e = &expr.Quota{}
+	case nftables.ObjTypeLimit:
+		e = &expr.Limit{}
+	case nftables.ObjTypeConnLimit:
+		e = &expr.Connlimit{}
+	case nftables.ObjTypeCtHelper:
+		e = &expr.CtHelper{}
+	case nftables.ObjTypeCtExpect:
+		e = &expr.CtExpect{}
+	case nftables.ObjTypeSecMark:
+		e = &expr.SecMark{}
+	case nftables.ObjTypeSynProxy:
+		e = &expr.SynProxy{}
+	default:
+		return nil, nil
+	}
+	if err := expr.Unmarshal(fam, data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// marshalCtTimeout encodes the timeouts of the policy of v, the kernel keeps
+// its defaults for the other states
+func marshalCtTimeout(v *expr.CtTimeout) ([]byte, error) {
+	attrs := make([]netlink.Attribute, 0, len(v.Policy))
+	for _, state := range slices.Sorted(maps.Keys(v.Policy)) {
+		attrs = append(attrs, netlink.Attribute{Type: state + 1, Data: binaryutil.BigEndian.PutUint32(v.Policy[state])})
+	}
+	policy, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: expr.NFTA_CT_TIMEOUT_L3PROTO, Data: binaryutil.BigEndian.PutUint16(v.L3Proto)},
+		{Type: expr.NFTA_CT_TIMEOUT_L4PROTO, Data: []byte{v.L4Proto}},
+		{Type: unix.NLA_F_NESTED | expr.NFTA_CT_TIMEOUT_DATA, Data: policy},
+	})
+}
+
+func unmarshalCtTimeout(data []byte) (*expr.CtTimeout, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	v := &expr.CtTimeout{Policy: expr.CtStatePolicyTimeout{}}
+	for ad.Next() {
+		switch ad.Type() {
+		case expr.NFTA_CT_TIMEOUT_L3PROTO:
+			v.L3Proto = ad.Uint16()
+		case expr.NFTA_CT_TIMEOUT_L4PROTO:
+			v.L4Proto = ad.Uint8()
+		case expr.NFTA_CT_TIMEOUT_DATA:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					v.Policy[nad.Type()-1] = nad.Uint32()
+				}
+				return nil
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
@@ -0,0 +1,255 @@
+// Package object A library for managing named nftables stateful objects:
+// quotas, limits, ct timeout policies and ct helpers
+package object
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+
+	utils "github.com/admpub/nftablesutils"
+)
+
+// Object represents a named stateful object on a given table
+type Object struct {
+	obj *nftables.NamedObj
+}
+
+// Quota usage
+type Quota struct {
+	Bytes    uint64 // quota
+	Consumed uint64
+	Over     bool
+}
+
+// Remaining bytes before the quota is reached
+func (q Quota) Remaining() uint64 {
+	if q.Consumed >= q.Bytes {
+		return 0
+	}
+	return q.Bytes - q.Consumed
+}
+
+// Create a new quota, over makes it match once bytes are consumed instead of until
+func NewQuota(c *Conn, table *nftables.Table, name string, bytes uint64, over bool) (Object, error) {
+	return add(c, &nftables.NamedObj{
+		Table: table,
+		Name:  name,
+		Type:  nftables.ObjTypeQuota,
+		Obj:   utils.ExprQuota(bytes, over),
+	})
+}
+
+// Create a new named limit, e.g. from utils.ParseLimits
+func NewLimit(c *Conn, table *nftables.Table, name string, limit *expr.Limit) (Object, error) {
+	return add(c, &nftables.NamedObj{
+		Table: table,
+		Name:  name,
+		Type:  nftables.ObjTypeLimit,
+		Obj:   limit,
+	})
+}
+
+// Create a new ct timeout policy for l4proto (unix.IPPROTO_TCP / unix.IPPROTO_UDP).
+// policy overrides the default timeouts (in seconds) by state, e.g. expr.CtStateTCPESTABLISHED
+func NewCtTimeout(c *Conn, table *nftables.Table, name string, l4proto uint8, policy expr.CtStatePolicyTimeout) (Object, error) {
+	l3proto, err := l3Proto(table)
+	if err != nil {
+		return Object{}, fmt.Errorf("unsupported table family for ct timeout %v: %v", name, table.Family)
+	}
+	return add(c, &nftables.NamedObj{
+		Table: table,
+		Name:  name,
+		Type:  nftables.ObjTypeCtTimeout,
+		Obj: &expr.CtTimeout{
+			L3Proto: l3proto,
+			L4Proto: l4proto,
+			Policy:  maps.Clone(policy),
+		},
+	})
+}
+
+// CtHelper is a kernel conntrack helper and the control port it is assigned on
+type CtHelper struct {
+	Name     string // kernel helper name
+	Protocol uint8  // unix.IPPROTO_TCP / unix.IPPROTO_UDP
+	Port     uint16 // default control port
+}
+
+// CtHelpers are the kernel helpers of the supported protocols
+var CtHelpers = map[string][]CtHelper{
+	"ftp":  {{Name: "ftp", Protocol: unix.IPPROTO_TCP, Port: 21}},
+	"sip":  {{Name: "sip", Protocol: unix.IPPROTO_UDP, Port: 5060}, {Name: "sip", Protocol: unix.IPPROTO_TCP, Port: 5060}},
+	"tftp": {{Name: "tftp", Protocol: unix.IPPROTO_UDP, Port: 69}},
+	"irc":  {{Name: "irc", Protocol: unix.IPPROTO_TCP, Port: 6667}},
+	"h323": {{Name: "RAS", Protocol: unix.IPPROTO_UDP, Port: 1719}, {Name: "Q.931", Protocol: unix.IPPROTO_TCP, Port: 1720}},
+}
+
+// Create a new ct helper for the kernel helper (e.g. "ftp") on l4proto,
+// the nf_conntrack_<helper> module must be available
+func NewCtHelper(c *Conn, table *nftables.Table, name string, helper string, l4proto uint8) (Object, error) {
+	obj, err := CtHelperObj(table, name, helper, l4proto)
+	if err != nil {
+		return Object{}, err
+	}
+	return add(c, obj)
+}
+
+// CtHelperObj returns the ct helper object to add in a batch
+func CtHelperObj(table *nftables.Table, name string, helper string, l4proto uint8) (*nftables.NamedObj, error) {
+	l3proto, err := l3Proto(table)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported table family for ct helper %v: %v", name, table.Family)
+	}
+	return &nftables.NamedObj{
+		Table: table,
+		Name:  name,
+		Type:  nftables.ObjTypeCtHelper,
+		Obj: &expr.CtHelper{
+			Name:    helper,
+			L3Proto: l3proto,
+			L4Proto: l4proto,
+		},
+	}, nil
+}
+
+// l3Proto returns the layer 3 protocol of the objects of table
+func l3Proto(table *nftables.Table) (uint16, error) {
+	switch table.Family {
+	case nftables.TableFamilyIPv4:
+		return unix.NFPROTO_IPV4, nil
+	case nftables.TableFamilyIPv6:
+		return unix.NFPROTO_IPV6, nil
+	case nftables.TableFamilyINet:
+		return unix.NFPROTO_INET, nil
+	}
+	return 0, fmt.Errorf("unsupported table family: %v", table.Family)
+}
+
+func add(c *Conn, obj *nftables.NamedObj) (Object, error) {
+	data, err := marshalData(byte(obj.Table.Family), obj.Obj)
+	if err == nil {
+		var attrs []netlink.Attribute
+		if len(data) > 0 {
+			attrs = append(attrs, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_OBJ_DATA, Data: data})
+		}
+		err = c.exec(unix.NFT_MSG_NEWOBJ, netlink.Create, obj, attrs...)
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("error adding object %v: %v", obj.Name, err)
+	}
+	return Object{obj: obj}, nil
+}
+
+// List the objects of type on a table, all types if typ is 0
+func List(c *Conn, table *nftables.Table, typ nftables.ObjType) ([]Object, error) {
+	objs, err := c.query(unix.NFT_MSG_GETOBJ, table, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects of table %v: %v", table.Name, err)
+	}
+	list := make([]Object, 0, len(objs))
+	for _, obj := range objs {
+		if typ != 0 && obj.Type != typ {
+			continue
+		}
+		list = append(list, Object{obj: obj})
+	}
+	return list, nil
+}
+
+// Get the object associated with this Object
+func (o Object) GetObj() *nftables.NamedObj {
+	return o.obj
+}
+
+// Name of the object
+func (o Object) Name() string {
+	return o.obj.Name
+}
+
+// Ref returns the expression referencing the object in a rule
+func (o Object) Ref() *expr.Objref {
+	return utils.ExprObjref(uint32(o.obj.Type), o.obj.Name)
+}
+
+// Read the current state of the object: *expr.Quota, *expr.Limit, *expr.CtTimeout or *expr.CtHelper
+func (o Object) Read(c *Conn) (expr.Any, error) {
+	return o.get(c, false)
+}
+
+// Reset the consumed bytes of a quota, returning the state before the reset
+func (o Object) Reset(c *Conn) (expr.Any, error) {
+	return o.get(c, true)
+}
+
+func (o Object) get(c *Conn, reset bool) (expr.Any, error) {
+	msgType := uint16(unix.NFT_MSG_GETOBJ)
+	if reset {
+		msgType = unix.NFT_MSG_GETOBJ_RESET
+	}
+	objs, err := c.query(msgType, o.obj.Table, o.obj)
+	if err != nil {
+		return nil, fmt.Errorf("error reading object %v: %v", o.obj.Name, err)
+	}
+	if len(objs) == 0 || objs[0].Obj == nil {
+		return nil, fmt.Errorf("object %v not found", o.obj.Name)
+	}
+	return objs[0].Obj, nil
+}
+
+// Quota returns the usage of a quota object
+func (o Object) Quota(c *Conn) (Quota, error) {
+	if o.obj.Type != nftables.ObjTypeQuota {
+		return Quota{}, fmt.Errorf("object %v is not a quota", o.obj.Name)
+	}
+	data, err := o.Read(c)
+	if err != nil {
+		return Quota{}, err
+	}
+	q, ok := data.(*expr.Quota)
+	if !ok {
+		return Quota{}, fmt.Errorf("unexpected data of quota %v: %T", o.obj.Name, data)
+	}
+	return Quota{Bytes: q.Bytes, Consumed: q.Consumed, Over: q.Over}, nil
+}
+
+// Update the object in place, the rules referencing it are kept.
+// The consumed bytes of a quota are kept.
+func (o *Object) Update(c *Conn, data expr.Any) error {
+	obj := &nftables.NamedObj{Table: o.obj.Table, Name: o.obj.Name, Type: o.obj.Type, Obj: data}
+	if _, err := add(c, obj); err != nil {
+		return err
+	}
+	o.obj = obj
+	return nil
+}
+
+// FlushRules flushes the batch of the rules referencing the objects created
+// for them. The objects are not part of the batch, they are deleted if the
+// flush fails so that no object is left without its rules.
+func FlushRules(c *Conn, rules *nftables.Conn, created ...Object) error {
+	err := rules.Flush()
+	if err == nil {
+		return nil
+	}
+	errs := []error{err}
+	for _, o := range created {
+		if err := o.Delete(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Delete the object, it fails while rules reference it
+func (o Object) Delete(c *Conn) error {
+	if err := c.exec(unix.NFT_MSG_DELOBJ, 0, o.obj); err != nil {
+		return fmt.Errorf("error deleting object %v: %v", o.obj.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package object
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/admpub/nftablesutils/nftest"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func testTable(t *testing.T, k *nftest.Kernel) (*nftables.Table, *nftables.Chain) {
+	c := k.Conn()
+	table := c.AddTable(&nftables.Table{Name: `filter`, Family: nftables.TableFamilyIPv4})
+	chain := c.AddChain(&nftables.Chain{
+		Name:     `forward`,
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	assert.NoError(t, c.Flush())
+	return table, chain
+}
+
+func TestQuota(t *testing.T) {
+	k := nftest.New()
+	table, chain := testTable(t, k)
+	c := k.Conn()
+	o := NewConn(k.NetlinkConn())
+
+	q, err := NewQuota(o, table, `customer1`, 10<<30, true)
+	assert.NoError(t, err)
+	// cmd: nft add rule ip filter forward ip saddr 10.0.0.2 quota name "customer1" drop
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: utils.Exprs(utils.SetCIDRMatcherIngoreError(utils.ExprDirectionSource, `10.0.0.2/32`, false)).Add(q.Ref(), utils.Drop()),
+	})
+	assert.NoError(t, c.Flush())
+	usage, err := q.Quota(o)
+	assert.NoError(t, err)
+	assert.Equal(t, Quota{Bytes: 10 << 30, Over: true}, usage)
+	assert.Equal(t, uint64(10<<30), usage.Remaining())
+
+	assert.NoError(t, q.Update(o, utils.ExprQuota(20<<30, true)))
+	usage, err = q.Quota(o)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20<<30), usage.Bytes)
+
+	data, err := q.Reset(o)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(20<<30), data.(*expr.Quota).Bytes)
+
+	assert.NoError(t, q.Delete(o))
+	_, err = q.Read(o)
+	assert.Error(t, err)
+}
+
+func TestFlushRules(t *testing.T) {
+	k := nftest.New()
+	table, chain := testTable(t, k)
+	c := k.Conn()
+	o := NewConn(k.NetlinkConn())
+
+	q, err := NewQuota(o, table, `customer1`, 10<<30, true)
+	assert.NoError(t, err)
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.Exprs{q.Ref(), utils.Drop()}})
+	// the rule of the missing chain fails the batch
+	c.AddRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: `missing`, Table: table}, Exprs: utils.Exprs{q.Ref(), utils.Drop()}})
+	assert.Error(t, FlushRules(o, c, q))
+	objs, err := List(o, table, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, objs)
+
+	q, err = NewQuota(o, table, `customer1`, 10<<30, true)
+	assert.NoError(t, err)
+	c.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: utils.Exprs{q.Ref(), utils.Drop()}})
+	assert.NoError(t, FlushRules(o, c, q))
+	objs, err = List(o, table, 0)
+	assert.NoError(t, err)
+	assert.Len(t, objs, 1)
+}
+
+func TestLimitAndCtTimeout(t *testing.T) {
+	k := nftest.New()
+	table, _ := testTable(t, k)
+	c := NewConn(k.NetlinkConn())
+
+	limit, err := utils.ParseLimits(`100/p/s`, 10)
+	assert.NoError(t, err)
+	l, err := NewLimit(c, table, `ssh`, limit)
+	assert.NoError(t, err)
+	assert.Equal(t, &expr.Objref{Type: unix.NFT_OBJECT_LIMIT, Name: `ssh`}, l.Ref())
+
+	established := expr.CtStateTCPTimeoutDefaults[expr.CtStateTCPESTABLISHED]
+	_, err = NewCtTimeout(c, table, `short`, unix.IPPROTO_TCP, expr.CtStatePolicyTimeout{expr.CtStateTCPESTABLISHED: 300})
+	assert.NoError(t, err)
+	assert.Equal(t, established, expr.CtStateTCPTimeoutDefaults[expr.CtStateTCPESTABLISHED])
+
+	objs, err := List(c, table, 0)
+	assert.NoError(t, err)
+	assert.Len(t, objs, 2)
+
+	objs, err = List(c, table, nftables.ObjTypeCtTimeout)
+	assert.NoError(t, err)
+	if assert.Len(t, objs, 1) {
+		data, err := objs[0].Read(c)
+		assert.NoError(t, err)
+		timeout := data.(*expr.CtTimeout)
+		assert.Equal(t, uint16(unix.NFPROTO_IPV4), timeout.L3Proto)
+		// the kernel keeps its defaults for the other states
+		assert.Equal(t, expr.CtStatePolicyTimeout{expr.CtStateTCPESTABLISHED: 300}, timeout.Policy)
+	}
+	assert.Equal(t, established, expr.CtStateTCPTimeoutDefaults[expr.CtStateTCPESTABLISHED])
+
+	data, err := l.Read(c)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(100), data.(*expr.Limit).Rate)
+}
+
+func TestCtHelper(t *testing.T) {
+	k := nftest.New()
+	table, _ := testTable(t, k)
+	c := NewConn(k.NetlinkConn())
+
+	for _, helper := range CtHelpers[`h323`] {
+		_, err := NewCtHelper(c, table, `voip_`+helper.Name, helper.Name, helper.Protocol)
+		assert.NoError(t, err)
+	}
+	h, err := NewCtHelper(c, table, `ftp`, `ftp`, unix.IPPROTO_TCP)
+	assert.NoError(t, err)
+	assert.Equal(t, &expr.Objref{Type: unix.NFT_OBJECT_CT_HELPER, Name: `ftp`}, h.Ref())
+
+	objs, err := List(c, table, nftables.ObjTypeCtHelper)
+	assert.NoError(t, err)
+	assert.Len(t, objs, 3)
+
+	data, err := h.Read(c)
+	assert.NoError(t, err)
+	assert.Equal(t, &expr.CtHelper{Name: `ftp`, L3Proto: unix.NFPROTO_IPV4, L4Proto: unix.IPPROTO_TCP}, data)
+
+	_, err = CtHelperObj(&nftables.Table{Name: `filter`, Family: nftables.TableFamilyBridge}, `ftp`, `ftp`, unix.IPPROTO_TCP)
+	assert.Error(t, err)
+}
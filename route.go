@@ -0,0 +1,159 @@
+package nftablesutils
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultRoute is a default route of the system.
+type DefaultRoute struct {
+	Family  int // unix.AF_INET or unix.AF_INET6
+	Iface   string
+	Index   int
+	Gateway net.IP
+	Src     net.IP // preferred source address, or the first address of Iface
+	Metric  int
+	Table   int
+}
+
+// IsMain reports whether the route belongs to the main routing table.
+func (r DefaultRoute) IsMain() bool {
+	return r.Table == unix.RT_TABLE_MAIN
+}
+
+// DefaultRoutes returns the default routes of all routing tables of the
+// current network namespace, ordered by metric.
+// family is unix.AF_INET, unix.AF_INET6 or unix.AF_UNSPEC for both.
+func DefaultRoutes(family int) ([]DefaultRoute, error) {
+	return DefaultRoutesAt(netns.None(), family)
+}
+
+// DefaultRoutesAt returns the default routes of all routing tables of the
+// network namespace ns, ordered by metric.
+func DefaultRoutesAt(ns netns.NsHandle, family int) ([]DefaultRoute, error) {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("can't create netlink handle: %w", err)
+	}
+	defer h.Delete()
+
+	families := []int{family}
+	if family == unix.AF_UNSPEC {
+		families = []int{unix.AF_INET, unix.AF_INET6}
+	}
+	var routes []DefaultRoute
+	for _, fam := range families {
+		list, err := h.RouteListFiltered(fam, &netlink.Route{Table: unix.RT_TABLE_UNSPEC}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return nil, fmt.Errorf("can't list routes: %w", err)
+		}
+		routes = append(routes, defaultRoutesOf(fam, list)...)
+	}
+
+	links := map[int]netlink.Link{}
+	for i := range routes {
+		r := &routes[i]
+		link, ok := links[r.Index]
+		if !ok {
+			link, err = h.LinkByIndex(r.Index)
+			if err != nil {
+				return nil, fmt.Errorf("can't get link by index %d: %w", r.Index, err)
+			}
+			links[r.Index] = link
+		}
+		r.Iface = link.Attrs().Name
+		if r.Src != nil {
+			continue
+		}
+		addrs, err := h.AddrList(link, r.Family)
+		if err != nil {
+			return nil, fmt.Errorf("can't get %q addrs: %w", r.Iface, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsGlobalUnicast() {
+				r.Src = addr.IP
+				break
+			}
+		}
+	}
+	SortDefaultRoutes(routes)
+	return routes, nil
+}
+
+// IfaceAddrs returns the addresses of iface in the current network namespace.
+// family is unix.AF_INET, unix.AF_INET6 or unix.AF_UNSPEC for both.
+func IfaceAddrs(iface string, family int) ([]net.IP, error) {
+	return IfaceAddrsAt(netns.None(), iface, family)
+}
+
+// IfaceAddrsAt returns the addresses of iface in the network namespace ns.
+func IfaceAddrsAt(ns netns.NsHandle, iface string, family int) ([]net.IP, error) {
+	h, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, fmt.Errorf("can't create netlink handle: %w", err)
+	}
+	defer h.Delete()
+
+	link, err := h.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("can't get link %q: %w", iface, err)
+	}
+	addrs, err := h.AddrList(link, family)
+	if err != nil {
+		return nil, fmt.Errorf("can't get %q addrs: %w", iface, err)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func defaultRoutesOf(family int, list []netlink.Route) []DefaultRoute {
+	var routes []DefaultRoute
+	for _, r := range list {
+		if r.Type != unix.RTN_UNICAST {
+			continue
+		}
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		route := DefaultRoute{
+			Family:  family,
+			Index:   r.LinkIndex,
+			Gateway: r.Gw,
+			Src:     r.Src,
+			Metric:  r.Priority,
+			Table:   r.Table,
+		}
+		if len(r.MultiPath) == 0 {
+			routes = append(routes, route)
+			continue
+		}
+		// ECMP: one route per next hop
+		for _, nh := range r.MultiPath {
+			route.Index = nh.LinkIndex
+			route.Gateway = nh.Gw
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// SortDefaultRoutes orders the routes by metric. Routes of the main table
+// go first on equal metric.
+func SortDefaultRoutes(routes []DefaultRoute) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Metric != routes[j].Metric {
+			return routes[i].Metric < routes[j].Metric
+		}
+		return routes[i].IsMain() && !routes[j].IsMain()
+	})
+}
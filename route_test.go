@@ -0,0 +1,58 @@
+package nftablesutils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDefaultRoutesOf(t *testing.T) {
+	_, lan, _ := net.ParseCIDR(`192.168.1.0/24`)
+	_, any4, _ := net.ParseCIDR(`0.0.0.0/0`)
+	list := []netlink.Route{
+		{LinkIndex: 2, Dst: lan, Type: unix.RTN_UNICAST, Table: unix.RT_TABLE_MAIN},
+		{LinkIndex: 2, Gw: net.ParseIP(`192.168.1.1`), Priority: 100, Type: unix.RTN_UNICAST, Table: unix.RT_TABLE_MAIN},
+		{LinkIndex: 3, Dst: any4, Gw: net.ParseIP(`10.0.0.1`), Priority: 50, Type: unix.RTN_UNICAST, Table: 100},
+		{Dst: any4, Type: unix.RTN_UNREACHABLE, Table: 200},
+		{Priority: 200, Type: unix.RTN_UNICAST, Table: unix.RT_TABLE_MAIN, MultiPath: []*netlink.NexthopInfo{
+			{LinkIndex: 4, Gw: net.ParseIP(`172.16.0.1`)},
+			{LinkIndex: 5, Gw: net.ParseIP(`172.17.0.1`)},
+		}},
+	}
+	routes := defaultRoutesOf(unix.AF_INET, list)
+	assert.Len(t, routes, 4)
+	SortDefaultRoutes(routes)
+	assert.Equal(t, 3, routes[0].Index)
+	assert.Equal(t, 100, routes[0].Table)
+	assert.False(t, routes[0].IsMain())
+	assert.Equal(t, 2, routes[1].Index)
+	assert.Equal(t, `192.168.1.1`, routes[1].Gateway.String())
+	assert.Equal(t, 4, routes[2].Index)
+	assert.Equal(t, 5, routes[3].Index)
+	assert.Equal(t, 200, routes[3].Metric)
+}
+
+func TestSortDefaultRoutes(t *testing.T) {
+	routes := []DefaultRoute{
+		{Iface: `eth1`, Metric: 100, Table: 100},
+		{Iface: `eth0`, Metric: 100, Table: unix.RT_TABLE_MAIN},
+		{Iface: `eth2`, Metric: 10, Table: unix.RT_TABLE_MAIN},
+	}
+	SortDefaultRoutes(routes)
+	assert.Equal(t, `eth2`, routes[0].Iface)
+	assert.Equal(t, `eth0`, routes[1].Iface)
+	assert.Equal(t, `eth1`, routes[2].Iface)
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	routes, err := DefaultRoutes(unix.AF_UNSPEC)
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, r := range routes {
+		assert.NotEmpty(t, r.Iface)
+	}
+}
@@ -0,0 +1,68 @@
+package rule
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Counter is the traffic counted by rules or counter objects
+type Counter struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// Add the packets and bytes of v to the counter
+func (c *Counter) Add(v Counter) {
+	c.Packets += v.Packets
+	c.Bytes += v.Bytes
+}
+
+// Sub returns the traffic counted since base, or the counter itself if it
+// was reset after base was read
+func (c Counter) Sub(base Counter) Counter {
+	if c.Packets < base.Packets || c.Bytes < base.Bytes {
+		return c
+	}
+	return Counter{Packets: c.Packets - base.Packets, Bytes: c.Bytes - base.Bytes}
+}
+
+// CounterOf returns the sum of the counter expressions of a rule, false if it has none
+func CounterOf(r *nftables.Rule) (Counter, bool) {
+	var counter Counter
+	var found bool
+	for _, e := range r.Exprs {
+		if v, ok := e.(*expr.Counter); ok {
+			counter.Add(Counter{Packets: v.Packets, Bytes: v.Bytes})
+			found = true
+		}
+	}
+	return counter, found
+}
+
+// CountersOf returns the counters of rules by rule ID, the counters of rules
+// sharing an ID are summed. Rules without ID or counter are skipped.
+func CountersOf(rules []*nftables.Rule) map[string]Counter {
+	counters := make(map[string]Counter)
+	for _, r := range rules {
+		if len(r.UserData) == 0 {
+			continue
+		}
+		v, ok := CounterOf(r)
+		if !ok {
+			continue
+		}
+		counter := counters[string(r.UserData)]
+		counter.Add(v)
+		counters[string(r.UserData)] = counter
+	}
+	return counters
+}
+
+// Counters returns the counters of the rules in the table and chain by rule ID
+func (r *RuleTarget) Counters(c *nftables.Conn) (map[string]Counter, error) {
+	rules, err := c.GetRules(r.table, r.chain)
+	if err != nil {
+		return nil, err
+	}
+	return CountersOf(rules), nil
+}
@@ -0,0 +1,25 @@
+package rule
+
+import (
+	"testing"
+
+	utils "github.com/admpub/nftablesutils"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountersOf(t *testing.T) {
+	rules := []*nftables.Rule{
+		{UserData: []byte(`ssh`), Exprs: utils.SetProtoTCP().Add(&expr.Counter{Packets: 2, Bytes: 120}, utils.Accept())},
+		{UserData: []byte(`ssh`), Exprs: utils.SetProtoUDP().Add(&expr.Counter{Packets: 1, Bytes: 60}, utils.Accept())},
+		{UserData: []byte(`nocounter`), Exprs: utils.SetProtoTCP()},
+		{Exprs: []expr.Any{&expr.Counter{Packets: 1}}},
+	}
+	counters := CountersOf(rules)
+	assert.Equal(t, map[string]Counter{`ssh`: {Packets: 3, Bytes: 180}}, counters)
+
+	assert.Equal(t, Counter{Packets: 1, Bytes: 60}, counters[`ssh`].Sub(Counter{Packets: 2, Bytes: 120}))
+	// reset since base was read
+	assert.Equal(t, Counter{Packets: 1}, Counter{Packets: 1}.Sub(Counter{Packets: 2}))
+}
@@ -3,6 +3,7 @@ package set
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,8 +21,14 @@ const (
 	// https://datatracker.ietf.org/doc/html/rfc5156#section-2.6
 	initIPv6 = "2001:0db8:85a3:1:1:8a2e:0370:7334"
 	initPort = "1"
+	// https://datatracker.ietf.org/doc/html/rfc7042#section-2.1.2
+	initEtherAddr = "00:00:5e:00:53:01"
+	initIface     = "nftinit0"
 )
 
+// ifNameSize is the size of the keys of the ifname sets, IFNAMSIZ
+const ifNameSize = 16
+
 // Set represents an nftables a set on a given table
 type Set struct {
 	set *nftables.Set
@@ -68,6 +75,26 @@ func New(c *nftables.Conn, table *nftables.Table, name string, keyType nftables.
 		if err != nil {
 			return Set{}, fmt.Errorf("failed to generate initial port set element: %v: %v", port, err)
 		}
+	case nftables.TypeEtherAddr:
+		mac, err := EtherAddrStringToSetData(initEtherAddr)
+		if err != nil {
+			return Set{}, fmt.Errorf("failed to parse initial ether set element %v: %v", initEtherAddr, err)
+		}
+
+		initElems, err = GenerateElements(keyType, []SetData{mac})
+		if err != nil {
+			return Set{}, fmt.Errorf("failed to generate initial ether set element: %v: %v", mac, err)
+		}
+	case nftables.TypeIFName:
+		iface, err := IfaceStringToSetData(initIface)
+		if err != nil {
+			return Set{}, fmt.Errorf("failed to parse initial ifname set element %v: %v", initIface, err)
+		}
+
+		initElems, err = GenerateElements(keyType, []SetData{iface})
+		if err != nil {
+			return Set{}, fmt.Errorf("failed to generate initial ifname set element: %v: %v", iface, err)
+		}
 	default:
 		return Set{}, fmt.Errorf("unsupported set key type: %v", keyType)
 	}
@@ -215,6 +242,26 @@ func GenerateElementsFromIPv6Address(ipAddresses []string, timeout ...time.Durat
 	return GenerateElements(nftables.TypeIP6Addr, setData)
 }
 
+func GenerateElementsFromEtherAddr(addrs []string, timeout ...time.Duration) ([]nftables.SetElement, error) {
+
+	setData, err := EtherAddrStringsToSetData(addrs, timeout...)
+	if err != nil {
+		return nil, err
+	}
+
+	return GenerateElements(nftables.TypeEtherAddr, setData)
+}
+
+func GenerateElementsFromIface(ifaces []string, timeout ...time.Duration) ([]nftables.SetElement, error) {
+
+	setData, err := IfaceStringsToSetData(ifaces, timeout...)
+	if err != nil {
+		return nil, err
+	}
+
+	return GenerateElements(nftables.TypeIFName, setData)
+}
+
 func GenerateElements(keyType nftables.SetDatatype, list []SetData) ([]nftables.SetElement, error) {
 	// we use interval sets for everything so we have a common set to build on top of
 	// due to this for each set type we need to generate start and ends of each interval even for single IPs
@@ -288,6 +335,44 @@ func GenerateElements(keyType nftables.SetDatatype, list []SetData) ([]nftables.
 					{Key: binaryutil.BigEndian.PutUint16(uint16(e.Port + 1)), IntervalEnd: true},
 				}
 			}
+		case nftables.TypeEtherAddr:
+			if e.EtherAddr == [6]byte{} {
+				return []nftables.SetElement{}, fmt.Errorf("invalid set data: %v", e)
+			}
+
+			start := append([]byte{}, e.EtherAddr[:]...)
+			end, ok := nextKey(start)
+			if !ok {
+				return []nftables.SetElement{}, fmt.Errorf("ether address %v can't be the end of an interval", e)
+			}
+			toAppend = []nftables.SetElement{
+				{Key: start, Timeout: e.Timeout},
+				{Key: end, IntervalEnd: true},
+			}
+		case nftables.TypeIFName:
+			if _, err := IfaceStringToSetData(e.Iface); err != nil {
+				return []nftables.SetElement{}, err
+			}
+
+			// an exact name includes its terminating NUL, a wildcard is the
+			// interval of the names starting with the prefix
+			start := make([]byte, ifNameSize)
+			prefix, isWildcard := strings.CutSuffix(e.Iface, "*")
+			copy(start, prefix)
+			endLen := len(prefix) + 1
+			if isWildcard {
+				endLen = len(prefix)
+			}
+			end := make([]byte, ifNameSize)
+			next, ok := nextKey(start[:endLen])
+			if !ok {
+				return []nftables.SetElement{}, fmt.Errorf("interface name %v can't be the end of an interval", e)
+			}
+			copy(end, next)
+			toAppend = []nftables.SetElement{
+				{Key: start, Timeout: e.Timeout},
+				{Key: end, IntervalEnd: true},
+			}
 		default:
 			return []nftables.SetElement{}, fmt.Errorf("unsupported set key type %v", keyType)
 		}
@@ -298,6 +383,19 @@ func GenerateElements(keyType nftables.SetDatatype, list []SetData) ([]nftables.
 	return elems, nil
 }
 
+// nextKey returns the big endian successor of key, false if key is the last
+// value of its length.
+func nextKey(key []byte) ([]byte, bool) {
+	next := append([]byte{}, key...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
 func validateSetDataAddresses(setData SetData) error {
 	if setData.AddressRangeStart.IsValid() || setData.AddressRangeEnd.IsValid() {
 		if setData.Address.IsValid() {
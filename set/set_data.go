@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/gaissmai/extnetip"
 )
 
 // SetData is a struct that is used to create elements of a given set based on the key type of the set
@@ -18,6 +21,8 @@ type SetData struct {
 	AddressRangeStart netip.Addr
 	AddressRangeEnd   netip.Addr
 	Prefix            netip.Prefix
+	EtherAddr         [6]byte // MAC address of an ether_addr set
+	Iface             string  // interface name of an ifname set, a trailing * matches the names starting with the rest
 	Timeout           time.Duration
 }
 
@@ -171,6 +176,69 @@ func PortStringsToSetData(portStrings []string, timeout ...time.Duration) ([]Set
 	return data, nil
 }
 
+// Convert a string MAC address to the SetData type
+func EtherAddrStringToSetData(addrString string, timeout ...time.Duration) (SetData, error) {
+	mac, err := net.ParseMAC(addrString)
+	if err != nil {
+		return SetData{}, err
+	}
+	if len(mac) != 6 {
+		return SetData{}, fmt.Errorf("invalid ether address: %v", addrString)
+	}
+
+	var t time.Duration
+	if len(timeout) > 0 {
+		t = timeout[0]
+	}
+	data := SetData{Timeout: t}
+	copy(data.EtherAddr[:], mac)
+	return data, nil
+}
+
+// Convert a list of string MAC addresses to the SetData type
+func EtherAddrStringsToSetData(addrStrings []string, timeout ...time.Duration) ([]SetData, error) {
+	data := []SetData{}
+
+	for _, addrString := range addrStrings {
+		addr, err := EtherAddrStringToSetData(addrString, timeout...)
+		if err != nil {
+			return data, err
+		}
+		data = append(data, addr)
+	}
+
+	return data, nil
+}
+
+// Convert a string interface name, e.g. eth0 or vnet*, to the SetData type
+func IfaceStringToSetData(ifaceString string, timeout ...time.Duration) (SetData, error) {
+	name := strings.TrimSuffix(ifaceString, "*")
+	if len(name) == 0 || len(name) >= ifNameSize || strings.ContainsAny(name, "*\x00") {
+		return SetData{}, fmt.Errorf("invalid interface name: %q", ifaceString)
+	}
+
+	var t time.Duration
+	if len(timeout) > 0 {
+		t = timeout[0]
+	}
+	return SetData{Iface: ifaceString, Timeout: t}, nil
+}
+
+// Convert a list of string interface names to the SetData type
+func IfaceStringsToSetData(ifaceStrings []string, timeout ...time.Duration) ([]SetData, error) {
+	data := []SetData{}
+
+	for _, ifaceString := range ifaceStrings {
+		iface, err := IfaceStringToSetData(ifaceString, timeout...)
+		if err != nil {
+			return data, err
+		}
+		data = append(data, iface)
+	}
+
+	return data, nil
+}
+
 // Convert net.IPNet to the SetData type
 func NetIPNetToSetData(net *net.IPNet, timeout ...time.Duration) (SetData, error) {
 	ones, _ := net.Mask.Size()
@@ -304,3 +372,66 @@ func NetipAddrPortToSetData(addrport netip.AddrPort, timeout ...time.Duration) (
 	}
 	return SetData{Address: addrport.Addr()}, SetData{Port: uint16(addrport.Port()), Timeout: t}, nil
 }
+
+// MergeAddressSetData merges the overlapping and adjacent addresses, address ranges and prefixes, since an interval set
+// refuses overlapping elements. A merged element is a prefix if possible, otherwise a range, and has
+// the longest timeout of its parts. Ports are returned unchanged after the addresses.
+func MergeAddressSetData(list []SetData) []SetData {
+	type interval struct {
+		start, end netip.Addr
+		timeout    time.Duration
+	}
+	intervals := make([]interval, 0, len(list))
+	var others []SetData
+	for _, data := range list {
+		switch {
+		case data.AddressRangeStart.IsValid() && data.AddressRangeEnd.IsValid():
+			intervals = append(intervals, interval{data.AddressRangeStart, data.AddressRangeEnd, data.Timeout})
+		case data.Address.IsValid():
+			intervals = append(intervals, interval{data.Address, data.Address, data.Timeout})
+		case data.Prefix.IsValid():
+			start, end := extnetip.Range(data.Prefix)
+			intervals = append(intervals, interval{start, end, data.Timeout})
+		default:
+			others = append(others, data)
+		}
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Less(intervals[j].start)
+	})
+
+	merged := make([]SetData, 0, len(intervals)+len(others))
+	appendInterval := func(v interval) {
+		switch {
+		case v.start == v.end:
+			merged = append(merged, SetData{Address: v.start, Timeout: v.timeout})
+		default:
+			if prefix, ok := extnetip.Prefix(v.start, v.end); ok {
+				merged = append(merged, SetData{Prefix: prefix, Timeout: v.timeout})
+			} else {
+				merged = append(merged, SetData{AddressRangeStart: v.start, AddressRangeEnd: v.end, Timeout: v.timeout})
+			}
+		}
+	}
+	for i := 0; i < len(intervals); {
+		curr := intervals[i]
+		for i++; i < len(intervals); i++ {
+			next := intervals[i]
+			if next.start.Is4() != curr.end.Is4() {
+				break
+			}
+			// next starts within curr or right after it
+			if after := curr.end.Next(); after.IsValid() && after.Less(next.start) {
+				break
+			}
+			if curr.end.Less(next.end) {
+				curr.end = next.end
+			}
+			if curr.timeout < next.timeout {
+				curr.timeout = next.timeout
+			}
+		}
+		appendInterval(curr)
+	}
+	return append(merged, others...)
+}
@@ -264,3 +264,47 @@ func TestGoodNetipAddrPortsV4(t *testing.T) {
 	assert.Equal(t, addrs[0].Address, parsed.Addr())
 	assert.Equal(t, ports[0].Port, parsed.Port())
 }
+
+func TestMergeAddressSetData(t *testing.T) {
+	list, err := AddressStringsToSetData([]string{
+		"10.0.1.0/24",
+		"10.0.0.0/24",
+		"10.0.0.128/25",
+		"10.0.2.1-10.0.2.10",
+		"10.0.3.5",
+		"192.168.0.1",
+		"2001:db8::/33",
+		"2001:db8:8000::/33",
+	})
+	assert.NoError(t, err)
+	port, err := PortStringToSetData("80")
+	assert.NoError(t, err)
+	list = append(list, port)
+
+	expected := []SetData{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/23")},
+		{AddressRangeStart: netip.MustParseAddr("10.0.2.1"), AddressRangeEnd: netip.MustParseAddr("10.0.2.10")},
+		{Address: netip.MustParseAddr("10.0.3.5")},
+		{Address: netip.MustParseAddr("192.168.0.1")},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32")},
+		port,
+	}
+	assert.Equal(t, expected, MergeAddressSetData(list))
+
+	// the interval reaching the top of the IPv4 space is not merged with IPv6
+	list, err = AddressStringsToSetData([]string{"255.255.255.0/24", "::/128"})
+	assert.NoError(t, err)
+	assert.Len(t, MergeAddressSetData(list), 2)
+}
+
+func TestGoodEtherAddrAndIfaceStringList(t *testing.T) {
+	res, err := EtherAddrStringsToSetData([]string{"52:54:00:12:34:56", "52-54-00-AB-CD-EF"})
+	assert.Nil(t, err)
+	if assert.Len(t, res, 2) {
+		assert.Equal(t, [6]byte{0x52, 0x54, 0x00, 0xab, 0xcd, 0xef}, res[1].EtherAddr)
+	}
+
+	res, err = IfaceStringsToSetData([]string{"eth0", "vnet*"})
+	assert.Nil(t, err)
+	assert.Equal(t, []SetData{{Iface: "eth0"}, {Iface: "vnet*"}}, res)
+}
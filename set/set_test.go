@@ -6,6 +6,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/admpub/nftablesutils/nftest"
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/mdlayher/netlink"
@@ -580,3 +581,60 @@ func TestGetSet(t *testing.T) {
 
 	assert.Equal(t, nfSet, set.GetSet())
 }
+
+func TestGenerateSetElementsEtherAddr(t *testing.T) {
+	elements, err := GenerateElementsFromEtherAddr([]string{"52:54:00:12:34:ff", "02:00:00:00:00:01"})
+	assert.Nil(t, err)
+	assert.Equal(t, []nftables.SetElement{
+		{Key: []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0xff}},
+		{Key: []byte{0x52, 0x54, 0x00, 0x12, 0x35, 0x00}, IntervalEnd: true},
+		{Key: []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}},
+		{Key: []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}, IntervalEnd: true},
+	}, elements)
+
+	_, err = GenerateElementsFromEtherAddr([]string{"52:54:00:12:34"})
+	assert.Error(t, err)
+	_, err = GenerateElements(nftables.TypeEtherAddr, []SetData{{}})
+	assert.Error(t, err)
+}
+
+func TestGenerateSetElementsIface(t *testing.T) {
+	elements, err := GenerateElementsFromIface([]string{"eth0", "vnet*"})
+	assert.Nil(t, err)
+	if assert.Len(t, elements, 4) {
+		assert.Equal(t, ifnameKey("eth0"), elements[0].Key)
+		assert.Equal(t, ifnameKey("eth0\x01"), elements[1].Key)
+		assert.True(t, elements[1].IntervalEnd)
+		assert.Equal(t, ifnameKey("vnet"), elements[2].Key)
+		assert.Equal(t, ifnameKey("vneu"), elements[3].Key)
+	}
+
+	for _, bad := range []string{"", "*", "a*b", "averyveryverylongname"} {
+		_, err = GenerateElementsFromIface([]string{bad})
+		assert.Error(t, err, bad)
+	}
+}
+
+func ifnameKey(name string) []byte {
+	key := make([]byte, ifNameSize)
+	copy(key, name)
+	return key
+}
+
+func TestNewEtherAddrAndIfaceSet(t *testing.T) {
+	k := nftest.New()
+	c := k.Conn()
+	table := c.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyBridge,
+		Name:   "testtable",
+	})
+	for _, keyType := range []nftables.SetDatatype{nftables.TypeEtherAddr, nftables.TypeIFName} {
+		res, err := New(c, table, "testset_"+keyType.Name, keyType)
+		if assert.Nil(t, err) {
+			assert.Equal(t, keyType, res.GetSet().KeyType)
+			elems, err := k.SetElements(table, res.GetSet().Name)
+			assert.Nil(t, err)
+			assert.Len(t, elems, 0)
+		}
+	}
+}
@@ -15,6 +15,8 @@ var (
 	typeConntrackStateNew         = []byte{0x08, 0x00, 0x00, 0x00}
 	typeConntrackStateEstablished = []byte{0x02, 0x00, 0x00, 0x00}
 	typeConntrackStateRelated     = []byte{0x04, 0x00, 0x00, 0x00}
+	typeConntrackStateInvalid     = []byte{0x01, 0x00, 0x00, 0x00}
+	typeConntrackStateUntracked   = []byte{0x40, 0x00, 0x00, 0x00}
 )
 
 // TypeProtoICMP bytes.
@@ -62,6 +64,16 @@ func TypeConntrackStateRelated() []byte {
 	return typeConntrackStateRelated
 }
 
+// TypeConntrackStateInvalid bytes.
+func TypeConntrackStateInvalid() []byte {
+	return typeConntrackStateInvalid
+}
+
+// TypeConntrackStateUntracked bytes.
+func TypeConntrackStateUntracked() []byte {
+	return typeConntrackStateUntracked
+}
+
 // ConntrackStateDatatype object.
 func TypeConntrackStateDatatype() nftables.SetDatatype {
 	return nftables.TypeCTState